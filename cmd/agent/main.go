@@ -36,18 +36,22 @@ var (
 )
 
 type flags struct {
-	Addr           string `json:"address"`
-	Key            string `json:"key"`
-	PublicKeyPath  string `json:"crypto_key"`
-	RateLimit      uint   `json:"rate_limit"`
-	ReportInterval uint   `json:"report_interval"`
-	PollInterval   uint   `json:"poll_interval"`
+	Addr           string            `json:"address"`
+	Key            string            `json:"key"`
+	PublicKeyPath  string            `json:"crypto_key"`
+	Labels         map[string]string `json:"labels"`
+	Aggregates     string            `json:"aggregates"`
+	RateLimit      uint              `json:"rate_limit"`
+	ReportInterval uint              `json:"report_interval"`
+	PollInterval   uint              `json:"poll_interval"`
 }
 
 var defOpts = &flags{
 	Addr:           "http://localhost:8080",
 	Key:            "",
 	PublicKeyPath:  "",
+	Labels:         nil,
+	Aggregates:     "",
 	RateLimit:      3,
 	ReportInterval: 10,
 	PollInterval:   2,
@@ -67,6 +71,24 @@ func setAddr(value string, defaultValue string) string {
 	return value
 }
 
+// Parses labels from the string in the next format: host=srv-1,env=prod
+func parseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be in format name=value", pair)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return labels, nil
+}
+
 var agOpts = &flags{
 	Addr: defOpts.Addr,
 }
@@ -87,7 +109,7 @@ func init() {
 			fmt.Println("failed to parse json from config file")
 		}
 	}
-	options.SetEnvStr(&agOpts.key, "KEY")
+	agOpts.Labels = defOpts.Labels
 
 	flag.Func("a", "address of a server to send metrics", func(flagValue string) error {
 		fmt.Println(flagValue, defOpts.Addr)
@@ -96,6 +118,15 @@ func init() {
 	})
 	flag.StringVar(&agOpts.Key, "k", defOpts.Key, "key for signing data in requests")
 	flag.StringVar(&agOpts.PublicKeyPath, "crypto-key", defOpts.PublicKeyPath, "path to .pem file with a public key")
+	flag.Func("L", "labels attached to every metric, e.g. host=srv-1,env=prod", func(flagValue string) error {
+		labels, err := parseLabels(flagValue)
+		if err != nil {
+			return err
+		}
+		agOpts.Labels = labels
+		return nil
+	})
+	flag.StringVar(&agOpts.Aggregates, "g", defOpts.Aggregates, "aggregates of gauges sent along with the last value, e.g. min,max,avg,count")
 	flag.UintVar(&agOpts.RateLimit, "l", defOpts.RateLimit, "maximum requests with report to a server")
 	flag.UintVar(&agOpts.ReportInterval, "r", defOpts.ReportInterval, "interval (in seconds) of sending metrics to a server")
 	flag.UintVar(&agOpts.PollInterval, "p", defOpts.PollInterval, "interval (in seconds) of reading metrics from a system")
@@ -110,6 +141,16 @@ func setEnv() {
 	}
 	options.SetEnvStr(&agOpts.Key, "KEY")
 
+	if v, ok := os.LookupEnv("LABELS"); ok {
+		labels, err := parseLabels(v)
+		if err != nil {
+			fmt.Println(err.Error())
+		} else {
+			agOpts.Labels = labels
+		}
+	}
+
+	options.SetEnvStr(&agOpts.Aggregates, "AGGREGATES")
 	options.SetEnvUint(&agOpts.ReportInterval, "REPORT_INTERVAL")
 	options.SetEnvUint(&agOpts.PollInterval, "POLL_INTERVAL")
 }
@@ -138,7 +179,12 @@ func main() {
 		cryptoKey = k
 	}
 
-	client := monclient.NewInstance(agOpts.Addr, agOpts.Key, cryptoKey, agOpts.ReportInterval)
+	aggrs, err := collector.ParseAggregates(agOpts.Aggregates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := monclient.NewInstance(agOpts.Addr, agOpts.Key, cryptoKey, agOpts.ReportInterval, agOpts.Labels, aggrs)
 	cl := collector.New(agOpts.PollInterval)
 
 	g, gCtx := errgroup.WithContext(ctx)
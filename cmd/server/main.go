@@ -7,15 +7,18 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Allegathor/perfmon/internal/ciphers"
+	"github.com/Allegathor/perfmon/internal/mondata"
 	"github.com/Allegathor/perfmon/internal/monserv"
-	"github.com/Allegathor/perfmon/internal/monserv/fw"
 	"github.com/Allegathor/perfmon/internal/options"
 	"github.com/Allegathor/perfmon/internal/repo"
 	"go.uber.org/zap"
@@ -38,29 +41,152 @@ var (
 )
 
 type flags struct {
-	Addr           string `json:"address"`
-	DBConnStr      string `json:"database_dsn"`
-	Mode           string `json:"mode"`
-	Path           string `json:"store_file"`
-	Key            string `json:"key"`
-	PrivateKeyPath string `json:"crypto_key"`
-	StoreInterval  uint   `json:"store_interval"`
-	Restore        bool   `json:"restore"`
+	Addr           string            `json:"address"`
+	DBConnStr      string            `json:"database_dsn"`
+	ReplicaDSN     string            `json:"database_replica_dsn"`
+	Mode           string            `json:"mode"`
+	Path           string            `json:"store_path"`
+	StoreFile      string            `json:"store_file"` // deprecated alias of store_path, see resolveStorePath
+	Key            string            `json:"key"`
+	PrivateKeyPath string            `json:"crypto_key"`
+	TTL            string            `json:"ttl"`
+	TTLPrefixes    map[string]string `json:"ttl_prefixes"`
+	Overflow       string            `json:"counter_overflow"`
+	StoreInterval  uint              `json:"store_interval"`
+	HistorySize    uint              `json:"history_size"`
+	MaxSeries      uint              `json:"max_series"`
+	RetentionDays  uint              `json:"retention_days"`
+	Restore        bool              `json:"restore"`
 }
 
-var srvOpts flags
+var (
+	srvOpts flags
+	// error of options read from config file, it's reported once logger is initialized
+	configErr error
+)
 
 var defSrvOpts = &flags{
 	Addr:           "localhost:8080",
 	DBConnStr:      "",
+	ReplicaDSN:     "",
 	Mode:           devMode,
-	Path:           "./backup.json",
+	Path:           "./data",
 	PrivateKeyPath: "",
 	Key:            "",
+	TTL:            "",
+	TTLPrefixes:    nil,
+	Overflow:       "",
 	StoreInterval:  300,
+	HistorySize:    1024,
+	MaxSeries:      0,
+	RetentionDays:  30,
 	Restore:        false,
 }
 
+// Parses TTL of name prefixes from the string in the next format: CPU=1h,tmp_=5m
+func parseTTLPrefixes(value string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("TTL of prefix %q must be in format prefix=duration", pair)
+		}
+		prefixes[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return prefixes, nil
+}
+
+// Builds TTL policy from options, empty TTL keeps series forever
+func ttlPolicy(opts flags) (mondata.TTLPolicy, error) {
+	var (
+		policy mondata.TTLPolicy
+		err    error
+	)
+
+	if opts.TTL != "" {
+		policy.Default, err = time.ParseDuration(opts.TTL)
+		if err != nil {
+			return policy, fmt.Errorf("invalid TTL: %w", err)
+		}
+	}
+
+	policy.Prefixes = make(map[string]time.Duration, len(opts.TTLPrefixes))
+	for prefix, v := range opts.TTLPrefixes {
+		policy.Prefixes[prefix], err = time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid TTL of prefix %q: %w", prefix, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Takes directory of in-memory storage from store_file key of config, which was a path to file of backup
+// before values were persisted by write-ahead log. Paths to existing files are rejected,
+// since they would be treated as a directory of write-ahead log
+func resolveStorePath(opts *flags) error {
+	if opts.StoreFile == "" || opts.Path != "" {
+		return nil
+	}
+
+	info, err := os.Stat(opts.StoreFile)
+	if err == nil && !info.IsDir() {
+		return fmt.Errorf(
+			"store_file %q of config is a file, but in-memory storage keeps write-ahead log and snapshots in a directory, "+
+				"set store_path to a directory instead", opts.StoreFile)
+	}
+
+	fmt.Println("store_file of config is deprecated, use store_path instead")
+	opts.Path = opts.StoreFile
+	return nil
+}
+
+// Returns DSN of storage, in-memory storage persisting values by options of backup is the default one
+func storageDSN(opts flags) string {
+	if opts.DBConnStr != "" {
+		if opts.ReplicaDSN == "" && opts.Overflow == "" {
+			return opts.DBConnStr
+		}
+
+		u, err := url.Parse(opts.DBConnStr)
+		if err != nil {
+			// the error is reported by storage
+			return opts.DBConnStr
+		}
+		q := u.Query()
+		if opts.ReplicaDSN != "" {
+			q.Set("replica", opts.ReplicaDSN)
+		}
+		if opts.Overflow != "" {
+			q.Set(mondata.OverflowOption, opts.Overflow)
+		}
+		u.RawQuery = q.Encode()
+
+		return u.String()
+	}
+
+	q := url.Values{}
+	if opts.ReplicaDSN != "" {
+		// in-memory storage has no replicas, so it fails on the option
+		q.Set("replica", opts.ReplicaDSN)
+	}
+	if opts.Overflow != "" {
+		q.Set(mondata.OverflowOption, opts.Overflow)
+	}
+	if opts.Path != "" {
+		q.Set("dir", opts.Path)
+	}
+	q.Set("snapshot_interval", (time.Duration(opts.StoreInterval) * time.Second).String())
+	q.Set("restore", strconv.FormatBool(opts.Restore))
+
+	return "memory://?" + q.Encode()
+}
+
 func init() {
 	info, err := os.Stat(configPath)
 	if os.IsNotExist(err) {
@@ -72,30 +198,66 @@ func init() {
 			fmt.Println("failed to read config file")
 		}
 
+		// store_path of config overrides the default one, store_file is used only if it isn't set
+		path := defSrvOpts.Path
+		defSrvOpts.Path = ""
 		jsonErr := json.Unmarshal(f, defSrvOpts)
 		if jsonErr != nil {
 			fmt.Println("failed to parse json from config file")
 		}
+		configErr = resolveStorePath(defSrvOpts)
+		if defSrvOpts.Path == "" {
+			defSrvOpts.Path = path
+		}
 	}
 
 	flag.StringVar(&srvOpts.Addr, "a", defSrvOpts.Addr, "address to runing a server on")
-	flag.StringVar(&srvOpts.DBConnStr, "d", defSrvOpts.DBConnStr, "URL for DB connection")
+	flag.StringVar(&srvOpts.DBConnStr, "d", defSrvOpts.DBConnStr, "DSN of storage: memory://, postgres:// or file:// for SQLite, in-memory storage is used if it's empty")
+	flag.StringVar(&srvOpts.ReplicaDSN, "replica-d", defSrvOpts.ReplicaDSN, "DSN of PostgreSQL read replica serving values and dashboard, reads fall back to primary when it's unhealthy")
 	flag.StringVar(&srvOpts.Mode, "m", defSrvOpts.Mode, "mode of running the server: dev or prod")
 	flag.StringVar(&srvOpts.Key, "k", defSrvOpts.Key, "key for signing data")
 	flag.StringVar(&srvOpts.PrivateKeyPath, "crypto-key", defSrvOpts.PrivateKeyPath, "path to .pem file with a private key")
-	flag.StringVar(&srvOpts.Path, "f", defSrvOpts.Path, "path to backup file")
-	flag.UintVar(&srvOpts.StoreInterval, "i", defSrvOpts.StoreInterval, "interval (in seconds) of writing to backup file")
-	flag.BoolVar(&srvOpts.Restore, "r", defSrvOpts.Restore, "option to restore from backup file on startup")
+	flag.StringVar(&srvOpts.Path, "f", defSrvOpts.Path, "directory of write-ahead log and snapshots of in-memory storage")
+	flag.StringVar(&srvOpts.TTL, "ttl", defSrvOpts.TTL, "evict gauges and counters not updated within the duration, e.g. 24h")
+	srvOpts.TTLPrefixes = defSrvOpts.TTLPrefixes
+	flag.Func("ttl-prefixes", "TTL of metrics by name prefix, e.g. CPU=1h,tmp_=5m", func(flagValue string) error {
+		prefixes, err := parseTTLPrefixes(flagValue)
+		if err != nil {
+			return err
+		}
+		srvOpts.TTLPrefixes = prefixes
+		return nil
+	})
+	flag.StringVar(&srvOpts.Overflow, "counter-overflow", defSrvOpts.Overflow, "what happens when counter exceeds the max value: wrap, saturate or reject updates, it wraps by default")
+	flag.UintVar(&srvOpts.StoreInterval, "i", defSrvOpts.StoreInterval, "interval (in seconds) of compacting write-ahead log into snapshot, 0 compacts it only on shutdown")
+	flag.UintVar(&srvOpts.HistorySize, "history-size", defSrvOpts.HistorySize, "number of samples kept in history of every series")
+	flag.UintVar(&srvOpts.MaxSeries, "max-series", defSrvOpts.MaxSeries, "max number of distinct series, updates creating new ones are rejected with 429 once it's reached, 0 disables the limit")
+	flag.UintVar(&srvOpts.RetentionDays, "retention-days", defSrvOpts.RetentionDays, "days of keeping samples in DB, 0 keeps them forever")
+	flag.BoolVar(&srvOpts.Restore, "r", defSrvOpts.Restore, "option to replay snapshot and write-ahead log on startup")
 }
 
 func setEnv() {
 	options.SetEnvStr(&srvOpts.Addr, "ADDRESS")
 	options.SetEnvStr(&srvOpts.DBConnStr, "DATABASE_DSN")
+	options.SetEnvStr(&srvOpts.ReplicaDSN, "DATABASE_REPLICA_DSN")
 	options.SetEnvStr(&srvOpts.Mode, "MODE")
 	options.SetEnvStr(&srvOpts.Key, "KEY")
 	options.SetEnvStr(&srvOpts.PrivateKeyPath, "CRYPTO_KEY")
 	options.SetEnvStr(&srvOpts.Path, "FILE_STORAGE_PATH")
+	options.SetEnvStr(&srvOpts.TTL, "TTL")
+	if v, ok := os.LookupEnv("TTL_PREFIXES"); ok {
+		prefixes, err := parseTTLPrefixes(v)
+		if err != nil {
+			fmt.Println(err.Error())
+		} else {
+			srvOpts.TTLPrefixes = prefixes
+		}
+	}
+	options.SetEnvStr(&srvOpts.Overflow, "COUNTER_OVERFLOW")
 	options.SetEnvUint(&srvOpts.StoreInterval, "STORE_INTERVAL")
+	options.SetEnvUint(&srvOpts.HistorySize, "HISTORY_SIZE")
+	options.SetEnvUint(&srvOpts.MaxSeries, "MAX_SERIES")
+	options.SetEnvUint(&srvOpts.RetentionDays, "RETENTION_DAYS")
 	options.SetEnvBool(&srvOpts.Restore, "RESTORE")
 }
 
@@ -147,15 +309,19 @@ func main() {
 	var err error
 	logger := initLogger(srvOpts.Mode).Sugar()
 	logger.Infof("\nBuild version: %s\nBuild date: %s\nBuild commit: %s\n", buildVersion, buildDate, buildCommit)
+	if configErr != nil {
+		logger.Fatalln(configErr)
+	}
 
-	bkp := &fw.Backup{
-		Path:        srvOpts.Path,
-		Interval:    srvOpts.StoreInterval,
-		Logger:      logger,
-		RestoreFlag: srvOpts.Restore,
+	policy, err := ttlPolicy(srvOpts)
+	if err != nil {
+		logger.Fatalln(err)
 	}
 
-	db := repo.Init(context.Background(), srvOpts.DBConnStr, bkp, logger)
+	db, err := repo.Init(context.Background(), storageDSN(srvOpts), srvOpts.HistorySize, logger)
+	if err != nil {
+		logger.Fatalln(err)
+	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -164,6 +330,11 @@ func main() {
 	}()
 	wg.Wait()
 
+	// restored series are counted, so the limit is set after they're restored
+	if err := db.LimitSeries(ctx, int(srvOpts.MaxSeries)); err != nil {
+		logger.Fatalln(err)
+	}
+
 	var cryptoKey *rsa.PrivateKey
 	if srvOpts.PrivateKeyPath != "" {
 		cryptoKey, err = ciphers.ReadPrivateKey(srvOpts.PrivateKeyPath)
@@ -180,7 +351,25 @@ func main() {
 		return s.ListenAndServe()
 	})
 	g.Go(func() error {
-		return db.ScheduleBackup(gCtx)
+		return db.ScheduleSnapshots(gCtx)
+	})
+	g.Go(func() error {
+		return db.ScheduleRollup(gCtx)
+	})
+	g.Go(func() error {
+		return db.ScheduleEviction(gCtx, policy)
+	})
+	g.Go(func() error {
+		return db.ScheduleFailover(gCtx)
+	})
+	g.Go(func() error {
+		return db.ScheduleDivergenceChecks(gCtx)
+	})
+	g.Go(func() error {
+		return db.ListenChanges(gCtx)
+	})
+	g.Go(func() error {
+		return db.ScheduleRetention(gCtx, time.Duration(srvOpts.RetentionDays)*24*time.Hour)
 	})
 	g.Go(func() error {
 		<-gCtx.Done()
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregates of gauge samples that can be sent along with the last value
+const (
+	AggrMin   = "min"
+	AggrMax   = "max"
+	AggrAvg   = "avg"
+	AggrCount = "count"
+)
+
+// Summary of gauge samples polled during a report window
+type Aggregate struct {
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int64
+}
+
+func (a *Aggregate) Add(v float64) {
+	if a.Count == 0 || v < a.Min {
+		a.Min = v
+	}
+	if a.Count == 0 || v > a.Max {
+		a.Max = v
+	}
+	a.Sum += v
+	a.Count++
+}
+
+func (a Aggregate) Avg() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+
+	return a.Sum / float64(a.Count)
+}
+
+func (a Aggregate) value(kind string) (float64, bool) {
+	switch kind {
+	case AggrMin:
+		return a.Min, true
+	case AggrMax:
+		return a.Max, true
+	case AggrAvg:
+		return a.Avg(), true
+	case AggrCount:
+		return float64(a.Count), true
+	default:
+		return 0, false
+	}
+}
+
+// Parses aggregates from the string in the next format: min,max,avg,count
+func ParseAggregates(value string) ([]string, error) {
+	kinds := make([]string, 0)
+	for _, k := range strings.Split(value, ",") {
+		k = strings.TrimSpace(k)
+		switch k {
+		case "":
+			continue
+		case AggrMin, AggrMax, AggrAvg, AggrCount:
+			kinds = append(kinds, k)
+		default:
+			return nil, fmt.Errorf("unknown aggregate %q, expected one of: min, max, avg, count", k)
+		}
+	}
+
+	return kinds, nil
+}
+
+// Derives gauges from aggregates by suffixing their names with a kind of aggregate,
+// e.g. HeapAlloc_max. Empty windows and unknown kinds are skipped
+func DeriveGauges(aggs map[string]Aggregate, kinds []string) map[string]float64 {
+	gm := make(map[string]float64, len(aggs)*len(kinds))
+	for name, a := range aggs {
+		if a.Count == 0 {
+			continue
+		}
+		for _, k := range kinds {
+			if v, ok := a.value(k); ok {
+				gm[name+"_"+k] = v
+			}
+		}
+	}
+
+	return gm
+}
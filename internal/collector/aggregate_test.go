@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAggregates(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "positive test #1 (all kinds)",
+			value: "min,max,avg,count",
+			want:  []string{AggrMin, AggrMax, AggrAvg, AggrCount},
+		},
+		{
+			name:  "positive test #2 (spaces and empty items)",
+			value: " max , ,avg,",
+			want:  []string{AggrMax, AggrAvg},
+		},
+		{
+			name:  "positive test #3 (empty string)",
+			value: "",
+			want:  []string{},
+		},
+		{
+			name:    "negative test #1 (unknown kind)",
+			value:   "min,median",
+			wantErr: true,
+		},
+		{
+			name:    "negative test #2 (kinds are case-sensitive)",
+			value:   "MIN",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kinds, err := ParseAggregates(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, kinds)
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []float64
+		want    Aggregate
+		wantAvg float64
+	}{
+		{
+			name:    "positive test #1 (empty window)",
+			want:    Aggregate{},
+			wantAvg: 0,
+		},
+		{
+			name:    "positive test #2 (single sample)",
+			samples: []float64{-2},
+			want:    Aggregate{Min: -2, Max: -2, Sum: -2, Count: 1},
+			wantAvg: -2,
+		},
+		{
+			name:    "positive test #3 (several samples)",
+			samples: []float64{3, 1, 5, 3},
+			want:    Aggregate{Min: 1, Max: 5, Sum: 12, Count: 4},
+			wantAvg: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a Aggregate
+			for _, v := range tt.samples {
+				a.Add(v)
+			}
+			assert.Equal(t, tt.want, a)
+			assert.Equal(t, tt.wantAvg, a.Avg())
+		})
+	}
+}
+
+func TestDeriveGauges(t *testing.T) {
+	aggs := map[string]Aggregate{
+		"HeapAlloc": {Min: 1, Max: 5, Sum: 12, Count: 4},
+		"Sys":       {},
+	}
+
+	tests := []struct {
+		name  string
+		kinds []string
+		want  map[string]float64
+	}{
+		{
+			name:  "positive test #1 (all kinds)",
+			kinds: []string{AggrMin, AggrMax, AggrAvg, AggrCount},
+			want:  map[string]float64{"HeapAlloc_min": 1, "HeapAlloc_max": 5, "HeapAlloc_avg": 3, "HeapAlloc_count": 4},
+		},
+		{
+			name:  "positive test #2 (no kinds)",
+			kinds: nil,
+			want:  map[string]float64{},
+		},
+		{
+			name:  "positive test #3 (unknown kinds are skipped)",
+			kinds: []string{AggrMax, "median"},
+			want:  map[string]float64{"HeapAlloc_max": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// gauges of empty windows aren't derived
+			assert.Equal(t, tt.want, DeriveGauges(aggs, tt.kinds))
+		})
+	}
+}
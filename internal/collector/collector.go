@@ -40,17 +40,41 @@ func (tx *MtcsTx[T]) Get(name string) (T, bool) {
 	return v, ok
 }
 
+// Returns copy of values, so it could be read after the transaction is over
 func (tx *MtcsTx[T]) GetAll() map[string]T {
-	return tx.repo.Data
+	m := make(map[string]T, len(tx.repo.Data))
+	for k, v := range tx.repo.Data {
+		m[k] = v
+	}
+
+	return m
 }
 
 func (tx *MtcsTx[T]) Set(name string, v T) {
 	tx.repo.Data[name] = v
+
+	if tx.repo.Window != nil {
+		a := tx.repo.Window[name]
+		a.Add(float64(v))
+		tx.repo.Window[name] = a
+	}
+}
+
+// Returns aggregates of samples set since the previous call and starts a new window
+func (tx *MtcsTx[T]) TakeWindow() map[string]Aggregate {
+	w := tx.repo.Window
+	if w != nil {
+		tx.repo.Window = make(map[string]Aggregate, len(w))
+	}
+
+	return w
 }
 
 type Mtcs[T mondata.VTypes] struct {
 	mu   sync.RWMutex
 	Data map[string]T
+	// aggregates of samples set during a report window, nil if not tracked
+	Window map[string]Aggregate
 }
 
 func (r *Mtcs[T]) Begin(writable bool) (*MtcsTx[T], error) {
@@ -87,29 +111,101 @@ func (r *Mtcs[T]) Update(fn func(*MtcsTx[T]) error) error {
 
 type Repo struct {
 	Gauge   *Mtcs[float64]
-	Counter *Mtcs[int64]
+	Counter *Mtcs[uint64]
+	// absolute values of monotonically increasing stats, server computes deltas itself
+	Total *Mtcs[uint64]
+}
+
+// Snapshot is a consistent copy of collected values
+type Snapshot struct {
+	Gauges   map[string]float64
+	Counters map[string]uint64
+	Totals   map[string]uint64
+	// aggregates of gauge samples set since the previous snapshot
+	Window map[string]Aggregate
+}
+
+// Copies values while all repos are locked and starts a new window of gauge samples,
+// so values of the same poll aren't split between reports
+func (r *Repo) TakeSnapshot() Snapshot {
+	var snap Snapshot
+	r.Gauge.Update(func(g *MtcsTx[float64]) error {
+		return r.Counter.Read(func(c *MtcsTx[uint64]) error {
+			return r.Total.Read(func(t *MtcsTx[uint64]) error {
+				snap = Snapshot{
+					Gauges:   g.GetAll(),
+					Counters: c.GetAll(),
+					Totals:   t.GetAll(),
+					// the window is taken even if no aggregates are sent, so it doesn't grow unbounded
+					Window: g.TakeWindow(),
+				}
+				return nil
+			})
+		})
+	})
+
+	return snap
 }
 
 type Collector struct {
 	Repo         *Repo
 	cpuCores     int
 	pollInterval uint
+
+	metaMu      sync.RWMutex
+	meta        mondata.MetaMap
+	metaVersion int64
+	runtimeMeta sync.Once
+}
+
+// Adds metadata of emitted metrics, it will be sent to a server with the next report
+func (c *Collector) RegisterMeta(mm ...mondata.Meta) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+
+	if c.meta == nil {
+		c.meta = make(mondata.MetaMap)
+	}
+
+	for _, m := range mm {
+		c.meta[m.Name] = m
+	}
+	c.metaVersion++
+}
+
+// Returns registered metadata and its version which changes on every registration
+func (c *Collector) Meta() ([]mondata.Meta, int64) {
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+
+	mm := make([]mondata.Meta, 0, len(c.meta))
+	for _, m := range c.meta {
+		mm = append(mm, m)
+	}
+
+	return mm, c.metaVersion
 }
 
 func New(pollInterval uint) *Collector {
 	count, _ := cpu.Counts(false)
 	g := &Mtcs[float64]{
-		Data: make(map[string]float64),
+		Data:   make(map[string]float64),
+		Window: make(map[string]Aggregate),
 	}
 
-	c := &Mtcs[int64]{
-		Data: make(map[string]int64),
+	c := &Mtcs[uint64]{
+		Data: make(map[string]uint64),
+	}
+
+	t := &Mtcs[uint64]{
+		Data: make(map[string]uint64),
 	}
 
 	return &Collector{
 		Repo: &Repo{
 			Gauge:   g,
 			Counter: c,
+			Total:   t,
 		},
 		cpuCores:     count,
 		pollInterval: pollInterval,
@@ -132,8 +228,44 @@ func (c *Collector) GopsStats(wg *sync.WaitGroup) {
 	})
 }
 
+// metadata of gauges collected from runtime.MemStats
+var runtimeMeta = []mondata.Meta{
+	{Name: "Alloc", Unit: mondata.UnitBytes, Description: "bytes of allocated heap objects"},
+	{Name: "TotalAlloc", Unit: mondata.UnitBytes, Description: "cumulative bytes allocated for heap objects"},
+	{Name: "Sys", Unit: mondata.UnitBytes, Description: "total bytes of memory obtained from the OS"},
+	{Name: "Lookups", Description: "number of pointer lookups performed by the runtime"},
+	{Name: "Mallocs", Description: "cumulative count of heap objects allocated"},
+	{Name: "Frees", Description: "cumulative count of heap objects freed"},
+	{Name: "BuckHashSys", Unit: mondata.UnitBytes, Description: "bytes of memory in profiling bucket hash tables"},
+	{Name: "HeapAlloc", Unit: mondata.UnitBytes, Description: "bytes of allocated heap objects"},
+	{Name: "HeapIdle", Unit: mondata.UnitBytes, Description: "bytes in idle (unused) spans"},
+	{Name: "HeapInuse", Unit: mondata.UnitBytes, Description: "bytes in in-use spans"},
+	{Name: "HeapObjects", Description: "number of allocated heap objects"},
+	{Name: "HeapReleased", Unit: mondata.UnitBytes, Description: "bytes of physical memory returned to the OS"},
+	{Name: "HeapSys", Unit: mondata.UnitBytes, Description: "bytes of heap memory obtained from the OS"},
+	{Name: "StackInuse", Unit: mondata.UnitBytes, Description: "bytes in stack spans"},
+	{Name: "StackSys", Unit: mondata.UnitBytes, Description: "bytes of stack memory obtained from the OS"},
+	{Name: "MSpanInuse", Unit: mondata.UnitBytes, Description: "bytes of allocated mspan structures"},
+	{Name: "MSpanSys", Unit: mondata.UnitBytes, Description: "bytes of memory obtained from the OS for mspan structures"},
+	{Name: "MCacheInuse", Unit: mondata.UnitBytes, Description: "bytes of allocated mcache structures"},
+	{Name: "MCacheSys", Unit: mondata.UnitBytes, Description: "bytes of memory obtained from the OS for mcache structures"},
+	{Name: "GCCPUFraction", Unit: mondata.UnitRatio, Description: "fraction of CPU time used by the GC since the program started"},
+	{Name: "GCSys", Unit: mondata.UnitBytes, Description: "bytes of memory in garbage collection metadata"},
+	{Name: "LastGC", Unit: mondata.UnitUnixNs, Description: "time the last garbage collection finished"},
+	{Name: "NextGC", Unit: mondata.UnitBytes, Description: "target heap size of the next GC cycle"},
+	{Name: "NumForcedGC", Description: "number of GC cycles that were forced by the application"},
+	{Name: "NumGC", Description: "number of completed GC cycles"},
+	{Name: "PauseTotalNs", Unit: mondata.UnitNanos, Description: "cumulative time spent in GC stop-the-world pauses"},
+	{Name: "OtherSys", Unit: mondata.UnitBytes, Description: "bytes of memory in miscellaneous off-heap runtime allocations"},
+	{Name: "RandomValue", Description: "random value"},
+}
+
 func (c *Collector) RuntimeStats(wg *sync.WaitGroup) {
 	defer wg.Done()
+	c.runtimeMeta.Do(func() {
+		c.RegisterMeta(runtimeMeta...)
+	})
+
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
@@ -177,11 +309,22 @@ func (c *Collector) RuntimeStats(wg *sync.WaitGroup) {
 		tx.Set("RandomValue", (rand.Float64()*100)+1)
 		return nil
 	})
+
+	c.Repo.Total.Update(func(tx *MtcsTx[uint64]) error {
+		tx.Set("TotalAlloc", uint64(m.TotalAlloc))
+		tx.Set("Lookups", uint64(m.Lookups))
+		tx.Set("Mallocs", uint64(m.Mallocs))
+		tx.Set("Frees", uint64(m.Frees))
+		tx.Set("NumForcedGC", uint64(m.NumForcedGC))
+		tx.Set("NumGC", uint64(m.NumGC))
+		tx.Set("PauseTotalNs", uint64(m.PauseTotalNs))
+		return nil
+	})
 }
 
 func (c *Collector) UpdateCounters(wg *sync.WaitGroup) {
 	defer wg.Done()
-	c.Repo.Counter.Update(func(tx *MtcsTx[int64]) error {
+	c.Repo.Counter.Update(func(tx *MtcsTx[uint64]) error {
 		tx.Set("PollCount", 1)
 
 		return nil
@@ -202,7 +345,7 @@ func (c *Collector) Stats(mainGroup *sync.WaitGroup) {
 
 type MonitorResult struct {
 	Gauge   map[string]float64
-	Counter map[string]int64
+	Counter map[string]uint64
 }
 
 func (c *Collector) Monitor(ctx context.Context) error {
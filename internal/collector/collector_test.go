@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run with -race: snapshots are taken and changed while stats are polled
+func TestRepo_TakeSnapshot(t *testing.T) {
+	c := New(1)
+
+	const polls = 100
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range polls {
+			c.Repo.Gauge.Update(func(tx *MtcsTx[float64]) error {
+				tx.Set("Alloc", float64(i))
+				tx.Set("HeapAlloc", float64(i))
+				return nil
+			})
+			c.Repo.Counter.Update(func(tx *MtcsTx[uint64]) error {
+				tx.Set("PollCount", 1)
+				return nil
+			})
+		}
+	}()
+
+	var samples int64
+	for range polls {
+		snap := c.Repo.TakeSnapshot()
+		// gauges of the same poll are set within one transaction, so they're never split
+		assert.Equal(t, snap.Gauges["Alloc"], snap.Gauges["HeapAlloc"])
+		assert.Equal(t, snap.Window["Alloc"].Count, snap.Window["HeapAlloc"].Count)
+		samples += snap.Window["Alloc"].Count
+
+		// values are copies, so they could be changed while collector keeps polling
+		snap.Gauges["Alloc"] = -1
+		snap.Counters["PollCount"] = 0
+	}
+	wg.Wait()
+
+	samples += c.Repo.TakeSnapshot().Window["Alloc"].Count
+	assert.Equal(t, int64(polls), samples, "every sample belongs to exactly one window")
+}
@@ -25,6 +25,7 @@ import (
 const (
 	updatePath      = "/update"
 	updateBatchPath = "/updates"
+	metaPath        = "/meta"
 )
 
 type MonClient struct {
@@ -32,10 +33,12 @@ type MonClient struct {
 	reportInterval uint
 	h              hash.Hash
 	cryptoKey      *rsa.PublicKey
+	labels         map[string]string
+	aggregates     []string
 	Client         *resty.Client
 }
 
-func NewInstance(addr string, key string, cryptoKey *rsa.PublicKey, interval uint) *MonClient {
+func NewInstance(addr string, key string, cryptoKey *rsa.PublicKey, interval uint, labels map[string]string, aggregates []string) *MonClient {
 	retryCount := 3
 
 	c := resty.New()
@@ -64,6 +67,8 @@ func NewInstance(addr string, key string, cryptoKey *rsa.PublicKey, interval uin
 		addr:           addr,
 		h:              h,
 		cryptoKey:      cryptoKey,
+		labels:         labels,
+		aggregates:     aggregates,
 		reportInterval: interval,
 		Client:         c,
 	}
@@ -71,10 +76,11 @@ func NewInstance(addr string, key string, cryptoKey *rsa.PublicKey, interval uin
 	return m
 }
 
-func buildReqBody(name string, mtype string, g *float64, c *int64) []byte {
+func buildReqBody(name string, mtype string, labels map[string]string, g *float64, c *int64) []byte {
 	data := &mondata.Metrics{
-		ID:    name,
-		MType: mtype,
+		ID:     name,
+		MType:  mtype,
+		Labels: labels,
 	}
 	if mtype == mondata.GaugeType {
 		data.Value = g
@@ -88,26 +94,42 @@ func buildReqBody(name string, mtype string, g *float64, c *int64) []byte {
 	return j
 }
 
-func buildReqBatchBody(gm map[string]float64, cm map[string]int64) []byte {
+func buildReqBatchBody(gm map[string]float64, cm map[string]uint64, tm map[string]uint64, labels map[string]string, ts time.Time) []byte {
 	mbatch := make([]mondata.Metrics, 0)
 
-	if len(gm) == 0 && len(cm) == 0 {
+	if len(gm) == 0 && len(cm) == 0 && len(tm) == 0 {
 		return make([]byte, 0)
 	}
 
 	for k, v := range gm {
 		mbatch = append(mbatch, mondata.Metrics{
-			ID:    k,
-			MType: "gauge",
-			Value: &v,
+			ID:        k,
+			MType:     "gauge",
+			Labels:    labels,
+			Value:     &v,
+			Timestamp: &ts,
 		})
 	}
 
-	for k, d := range cm {
+	for k, v := range cm {
+		d := int64(v)
 		mbatch = append(mbatch, mondata.Metrics{
-			ID:    k,
-			MType: "counter",
-			Delta: &d,
+			ID:        k,
+			MType:     "counter",
+			Labels:    labels,
+			Delta:     &d,
+			Timestamp: &ts,
+		})
+	}
+
+	for k, v := range tm {
+		t := int64(v)
+		mbatch = append(mbatch, mondata.Metrics{
+			ID:        k,
+			MType:     "counter",
+			Labels:    labels,
+			Total:     &t,
+			Timestamp: &ts,
 		})
 	}
 
@@ -173,20 +195,21 @@ func (m *MonClient) PollStats(cl *collector.Collector) {
 				return nil
 			})
 			for k, v := range data {
-				b := buildReqBody(k, mondata.GaugeType, &v, nil)
+				b := buildReqBody(k, mondata.GaugeType, m.labels, &v, nil)
 				m.Post(b, updatePath)
 			}
 		}()
 
 		go func() {
-			var data map[string]int64
-			cl.Repo.Counter.Read(func(tx *collector.MtcsTx[int64]) error {
+			var data map[string]uint64
+			cl.Repo.Counter.Read(func(tx *collector.MtcsTx[uint64]) error {
 				data = tx.GetAll()
 
 				return nil
 			})
 			for k, v := range data {
-				b := buildReqBody(k, mondata.CounterType, nil, &v)
+				d := int64(v)
+				b := buildReqBody(k, mondata.CounterType, m.labels, nil, &d)
 				m.Post(b, updatePath)
 			}
 		}()
@@ -196,14 +219,16 @@ func (m *MonClient) PollStats(cl *collector.Collector) {
 
 type Report struct {
 	gm map[string]float64
-	cm map[string]int64
+	cm map[string]uint64
+	tm map[string]uint64
+	ts time.Time
 	id int64
 }
 
 func (m *MonClient) PollWorker(idx uint, reps <-chan *Report, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for r := range reps {
-		b := buildReqBatchBody(r.gm, r.cm)
+		b := buildReqBatchBody(r.gm, r.cm, r.tm, m.labels, r.ts)
 		if len(b) > 0 {
 			m.Post(b, updateBatchPath)
 		}
@@ -211,32 +236,39 @@ func (m *MonClient) PollWorker(idx uint, reps <-chan *Report, wg *sync.WaitGroup
 	}
 }
 
-func readStats(id int64, cl *collector.Collector, wg *sync.WaitGroup, repsCh chan<- *Report) {
-	var (
-		gm map[string]float64
-		cm map[string]int64
-	)
+func readStats(id int64, cl *collector.Collector, aggrs []string, wg *sync.WaitGroup, repsCh chan<- *Report) {
 	defer wg.Done()
 
-	cl.Repo.Gauge.Read(func(tx *collector.MtcsTx[float64]) error {
-		gm = tx.GetAll()
-
-		return nil
-	})
+	snap := cl.Repo.TakeSnapshot()
+	gm, cm, tm := snap.Gauges, snap.Counters, snap.Totals
+	for k, v := range collector.DeriveGauges(snap.Window, aggrs) {
+		gm[k] = v
+	}
 
-	cl.Repo.Counter.Read(func(tx *collector.MtcsTx[int64]) error {
-		cm = tx.GetAll()
+	repsCh <- &Report{gm, cm, tm, time.Now(), id}
 
-		return nil
-	})
+	id++
+}
 
-	repsCh <- &Report{gm, cm, id}
+// Sends metadata of collected metrics
+func (m *MonClient) PostMeta(mm []mondata.Meta, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if len(mm) == 0 {
+		return
+	}
 
-	id++
+	b, err := json.Marshal(mm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Post(b, metaPath)
 }
 
 func (m *MonClient) PollStatsBatch(ctx context.Context, cl *collector.Collector, wpoolCount uint, chCap uint) error {
-	var id int64
+	var (
+		id          int64
+		metaVersion int64
+	)
 	repsCh := make(chan *Report, chCap)
 
 	var poolWG sync.WaitGroup
@@ -250,8 +282,14 @@ func (m *MonClient) PollStatsBatch(ctx context.Context, cl *collector.Collector,
 	for {
 		select {
 		case <-ticker.C:
+			if mm, v := cl.Meta(); v != metaVersion {
+				metaVersion = v
+				tickerWG.Add(1)
+				go m.PostMeta(mm, &tickerWG)
+			}
+
 			tickerWG.Add(1)
-			go readStats(id, cl, &tickerWG, repsCh)
+			go readStats(id, cl, m.aggregates, &tickerWG, repsCh)
 		case <-ctx.Done():
 			ticker.Stop()
 			tickerWG.Wait()
@@ -0,0 +1,11 @@
+package mondata
+
+// type of changes of metadata
+const MetaType = "meta"
+
+// Change is a notification about series changed by an instance of server
+type Change struct {
+	Origin string   `json:"origin"`         // ID of instance which made the change
+	MType  string   `json:"type"`           // type of changed series, or MetaType
+	Keys   []string `json:"keys,omitempty"` // keys of changed series, empty if any series of the type could change
+}
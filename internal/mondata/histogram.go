@@ -0,0 +1,148 @@
+package mondata
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidHistogram = errors.New("invalid histogram")
+	ErrBoundsMismatch   = errors.New("histogram bucket bounds don't match")
+)
+
+// Histogram represents distribution of observed values.
+//
+// Bounds contains upper bounds of buckets in ascending order,
+// Counts contains number of observations per bucket, it always has
+// one more element than Bounds: the last one is for values above the highest bound.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  int64     `json:"count"`
+}
+
+// Checks that bounds are sorted and finite, counts are non-negative
+// and their total matches Count, sum is finite
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: expected %d counts for %d bounds, got %d",
+			ErrInvalidHistogram, len(h.Bounds)+1, len(h.Bounds), len(h.Counts))
+	}
+
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("%w: bound #%d is not a finite number", ErrInvalidHistogram, i)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds must be in ascending order", ErrInvalidHistogram)
+		}
+	}
+
+	var total int64
+	for _, c := range h.Counts {
+		if c < 0 {
+			return fmt.Errorf("%w: counts must not be negative", ErrInvalidHistogram)
+		}
+		total += c
+	}
+
+	if total != h.Count {
+		return fmt.Errorf("%w: count %d doesn't match sum of bucket counts %d", ErrInvalidHistogram, h.Count, total)
+	}
+
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return fmt.Errorf("%w: sum is not a finite number", ErrInvalidHistogram)
+	}
+
+	return nil
+}
+
+// Adds observations of other histogram to h,
+// both of them must have the same bounds
+func (h *Histogram) Merge(other Histogram) error {
+	if !slices.Equal(h.Bounds, other.Bounds) {
+		return ErrBoundsMismatch
+	}
+
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+
+	return nil
+}
+
+// Returns deep copy of histogram
+func (h Histogram) Clone() Histogram {
+	return Histogram{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+func (h Histogram) String() string {
+	return FormatHistogram(h)
+}
+
+// Parses histogram from the string in the next format:
+//
+//	<bound>,<bound>,...;<count>,<count>,...;<sum>
+//
+// e.g. "0.1,0.5,1;3,5,1,0;2.7"
+func ParseHistogram(s string) (Histogram, error) {
+	var h Histogram
+
+	parts := strings.Split(s, ";")
+	if len(parts) != 3 {
+		return h, fmt.Errorf("%w: expected bounds, counts and sum separated by ';'", ErrInvalidHistogram)
+	}
+
+	if parts[0] != "" {
+		for _, bs := range strings.Split(parts[0], ",") {
+			b, err := strconv.ParseFloat(bs, 64)
+			if err != nil {
+				return h, err
+			}
+			h.Bounds = append(h.Bounds, b)
+		}
+	}
+
+	for _, cs := range strings.Split(parts[1], ",") {
+		c, err := strconv.ParseInt(cs, 10, 64)
+		if err != nil {
+			return h, err
+		}
+		h.Counts = append(h.Counts, c)
+		h.Count += c
+	}
+
+	sum, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return h, err
+	}
+	h.Sum = sum
+
+	return h, h.Validate()
+}
+
+func FormatHistogram(h Histogram) string {
+	bounds := make([]string, len(h.Bounds))
+	for i, b := range h.Bounds {
+		bounds[i] = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+
+	counts := make([]string, len(h.Counts))
+	for i, c := range h.Counts {
+		counts[i] = strconv.FormatInt(c, 10)
+	}
+
+	return strings.Join(bounds, ",") + ";" + strings.Join(counts, ",") + ";" + strconv.FormatFloat(h.Sum, 'f', -1, 64)
+}
@@ -0,0 +1,124 @@
+package mondata
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidLabels = errors.New("invalid labels")
+
+// Checks that every label name consists of latin letters, digits and underscores
+// and doesn't start with a digit
+func ValidateLabels(labels map[string]string) error {
+	for k := range labels {
+		if k == "" {
+			return fmt.Errorf("%w: label name must not be empty", ErrInvalidLabels)
+		}
+
+		for i, r := range k {
+			isLetter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+			isDigit := r >= '0' && r <= '9'
+			if !isLetter && (!isDigit || i == 0) {
+				return fmt.Errorf("%w: label name %q contains forbidden characters", ErrInvalidLabels, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Builds a key that identifies time series by metric name and set of labels.
+// Labels are sorted by name, labels with empty value are omitted:
+//
+//	TotalMemory{env="prod",host="srv-1"}
+//
+// Metric without labels is identified by its name.
+func SeriesKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) == 0 {
+		return name
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+// Splits series key built with SeriesKey to metric name and labels
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, map[string]string{}, nil
+	}
+
+	name := key[:i]
+	rest := key[i+1:]
+	if !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("%w: series key %q isn't closed", ErrInvalidLabels, key)
+	}
+	rest = rest[:len(rest)-1]
+
+	labels := make(map[string]string)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, fmt.Errorf("%w: missing value in series key %q", ErrInvalidLabels, key)
+		}
+
+		k := rest[:eq]
+		qv, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: malformed value in series key %q", ErrInvalidLabels, key)
+		}
+
+		v, _ := strconv.Unquote(qv)
+		labels[k] = v
+
+		rest = rest[eq+1+len(qv):]
+		if rest != "" {
+			if rest[0] != ',' {
+				return "", nil, fmt.Errorf("%w: malformed series key %q", ErrInvalidLabels, key)
+			}
+			rest = rest[1:]
+		}
+	}
+
+	return name, labels, nil
+}
+
+// Reports whether labels contain every label from selector with the same value
+func MatchLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns series key of metric
+func (m *Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
@@ -0,0 +1,69 @@
+package mondata
+
+import (
+	"strconv"
+	"time"
+)
+
+// Units known to formatter, any other unit is printed after the value as is
+const (
+	UnitBytes   = "bytes"
+	UnitNanos   = "ns"
+	UnitSeconds = "s"
+	UnitPercent = "percent"
+	UnitRatio   = "ratio"
+	UnitUnixNs  = "unix_ns" // point in time, nanoseconds since epoch
+)
+
+// Meta describes metric with specified name: its unit and how it should be displayed
+type Meta struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Help        string `json:"help,omitempty"`
+	Precision   *int   `json:"precision,omitempty"` // digits after the decimal point
+}
+
+type MetaMap = map[string]Meta
+
+var bytePrefixes = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+func (m Meta) precision(def int) int {
+	if m.Precision != nil {
+		return *m.Precision
+	}
+	return def
+}
+
+// Formats value according to the unit and precision of metric,
+// e.g. 12896123 bytes are formatted as "12.3 MiB"
+func (m Meta) Format(v float64) string {
+	switch m.Unit {
+	case UnitBytes:
+		i := 0
+		for ; i < len(bytePrefixes)-1 && (v >= 1024 || v <= -1024); i++ {
+			v /= 1024
+		}
+		if i == 0 {
+			return strconv.FormatFloat(v, 'f', m.precision(-1), 64) + " " + bytePrefixes[i]
+		}
+		return strconv.FormatFloat(v, 'f', m.precision(1), 64) + " " + bytePrefixes[i]
+	case UnitNanos:
+		return time.Duration(v).String()
+	case UnitSeconds:
+		return time.Duration(v * float64(time.Second)).String()
+	case UnitPercent:
+		return strconv.FormatFloat(v, 'f', m.precision(1), 64) + "%"
+	case UnitRatio:
+		return strconv.FormatFloat(v*100, 'f', m.precision(2), 64) + "%"
+	case UnitUnixNs:
+		if v == 0 {
+			return "-"
+		}
+		return time.Unix(0, int64(v)).UTC().Format(time.RFC3339)
+	case "":
+		return strconv.FormatFloat(v, 'f', m.precision(-1), 64)
+	default:
+		return strconv.FormatFloat(v, 'f', m.precision(-1), 64) + " " + m.Unit
+	}
+}
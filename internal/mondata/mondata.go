@@ -1,31 +1,132 @@
 package mondata
 
 import (
+	"errors"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Metrics struct {
-	ID     string   `json:"id"`
-	MType  string   `json:"type"`
-	Delta  *int64   `json:"delta,omitempty"`
-	Value  *float64 `json:"value,omitempty"`
-	SValue string   `json:"-"`
+	ID        string            `json:"id"`
+	MType     string            `json:"type"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Delta     *int64            `json:"delta,omitempty"` // counters never go down, so negative deltas and totals are rejected
+	Total     *int64            `json:"total,omitempty"` // absolute value of cumulative counter
+	Value     *float64          `json:"value,omitempty"`
+	Histogram *Histogram        `json:"histogram,omitempty"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"` // time when agent took the sample
+	Received  *time.Time        `json:"received,omitempty"`  // time when server received the sample
+	Wrapped   *time.Time        `json:"wrapped,omitempty"`   // time when counter wrapped around last time
+	SValue    string            `json:"-"`
 }
 
 const (
-	GaugeType   = "gauge"
-	CounterType = "counter"
+	GaugeType     = "gauge"
+	CounterType   = "counter"
+	HistogramType = "histogram"
 )
 
 type (
-	GaugeVType   = float64
-	CounterVType = int64
+	GaugeVType     = float64
+	CounterVType   = uint64
+	HistogramVType = Histogram
 
-	GaugeMap   = map[string]GaugeVType
-	CounterMap = map[string]CounterVType
+	GaugeMap     = map[string]GaugeVType
+	CounterMap   = map[string]CounterVType
+	HistogramMap = map[string]HistogramVType
 )
 
+// the connection was lost while the write was committed, so it's unknown whether storage applied it
+var ErrCommitUnknown = errors.New("commit status of the write is unknown")
+
+// Stamp keeps track of when the value of series was updated
+type Stamp struct {
+	Sampled  *time.Time `json:"sampled,omitempty"`
+	Received time.Time  `json:"received"`
+	Wrapped  *time.Time `json:"wrapped,omitempty"` // time when counter wrapped around last time, see OverflowWrap
+}
+
+type StampMap = map[string]Stamp
+
+// Snapshot is a consistent view of gauges and counters with their timestamps,
+// maps are copies of stored ones, so they could be read without any locks
+type Snapshot struct {
+	Gauges        GaugeMap
+	Counters      CounterMap
+	GaugeStamps   StampMap
+	CounterStamps StampMap
+}
+
+func NewSnapshot() Snapshot {
+	return Snapshot{
+		Gauges:        make(GaugeMap),
+		Counters:      make(CounterMap),
+		GaugeStamps:   make(StampMap),
+		CounterStamps: make(StampMap),
+	}
+}
+
+// State is the whole state of storage, e.g. to copy it to another storage
+type State struct {
+	Snapshot
+	Totals     CounterMap // last totals of cumulative counters
+	Histograms HistogramMap
+	Meta       MetaMap
+}
+
+// GaugeBatch is gauge values of a single report with time when agent sampled them
+type GaugeBatch struct {
+	Values  GaugeMap
+	Sampled map[string]time.Time
+}
+
+func (b GaugeBatch) Empty() bool {
+	return len(b.Values) == 0 && len(b.Sampled) == 0
+}
+
+// CounterBatch is increments and absolute totals of counters of a single report
+// with time when agent sampled them, totals are applied after increments
+type CounterBatch struct {
+	Deltas  CounterMap
+	Totals  CounterMap
+	Sampled map[string]time.Time
+}
+
+func (b CounterBatch) Empty() bool {
+	return len(b.Deltas) == 0 && len(b.Totals) == 0 && len(b.Sampled) == 0
+}
+
+// Resolutions of aggregates which raw samples are rolled up into, from the finest one
+var RollupResolutions = []time.Duration{time.Minute, time.Hour}
+
+// Returns index of the coarsest rollup resolution which fits the step, -1 means raw samples
+func RollupLevel(step time.Duration) int {
+	lvl := -1
+	for i, res := range RollupResolutions {
+		if step >= res {
+			lvl = i
+		}
+	}
+
+	return lvl
+}
+
+// Sample is a value of series at the time it was received
+type Sample struct {
+	T time.Time `json:"t"`
+	V float64   `json:"v"`
+}
+
+// Returns increase of accumulated value, value which went down was reset or wrapped, so all of it is an increase
+func Increase(prev float64, v float64) float64 {
+	if v < prev {
+		return v
+	}
+
+	return v - prev
+}
+
 type VTypes interface {
 	GaugeVType | CounterVType
 }
@@ -63,18 +164,18 @@ func (g *Gauge) String() string {
 type Counter struct {
 	MetricType string
 	Name       string
-	Value      int64
+	Value      uint64
 }
 
-func ParseCounter(s string) (int64, error) {
-	return strconv.ParseInt(s, 10, 64)
+func ParseCounter(s string) (uint64, error) {
+	return strconv.ParseUint(s, 10, 64)
 }
 
-func FormatCounter(f int64) string {
-	return strconv.FormatInt(f, 10)
+func FormatCounter(f uint64) string {
+	return strconv.FormatUint(f, 10)
 }
 
-func NewCounter(name string, i int64) *Counter {
+func NewCounter(name string, i uint64) *Counter {
 	return &Counter{
 		MetricType: CounterType,
 		Name:       name,
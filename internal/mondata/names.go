@@ -0,0 +1,46 @@
+package mondata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidName = errors.New("invalid metric name")
+	// the limit of distinct series is reached, so series which aren't stored yet are rejected
+	ErrSeriesLimit = errors.New("limit of series is reached")
+)
+
+const (
+	// names are stored as VARCHAR(64) by PostgreSQL storage
+	MaxNameLen = 64
+	// prefix of names reserved for internal use, e.g. labels of query results
+	ReservedPrefix = "__"
+)
+
+// Checks that metric name is at most MaxNameLen bytes long, consists of latin letters, digits,
+// underscores, colons and dots, doesn't start with a digit and doesn't start with ReservedPrefix
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name must not be empty", ErrInvalidName)
+	}
+
+	if len(name) > MaxNameLen {
+		return fmt.Errorf("%w: name %.16q... is longer than %d bytes", ErrInvalidName, name, MaxNameLen)
+	}
+
+	for i, r := range name {
+		isLetter := r == '_' || r == ':' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		isDigit := r >= '0' && r <= '9'
+		if !isLetter && (!isDigit || i == 0) {
+			return fmt.Errorf("%w: name %q contains forbidden characters", ErrInvalidName, name)
+		}
+	}
+
+	if strings.HasPrefix(name, ReservedPrefix) {
+		return fmt.Errorf("%w: prefix %q of name %q is reserved", ErrInvalidName, ReservedPrefix, name)
+	}
+
+	return nil
+}
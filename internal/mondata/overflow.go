@@ -0,0 +1,82 @@
+package mondata
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+)
+
+var ErrCounterOverflow = errors.New("counter value exceeds the max one")
+
+// OverflowPolicy defines what happens when counter value exceeds the max value of CounterVType
+type OverflowPolicy string
+
+const (
+	// value wraps around zero and the time of wrapping is kept in Stamp.Wrapped, it's the default one
+	OverflowWrap OverflowPolicy = "wrap"
+	// value stays at the max one
+	OverflowSaturate OverflowPolicy = "saturate"
+	// update is rejected with ErrCounterOverflow and value isn't changed
+	OverflowReject OverflowPolicy = "reject"
+)
+
+// option of DSN of storages, see ParseOverflowPolicy
+const OverflowOption = "counter_overflow"
+
+// Parses policy by its name, empty name is the default policy
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case "":
+		return OverflowWrap, nil
+	case OverflowWrap, OverflowSaturate, OverflowReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown counter overflow policy %q, expected one of: wrap, saturate, reject", s)
+	}
+}
+
+// Takes overflow policy from DSN of storage, so the option isn't parsed as an option of storage itself
+func TakeOverflowPolicy(dsn *url.URL) (OverflowPolicy, error) {
+	q := dsn.Query()
+	if !q.Has(OverflowOption) {
+		return OverflowWrap, nil
+	}
+
+	p, err := ParseOverflowPolicy(q.Get(OverflowOption))
+	if err != nil {
+		return "", err
+	}
+	q.Del(OverflowOption)
+	dsn.RawQuery = q.Encode()
+
+	return p, nil
+}
+
+// Adds increment to counter value according to the policy, wrapped reports whether the sum wrapped around.
+// Zero policy wraps
+func (p OverflowPolicy) Add(v CounterVType, inc CounterVType) (sum CounterVType, wrapped bool, err error) {
+	sum = v + inc
+	if sum >= v {
+		return sum, false, nil
+	}
+
+	switch p {
+	case OverflowSaturate:
+		return math.MaxUint64, false, nil
+	case OverflowReject:
+		return v, false, ErrCounterOverflow
+	default:
+		return sum, true, nil
+	}
+}
+
+// Returns increment of cumulative counter since the previous total,
+// a decreased total means the source was restarted and counts from zero again
+func TotalIncrement(prev CounterVType, seen bool, total CounterVType) CounterVType {
+	if !seen || total < prev {
+		return total
+	}
+
+	return total - prev
+}
@@ -0,0 +1,91 @@
+package mondata
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TTLPolicy defines how long series are kept without updates,
+// TTL of the longest matching name prefix overrides the default one, zero TTL keeps series forever
+type TTLPolicy struct {
+	Default  time.Duration
+	Prefixes map[string]time.Duration
+}
+
+func (p TTLPolicy) Enabled() bool {
+	if p.Default > 0 {
+		return true
+	}
+
+	for _, ttl := range p.Prefixes {
+		if ttl > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns TTL of series with the name
+func (p TTLPolicy) TTL(name string) time.Duration {
+	ttl := p.Default
+	matched := -1
+	for prefix, d := range p.Prefixes {
+		if strings.HasPrefix(name, prefix) && len(prefix) > matched {
+			ttl = d
+			matched = len(prefix)
+		}
+	}
+
+	return ttl
+}
+
+// Checks whether series with the name, which was updated at the time, is stale at the time now
+func (p TTLPolicy) Expired(name string, updated time.Time, now time.Time) bool {
+	ttl := p.TTL(name)
+	return ttl > 0 && now.Sub(updated) > ttl
+}
+
+// TTLRule is a part of TTLPolicy which could be checked by a query:
+// series which names have Prefix, but none of Excluded prefixes, are stale after TTL
+type TTLRule struct {
+	Prefix   string
+	Excluded []string // longer prefixes which override TTL of the rule
+	TTL      time.Duration
+}
+
+// Returns rules of the policy which keep series for a limited time ordered by prefix,
+// name of series matches a single rule at most
+func (p TTLPolicy) Rules() []TTLRule {
+	ttls := make(map[string]time.Duration, len(p.Prefixes)+1)
+	ttls[""] = p.Default
+	for prefix, ttl := range p.Prefixes {
+		ttls[prefix] = ttl
+	}
+
+	rules := make([]TTLRule, 0, len(ttls))
+	for prefix, ttl := range ttls {
+		if ttl <= 0 {
+			continue
+		}
+
+		r := TTLRule{Prefix: prefix, TTL: ttl}
+		for other := range ttls {
+			if len(other) > len(prefix) && strings.HasPrefix(other, prefix) {
+				r.Excluded = append(r.Excluded, other)
+			}
+		}
+		sort.Strings(r.Excluded)
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Prefix < rules[j].Prefix })
+
+	return rules
+}
+
+// SeriesRef identifies series of specific metric type
+type SeriesRef struct {
+	MType string
+	Key   string
+}
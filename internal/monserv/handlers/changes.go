@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// Database which notifies about changes made by other instances of server sharing it, it's optional
+type ChangeStore interface {
+	Subscribe(fn func(mondata.Change))
+}
+
+// number of changes queued for a streaming client before it's disconnected
+const changesQueueSize = 64
+
+// changeFeed fans changes made by other instances of server out to streaming clients.
+// Clients which don't keep up are disconnected, so they reconnect and reload the series
+type changeFeed struct {
+	mu      sync.Mutex
+	clients map[chan mondata.Change]struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{clients: make(map[chan mondata.Change]struct{})}
+}
+
+// Passes change to clients, it doesn't block, so it's called by database directly
+func (f *changeFeed) publish(c mondata.Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.clients {
+		select {
+		case ch <- c:
+		default:
+			delete(f.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+func (f *changeFeed) subscribe() chan mondata.Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan mondata.Change, changesQueueSize)
+	f.clients[ch] = struct{}{}
+
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan mondata.Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.clients[ch]; ok {
+		delete(f.clients, ch)
+		close(ch)
+	}
+}
+
+// Streams changes made by other instances of server as server-sent events,
+// so dashboards refresh series named by them, all series of the type if keys are empty
+func (api *API) ChangesHandler(rw http.ResponseWriter, req *http.Request) {
+	if api.changes == nil {
+		respErr := NewRespError("changes of other instances aren't tracked by storage", nil)
+		api.Error(rw, respErr, http.StatusNotImplemented)
+		return
+	}
+
+	ch := api.changes.subscribe()
+	defer api.changes.unsubscribe(ch)
+
+	rc := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		api.logger.Errorln("streaming of changes isn't supported:", err)
+		return
+	}
+
+	for {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(c)
+			if err != nil {
+				api.logger.Errorln("encoding of change failed:", err)
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "event: change\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"html/template"
+	"math"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/query"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -52,6 +57,15 @@ type Getters interface {
 
 	GetCounter(ctx context.Context, name string) (mondata.CounterVType, bool, error)
 	GetCounterAll(ctx context.Context) (mondata.CounterMap, error)
+
+	GetHistogram(ctx context.Context, name string) (mondata.HistogramVType, bool, error)
+	GetHistogramAll(ctx context.Context) (mondata.HistogramMap, error)
+
+	GetStamp(ctx context.Context, mtype string, name string) (mondata.Stamp, bool, error)
+	GetStampAll(ctx context.Context, mtype string) (mondata.StampMap, error)
+
+	// Returns gauges and counters with their timestamps as of the same moment
+	GetSnapshot(ctx context.Context) (mondata.Snapshot, error)
 }
 
 type Setters interface {
@@ -60,12 +74,42 @@ type Setters interface {
 
 	SetCounter(ctx context.Context, name string, value mondata.CounterVType) error
 	SetCounterAll(ctx context.Context, gaugeMap mondata.CounterMap) error
+	SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error
+	SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error
+
+	SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error
+	SetHistogramAll(ctx context.Context, histogramMap mondata.HistogramMap) error
+
+	SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error
+
+	// Stores gauges, counters and histograms of a report all together, none of them are stored if it fails
+	ApplyBatch(ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap) error
+}
+
+// Metadata of metrics
+type MetaStore interface {
+	GetMeta(ctx context.Context, name string) (mondata.Meta, bool, error)
+	GetMetaAll(ctx context.Context) (mondata.MetaMap, error)
+	SetMetaAll(ctx context.Context, metaMap mondata.MetaMap) error
+}
+
+// History of series values, it's optional for database
+type HistoryStore interface {
+	GetHistory(
+		ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+	) ([]mondata.Sample, bool, error)
+}
+
+// Overflow policy of counters, it's optional for database, counters wrap by default
+type OverflowStore interface {
+	Overflow() mondata.OverflowPolicy
 }
 
 // Database interface
 type MDB interface {
 	Getters
 	Setters
+	MetaStore
 	Ping(ctx context.Context) error
 }
 
@@ -77,13 +121,50 @@ type ErrLogger interface {
 type API struct {
 	db     MDB
 	logger ErrLogger
+	// nil unless database notifies about changes of other instances
+	changes *changeFeed
 }
 
 func NewAPI(db MDB, logger ErrLogger) *API {
-	return &API{
-		db,
-		logger,
+	api := &API{
+		db:     db,
+		logger: logger,
 	}
+	if cs, ok := db.(ChangeStore); ok {
+		api.changes = newChangeFeed()
+		cs.Subscribe(api.changes.publish)
+	}
+
+	return api
+}
+
+// Returns overflow policy of counters of the database
+func (api *API) overflow() mondata.OverflowPolicy {
+	if store, ok := api.db.(OverflowStore); ok {
+		return store.Overflow()
+	}
+
+	return mondata.OverflowWrap
+}
+
+var errNegativeCounter = errors.New("counter delta and total can't be negative")
+
+// Converts delta and total of metrics to counter values, nil ones stay nil
+func counterValues(m *mondata.Metrics) (delta *mondata.CounterVType, total *mondata.CounterVType, err error) {
+	conv := func(v *int64) *mondata.CounterVType {
+		if v == nil {
+			return nil
+		}
+		if *v < 0 {
+			err = errNegativeCounter
+			return nil
+		}
+		cv := mondata.CounterVType(*v)
+		return &cv
+	}
+
+	delta, total = conv(m.Delta), conv(m.Total)
+	return delta, total, err
 }
 
 // Logs error and responds with error code and error message
@@ -92,7 +173,79 @@ func (api *API) Error(rw http.ResponseWriter, err *RespError, code int) {
 	http.Error(rw, err.Msg(), code)
 }
 
-// Responds with html-template which represents table with all collected metrics
+// Returns labels specified in the query of request URL, except reserved params
+func labelsFromQuery(req *http.Request, reserved ...string) map[string]string {
+	q := req.URL.Query()
+	for _, k := range reserved {
+		q.Del(k)
+	}
+	if len(q) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, len(q))
+	for k := range q {
+		labels[k] = q.Get(k)
+	}
+
+	return labels
+}
+
+// Returns series which labels match selector
+func filterByLabels[V any](m map[string]V, selector map[string]string) map[string]V {
+	if len(selector) == 0 {
+		return m
+	}
+
+	fm := make(map[string]V)
+	for k, v := range m {
+		_, labels, err := mondata.ParseSeriesKey(k)
+		if err != nil {
+			continue
+		}
+
+		if mondata.MatchLabels(labels, selector) {
+			fm[k] = v
+		}
+	}
+
+	return fm
+}
+
+// Formats values according to units from metadata and collects descriptions of series
+func displayValues[V mondata.GaugeVType | mondata.CounterVType | mondata.Histogram](m map[string]V, meta mondata.MetaMap) (map[string]string, map[string]string) {
+	display := make(map[string]string)
+	hints := make(map[string]string)
+	if len(meta) == 0 {
+		return display, hints
+	}
+
+	for k, v := range m {
+		name, _, err := mondata.ParseSeriesKey(k)
+		if err != nil {
+			continue
+		}
+
+		md, ok := meta[name]
+		if !ok {
+			continue
+		}
+
+		switch fv := any(v).(type) {
+		case float64:
+			display[k] = md.Format(fv)
+		case mondata.CounterVType:
+			display[k] = md.Format(float64(fv))
+		}
+
+		hints[k] = strings.TrimSpace(md.Description + " " + md.Help)
+	}
+
+	return display, hints
+}
+
+// Responds with html-template which represents table with all collected metrics,
+// series could be filtered by labels specified in the query: /?host=srv-1
 func (api *API) CreateRootHandler(path string) http.HandlerFunc {
 
 	if path == "" {
@@ -104,31 +257,54 @@ func (api *API) CreateRootHandler(path string) http.HandlerFunc {
 
 	return func(rw http.ResponseWriter, req *http.Request) {
 		type Vals interface {
-			map[string]float64 | map[string]int64
+			map[string]float64 | mondata.CounterMap | mondata.HistogramMap
 		}
 
 		type Table[T Vals] struct {
 			Name    string
 			Content T
+			Stamps  mondata.StampMap
+			Display map[string]string // values formatted according to metadata
+			Hints   map[string]string
 		}
 
-		gVals, err := api.db.GetGaugeAll(req.Context())
+		// gauges and counters are shown as of the same moment
+		snap, err := api.db.GetSnapshot(req.Context())
 		if err != nil {
-			respErr := NewRespError("an error occured while acquaring gauge values from db", err)
+			respErr := NewRespError("an error occured while acquaring snapshot of values from db", err)
 			api.Error(rw, respErr, http.StatusInternalServerError)
 			return
 		}
+		gVals, cVals := snap.Gauges, snap.Counters
+		gStamps, cStamps := snap.GaugeStamps, snap.CounterStamps
 
-		cVals, err := api.db.GetCounterAll(req.Context())
+		hVals, err := api.db.GetHistogramAll(req.Context())
 		if err != nil {
-			respErr := NewRespError("an error occured while acquaring counter values from db", err)
+			respErr := NewRespError("an error occured while acquaring histogram values from db", err)
 			api.Error(rw, respErr, http.StatusInternalServerError)
 			return
 		}
 
+		meta, err := api.db.GetMetaAll(req.Context())
+		if err != nil {
+			respErr := NewRespError("an error occured while acquaring metadata from db", err)
+			api.Error(rw, respErr, http.StatusInternalServerError)
+			return
+		}
+
+		selector := labelsFromQuery(req)
+		gVals = filterByLabels(gVals, selector)
+		cVals = filterByLabels(cVals, selector)
+		hVals = filterByLabels(hVals, selector)
+
+		gDisplay, gHints := displayValues(gVals, meta)
+		cDisplay, cHints := displayValues(cVals, meta)
+		_, hHints := displayValues(hVals, meta)
+
 		viewData := []any{
-			Table[map[string]float64]{Name: "Gauge", Content: gVals},
-			Table[map[string]int64]{Name: "Counter", Content: cVals},
+			Table[map[string]float64]{Name: "Gauge", Content: gVals, Stamps: gStamps, Display: gDisplay, Hints: gHints},
+			Table[mondata.CounterMap]{Name: "Counter", Content: cVals, Stamps: cStamps, Display: cDisplay, Hints: cHints},
+			Table[mondata.HistogramMap]{Name: "Histogram", Content: hVals, Hints: hHints},
 		}
 
 		if tmplErr != nil {
@@ -154,6 +330,14 @@ func updateMetrics(ctx context.Context, m *mondata.Metrics, db MDB) (int, *RespE
 		return http.StatusNotFound, NewRespError("name must contain a value", nil)
 	}
 
+	if err := mondata.ValidateName(m.ID); err != nil {
+		return http.StatusBadRequest, NewRespError("invalid name", err)
+	}
+	if err := mondata.ValidateLabels(m.Labels); err != nil {
+		return http.StatusBadRequest, NewRespError("invalid labels", err)
+	}
+	key := m.Key()
+
 	switch m.MType {
 	case mondata.GaugeType:
 		if m.SValue != "" {
@@ -164,25 +348,87 @@ func updateMetrics(ctx context.Context, m *mondata.Metrics, db MDB) (int, *RespE
 			m.Value = &v
 		}
 
-		err := db.SetGauge(ctx, m.ID, *m.Value)
+		err := db.SetGauge(ctx, key, *m.Value)
+		if errors.Is(err, mondata.ErrSeriesLimit) {
+			return http.StatusTooManyRequests, NewRespError("limit of series is reached", err)
+		}
 		if err != nil {
 			return http.StatusInternalServerError, NewRespError("setting gauge value in db failed", err)
 		}
 
+		if m.Timestamp != nil {
+			err = db.SetSampled(ctx, m.MType, map[string]time.Time{key: *m.Timestamp})
+			if err != nil {
+				return http.StatusInternalServerError, NewRespError("setting gauge timestamp in db failed", err)
+			}
+		}
+
 		return http.StatusOK, nil
 	case mondata.CounterType:
+		delta, total, err := counterValues(m)
+		if err != nil {
+			return http.StatusBadRequest, NewRespError("invalid value", err)
+		}
 		if m.SValue != "" {
 			d, err := mondata.ParseCounter(m.SValue)
 			if err != nil {
 				return http.StatusBadRequest, NewRespError("invalid value", err)
 			}
-			m.Delta = &d
+			delta = &d
 		}
 
-		err := db.SetCounter(ctx, m.ID, *m.Delta)
+		switch {
+		case total != nil:
+			err = db.SetCounterTotal(ctx, key, *total)
+		case delta != nil:
+			err = db.SetCounter(ctx, key, *delta)
+		default:
+			return http.StatusBadRequest, NewRespError("counter must contain delta or total", nil)
+		}
+		if errors.Is(err, mondata.ErrCounterOverflow) {
+			return http.StatusUnprocessableEntity, NewRespError("counter value overflows", err)
+		}
+		if errors.Is(err, mondata.ErrSeriesLimit) {
+			return http.StatusTooManyRequests, NewRespError("limit of series is reached", err)
+		}
 		if err != nil {
 			return http.StatusInternalServerError, NewRespError("setting counter value in db failed", err)
 		}
+
+		if m.Timestamp != nil {
+			err = db.SetSampled(ctx, m.MType, map[string]time.Time{key: *m.Timestamp})
+			if err != nil {
+				return http.StatusInternalServerError, NewRespError("setting counter timestamp in db failed", err)
+			}
+		}
+		return http.StatusOK, nil
+	case mondata.HistogramType:
+		if m.SValue != "" {
+			h, err := mondata.ParseHistogram(m.SValue)
+			if err != nil {
+				return http.StatusBadRequest, NewRespError("invalid value", err)
+			}
+			m.Histogram = &h
+		}
+
+		if m.Histogram == nil {
+			return http.StatusBadRequest, NewRespError("histogram must contain a value", nil)
+		}
+
+		if err := m.Histogram.Validate(); err != nil {
+			return http.StatusBadRequest, NewRespError("invalid value", err)
+		}
+
+		err := db.SetHistogram(ctx, key, *m.Histogram)
+		if errors.Is(err, mondata.ErrBoundsMismatch) {
+			return http.StatusConflict, NewRespError("histogram bounds don't match stored ones", err)
+		}
+		if errors.Is(err, mondata.ErrSeriesLimit) {
+			return http.StatusTooManyRequests, NewRespError("limit of series is reached", err)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, NewRespError("setting histogram value in db failed", err)
+		}
 		return http.StatusOK, nil
 	default:
 		return http.StatusBadRequest, NewRespError("incorrect request type", nil)
@@ -198,6 +444,7 @@ func (api *API) UpdateHandler(rw http.ResponseWriter, req *http.Request) {
 	m.MType = chi.URLParam(req, URLPathType)
 	m.ID = chi.URLParam(req, URLPathName)
 	m.SValue = chi.URLParam(req, URLPathValue)
+	m.Labels = labelsFromQuery(req)
 	code, err := updateMetrics(req.Context(), m, api.db)
 	if err != nil {
 		api.Error(rw, err, code)
@@ -281,45 +528,107 @@ func (api *API) UpdateBatchHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		gm := make(map[string]float64)
-		cm := make(map[string]int64)
+		cm := make(mondata.CounterMap)
+		ctm := make(mondata.CounterMap)
+		hm := make(mondata.HistogramMap)
+		gts := make(map[string]time.Time)
+		cts := make(map[string]time.Time)
 
 		for _, rec := range *mm {
 			if rec.ID == "" {
 				continue
 			}
 
+			if err := mondata.ValidateName(rec.ID); err != nil {
+				respErr := NewRespError("invalid name", err)
+				api.Error(rw, respErr, http.StatusBadRequest)
+				return
+			}
+			if err := mondata.ValidateLabels(rec.Labels); err != nil {
+				respErr := NewRespError("invalid labels", err)
+				api.Error(rw, respErr, http.StatusBadRequest)
+				return
+			}
+			key := rec.Key()
+
 			if rec.MType == mondata.GaugeType {
-				gm[rec.ID] = *rec.Value
+				gm[key] = *rec.Value
+				if rec.Timestamp != nil {
+					gts[key] = *rec.Timestamp
+				}
 
 			} else if rec.MType == mondata.CounterType {
-				if cv, ok := cm[rec.ID]; ok {
-					cm[rec.ID] = cv + *rec.Delta
+				delta, total, err := counterValues(&rec)
+				if err != nil {
+					respErr := NewRespError("invalid value", err)
+					api.Error(rw, respErr, http.StatusBadRequest)
+					return
+				}
+				if rec.Timestamp != nil {
+					cts[key] = *rec.Timestamp
+				}
+				// totals are absolute, so only the latest one matters
+				if total != nil {
+					ctm[key] = *total
+					continue
+				}
+				if delta == nil {
+					continue
+				}
+				if cv, ok := cm[key]; ok {
+					// deltas are merged by the policy of the storage, so their sum is accumulated as they would be one by one
+					sum, _, err := api.overflow().Add(cv, *delta)
+					if err != nil {
+						respErr := NewRespError("sum of counter deltas within the batch overflows", err)
+						api.Error(rw, respErr, http.StatusUnprocessableEntity)
+						return
+					}
+					cm[key] = sum
 					continue
 				}
-				cm[rec.ID] = *rec.Delta
+				cm[key] = *delta
+			} else if rec.MType == mondata.HistogramType && rec.Histogram != nil {
+				if err := rec.Histogram.Validate(); err != nil {
+					respErr := NewRespError("invalid histogram value", err)
+					api.Error(rw, respErr, http.StatusBadRequest)
+					return
+				}
+
+				if hv, ok := hm[key]; ok {
+					if err := hv.Merge(*rec.Histogram); err != nil {
+						respErr := NewRespError("histogram bounds don't match within the batch", err)
+						api.Error(rw, respErr, http.StatusBadRequest)
+						return
+					}
+					hm[key] = hv
+					continue
+				}
+				hm[key] = rec.Histogram.Clone()
 			}
 		}
 
-		if len(gm) == 0 && len(cm) == 0 {
+		if len(gm) == 0 && len(cm) == 0 && len(ctm) == 0 && len(hm) == 0 {
 			respErr := NewRespError("nothing to update", nil)
 			api.Error(rw, respErr, http.StatusBadRequest)
 			return
 		}
 
-		if len(gm) > 0 {
-			if err := api.db.SetGaugeAll(req.Context(), gm); err != nil {
-				respErr := NewRespError("gauge batch update to db failed", err)
-				api.Error(rw, respErr, http.StatusInternalServerError)
-				return
-			}
-		}
-
-		if len(cm) > 0 {
-			if err := api.db.SetCounterAll(req.Context(), cm); err != nil {
-				respErr := NewRespError("counter batch update to db failed", err)
-				api.Error(rw, respErr, http.StatusInternalServerError)
-				return
+		// series of the batch are stored all together, so the batch is never applied partially
+		gb := mondata.GaugeBatch{Values: gm, Sampled: gts}
+		cb := mondata.CounterBatch{Deltas: cm, Totals: ctm, Sampled: cts}
+		if err := api.db.ApplyBatch(req.Context(), gb, cb, hm); err != nil {
+			code := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, mondata.ErrCounterOverflow):
+				code = http.StatusUnprocessableEntity
+			case errors.Is(err, mondata.ErrBoundsMismatch):
+				code = http.StatusConflict
+			case errors.Is(err, mondata.ErrSeriesLimit):
+				code = http.StatusTooManyRequests
 			}
+			respErr := NewRespError("batch update to db failed", err)
+			api.Error(rw, respErr, code)
+			return
 		}
 
 		rw.WriteHeader(http.StatusOK)
@@ -335,34 +644,79 @@ type vhData struct {
 	code    int
 }
 
+// Adds sample and receive timestamps to metrics
+func setStamp(ctx context.Context, m *mondata.Metrics, key string, db MDB) *RespError {
+	st, ok, err := db.GetStamp(ctx, m.MType, key)
+	if err != nil {
+		return NewRespError("getting timestamps from db failed", err)
+	}
+
+	if ok {
+		m.Timestamp = st.Sampled
+		m.Wrapped = st.Wrapped
+		if !st.Received.IsZero() {
+			m.Received = &st.Received
+		}
+	}
+
+	return nil
+}
+
 func getVhData(ctx context.Context, m *mondata.Metrics, db MDB) (*vhData, *RespError) {
 	if m.ID == "" {
 		return &vhData{code: http.StatusNotFound}, NewRespError("name must contain a value", nil)
 	}
+	key := m.Key()
 
 	switch m.MType {
 	case mondata.GaugeType:
-		v, ok, err := db.GetGauge(ctx, m.ID)
+		v, ok, err := db.GetGauge(ctx, key)
 		if err != nil {
 			return &vhData{code: http.StatusInternalServerError}, NewRespError("getting gauge value from db failed", err)
 		} else if ok {
-			return &vhData{
+			vhd := &vhData{
 				code: http.StatusOK,
 				metrics: &mondata.Metrics{
-					ID: m.ID, MType: m.MType, Value: &v, SValue: mondata.FormatGauge(v),
+					ID: m.ID, MType: m.MType, Labels: m.Labels, Value: &v, SValue: mondata.FormatGauge(v),
 				},
-			}, nil
+			}
+			if respErr := setStamp(ctx, vhd.metrics, key, db); respErr != nil {
+				return &vhData{code: http.StatusInternalServerError}, respErr
+			}
+			return vhd, nil
 		}
 		return &vhData{code: http.StatusNotFound}, NewRespError("value doesn't exist in the storage", nil)
 	case mondata.CounterType:
-		v, ok, err := db.GetCounter(ctx, m.ID)
+		v, ok, err := db.GetCounter(ctx, key)
 		if err != nil {
 			return &vhData{code: http.StatusInternalServerError}, NewRespError("getting counter value from db failed", err)
+		} else if ok {
+			vhd := &vhData{
+				code: http.StatusOK,
+				metrics: &mondata.Metrics{
+					ID: m.ID, MType: m.MType, Labels: m.Labels, SValue: mondata.FormatCounter(v),
+				},
+			}
+			// values which don't fit into delta could be read as text only
+			if v <= math.MaxInt64 {
+				d := int64(v)
+				vhd.metrics.Delta = &d
+			}
+			if respErr := setStamp(ctx, vhd.metrics, key, db); respErr != nil {
+				return &vhData{code: http.StatusInternalServerError}, respErr
+			}
+			return vhd, nil
+		}
+		return &vhData{code: http.StatusNotFound}, NewRespError("value doesn't exist in the storage", nil)
+	case mondata.HistogramType:
+		v, ok, err := db.GetHistogram(ctx, key)
+		if err != nil {
+			return &vhData{code: http.StatusInternalServerError}, NewRespError("getting histogram value from db failed", err)
 		} else if ok {
 			return &vhData{
 				code: http.StatusOK,
 				metrics: &mondata.Metrics{
-					ID: m.ID, MType: m.MType, Delta: &v, SValue: mondata.FormatCounter(v),
+					ID: m.ID, MType: m.MType, Labels: m.Labels, Histogram: &v, SValue: mondata.FormatHistogram(v),
 				},
 			}, nil
 		}
@@ -373,12 +727,14 @@ func getVhData(ctx context.Context, m *mondata.Metrics, db MDB) (*vhData, *RespE
 }
 
 // Accepts request with next URL params: type/name.
+// Labels of the series could be specified in the query: ?host=srv-1&env=prod
 //
 // Responds with text/plain body containing specified value.
 func (api *API) ValueHandler(rw http.ResponseWriter, req *http.Request) {
 	m := &mondata.Metrics{}
 	m.MType = chi.URLParam(req, URLPathType)
 	m.ID = chi.URLParam(req, URLPathName)
+	m.Labels = labelsFromQuery(req)
 	vhd, respErr := getVhData(req.Context(), m, api.db)
 	if respErr != nil {
 		api.Error(rw, respErr, vhd.code)
@@ -427,6 +783,11 @@ func (api *API) ValueRootHandler(rw http.ResponseWriter, req *http.Request) {
 			api.Error(rw, respErr, vhd.code)
 			return
 		}
+		if vhd.metrics.MType == mondata.CounterType && vhd.metrics.Delta == nil {
+			respErr := NewRespError("counter value exceeds the max delta, it could be read as text", nil)
+			api.Error(rw, respErr, http.StatusUnprocessableEntity)
+			return
+		}
 
 		b, err := json.Marshal(vhd.metrics)
 		if err != nil {
@@ -459,3 +820,237 @@ func (api *API) PingHandler(rw http.ResponseWriter, req *http.Request) {
 
 	rw.WriteHeader(http.StatusOK)
 }
+
+// Accepts requests with JSON-body, that contains array of metadata.
+//
+// Updates metadata of specified metrics and respond with 200 if succeeded.
+func (api *API) UpdateMetaHandler(rw http.ResponseWriter, req *http.Request) {
+	if !strings.Contains(req.Header.Get("Content-Type"), "application/json") {
+		respErr := NewRespError("unsupported content type", nil)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(req.Body)
+	if err != nil {
+		respErr := NewRespError("working with request body failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+	defer req.Body.Close()
+
+	var mm []mondata.Meta
+	if err := json.Unmarshal(buf.Bytes(), &mm); err != nil {
+		respErr := NewRespError("unmarshaling failed", err)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	metaMap := make(mondata.MetaMap, len(mm))
+	for _, m := range mm {
+		if m.Name == "" {
+			respErr := NewRespError("name must contain a value", nil)
+			api.Error(rw, respErr, http.StatusBadRequest)
+			return
+		}
+		metaMap[m.Name] = m
+	}
+
+	if len(metaMap) == 0 {
+		respErr := NewRespError("nothing to update", nil)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	if err := api.db.SetMetaAll(req.Context(), metaMap); err != nil {
+		respErr := NewRespError("metadata update to db failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// Responds with JSON array containing metadata of all metrics
+func (api *API) MetaRootHandler(rw http.ResponseWriter, req *http.Request) {
+	metaMap, err := api.db.GetMetaAll(req.Context())
+	if err != nil {
+		respErr := NewRespError("getting metadata from db failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	mm := make([]mondata.Meta, 0, len(metaMap))
+	for _, m := range metaMap {
+		mm = append(mm, m)
+	}
+	sort.Slice(mm, func(i, j int) bool { return mm[i].Name < mm[j].Name })
+
+	api.writeJSON(rw, mm)
+}
+
+// Accepts request with next URL param: name.
+//
+// Responds with JSON body containing metadata of specified metric.
+func (api *API) MetaHandler(rw http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, URLPathName)
+	m, ok, err := api.db.GetMeta(req.Context(), name)
+	if err != nil {
+		respErr := NewRespError("getting metadata from db failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		respErr := NewRespError("metadata doesn't exist in the storage", nil)
+		api.Error(rw, respErr, http.StatusNotFound)
+		return
+	}
+
+	api.writeJSON(rw, m)
+}
+
+// Marshals v and writes it to response
+func (api *API) writeJSON(rw http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		respErr := NewRespError("marshaling failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Add("Content-Type", "application/json; charset=utf-8")
+	_, err = rw.Write(b)
+	if err != nil {
+		respErr := NewRespError("rw error", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+	}
+}
+
+const (
+	historyFrom = "from"
+	historyTo   = "to"
+	historyStep = "step"
+)
+
+// Parses time in RFC3339 format or as unix seconds, empty string is a zero time
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+type historyResp struct {
+	ID      string            `json:"id"`
+	MType   string            `json:"type"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Samples []mondata.Sample  `json:"samples"`
+}
+
+// Accepts request with next URL params: type/name.
+// Range is specified in the query: ?from=&to=&step=, where from and to are
+// RFC3339 or unix seconds and step is a duration like 30s, other params are labels.
+//
+// Responds with JSON body containing samples of specified series.
+func (api *API) HistoryHandler(rw http.ResponseWriter, req *http.Request) {
+	hs, ok := api.db.(HistoryStore)
+	if !ok {
+		respErr := NewRespError("history isn't supported by storage", nil)
+		api.Error(rw, respErr, http.StatusNotImplemented)
+		return
+	}
+
+	m := &mondata.Metrics{}
+	m.MType = chi.URLParam(req, URLPathType)
+	m.ID = chi.URLParam(req, URLPathName)
+	m.Labels = labelsFromQuery(req, historyFrom, historyTo, historyStep)
+	if m.MType != mondata.GaugeType && m.MType != mondata.CounterType {
+		respErr := NewRespError("history is kept only for gauge and counter metrics", nil)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	q := req.URL.Query()
+	from, err := parseHistoryTime(q.Get(historyFrom))
+	if err != nil {
+		respErr := NewRespError("invalid from param", err)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	to, err := parseHistoryTime(q.Get(historyTo))
+	if err != nil {
+		respErr := NewRespError("invalid to param", err)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if s := q.Get(historyStep); s != "" {
+		step, err = time.ParseDuration(s)
+		if err != nil || step < 0 {
+			respErr := NewRespError("invalid step param", err)
+			api.Error(rw, respErr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	samples, ok, err := hs.GetHistory(req.Context(), m.MType, m.Key(), from, to, step)
+	if err != nil {
+		respErr := NewRespError("getting history from db failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		respErr := NewRespError("history doesn't exist in the storage", nil)
+		api.Error(rw, respErr, http.StatusNotFound)
+		return
+	}
+
+	if samples == nil {
+		samples = []mondata.Sample{}
+	}
+
+	api.writeJSON(rw, historyResp{ID: m.ID, MType: m.MType, Labels: m.Labels, Samples: samples})
+}
+
+// Accepts request with expression in the query: ?expr=sum by (host) (rate(PollCount[5m])).
+//
+// Responds with JSON body containing scalar or vector of series evaluated at the current time.
+func (api *API) QueryHandler(rw http.ResponseWriter, req *http.Request) {
+	src, ok := api.db.(query.Source)
+	if !ok {
+		respErr := NewRespError("queries aren't supported by storage", nil)
+		api.Error(rw, respErr, http.StatusNotImplemented)
+		return
+	}
+
+	expr := req.URL.Query().Get("expr")
+	if expr == "" {
+		respErr := NewRespError("expr must contain a value", nil)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+
+	res, err := query.Eval(req.Context(), src, expr, time.Now())
+	if errors.Is(err, query.ErrSyntax) || errors.Is(err, query.ErrType) {
+		respErr := NewRespError(err.Error(), err)
+		api.Error(rw, respErr, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respErr := NewRespError("query evaluation failed", err)
+		api.Error(rw, respErr, http.StatusInternalServerError)
+		return
+	}
+
+	api.writeJSON(rw, res)
+}
@@ -96,12 +96,8 @@ func ExampleAPI_CreateRootHandler() {
 
 func ExampleAPI_ValueHandler() {
 	db := &memory.MemorySt{
-		Gauge: &safe.MRepo[mondata.GaugeVType]{},
-		Counter: &safe.MRepo[mondata.CounterVType]{
-			Data: mondata.CounterMap{
-				"PollCount": 2,
-			},
-		},
+		Gauge:   safe.NewShardedMRepo[mondata.GaugeVType](4),
+		Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{"PollCount": 2}),
 	}
 	req := WrapWithChiCtx(
 		httptest.NewRequest("GET", "/value/counter/PollCount", nil), map[string]string{
@@ -130,12 +126,8 @@ func ExampleAPI_ValueHandler() {
 
 func ExampleAPI_ValueRootHandler() {
 	db := &memory.MemorySt{
-		Gauge: &safe.MRepo[mondata.GaugeVType]{},
-		Counter: &safe.MRepo[mondata.CounterVType]{
-			Data: mondata.CounterMap{
-				"PollCount": 64,
-			},
-		},
+		Gauge:   safe.NewShardedMRepo[mondata.GaugeVType](4),
+		Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{"PollCount": 64}),
 	}
 	req := WrapWithChiCtx(
 		httptest.NewRequest("POST", "/value",
@@ -1,25 +1,37 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/monserv/middlewares"
+	"github.com/Allegathor/perfmon/internal/repo"
 	"github.com/Allegathor/perfmon/internal/repo/memory"
 	"github.com/Allegathor/perfmon/internal/repo/safe"
+	"github.com/Allegathor/perfmon/internal/repo/sqlite"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 // MARK: Update
 func TestAPI_UpdateHandler(t *testing.T) {
-	type want[T int64 | float64] struct {
+	type want[T uint64 | float64] struct {
 		contentType string
 		code        int
 		errMsg      string
@@ -31,7 +43,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 		success bool
 		req     *http.Request
 		db      *memory.MemorySt
-		want    want[int64]
+		want    want[uint64]
 	}{
 		{
 			name:    "positive test #1",
@@ -44,7 +56,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        200,
 				key:         "PollCount",
@@ -63,12 +75,10 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{"PollCount": 56},
-				},
+				Gauge:   safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{"PollCount": 56}),
 			},
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        200,
 				key:         "PollCount",
@@ -87,7 +97,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        405,
 				key:         "PollCount",
@@ -106,7 +116,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        404,
 				key:         "PollCount",
@@ -125,7 +135,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        404,
 				key:         "PollCount",
@@ -144,7 +154,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        400,
 				key:         "PollCount",
@@ -163,7 +173,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 				},
 			),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        400,
 				key:         "PollCount",
@@ -205,7 +215,7 @@ func TestAPI_UpdateHandler(t *testing.T) {
 // MARK: Update root
 
 func TestAPI_UpdateRootHandler(t *testing.T) {
-	type want[T int64 | float64] struct {
+	type want[T uint64 | float64] struct {
 		contentType string
 		code        int
 		errMsg      string
@@ -217,7 +227,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 		success bool
 		req     *http.Request
 		db      *memory.MemorySt
-		want    want[int64]
+		want    want[uint64]
 	}{
 		{
 			name:    "positive test #1",
@@ -227,7 +237,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter","delta":99}`))),
 				nil),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        200,
 				key:         "PollCount",
@@ -243,14 +253,12 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter","delta":50}`))),
 				nil),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{
-						"PollCount": 101,
-					},
-				},
+				Gauge: safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount": 101,
+				}),
 			},
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        200,
 				key:         "PollCount",
@@ -258,12 +266,33 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 				errMsg:      "",
 			},
 		},
+		{
+			name:    "positive test #3 (labels)",
+			success: true,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("POST", "/update",
+					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter","labels":{"host":"srv-1"},"delta":5}`))),
+				nil),
+			db: &memory.MemorySt{
+				Gauge: safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount": 101,
+				}),
+			},
+			want: want[uint64]{
+				contentType: "",
+				code:        200,
+				key:         `PollCount{host="srv-1"}`,
+				value:       5,
+				errMsg:      "",
+			},
+		},
 		{
 			name:    "negative test #1 (method not allowed)",
 			success: false,
 			req:     WrapWithChiCtx(httptest.NewRequest("GET", "/update", nil), nil),
 			db:      memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "",
 				code:        405,
 				key:         "PollCount",
@@ -276,7 +305,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 			success: false,
 			req:     WrapWithChiCtx(httptest.NewRequest("POST", "/updat", nil), nil),
 			db:      memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        404,
 				key:         "PollCount",
@@ -292,7 +321,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"","type":"counter","delta":50}`))),
 				nil),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        404,
 				key:         "",
@@ -308,7 +337,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter","value":"one"}`))),
 				nil),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        400,
 				key:         "PollCount",
@@ -324,7 +353,7 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"sometype","value":1}`))),
 				nil),
 			db: memory.InitEmpty(),
-			want: want[int64]{
+			want: want[uint64]{
 				contentType: "text/plain; charset=utf-8",
 				code:        400,
 				key:         "PollCount",
@@ -332,6 +361,54 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 				errMsg:      "",
 			},
 		},
+		{
+			name:    "negative test #6 (forbidden characters in name)",
+			success: false,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("POST", "/update",
+					bytes.NewBuffer([]byte(`{"id":"Poll{Count}","type":"counter","delta":1}`))),
+				nil),
+			db: memory.InitEmpty(),
+			want: want[uint64]{
+				contentType: "text/plain; charset=utf-8",
+				code:        400,
+				key:         "Poll{Count}",
+				value:       0,
+				errMsg:      "",
+			},
+		},
+		{
+			name:    "negative test #7 (too long name)",
+			success: false,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("POST", "/update",
+					bytes.NewBuffer([]byte(`{"id":"PollCountPollCountPollCountPollCountPollCountPollCountPollCountPollCount","type":"counter","delta":1}`))),
+				nil),
+			db: memory.InitEmpty(),
+			want: want[uint64]{
+				contentType: "text/plain; charset=utf-8",
+				code:        400,
+				key:         "PollCountPollCountPollCountPollCountPollCountPollCountPollCountPollCount",
+				value:       0,
+				errMsg:      "",
+			},
+		},
+		{
+			name:    "negative test #8 (reserved prefix of name)",
+			success: false,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("POST", "/update",
+					bytes.NewBuffer([]byte(`{"id":"__PollCount","type":"counter","delta":1}`))),
+				nil),
+			db: memory.InitEmpty(),
+			want: want[uint64]{
+				contentType: "text/plain; charset=utf-8",
+				code:        400,
+				key:         "__PollCount",
+				value:       0,
+				errMsg:      "",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -363,6 +440,1017 @@ func TestAPI_UpdateRootHandler(t *testing.T) {
 	}
 }
 
+// MARK: Histogram
+func TestAPI_UpdateHistogram(t *testing.T) {
+	type want struct {
+		code  int
+		key   string
+		value mondata.Histogram
+	}
+	tests := []struct {
+		name    string
+		success bool
+		path    string
+		body    string
+		handler func(*API) http.HandlerFunc
+		db      *memory.MemorySt
+		want    want
+	}{
+		{
+			name:    "positive test #1 (URL params)",
+			success: true,
+			path:    "/update/histogram/Latency/0.1,0.5;3,2,1;1.7",
+			handler: func(api *API) http.HandlerFunc { return api.UpdateHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 200,
+				key:  "Latency",
+				value: mondata.Histogram{
+					Bounds: []float64{0.1, 0.5}, Counts: []int64{3, 2, 1}, Sum: 1.7, Count: 6,
+				},
+			},
+		},
+		{
+			name:    "positive test #2 (JSON, merged with stored value)",
+			success: true,
+			path:    "/update",
+			body:    `{"id":"Latency","type":"histogram","histogram":{"bounds":[0.1,0.5],"counts":[1,0,1],"sum":0.8,"count":2}}`,
+			handler: func(api *API) http.HandlerFunc { return api.UpdateRootHandler },
+			db: &memory.MemorySt{
+				Histogram: &safe.HRepo{
+					Data: mondata.HistogramMap{
+						"Latency": {Bounds: []float64{0.1, 0.5}, Counts: []int64{3, 2, 1}, Sum: 1.5, Count: 6},
+					},
+				},
+			},
+			want: want{
+				code: 200,
+				key:  "Latency",
+				value: mondata.Histogram{
+					Bounds: []float64{0.1, 0.5}, Counts: []int64{4, 2, 2}, Sum: 2.3, Count: 8,
+				},
+			},
+		},
+		{
+			name:    "positive test #3 (batch)",
+			success: true,
+			path:    "/updates",
+			body: `[{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}},` +
+				`{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[0,2],"sum":5,"count":2}}]`,
+			handler: func(api *API) http.HandlerFunc { return api.UpdateBatchHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 200,
+				key:  "Latency",
+				value: mondata.Histogram{
+					Bounds: []float64{1}, Counts: []int64{1, 2}, Sum: 5.5, Count: 3,
+				},
+			},
+		},
+		{
+			name:    "negative test #1 (bounds mismatch)",
+			success: false,
+			path:    "/update",
+			body:    `{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}}`,
+			handler: func(api *API) http.HandlerFunc { return api.UpdateRootHandler },
+			db: &memory.MemorySt{
+				Histogram: &safe.HRepo{
+					Data: mondata.HistogramMap{
+						"Latency": {Bounds: []float64{0.1, 0.5}, Counts: []int64{3, 2, 1}, Sum: 1.5, Count: 6},
+					},
+				},
+			},
+			want: want{
+				code: 409,
+				key:  "Latency",
+			},
+		},
+		{
+			name:    "negative test #2 (counts don't match bounds)",
+			success: false,
+			path:    "/update",
+			body:    `{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1],"sum":0.5,"count":1}}`,
+			handler: func(api *API) http.HandlerFunc { return api.UpdateRootHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 400,
+				key:  "Latency",
+			},
+		},
+		{
+			name:    "negative test #3 (invalid value)",
+			success: false,
+			path:    "/update/histogram/Latency/1,2",
+			handler: func(api *API) http.HandlerFunc { return api.UpdateHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 400,
+				key:  "Latency",
+			},
+		},
+		{
+			name:    "negative test #4 (sum is NaN)",
+			success: false,
+			path:    "/update/histogram/Latency/1;1,0;NaN",
+			handler: func(api *API) http.HandlerFunc { return api.UpdateHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 400,
+				key:  "Latency",
+			},
+		},
+		{
+			name:    "negative test #5 (sum is infinite)",
+			success: false,
+			path:    "/update/histogram/Latency/1;1,0;+Inf",
+			handler: func(api *API) http.HandlerFunc { return api.UpdateHandler },
+			db:      memory.InitEmpty(),
+			want: want{
+				code: 400,
+				key:  "Latency",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			h := tt.handler(NewAPI(tt.db, &ErrLoggerMock{}))
+			r.Post("/update/{type}/{name}/{value}", h)
+			r.Post("/update", h)
+			r.Post("/updates", h)
+
+			req := httptest.NewRequest("POST", tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			res := recorder.Result()
+			assert.Equal(t, tt.want.code, res.StatusCode)
+
+			err := res.Body.Close()
+			require.NoError(t, err)
+
+			if tt.success {
+				currentValue, ok, _ := tt.db.GetHistogram(context.TODO(), tt.want.key)
+				require.True(t, ok)
+				assert.Equal(t, tt.want.value.Bounds, currentValue.Bounds)
+				assert.Equal(t, tt.want.value.Counts, currentValue.Counts)
+				assert.InDelta(t, tt.want.value.Sum, currentValue.Sum, 1e-9)
+				assert.Equal(t, tt.want.value.Count, currentValue.Count)
+			}
+		})
+	}
+}
+
+// MARK: Timestamps
+func TestAPI_Timestamps(t *testing.T) {
+	tests := []struct {
+		name       string
+		updateBody string
+		valueBody  string
+		sampled    *time.Time
+	}{
+		{
+			name:       "gauge with sample time",
+			updateBody: `{"id":"Alloc","type":"gauge","value":1.5,"timestamp":"2025-03-01T10:00:00Z"}`,
+			valueBody:  `{"id":"Alloc","type":"gauge"}`,
+			sampled:    func() *time.Time { ts := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC); return &ts }(),
+		},
+		{
+			name:       "counter without sample time",
+			updateBody: `{"id":"PollCount","type":"counter","delta":1}`,
+			valueBody:  `{"id":"PollCount","type":"counter"}`,
+			sampled:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.InitEmpty()
+			api := NewAPI(db, &ErrLoggerMock{})
+			r := chi.NewRouter()
+			r.Post("/update", api.UpdateRootHandler)
+			r.Post("/value", api.ValueRootHandler)
+
+			before := time.Now()
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, WrapWithChiCtx(httptest.NewRequest("POST", "/update", bytes.NewBufferString(tt.updateBody)), nil))
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			recorder = httptest.NewRecorder()
+			r.ServeHTTP(recorder, WrapWithChiCtx(httptest.NewRequest("POST", "/value", bytes.NewBufferString(tt.valueBody)), nil))
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			m := &mondata.Metrics{}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), m))
+
+			require.NotNil(t, m.Received)
+			assert.False(t, m.Received.Before(before))
+			if tt.sampled != nil {
+				require.NotNil(t, m.Timestamp)
+				assert.True(t, tt.sampled.Equal(*m.Timestamp))
+			} else {
+				assert.Nil(t, m.Timestamp)
+			}
+		})
+	}
+}
+
+// MARK: Cumulative counters
+func TestAPI_CounterTotals(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []string
+		want    uint64
+		code    int
+	}{
+		{
+			name:    "first total is accumulated as is",
+			updates: []string{`{"id":"NumGC","type":"counter","total":5}`},
+			want:    5,
+			code:    200,
+		},
+		{
+			name: "deltas are computed from totals",
+			updates: []string{
+				`{"id":"NumGC","type":"counter","total":5}`,
+				`{"id":"NumGC","type":"counter","total":8}`,
+				`{"id":"NumGC","type":"counter","total":12}`,
+			},
+			want: 12,
+			code: 200,
+		},
+		{
+			name: "reset is detected when total goes down",
+			updates: []string{
+				`{"id":"NumGC","type":"counter","total":10}`,
+				`{"id":"NumGC","type":"counter","total":3}`,
+				`{"id":"NumGC","type":"counter","total":4}`,
+			},
+			want: 14,
+			code: 200,
+		},
+		{
+			name: "totals and deltas are mixed",
+			updates: []string{
+				`{"id":"NumGC","type":"counter","delta":2}`,
+				`{"id":"NumGC","type":"counter","total":3}`,
+				`{"id":"NumGC","type":"counter","total":4}`,
+			},
+			want: 6,
+			code: 200,
+		},
+		{
+			name:    "counter without delta and total",
+			updates: []string{`{"id":"NumGC","type":"counter"}`},
+			code:    400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.InitEmpty()
+			r := chi.NewRouter()
+			r.Post("/update", NewAPI(db, &ErrLoggerMock{}).UpdateRootHandler)
+
+			for _, body := range tt.updates {
+				req := httptest.NewRequest("POST", "/update", bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				require.Equal(t, tt.code, recorder.Code)
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+			v, ok, err := db.GetCounter(context.TODO(), "NumGC")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, v)
+		})
+	}
+}
+
+// MARK: Series limit
+func TestAPI_SeriesLimit(t *testing.T) {
+	db, err := repo.Init(context.TODO(), "memory://", 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+	require.NoError(t, db.LimitSeries(context.TODO(), 3))
+
+	r := chi.NewRouter()
+	api := NewAPI(db, &ErrLoggerMock{})
+	r.Post("/update", api.UpdateRootHandler)
+	r.Post("/updates", api.UpdateBatchHandler)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		code int
+	}{
+		{
+			name: "new series within the limit",
+			path: "/update",
+			body: `{"id":"PollCount","type":"counter","delta":1}`,
+			code: 200,
+		},
+		{
+			name: "invalid name within batch",
+			path: "/updates",
+			body: `[{"id":"HeapAlloc","type":"gauge","value":1},{"id":"Heap Alloc","type":"gauge","value":1}]`,
+			code: 400,
+		},
+		{
+			name: "batch exceeding the limit",
+			path: "/updates",
+			body: `[{"id":"HeapAlloc","type":"gauge","value":1},{"id":"Sys","type":"gauge","value":1}]`,
+			code: 429,
+		},
+		{
+			name: "new series within the limit after rejected batch",
+			path: "/update",
+			body: `{"id":"HeapAlloc","type":"gauge","value":1}`,
+			code: 200,
+		},
+		{
+			name: "new series beyond the limit",
+			path: "/update",
+			body: `{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}}`,
+			code: 429,
+		},
+		{
+			name: "stored series beyond the limit",
+			path: "/updates",
+			body: `[{"id":"Alloc","type":"gauge","value":2},{"id":"PollCount","type":"counter","delta":1}]`,
+			code: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			assert.Equal(t, tt.code, recorder.Code)
+		})
+	}
+
+	snap, err := db.GetSnapshot(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 2, "HeapAlloc": 1}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"PollCount": 2}, snap.Counters)
+}
+
+// MARK: Counter overflow
+func TestAPI_CounterOverflow(t *testing.T) {
+	storages := map[string]func(t *testing.T) string{
+		"memory": func(t *testing.T) string { return "memory://?dir=" + url.QueryEscape(t.TempDir()) + "&" },
+		"SQLite": func(t *testing.T) string { return "file:" + filepath.Join(t.TempDir(), "perfmon.db") + "?" },
+	}
+	tests := []struct {
+		policy  mondata.OverflowPolicy
+		code    int
+		want    uint64
+		wrapped bool
+	}{
+		{policy: mondata.OverflowWrap, code: 200, want: 4, wrapped: true},
+		{policy: mondata.OverflowSaturate, code: 200, want: math.MaxUint64},
+		{policy: mondata.OverflowReject, code: 422, want: math.MaxUint64 - 5},
+	}
+	for name, dsn := range storages {
+		for _, tt := range tests {
+			t.Run(name+" "+string(tt.policy), func(t *testing.T) {
+				db, err := repo.Init(context.TODO(), dsn(t)+"counter_overflow="+string(tt.policy), 16, zap.NewNop().Sugar())
+				require.NoError(t, err)
+				require.NoError(t, db.Restore())
+				defer db.Close()
+				require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+
+				r := chi.NewRouter()
+				api := NewAPI(db, &ErrLoggerMock{})
+				r.Post("/update", api.UpdateRootHandler)
+				r.Post("/updates", api.UpdateBatchHandler)
+				r.Post("/value", api.ValueRootHandler)
+
+				post := func(path string, body string) *httptest.ResponseRecorder {
+					req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+					req.Header.Set("Content-Type", "application/json")
+					recorder := httptest.NewRecorder()
+					r.ServeHTTP(recorder, req)
+					return recorder
+				}
+
+				// deltas of the wire format don't exceed the max int64, so the counter is close to overflow beforehand
+				require.NoError(t, db.SetCounter(context.TODO(), "BytesSent", math.MaxUint64-5))
+
+				// the batch is rejected as a whole, so the gauge isn't changed as well
+				recorder := post("/updates", `[{"id":"Alloc","type":"gauge","value":2},`+
+					`{"id":"BytesSent","type":"counter","delta":10}]`)
+				require.Equal(t, tt.code, recorder.Code)
+				recorder = post("/update", `{"id":"BytesSent","type":"counter","delta":0}`)
+				require.Equal(t, http.StatusOK, recorder.Code)
+
+				v, _, err := db.GetCounter(context.TODO(), "BytesSent")
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, v)
+				st, _, err := db.GetStamp(context.TODO(), mondata.CounterType, "BytesSent")
+				require.NoError(t, err)
+				assert.Equal(t, tt.wrapped, st.Wrapped != nil)
+
+				// values which don't fit into delta are read as text only
+				recorder = post("/value", `{"id":"BytesSent","type":"counter"}`)
+				if tt.want > math.MaxInt64 {
+					assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+				} else {
+					require.Equal(t, http.StatusOK, recorder.Code)
+					var m mondata.Metrics
+					require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &m))
+					require.NotNil(t, m.Delta)
+					assert.Equal(t, int64(tt.want), *m.Delta)
+					assert.Equal(t, tt.wrapped, m.Wrapped != nil)
+				}
+
+				alloc, _, err := db.GetGauge(context.TODO(), "Alloc")
+				require.NoError(t, err)
+				if tt.code == http.StatusOK {
+					assert.Equal(t, 2.0, alloc)
+				} else {
+					assert.Equal(t, 1.0, alloc)
+				}
+
+				recorder = post("/update", `{"id":"BytesSent","type":"counter","delta":10}`)
+				assert.Equal(t, tt.code, recorder.Code)
+			})
+		}
+	}
+
+	// deltas of the same counter within a batch are merged by the policy of the storage
+	for _, tt := range tests {
+		t.Run("deltas within a batch "+string(tt.policy), func(t *testing.T) {
+			db := memory.InitEmpty()
+			db.SetOverflow(tt.policy)
+			r := chi.NewRouter()
+			r.Post("/updates", NewAPI(db, &ErrLoggerMock{}).UpdateBatchHandler)
+
+			body := `[{"id":"BytesSent","type":"counter","delta":9223372036854775807},` +
+				`{"id":"BytesSent","type":"counter","delta":9223372036854775807},` +
+				`{"id":"BytesSent","type":"counter","delta":9223372036854775807}]`
+			req := httptest.NewRequest("POST", "/updates", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			require.Equal(t, tt.code, recorder.Code)
+
+			v, ok, err := db.GetCounter(context.TODO(), "BytesSent")
+			require.NoError(t, err)
+			if tt.code != http.StatusOK {
+				assert.False(t, ok)
+				return
+			}
+			want := map[mondata.OverflowPolicy]uint64{mondata.OverflowWrap: math.MaxInt64 - 2, mondata.OverflowSaturate: math.MaxUint64}
+			assert.Equal(t, want[tt.policy], v)
+		})
+	}
+
+	t.Run("negative deltas and totals", func(t *testing.T) {
+		r := chi.NewRouter()
+		api := NewAPI(memory.InitEmpty(), &ErrLoggerMock{})
+		r.Post("/update", api.UpdateRootHandler)
+		r.Post("/updates", api.UpdateBatchHandler)
+
+		for path, body := range map[string]string{
+			"/update":  `{"id":"BytesSent","type":"counter","delta":-1}`,
+			"/updates": `[{"id":"Alloc","type":"gauge","value":2},{"id":"NumGC","type":"counter","total":-5}]`,
+		} {
+			req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, path)
+		}
+	})
+}
+
+// MARK: History
+func TestAPI_HistoryHandler(t *testing.T) {
+	db, err := repo.Init(context.TODO(), "memory://", 2, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 2))
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 3))
+	require.NoError(t, db.SetGauge(context.TODO(), `Alloc{host="srv-1"}`, 4))
+	require.NoError(t, db.SetCounterAll(context.TODO(), mondata.CounterMap{"PollCount": 2}))
+	require.NoError(t, db.SetCounter(context.TODO(), "PollCount", 3))
+
+	r := chi.NewRouter()
+	r.Get("/history/{type}/{name}", NewAPI(db, &ErrLoggerMock{}).HistoryHandler)
+
+	tests := []struct {
+		name   string
+		path   string
+		code   int
+		values []float64
+	}{
+		{
+			name:   "positive test #1 (oldest samples are dropped)",
+			path:   "/history/gauge/Alloc",
+			code:   200,
+			values: []float64{2, 3},
+		},
+		{
+			name:   "positive test #2 (labeled series)",
+			path:   "/history/gauge/Alloc?host=srv-1&step=1m",
+			code:   200,
+			values: []float64{4},
+		},
+		{
+			name:   "positive test #3 (accumulated counter values)",
+			path:   "/history/counter/PollCount?from=0",
+			code:   200,
+			values: []float64{2, 5},
+		},
+		{
+			name:   "positive test #4 (empty range)",
+			path:   "/history/gauge/Alloc?to=2000-01-01T00:00:00Z",
+			code:   200,
+			values: []float64{},
+		},
+		{
+			name: "negative test #1 (unknown series)",
+			path: "/history/gauge/HeapAlloc",
+			code: 404,
+		},
+		{
+			name: "negative test #2 (histogram)",
+			path: "/history/histogram/Latency",
+			code: 400,
+		},
+		{
+			name: "negative test #3 (invalid step)",
+			path: "/history/gauge/Alloc?step=often",
+			code: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", tt.path, nil))
+			require.Equal(t, tt.code, recorder.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Samples []mondata.Sample `json:"samples"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+
+			values := make([]float64, 0, len(resp.Samples))
+			for _, smp := range resp.Samples {
+				values = append(values, smp.V)
+			}
+			assert.Equal(t, tt.values, values)
+		})
+	}
+
+	t.Run("negative test #4 (storage without history)", func(t *testing.T) {
+		r := chi.NewRouter()
+		r.Get("/history/{type}/{name}", NewAPI(memory.InitEmpty(), &ErrLoggerMock{}).HistoryHandler)
+
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest("GET", "/history/gauge/Alloc", nil))
+		assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+	})
+}
+
+// MARK: Query
+func TestAPI_QueryHandler(t *testing.T) {
+	db, err := repo.Init(context.TODO(), "memory://", 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.SetGauge(context.TODO(), `Alloc{host="srv-1",env="prod"}`, 10))
+	require.NoError(t, db.SetGauge(context.TODO(), `Alloc{host="srv-1",env="prod"}`, 20))
+	require.NoError(t, db.SetGauge(context.TODO(), `Alloc{host="srv-2",env="prod"}`, 30))
+	require.NoError(t, db.SetCounter(context.TODO(), `PollCount{host="srv-1"}`, 2))
+	require.NoError(t, db.SetCounter(context.TODO(), `PollCount{host="srv-1"}`, 3))
+
+	r := chi.NewRouter()
+	r.Get("/query", NewAPI(db, &ErrLoggerMock{}).QueryHandler)
+
+	tests := []struct {
+		name string
+		expr string
+		code int
+		want string
+	}{
+		{
+			name: "positive test #1 (scalar arithmetic)",
+			expr: "1 + 2 * 3",
+			code: 200,
+			want: `{"type":"scalar","scalar":7}`,
+		},
+		{
+			name: "positive test #2 (selector)",
+			expr: `Alloc{host="srv-2"}`,
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{"__name__":"Alloc","__type__":"gauge","env":"prod","host":"srv-2"},"value":30}]}`,
+		},
+		{
+			name: "positive test #3 (avg_over_time)",
+			expr: `avg_over_time(Alloc{host="srv-1"}[1h])`,
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{"env":"prod","host":"srv-1"},"value":15}]}`,
+		},
+		{
+			name: "positive test #4 (increase)",
+			expr: "increase(PollCount[5m])",
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{"host":"srv-1"},"value":3}]}`,
+		},
+		{
+			name: "positive test #5 (sum by label)",
+			expr: "sum by (env) (Alloc)",
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{"env":"prod"},"value":50}]}`,
+		},
+		{
+			name: "positive test #6 (max)",
+			expr: "max(Alloc) / 10",
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{},"value":3}]}`,
+		},
+		{
+			name: "positive test #7 (arithmetic between series)",
+			expr: `Alloc{host="srv-1"} - Alloc{host="srv-1"} * 2`,
+			code: 200,
+			want: `{"type":"vector","vector":[{"labels":{"env":"prod","host":"srv-1"},"value":-20}]}`,
+		},
+		{
+			name: "negative test #1 (syntax)",
+			expr: "sum by (env (Alloc)",
+			code: 400,
+		},
+		{
+			name: "negative test #2 (range selector without function)",
+			expr: "Alloc[5m]",
+			code: 400,
+		},
+		{
+			name: "negative test #3 (empty expression)",
+			expr: "",
+			code: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", "/query?expr="+url.QueryEscape(tt.expr), nil))
+			require.Equal(t, tt.code, recorder.Code)
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
+
+// MARK: Eviction
+func TestAPI_EvictedSeries(t *testing.T) {
+	db := memory.InitEmpty()
+	require.NoError(t, db.SetGauge(context.TODO(), "tmp_Alloc", 1))
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+	require.NoError(t, db.SetCounter(context.TODO(), "tmp_PollCount", 1))
+	time.Sleep(time.Millisecond)
+
+	policy := mondata.TTLPolicy{Prefixes: map[string]time.Duration{"tmp_": time.Nanosecond}}
+	evicted, err := db.Evict(context.TODO(), policy)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []mondata.SeriesRef{
+		{MType: mondata.GaugeType, Key: "tmp_Alloc"},
+		{MType: mondata.CounterType, Key: "tmp_PollCount"},
+	}, evicted)
+
+	r := chi.NewRouter()
+	r.Get("/value/{type}/{name}", NewAPI(db, &ErrLoggerMock{}).ValueHandler)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{path: "/value/gauge/tmp_Alloc", code: 404},
+		{path: "/value/counter/tmp_PollCount", code: 404},
+		{path: "/value/gauge/Alloc", code: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", tt.path, nil))
+			assert.Equal(t, tt.code, recorder.Code)
+		})
+	}
+}
+
+// MARK: Write-ahead log
+func TestAPI_RestoredFromWAL(t *testing.T) {
+	dsn := "memory://?dir=" + url.QueryEscape(t.TempDir())
+
+	// values of the first run are compacted into snapshot on close
+	db, err := repo.Init(context.TODO(), dsn, 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.Restore())
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+	require.NoError(t, db.SetGauge(context.TODO(), "tmp_Alloc", 1))
+	require.NoError(t, db.SetCounter(context.TODO(), "PollCount", 2))
+	require.NoError(t, db.SetCounterTotal(context.TODO(), "NumGC", 10))
+	db.Close()
+
+	// values of the second run are left in write-ahead log only, as if the server crashed
+	dsn += "&restore=true"
+	db, err = repo.Init(context.TODO(), dsn, 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.Restore())
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 2))
+	require.NoError(t, db.SetCounter(context.TODO(), "PollCount", 3))
+	require.NoError(t, db.SetCounterTotal(context.TODO(), "NumGC", 15))
+	time.Sleep(time.Millisecond)
+	_, err = db.Evict(context.TODO(), mondata.TTLPolicy{Prefixes: map[string]time.Duration{"tmp_": time.Nanosecond}})
+	require.NoError(t, err)
+
+	db, err = repo.Init(context.TODO(), dsn, 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.Restore())
+	// the last total is restored too, so only the increment is accumulated
+	require.NoError(t, db.SetCounterTotal(context.TODO(), "NumGC", 16))
+
+	r := chi.NewRouter()
+	r.Get("/value/{type}/{name}", NewAPI(db, &ErrLoggerMock{}).ValueHandler)
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{path: "/value/gauge/Alloc", code: 200, want: "2"},
+		{path: "/value/counter/PollCount", code: 200, want: "5"},
+		{path: "/value/counter/NumGC", code: 200, want: "16"},
+		{path: "/value/gauge/tmp_Alloc", code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", tt.path, nil))
+			require.Equal(t, tt.code, recorder.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+}
+
+// MARK: Atomic batch
+func TestAPI_AtomicBatch(t *testing.T) {
+	db, err := repo.Init(context.TODO(), "memory://?dir="+url.QueryEscape(t.TempDir()), 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.Restore())
+	require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+	require.NoError(t, db.SetCounterTotal(context.TODO(), "NumGC", 10))
+	before, err := db.GetSnapshot(context.TODO())
+	require.NoError(t, err)
+
+	// records can't be appended to closed write-ahead log, so the batch fails after values are set
+	db.Close()
+
+	r := chi.NewRouter()
+	r.Post("/updates", NewAPI(db, &ErrLoggerMock{}).UpdateBatchHandler)
+
+	body := `[{"id":"Alloc","type":"gauge","value":2,"timestamp":"2025-03-01T10:00:00Z"},` +
+		`{"id":"HeapAlloc","type":"gauge","value":3},` +
+		`{"id":"PollCount","type":"counter","delta":1},` +
+		`{"id":"NumGC","type":"counter","total":15}]`
+	req := httptest.NewRequest("POST", "/updates", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+	after, err := db.GetSnapshot(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "none of values of the failed batch must be stored")
+}
+
+// MARK: SQLite
+func TestAPI_SQLite(t *testing.T) {
+	db, err := sqlite.Init(context.TODO(), filepath.Join(t.TempDir(), "perfmon.db"), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer db.Close()
+
+	r := chi.NewRouter()
+	api := NewAPI(db, &ErrLoggerMock{})
+	r.Post("/updates", api.UpdateBatchHandler)
+	r.Get("/value/{type}/{name}", api.ValueHandler)
+
+	updates := []string{
+		`[{"id":"Alloc","type":"gauge","value":1.5},` +
+			`{"id":"Alloc","type":"gauge","labels":{"host":"srv-1"},"value":2},` +
+			`{"id":"PollCount","type":"counter","delta":2},` +
+			`{"id":"NumGC","type":"counter","total":10},` +
+			`{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}}]`,
+		`[{"id":"Alloc","type":"gauge","value":3.5},` +
+			`{"id":"PollCount","type":"counter","delta":3},` +
+			`{"id":"NumGC","type":"counter","total":4},` +
+			`{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[0,2],"sum":5,"count":2}}]`,
+	}
+	for _, body := range updates {
+		req := httptest.NewRequest("POST", "/updates", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{path: "/value/gauge/Alloc", code: 200, want: "3.5"},
+		{path: "/value/gauge/Alloc?host=srv-1", code: 200, want: "2"},
+		{path: "/value/counter/PollCount", code: 200, want: "5"},
+		{path: "/value/counter/NumGC", code: 200, want: "14"},
+		{path: "/value/gauge/HeapAlloc", code: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", tt.path, nil))
+			require.Equal(t, tt.code, recorder.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.want, recorder.Body.String())
+			}
+		})
+	}
+
+	t.Run("histograms are merged", func(t *testing.T) {
+		h, ok, err := db.GetHistogram(context.TODO(), "Latency")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, []int64{1, 2}, h.Counts)
+		assert.Equal(t, int64(3), h.Count)
+	})
+
+	t.Run("bounds mismatch", func(t *testing.T) {
+		err := db.SetHistogram(context.TODO(), "Latency", mondata.Histogram{Bounds: []float64{2}, Counts: []int64{1, 0}})
+		assert.ErrorIs(t, err, mondata.ErrBoundsMismatch)
+	})
+
+	t.Run("batch with histogram bounds mismatch isn't applied", func(t *testing.T) {
+		body := `[{"id":"Alloc","type":"gauge","value":7},` +
+			`{"id":"PollCount","type":"counter","delta":1},` +
+			`{"id":"Latency","type":"histogram","histogram":{"bounds":[2],"counts":[1,0],"sum":1,"count":1}}]`
+		req := httptest.NewRequest("POST", "/updates", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		snap, err := db.GetSnapshot(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, mondata.GaugeMap{"Alloc": 3.5, `Alloc{host="srv-1"}`: 2}, snap.Gauges)
+		assert.Equal(t, mondata.CounterMap{"PollCount": 5, "NumGC": 14}, snap.Counters)
+		assert.Len(t, snap.GaugeStamps, 2)
+		assert.Len(t, snap.CounterStamps, 2)
+	})
+}
+
+// MARK: Storage DSN
+func TestInit_StorageDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		fails   bool
+		wantErr error
+	}{
+		{name: "in-memory storage", dsn: "memory://"},
+		{name: "in-memory storage with options", dsn: "memory://?snapshot_interval=1m&restore=false"},
+		{name: "SQLite", dsn: "file:" + filepath.Join(t.TempDir(), "perfmon.db") + "?busy_timeout=1000"},
+		{name: "unknown scheme", dsn: "redis://localhost:6379", fails: true, wantErr: repo.ErrUnknownScheme},
+		{name: "DSN without scheme", dsn: "perfmon.db", fails: true, wantErr: repo.ErrUnknownScheme},
+		{name: "unknown option", dsn: "memory://?interval=1m", fails: true},
+		{name: "unknown option of SQLite", dsn: "file:perfmon.db?cache=shared", fails: true},
+		{name: "invalid value of option", dsn: "memory://?restore=sometimes", fails: true},
+		{name: "overflow policy", dsn: "memory://?counter_overflow=saturate"},
+		{name: "overflow policy of SQLite", dsn: "file:" + filepath.Join(t.TempDir(), "overflow.db") + "?counter_overflow=reject"},
+		{name: "unknown overflow policy", dsn: "memory://?counter_overflow=ignore", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := repo.Init(context.TODO(), tt.dsn, 16, zap.NewNop().Sugar())
+			if tt.fails {
+				require.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				return
+			}
+			require.NoError(t, err)
+			defer db.Close()
+
+			require.NoError(t, db.SetGauge(context.TODO(), "Alloc", 1))
+			v, ok, err := db.GetGauge(context.TODO(), "Alloc")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, 1.0, v)
+		})
+	}
+}
+
+// MARK: Metadata
+func TestAPI_Meta(t *testing.T) {
+	dir, _ := os.Getwd()
+	db := memory.InitEmpty()
+	db.SetGauge(context.TODO(), "HeapAlloc", 12896123)
+
+	api := NewAPI(db, &ErrLoggerMock{})
+	r := chi.NewRouter()
+	r.Get("/", api.CreateRootHandler(dir+"/../../../templates/index.html"))
+	r.Post("/meta", api.UpdateMetaHandler)
+	r.Get("/meta", api.MetaRootHandler)
+	r.Get("/meta/{name}", api.MetaHandler)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		code     int
+		contains string
+	}{
+		{
+			name:   "positive test #1 (set metadata)",
+			method: "POST",
+			path:   "/meta",
+			body:   `[{"name":"HeapAlloc","unit":"bytes","description":"bytes of allocated heap objects"}]`,
+			code:   200,
+		},
+		{
+			name:     "positive test #2 (get metadata)",
+			method:   "GET",
+			path:     "/meta/HeapAlloc",
+			code:     200,
+			contains: `{"name":"HeapAlloc","unit":"bytes","description":"bytes of allocated heap objects"}`,
+		},
+		{
+			name:     "positive test #3 (get all metadata)",
+			method:   "GET",
+			path:     "/meta",
+			code:     200,
+			contains: `[{"name":"HeapAlloc","unit":"bytes"`,
+		},
+		{
+			name:     "positive test #4 (value formatted on index page)",
+			method:   "GET",
+			path:     "/",
+			code:     200,
+			contains: "12.3 MiB",
+		},
+		{
+			name:   "negative test #1 (missing name)",
+			method: "POST",
+			path:   "/meta",
+			body:   `[{"unit":"bytes"}]`,
+			code:   400,
+		},
+		{
+			name:   "negative test #2 (not found)",
+			method: "GET",
+			path:   "/meta/StackSys",
+			code:   404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			res := recorder.Result()
+			assert.Equal(t, tt.code, res.StatusCode)
+
+			respBody, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+
+			err = res.Body.Close()
+			require.NoError(t, err)
+
+			if tt.contains != "" {
+				assert.Contains(t, string(respBody), tt.contains)
+			}
+		})
+	}
+}
+
 // MARK: Root
 func TestAPI_CreateRootHandler(t *testing.T) {
 	dir, _ := os.Getwd()
@@ -386,12 +1474,12 @@ func TestAPI_CreateRootHandler(t *testing.T) {
 			req:      WrapWithChiCtx(httptest.NewRequest("GET", "/", nil), nil),
 			filePath: dir + "/../../../templates/index.html",
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{
-						"PollCount": 1,
-					},
-				},
+				Histogram: safe.NewHRepo(),
+				Meta:      safe.NewMetaRepo(),
+				Gauge:     safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount": 1,
+				}),
 			},
 			want: want{
 				contentType: "text/html; charset=utf-8",
@@ -406,12 +1494,12 @@ func TestAPI_CreateRootHandler(t *testing.T) {
 			req:      WrapWithChiCtx(httptest.NewRequest("GET", "/", nil), nil),
 			filePath: dir + "/../../../templates/index.html",
 			db: &memory.MemorySt{
-				Counter: &safe.MRepo[mondata.CounterVType]{},
-				Gauge: &safe.MRepo[mondata.GaugeVType]{
-					Data: mondata.GaugeMap{
-						"Alloc": 1030.0012,
-					},
-				},
+				Histogram: safe.NewHRepo(),
+				Meta:      safe.NewMetaRepo(),
+				Counter:   safe.NewShardedMRepo[mondata.CounterVType](4),
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					"Alloc": 1030.0012,
+				}),
 			},
 			want: want{
 				contentType: "text/html; charset=utf-8",
@@ -420,17 +1508,38 @@ func TestAPI_CreateRootHandler(t *testing.T) {
 				name:        "Alloc",
 			},
 		},
+		{
+			name:     "positive test #3 (filtered by labels)",
+			success:  true,
+			req:      WrapWithChiCtx(httptest.NewRequest("GET", "/?host=srv-1", nil), nil),
+			filePath: dir + "/../../../templates/index.html",
+			db: &memory.MemorySt{
+				Histogram: safe.NewHRepo(),
+				Meta:      safe.NewMetaRepo(),
+				Counter:   safe.NewShardedMRepo[mondata.CounterVType](4),
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					`Alloc{host="srv-1"}`: 1030.0012,
+					`Alloc{host="srv-2"}`: 20.5,
+				}),
+			},
+			want: want{
+				contentType: "text/html; charset=utf-8",
+				code:        200,
+				errMsg:      "",
+				name:        "srv-1",
+			},
+		},
 		{
 			name:    "negative test #1",
 			success: false,
 			req:     WrapWithChiCtx(httptest.NewRequest("GET", "/", nil), nil),
 			db: &memory.MemorySt{
-				Counter: &safe.MRepo[mondata.CounterVType]{},
-				Gauge: &safe.MRepo[mondata.GaugeVType]{
-					Data: mondata.GaugeMap{
-						"Alloc": 1030.0012,
-					},
-				},
+				Histogram: safe.NewHRepo(),
+				Meta:      safe.NewMetaRepo(),
+				Counter:   safe.NewShardedMRepo[mondata.CounterVType](4),
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					"Alloc": 1030.0012,
+				}),
 			},
 			want: want{
 				contentType: "text/plain; charset=utf-8",
@@ -468,6 +1577,78 @@ func TestAPI_CreateRootHandler(t *testing.T) {
 	}
 }
 
+// MARK: Snapshot
+// Run with -race: values returned by storage are read and changed while agents keep sending updates
+func TestAPI_SnapshotRace(t *testing.T) {
+	dir, _ := os.Getwd()
+	db := memory.InitEmpty()
+
+	api := NewAPI(db, &ErrLoggerMock{})
+	r := chi.NewRouter()
+	r.Get("/", api.CreateRootHandler(dir+"/../../../templates/index.html"))
+	r.Post("/updates", api.UpdateBatchHandler)
+
+	const (
+		agents  = 4
+		reports = 50
+	)
+
+	var wg sync.WaitGroup
+	for a := range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range reports {
+				body := fmt.Sprintf(
+					`[{"id":"Alloc","type":"gauge","labels":{"host":"srv-%[1]d"},"value":%[2]d},`+
+						`{"id":"HeapAlloc","type":"gauge","labels":{"host":"srv-%[1]d"},"value":%[2]d},`+
+						`{"id":"PollCount","type":"counter","labels":{"host":"srv-%[1]d"},"delta":1}]`,
+					a, i)
+				req := httptest.NewRequest("POST", "/updates", bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, req)
+				assert.Equal(t, http.StatusOK, recorder.Code)
+			}
+		}()
+	}
+
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range reports {
+				recorder := httptest.NewRecorder()
+				r.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+				assert.Equal(t, http.StatusOK, recorder.Code)
+
+				snap, err := db.GetSnapshot(context.TODO())
+				assert.NoError(t, err)
+				for k := range snap.Gauges {
+					assert.Contains(t, snap.GaugeStamps, k)
+				}
+				for k := range snap.Counters {
+					assert.Contains(t, snap.CounterStamps, k)
+				}
+
+				// returned maps are copies, so changing them doesn't race with writers
+				snap.Gauges["Alloc"] = 0
+				gm, err := db.GetGaugeAll(context.TODO())
+				assert.NoError(t, err)
+				gm["Alloc"] = 0
+			}
+		}()
+	}
+	wg.Wait()
+
+	snap, err := db.GetSnapshot(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, snap.Gauges, 2*agents)
+	for a := range agents {
+		assert.Equal(t, uint64(reports), snap.Counters[fmt.Sprintf(`PollCount{host="srv-%d"}`, a)])
+	}
+}
+
 // MARK: Value
 func TestAPI_ValueHandler(t *testing.T) {
 	type want struct {
@@ -493,12 +1674,10 @@ func TestAPI_ValueHandler(t *testing.T) {
 				},
 			),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{
-						"PollCount": 2,
-					},
-				},
+				Gauge: safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount": 2,
+				}),
 			},
 			want: want{
 				contentType: "text/plain; charset=utf-8",
@@ -517,14 +1696,10 @@ func TestAPI_ValueHandler(t *testing.T) {
 				},
 			),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{
-					Data: mondata.GaugeMap{
-						"TotalAlloc": 11.0451,
-					},
-				},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{},
-				},
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					"TotalAlloc": 11.0451,
+				}),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{}),
 			},
 			want: want{
 				contentType: "text/plain; charset=utf-8",
@@ -533,6 +1708,29 @@ func TestAPI_ValueHandler(t *testing.T) {
 				value:       "11.0451",
 			},
 		},
+		{
+			name:    "positive test #3 (labels)",
+			success: true,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("GET", "/value/gauge/TotalMemory?host=srv-2", nil), map[string]string{
+					"type": "gauge",
+					"name": "TotalMemory",
+				},
+			),
+			db: &memory.MemorySt{
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					`TotalMemory{host="srv-1"}`: 1024,
+					`TotalMemory{host="srv-2"}`: 2048,
+				}),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{}),
+			},
+			want: want{
+				contentType: "text/plain; charset=utf-8",
+				code:        200,
+				errMsg:      "",
+				value:       "2048",
+			},
+		},
 		{
 			name:    "negative test #1 (wrong type, bad req)",
 			success: false,
@@ -635,12 +1833,10 @@ func TestAPI_ValueRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter"}`))),
 				nil),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{
-						"PollCount": 64,
-					},
-				},
+				Gauge: safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount": 64,
+				}),
 			},
 			want: want{
 				contentType: "application/json; charset=utf-8",
@@ -657,14 +1853,10 @@ func TestAPI_ValueRootHandler(t *testing.T) {
 					bytes.NewBuffer([]byte(`{"id":"Alloc","type":"gauge"}`))),
 				nil),
 			db: &memory.MemorySt{
-				Gauge: &safe.MRepo[mondata.GaugeVType]{
-					Data: mondata.GaugeMap{
-						"Alloc": 15994.03143,
-					},
-				},
-				Counter: &safe.MRepo[mondata.CounterVType]{
-					Data: mondata.CounterMap{},
-				},
+				Gauge: safe.ShardedMRepoOf(4, mondata.GaugeMap{
+					"Alloc": 15994.03143,
+				}),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{}),
 			},
 			want: want{
 				contentType: "application/json; charset=utf-8",
@@ -673,6 +1865,27 @@ func TestAPI_ValueRootHandler(t *testing.T) {
 				errMsg:      "",
 			},
 		},
+		{
+			name:    "positive test #3 (labels)",
+			success: true,
+			req: WrapWithChiCtx(
+				httptest.NewRequest("POST", "/value",
+					bytes.NewBuffer([]byte(`{"id":"PollCount","type":"counter","labels":{"host":"srv-1"}}`))),
+				nil),
+			db: &memory.MemorySt{
+				Gauge: safe.NewShardedMRepo[mondata.GaugeVType](4),
+				Counter: safe.ShardedMRepoOf(4, mondata.CounterMap{
+					"PollCount":               64,
+					`PollCount{host="srv-1"}`: 3,
+				}),
+			},
+			want: want{
+				contentType: "application/json; charset=utf-8",
+				code:        200,
+				respBody:    `{"id":"PollCount","type":"counter","labels":{"host":"srv-1"},"delta":3}`,
+				errMsg:      "",
+			},
+		},
 		{
 			name:    "negative test #1 (method not allowed)",
 			success: false,
@@ -768,3 +1981,80 @@ func TestAPI_ValueRootHandler(t *testing.T) {
 		})
 	}
 }
+
+// MARK: Changes
+// notifyingDB is storage shared with other instances of server
+type notifyingDB struct {
+	*memory.MemorySt
+	mu  sync.Mutex
+	fns []func(mondata.Change)
+}
+
+func (db *notifyingDB) Subscribe(fn func(mondata.Change)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.fns = append(db.fns, fn)
+}
+
+func (db *notifyingDB) publish(c mondata.Change) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, fn := range db.fns {
+		fn(c)
+	}
+}
+
+func TestAPI_ChangesHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewAPI(memory.InitEmpty(), &ErrLoggerMock{}).ChangesHandler(rec, httptest.NewRequest("GET", "/changes", nil))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code, "changes aren't streamed if storage isn't shared")
+
+	db := &notifyingDB{MemorySt: memory.InitEmpty()}
+	api := NewAPI(db, &ErrLoggerMock{})
+	r := chi.NewRouter()
+	r.With(middlewares.CreateLogger(zap.NewNop().Sugar())).Get("/changes", api.ChangesHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/changes")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the client is subscribed once headers are sent
+	db.publish(mondata.Change{Origin: "srv-2", MType: mondata.GaugeType, Keys: []string{"Alloc"}})
+	db.publish(mondata.Change{Origin: "srv-2", MType: mondata.CounterType})
+
+	sc := bufio.NewScanner(res.Body)
+	for _, want := range []string{
+		"event: change", `data: {"origin":"srv-2","type":"gauge","keys":["Alloc"]}`, "",
+		"event: change", `data: {"origin":"srv-2","type":"counter"}`, "",
+	} {
+		require.True(t, sc.Scan())
+		assert.Equal(t, want, sc.Text())
+	}
+
+	// disconnected clients are unsubscribed
+	require.NoError(t, res.Body.Close())
+	assert.Eventually(t, func() bool {
+		api.changes.mu.Lock()
+		defer api.changes.mu.Unlock()
+		return len(api.changes.clients) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChangeFeed_SlowClient(t *testing.T) {
+	f := newChangeFeed()
+	ch := f.subscribe()
+	for range changesQueueSize + 1 {
+		f.publish(mondata.Change{MType: mondata.GaugeType})
+	}
+
+	// queued changes are delivered, then the stream is over, so the client reconnects
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, changesQueueSize, n)
+	f.unsubscribe(ch)
+}
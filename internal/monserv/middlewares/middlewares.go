@@ -46,6 +46,11 @@ func (r *respWriter) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+// Returns the wrapped writer, so streaming handlers could flush it with http.ResponseController
+func (r *respWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func CreateLogger(l *zap.SugaredLogger) func(http.Handler) http.Handler {
 
 	return func(next http.Handler) http.Handler {
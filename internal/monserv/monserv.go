@@ -73,8 +73,17 @@ func (s *MonServ) MountHandlers() {
 		r.Route("/ping", func(r chi.Router) {
 			r.Get("/", api.PingHandler)
 		})
+
+		r.Get("/history/{type}/{name}", api.HistoryHandler)
+		r.Get("/query", api.QueryHandler)
+
+		r.Get("/meta", api.MetaRootHandler)
+		r.Get("/meta/{name}", api.MetaHandler)
 	})
 
+	// streaming isn't compressed, so events reach clients at once
+	s.Router.With(middlewares.CreateLogger(s.Logger)).Get("/changes", api.ChangesHandler)
+
 	// update group
 	s.Router.Group(func(r chi.Router) {
 		r.Use(umw...)
@@ -89,6 +98,8 @@ func (s *MonServ) MountHandlers() {
 		r.Route("/updates", func(r chi.Router) {
 			r.Post("/", api.UpdateBatchHandler)
 		})
+
+		r.Post("/meta", api.UpdateMetaHandler)
 	})
 
 	s.Handler = s.Router
@@ -0,0 +1,418 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+var ErrType = errors.New("invalid query types")
+
+const (
+	NameLabel = "__name__"
+	TypeLabel = "__type__"
+)
+
+// Source is a read interface of the storage which queries are evaluated against
+type Source interface {
+	GetGaugeAll(ctx context.Context) (mondata.GaugeMap, error)
+	GetCounterAll(ctx context.Context) (mondata.CounterMap, error)
+	GetHistory(
+		ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+	) ([]mondata.Sample, bool, error)
+}
+
+type Series struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// Result is either a scalar or a vector of series
+type Result struct {
+	Type   string   `json:"type"`
+	Scalar *float64 `json:"scalar,omitempty"`
+	Vector []Series `json:"vector,omitempty"`
+}
+
+const (
+	ScalarResult = "scalar"
+	VectorResult = "vector"
+)
+
+type value struct {
+	scalar *float64
+	vector []Series
+}
+
+type evaluator struct {
+	ctx context.Context
+	src Source
+	now time.Time
+
+	// values are loaded once per evaluation
+	gauges   mondata.GaugeMap
+	counters mondata.CounterMap
+}
+
+// Parses and evaluates expression at the time now
+func Eval(ctx context.Context, src Source, expr string, now time.Time) (*Result, error) {
+	e, err := Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{ctx: ctx, src: src, now: now}
+	v, err := ev.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.scalar != nil {
+		if math.IsNaN(*v.scalar) || math.IsInf(*v.scalar, 0) {
+			return nil, fmt.Errorf("%w: result is not a finite number", ErrType)
+		}
+		return &Result{Type: ScalarResult, Scalar: v.scalar}, nil
+	}
+
+	// NaN and Inf can't be encoded to JSON, e.g. after division by zero
+	vec := make([]Series, 0, len(v.vector))
+	for _, s := range v.vector {
+		if !math.IsNaN(s.Value) && !math.IsInf(s.Value, 0) {
+			vec = append(vec, s)
+		}
+	}
+	sort.Slice(vec, func(i, j int) bool {
+		return mondata.SeriesKey("", vec[i].Labels) < mondata.SeriesKey("", vec[j].Labels)
+	})
+
+	return &Result{Type: VectorResult, Vector: vec}, nil
+}
+
+func (ev *evaluator) eval(e Expr) (value, error) {
+	switch e := e.(type) {
+	case *NumberLit:
+		v := e.Val
+		return value{scalar: &v}, nil
+	case *Selector:
+		if e.Range > 0 {
+			return value{}, fmt.Errorf("%w: range selector %s must be an argument of a function", ErrType, e)
+		}
+		return ev.instant(e)
+	case *Call:
+		return ev.call(e)
+	case *Aggregation:
+		return ev.aggregate(e)
+	case *Binary:
+		return ev.binary(e)
+	default:
+		return value{}, fmt.Errorf("%w: unsupported expression %s", ErrType, e)
+	}
+}
+
+type matched struct {
+	mtype  string
+	key    string
+	labels map[string]string
+	value  float64
+}
+
+// Returns series of gauges and counters matching selector, labels include name and type
+func (ev *evaluator) match(sel *Selector) ([]matched, error) {
+	if ev.gauges == nil {
+		gm, err := ev.src.GetGaugeAll(ev.ctx)
+		if err != nil {
+			return nil, err
+		}
+		cm, err := ev.src.GetCounterAll(ev.ctx)
+		if err != nil {
+			return nil, err
+		}
+		ev.gauges, ev.counters = gm, cm
+	}
+
+	mm := make([]matched, 0)
+	add := func(mtype string, key string, v float64) {
+		name, labels, err := mondata.ParseSeriesKey(key)
+		if err != nil || name != sel.Name {
+			return
+		}
+
+		all := make(map[string]string, len(labels)+2)
+		for k, v := range labels {
+			all[k] = v
+		}
+		all[NameLabel] = name
+		all[TypeLabel] = mtype
+
+		if mondata.MatchLabels(all, sel.Matchers) {
+			mm = append(mm, matched{mtype: mtype, key: key, labels: all, value: v})
+		}
+	}
+
+	for k, v := range ev.gauges {
+		add(mondata.GaugeType, k, v)
+	}
+	for k, v := range ev.counters {
+		add(mondata.CounterType, k, float64(v))
+	}
+
+	return mm, nil
+}
+
+func (ev *evaluator) instant(sel *Selector) (value, error) {
+	mm, err := ev.match(sel)
+	if err != nil {
+		return value{}, err
+	}
+
+	vec := make([]Series, 0, len(mm))
+	for _, m := range mm {
+		vec = append(vec, Series{Labels: m.labels, Value: m.value})
+	}
+
+	return value{vector: vec}, nil
+}
+
+// Returns labels without name and type, they are dropped once values are transformed
+func dropMetricLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != NameLabel && k != TypeLabel {
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// Applies function to samples of range selector, series without enough samples are dropped
+func (ev *evaluator) call(c *Call) (value, error) {
+	sel := c.Arg.(*Selector)
+	mm, err := ev.match(sel)
+	if err != nil {
+		return value{}, err
+	}
+
+	vec := make([]Series, 0, len(mm))
+	for _, m := range mm {
+		samples, _, err := ev.src.GetHistory(ev.ctx, m.mtype, m.key, ev.now.Add(-sel.Range), ev.now, 0)
+		if err != nil {
+			return value{}, err
+		}
+
+		v, ok := applyRangeFunc(c.Func, samples)
+		if ok {
+			vec = append(vec, Series{Labels: dropMetricLabels(m.labels), Value: v})
+		}
+	}
+
+	return value{vector: vec}, nil
+}
+
+// Sums increases between samples, so resets and wraps of counters within the range aren't taken as decreases
+func increase(samples []mondata.Sample) float64 {
+	inc := 0.0
+	for i := 1; i < len(samples); i++ {
+		inc += mondata.Increase(samples[i-1].V, samples[i].V)
+	}
+
+	return inc
+}
+
+func applyRangeFunc(fn string, samples []mondata.Sample) (float64, bool) {
+	if len(samples) == 0 {
+		return 0, false
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	switch fn {
+	case "rate":
+		secs := last.T.Sub(first.T).Seconds()
+		if len(samples) < 2 || secs <= 0 {
+			return 0, false
+		}
+		return increase(samples) / secs, true
+	case "increase":
+		if len(samples) < 2 {
+			return 0, false
+		}
+		return increase(samples), true
+	case "count_over_time":
+		return float64(len(samples)), true
+	}
+
+	acc := samples[0].V
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.V
+		switch fn {
+		case "min_over_time":
+			acc = min(acc, s.V)
+		case "max_over_time":
+			acc = max(acc, s.V)
+		}
+	}
+
+	switch fn {
+	case "avg_over_time":
+		return sum / float64(len(samples)), true
+	case "sum_over_time":
+		return sum, true
+	default:
+		return acc, true
+	}
+}
+
+// Aggregates series by values of labels specified in by clause
+func (ev *evaluator) aggregate(a *Aggregation) (value, error) {
+	arg, err := ev.eval(a.Arg)
+	if err != nil {
+		return value{}, err
+	}
+	if arg.scalar != nil {
+		return value{}, fmt.Errorf("%w: %s expects a vector", ErrType, a.Op)
+	}
+
+	type group struct {
+		labels map[string]string
+		acc    float64
+		count  int
+	}
+	groups := make(map[string]*group)
+	order := make([]string, 0)
+
+	for _, s := range arg.vector {
+		labels := make(map[string]string, len(a.By))
+		for _, k := range a.By {
+			if v, ok := s.Labels[k]; ok {
+				labels[k] = v
+			}
+		}
+		id := mondata.SeriesKey("", labels)
+
+		g, ok := groups[id]
+		if !ok {
+			g = &group{labels: labels, acc: s.Value}
+			groups[id] = g
+			order = append(order, id)
+			if a.Op == "sum" || a.Op == "avg" {
+				g.acc = 0
+			}
+		}
+		g.count++
+
+		switch a.Op {
+		case "sum", "avg":
+			g.acc += s.Value
+		case "min":
+			g.acc = min(g.acc, s.Value)
+		case "max":
+			g.acc = max(g.acc, s.Value)
+		}
+	}
+
+	vec := make([]Series, 0, len(groups))
+	for _, id := range order {
+		g := groups[id]
+		v := g.acc
+		switch a.Op {
+		case "avg":
+			v = g.acc / float64(g.count)
+		case "count":
+			v = float64(g.count)
+		}
+		vec = append(vec, Series{Labels: g.labels, Value: v})
+	}
+
+	return value{vector: vec}, nil
+}
+
+func applyOp(op string, l float64, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// Applies arithmetic operator, series of two vectors are matched by labels without name and type
+func (ev *evaluator) binary(b *Binary) (value, error) {
+	lhs, err := ev.eval(b.LHS)
+	if err != nil {
+		return value{}, err
+	}
+	rhs, err := ev.eval(b.RHS)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch {
+	case lhs.scalar != nil && rhs.scalar != nil:
+		v := applyOp(b.Op, *lhs.scalar, *rhs.scalar)
+		return value{scalar: &v}, nil
+	case lhs.scalar != nil:
+		vec := make([]Series, 0, len(rhs.vector))
+		for _, s := range rhs.vector {
+			vec = append(vec, Series{Labels: dropMetricLabels(s.Labels), Value: applyOp(b.Op, *lhs.scalar, s.Value)})
+		}
+		return value{vector: vec}, nil
+	case rhs.scalar != nil:
+		vec := make([]Series, 0, len(lhs.vector))
+		for _, s := range lhs.vector {
+			vec = append(vec, Series{Labels: dropMetricLabels(s.Labels), Value: applyOp(b.Op, s.Value, *rhs.scalar)})
+		}
+		return value{vector: vec}, nil
+	}
+
+	left, err := matchingSeries(lhs.vector, b.Op)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := matchingSeries(rhs.vector, b.Op)
+	if err != nil {
+		return value{}, err
+	}
+
+	vec := make([]Series, 0, len(left))
+	for id, l := range left {
+		r, ok := right[id]
+		if !ok {
+			continue
+		}
+		vec = append(vec, Series{Labels: l.Labels, Value: applyOp(b.Op, l.Value, r.Value)})
+	}
+
+	return value{vector: vec}, nil
+}
+
+// Indexes series of operand by labels without name and type, operand must not contain
+// several series with the same labels, e.g. gauge and counter of the same name
+func matchingSeries(vec []Series, op string) (map[string]Series, error) {
+	m := make(map[string]Series, len(vec))
+	for _, s := range vec {
+		labels := dropMetricLabels(s.Labels)
+		id := mondata.SeriesKey("", labels)
+		if _, ok := m[id]; ok {
+			if id == "" {
+				id = "{}"
+			}
+			return nil, fmt.Errorf(
+				"%w: operand of %q contains several series with labels %s, select them by %s or aggregate them",
+				ErrType, op, id, TypeLabel,
+			)
+		}
+		m[id] = Series{Labels: labels, Value: s.Value}
+	}
+
+	return m, nil
+}
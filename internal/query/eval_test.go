@@ -0,0 +1,267 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sourceMock struct {
+	gauges   mondata.GaugeMap
+	counters mondata.CounterMap
+	history  map[string][]mondata.Sample // keyed by type and key of series
+}
+
+func (s *sourceMock) GetGaugeAll(ctx context.Context) (mondata.GaugeMap, error) {
+	return s.gauges, nil
+}
+
+func (s *sourceMock) GetCounterAll(ctx context.Context) (mondata.CounterMap, error) {
+	return s.counters, nil
+}
+
+func (s *sourceMock) GetHistory(
+	ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+) ([]mondata.Sample, bool, error) {
+	samples := make([]mondata.Sample, 0)
+	for _, smp := range s.history[mtype+":"+name] {
+		if !smp.T.Before(from) && !smp.T.After(to) {
+			samples = append(samples, smp)
+		}
+	}
+
+	return samples, true, nil
+}
+
+func TestEval(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration, v float64) mondata.Sample {
+		return mondata.Sample{T: now.Add(-ago), V: v}
+	}
+
+	src := &sourceMock{
+		gauges: mondata.GaugeMap{
+			`Alloc{env="prod",host="srv-1"}`: 10,
+			`Alloc{env="prod",host="srv-2"}`: 30,
+			`Alloc{env="dev",host="srv-3"}`:  5,
+			`Sys{env="prod",host="srv-1"}`:   100,
+			`NumGC`:                          4,
+		},
+		counters: mondata.CounterMap{
+			`PollCount{host="srv-1"}`: 20,
+			`PollCount{host="srv-2"}`: 5,
+			`NumGC`:                   7,
+		},
+		history: map[string][]mondata.Sample{
+			`counter:PollCount{host="srv-1"}`: {at(10*time.Minute, 0), at(4*time.Minute, 5), at(time.Minute, 20)},
+			`counter:PollCount{host="srv-2"}`: {at(time.Minute, 5)},
+			`gauge:Alloc{env="prod",host="srv-1"}`: {
+				at(3*time.Minute, 2), at(2*time.Minute, 8), at(time.Minute, 5),
+			},
+		},
+	}
+
+	series := func(v float64, labels ...string) Series {
+		s := Series{Labels: make(map[string]string), Value: v}
+		for i := 0; i < len(labels); i += 2 {
+			s.Labels[labels[i]] = labels[i+1]
+		}
+		return s
+	}
+	scalar := func(v float64) *Result {
+		return &Result{Type: ScalarResult, Scalar: &v}
+	}
+	vector := func(vec ...Series) *Result {
+		return &Result{Type: VectorResult, Vector: vec}
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		want *Result
+		err  error
+	}{
+		{
+			name: "positive test #1 (precedence)",
+			expr: "2 + 3 * 4 - 10 / 5",
+			want: scalar(12),
+		},
+		{
+			name: "positive test #2 (unary minus)",
+			expr: "-(2 - 5)",
+			want: scalar(3),
+		},
+		{
+			name: "positive test #3 (selector by label)",
+			expr: `Alloc{env="dev"}`,
+			want: vector(series(5, NameLabel, "Alloc", TypeLabel, mondata.GaugeType, "env", "dev", "host", "srv-3")),
+		},
+		{
+			name: "positive test #4 (selector by type)",
+			expr: `NumGC{__type__="counter"}`,
+			want: vector(series(7, NameLabel, "NumGC", TypeLabel, mondata.CounterType)),
+		},
+		{
+			name: "positive test #5 (no series matched)",
+			expr: "HeapAlloc",
+			want: vector(),
+		},
+		{
+			name: "positive test #6 (sum by)",
+			expr: "sum by (env) (Alloc)",
+			want: vector(series(5, "env", "dev"), series(40, "env", "prod")),
+		},
+		{
+			name: "positive test #7 (aggregations without by)",
+			expr: "count(Alloc) + min(Alloc) + max(Alloc) + avg(Alloc)",
+			want: vector(series(3 + 5 + 30 + 15)),
+		},
+		{
+			name: "positive test #8 (by label missing from series)",
+			expr: "sum(PollCount) by (env)",
+			want: vector(series(25)),
+		},
+		{
+			name: "positive test #9 (increase)",
+			expr: "increase(PollCount[5m])",
+			want: vector(series(15, "host", "srv-1")),
+		},
+		{
+			name: "positive test #10 (rate)",
+			expr: "rate(PollCount[15m])",
+			want: vector(series(20.0/540, "host", "srv-1")),
+		},
+		{
+			name: "positive test #11 (functions over time)",
+			expr: `min_over_time(Alloc{host="srv-1"}[5m]) + max_over_time(Alloc{host="srv-1"}[5m]) * 10`,
+			want: vector(series(82, "env", "prod", "host", "srv-1")),
+		},
+		{
+			name: "positive test #12 (avg, sum and count over time)",
+			expr: `avg_over_time(Alloc{host="srv-1"}[5m]) * count_over_time(Alloc{host="srv-1"}[5m]) - sum_over_time(Alloc{host="srv-1"}[5m])`,
+			want: vector(series(0, "env", "prod", "host", "srv-1")),
+		},
+		{
+			name: "positive test #13 (series matched by labels)",
+			expr: "Sys - Alloc",
+			want: vector(series(90, "env", "prod", "host", "srv-1")),
+		},
+		{
+			name: "positive test #14 (vector and scalar)",
+			expr: `100 - Alloc{host="srv-2"} / 2`,
+			want: vector(series(85, "env", "prod", "host", "srv-2")),
+		},
+		{
+			name: "positive test #15 (division by zero is dropped)",
+			expr: `Alloc / (Alloc - Alloc{env="prod"})`,
+			want: vector(),
+		},
+		{
+			name: "positive test #16 (duplicates selected by type)",
+			expr: `NumGC{__type__="counter"} - NumGC{__type__="gauge"}`,
+			want: vector(series(3)),
+		},
+		{
+			name: "negative test #1 (gauge and counter with the same labels)",
+			expr: `NumGC * 2 + NumGC{__type__="counter"}`,
+			err:  ErrType,
+		},
+		{
+			name: "negative test #2 (duplicates in the right operand)",
+			expr: "sum(Alloc) + NumGC",
+			err:  ErrType,
+		},
+		{
+			name: "negative test #3 (range selector without function)",
+			expr: "Alloc[5m]",
+			err:  ErrType,
+		},
+		{
+			name: "negative test #4 (aggregation of scalar)",
+			expr: "sum(1)",
+			err:  ErrType,
+		},
+		{
+			name: "negative test #5 (scalar division by zero)",
+			expr: "1 / 0",
+			err:  ErrType,
+		},
+		{
+			name: "negative test #6 (syntax)",
+			expr: "sum(",
+			err:  ErrSyntax,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Eval(context.TODO(), src, tt.expr, now)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Type, res.Type)
+			assert.Equal(t, tt.want.Scalar, res.Scalar)
+			assert.ElementsMatch(t, tt.want.Vector, res.Vector)
+		})
+	}
+}
+
+func TestApplyRangeFunc(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration, v float64) mondata.Sample {
+		return mondata.Sample{T: base.Add(offset), V: v}
+	}
+	// the counter was reset between 8 and 3
+	samples := []mondata.Sample{at(0, 5), at(10*time.Second, 8), at(20*time.Second, 3), at(40*time.Second, 7)}
+
+	tests := []struct {
+		name    string
+		fn      string
+		samples []mondata.Sample
+		want    float64
+		wantOk  bool
+	}{
+		{
+			name:    "positive test #1 (increase with reset)",
+			fn:      "increase",
+			samples: samples,
+			want:    3 + 3 + 4,
+			wantOk:  true,
+		},
+		{
+			name:    "positive test #2 (rate with reset)",
+			fn:      "rate",
+			samples: samples,
+			want:    10.0 / 40,
+			wantOk:  true,
+		},
+		{
+			name:    "positive test #3 (increase without reset)",
+			fn:      "increase",
+			samples: samples[:2],
+			want:    3,
+			wantOk:  true,
+		},
+		{
+			name:    "negative test #1 (increase of single sample)",
+			fn:      "increase",
+			samples: samples[:1],
+		},
+		{
+			name: "negative test #2 (rate without samples)",
+			fn:   "rate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, ok := applyRangeFunc(tt.fn, tt.samples)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, v)
+		})
+	}
+}
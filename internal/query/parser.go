@@ -0,0 +1,466 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+var ErrSyntax = errors.New("invalid query syntax")
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentRune(r rune, first bool) bool {
+	if r == '_' || r == ':' || unicode.IsLetter(r) {
+		return true
+	}
+
+	return !first && unicode.IsDigit(r)
+}
+
+// Splits expression into tokens, duration in square brackets is a single token
+func lex(s string) ([]token, error) {
+	rs := []rune(s)
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case isIdentRune(r, true):
+			j := i + 1
+			for j < len(rs) && isIdentRune(rs[j], false) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, string(rs[i:j]), i})
+			i = j
+		case unicode.IsDigit(r) || r == '.':
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E' ||
+				((rs[j] == '+' || rs[j] == '-') && (rs[j-1] == 'e' || rs[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(rs[i:j]), i})
+			i = j
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{tokString, string(rs[i : j+1]), i})
+			i = j + 1
+		case r == '[':
+			j := i + 1
+			for j < len(rs) && rs[j] != ']' {
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated range at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{tokDuration, strings.TrimSpace(string(rs[i+1 : j])), i})
+			i = j + 1
+		case strings.ContainsRune("(){},=+-*/", r):
+			tokens = append(tokens, token{tokPunct, string(r), i})
+			i++
+		default:
+			return nil, fmt.Errorf("%w: unexpected character %q at %d", ErrSyntax, r, i)
+		}
+	}
+
+	return append(tokens, token{tokEOF, "", len(rs)}), nil
+}
+
+// Parses duration like 30s, 5m, 1h or 7d
+func parseDuration(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+type Expr interface {
+	String() string
+}
+
+type NumberLit struct {
+	Val float64
+}
+
+// Selector matches series by name and labels, __type__ label matches type of metric.
+// Range is set for range selectors: name[5m]
+type Selector struct {
+	Name     string
+	Matchers map[string]string
+	Range    time.Duration
+}
+
+type Call struct {
+	Func string
+	Arg  Expr
+}
+
+type Aggregation struct {
+	Op  string
+	By  []string
+	Arg Expr
+}
+
+type Binary struct {
+	Op  string
+	LHS Expr
+	RHS Expr
+}
+
+func (n *NumberLit) String() string {
+	return strconv.FormatFloat(n.Val, 'f', -1, 64)
+}
+
+func (s *Selector) String() string {
+	if s.Range > 0 {
+		return mondata.SeriesKey(s.Name, s.Matchers) + "[" + s.Range.String() + "]"
+	}
+
+	return mondata.SeriesKey(s.Name, s.Matchers)
+}
+
+func (c *Call) String() string {
+	return c.Func + "(" + c.Arg.String() + ")"
+}
+
+func (a *Aggregation) String() string {
+	by := ""
+	if len(a.By) > 0 {
+		by = " by (" + strings.Join(a.By, ", ") + ")"
+	}
+
+	return a.Op + by + " (" + a.Arg.String() + ")"
+}
+
+func (b *Binary) String() string {
+	return "(" + b.LHS.String() + " " + b.Op + " " + b.RHS.String() + ")"
+}
+
+// functions over range selectors
+var rangeFuncs = map[string]bool{
+	"rate":            true,
+	"increase":        true,
+	"avg_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"sum_over_time":   true,
+	"count_over_time": true,
+}
+
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("%w: %s at %d", ErrSyntax, fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *parser) expect(text string) error {
+	t := p.next()
+	if t.kind != tokPunct || t.text != text {
+		return p.errorf(t, "expected %q, got %q", text, t.text)
+	}
+
+	return nil
+}
+
+func (p *parser) isPunct(text string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == text
+}
+
+// Parses expression, e.g. sum by (host) (rate(PollCount[5m])) * 60
+func Parse(s string) (Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+
+	return e, nil
+}
+
+func (p *parser) parseSum() (Expr, error) {
+	lhs, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		rhs, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: op, LHS: lhs, RHS: rhs}
+	}
+
+	return lhs, nil
+}
+
+func (p *parser) parseProduct() (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isPunct("*") || p.isPunct("/") {
+		op := p.next().text
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: op, LHS: lhs, RHS: rhs}
+	}
+
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.isPunct("-") {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Binary{Op: "-", LHS: &NumberLit{0}, RHS: e}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.text)
+		}
+		return &NumberLit{v}, nil
+	case tokPunct:
+		if t.text != "(" {
+			return nil, p.errorf(t, "unexpected %q", t.text)
+		}
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tokIdent:
+		switch {
+		case rangeFuncs[t.text] && p.isPunct("("):
+			return p.parseCall(t.text)
+		case aggregations[t.text] && (p.isPunct("(") || p.peek().text == "by"):
+			return p.parseAggregation(t.text)
+		default:
+			return p.parseSelector(t.text)
+		}
+	default:
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+}
+
+func (p *parser) parseCall(fn string) (Expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	arg, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if sel, ok := arg.(*Selector); !ok || sel.Range == 0 {
+		return nil, p.errorf(t, "%s expects a range selector, e.g. name[5m]", fn)
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return &Call{Func: fn, Arg: arg}, nil
+}
+
+func (p *parser) parseBy() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	by := make([]string, 0)
+	for !p.isPunct(")") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, p.errorf(t, "expected label name, got %q", t.text)
+		}
+		by = append(by, t.text)
+
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return by, nil
+}
+
+// Parses aggregation, by clause could be placed before or after arguments
+func (p *parser) parseAggregation(op string) (Expr, error) {
+	a := &Aggregation{Op: op}
+
+	if p.peek().text == "by" {
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		a.By = by
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	arg, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	a.Arg = arg
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if a.By == nil && p.peek().kind == tokIdent && p.peek().text == "by" {
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		a.By = by
+	}
+
+	return a, nil
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	sel := &Selector{Name: name, Matchers: make(map[string]string)}
+
+	if p.isPunct("{") {
+		p.next()
+		for !p.isPunct("}") {
+			k := p.next()
+			if k.kind != tokIdent {
+				return nil, p.errorf(k, "expected label name, got %q", k.text)
+			}
+
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+
+			v := p.next()
+			if v.kind != tokString {
+				return nil, p.errorf(v, "expected quoted label value, got %q", v.text)
+			}
+			s, err := strconv.Unquote(v.text)
+			if err != nil {
+				return nil, p.errorf(v, "invalid label value %s", v.text)
+			}
+			sel.Matchers[k.text] = s
+
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+
+	if t := p.peek(); t.kind == tokDuration {
+		p.next()
+		d, err := parseDuration(t.text)
+		if err != nil || d <= 0 {
+			return nil, p.errorf(t, "invalid range %q", t.text)
+		}
+		sel.Range = d
+	}
+
+	return sel, nil
+}
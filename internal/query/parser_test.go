@@ -0,0 +1,120 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{
+			name: "positive test #1 (product before sum)",
+			expr: "1 + 2 * 3 - 4 / 2",
+			want: "((1 + (2 * 3)) - (4 / 2))",
+		},
+		{
+			name: "positive test #2 (left associativity)",
+			expr: "8 / 4 / 2",
+			want: "((8 / 4) / 2)",
+		},
+		{
+			name: "positive test #3 (parentheses)",
+			expr: "(1 + 2) * 3",
+			want: "((1 + 2) * 3)",
+		},
+		{
+			name: "positive test #4 (unary minus)",
+			expr: "-Alloc * 2",
+			want: "((0 - Alloc) * 2)",
+		},
+		{
+			name: "positive test #5 (selector with labels)",
+			expr: `Alloc{host="srv-1", env="prod"}`,
+			want: `Alloc{env="prod",host="srv-1"}`,
+		},
+		{
+			name: "positive test #6 (range function)",
+			expr: "rate(PollCount[5m])",
+			want: "rate(PollCount[5m0s])",
+		},
+		{
+			name: "positive test #7 (range in days)",
+			expr: "max_over_time(Alloc[7d])",
+			want: "max_over_time(Alloc[168h0m0s])",
+		},
+		{
+			name: "positive test #8 (by before arguments)",
+			expr: "sum by (host, env) (Alloc)",
+			want: "sum by (host, env) (Alloc)",
+		},
+		{
+			name: "positive test #9 (by after arguments)",
+			expr: "avg (Alloc) by (host)",
+			want: "avg by (host) (Alloc)",
+		},
+		{
+			name: "positive test #10 (empty by)",
+			expr: "count by () (Alloc)",
+			want: "count (Alloc)",
+		},
+		{
+			name: "positive test #11 (name of function used as metric name)",
+			expr: "rate + sum",
+			want: "(rate + sum)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, e.String())
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{name: "negative test #1 (empty expression)", expr: ""},
+		{name: "negative test #2 (unclosed parenthesis)", expr: "(1 + 2"},
+		{name: "negative test #3 (unclosed by)", expr: "sum by (env (Alloc)"},
+		{name: "negative test #4 (missing operand)", expr: "1 +"},
+		{name: "negative test #5 (trailing tokens)", expr: "Alloc Sys"},
+		{name: "negative test #6 (unquoted label value)", expr: "Alloc{host=srv}"},
+		{name: "negative test #7 (unterminated string)", expr: `Alloc{host="srv}`},
+		{name: "negative test #8 (unterminated range)", expr: "rate(PollCount[5m)"},
+		{name: "negative test #9 (invalid range)", expr: "rate(PollCount[5x])"},
+		{name: "negative test #10 (negative range)", expr: "rate(PollCount[-5m])"},
+		{name: "negative test #11 (instant selector in range function)", expr: "rate(PollCount)"},
+		{name: "negative test #12 (unexpected character)", expr: "Alloc % 2"},
+		{name: "negative test #13 (label name expected in by)", expr: `sum by ("env") (Alloc)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			assert.ErrorIs(t, err, ErrSyntax)
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("2d")
+	require.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, d)
+
+	d, err = parseDuration("90s")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+
+	_, err = parseDuration("xd")
+	assert.Error(t, err)
+}
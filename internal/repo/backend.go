@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var ErrUnknownScheme = errors.New("unknown storage scheme")
+
+// Backend opens storage by DSN, options of storage are parsed from the DSN by the backend
+type Backend struct {
+	Name string // used as name of logger
+	Open func(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (MetricsRepo, error)
+	// storage is remote and could go away, so writes are buffered in memory while it's unreachable
+	Buffered bool
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// Registers backend for scheme of DSN, it panics if the scheme is already registered
+func Register(scheme string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, ok := backends[scheme]; ok {
+		panic(fmt.Sprintf("storage backend for scheme %q is already registered", scheme))
+	}
+	backends[scheme] = b
+}
+
+// Returns registered schemes in alphabetical order
+func Schemes() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	schemes := make([]string, 0, len(backends))
+	for k := range backends {
+		schemes = append(schemes, k)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Returns backend registered for scheme of DSN
+func lookup(dsn string) (Backend, *url.URL, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		// error of url.Parse contains the whole DSN with password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return Backend{}, nil, fmt.Errorf("invalid storage DSN: %w", err)
+	}
+
+	backendsMu.RLock()
+	b, ok := backends[u.Scheme]
+	backendsMu.RUnlock()
+	if !ok {
+		return Backend{}, nil, fmt.Errorf("%w %q, expected one of: %s", ErrUnknownScheme, u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	return b, u, nil
+}
@@ -0,0 +1,45 @@
+package repo
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/Allegathor/perfmon/internal/repo/pgsql"
+	"github.com/Allegathor/perfmon/internal/repo/sqlite"
+	"go.uber.org/zap"
+)
+
+// built-in backends
+func init() {
+	Register("memory", Backend{
+		Name: "in-memory storage",
+		Open: func(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (MetricsRepo, error) {
+			return memory.Open(ctx, dsn, logger)
+		},
+	})
+
+	pg := Backend{
+		Name: "PostgreSQL DB",
+		Open: func(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (MetricsRepo, error) {
+			return pgsql.Open(ctx, dsn, logger)
+		},
+		Buffered: true,
+	}
+	Register("postgres", pg)
+	Register("postgresql", pg)
+
+	Register("mirror", Backend{
+		Name: "mirrored storage",
+		Open: func(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (MetricsRepo, error) {
+			return openMirror(ctx, dsn, logger)
+		},
+	})
+
+	Register("file", Backend{
+		Name: "SQLite DB",
+		Open: func(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (MetricsRepo, error) {
+			return sqlite.Open(ctx, dsn, logger)
+		},
+	})
+}
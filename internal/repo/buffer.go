@@ -0,0 +1,641 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"go.uber.org/zap"
+)
+
+var ErrBufferFull = errors.New("storage is unreachable and write buffer is full")
+
+const (
+	// option of DSN of buffered backends, max number of writes buffered while backend is unreachable, 0 disables buffering
+	bufferSizeOpt     = "write_buffer"
+	defaultBufferSize = 10000
+	// option of DSN of buffered backends, max number of series kept in the last known state of backend,
+	// reads aren't served while backend is unreachable if it stores more of them
+	bufferStateOpt     = "buffer_state"
+	defaultBufferState = 100000
+
+	// interval of checking whether backend is reachable
+	failoverCheckInterval = 10 * time.Second
+	pingTimeout           = 2 * time.Second
+	// time of replaying buffered writes when server stops
+	flushTimeout = 5 * time.Second
+)
+
+// Takes non-negative number of option opt from DSN, so the option isn't passed to backend
+func takeCount(u *url.URL, opt string, def int) (int, error) {
+	q := u.Query()
+	if !q.Has(opt) {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(q.Get(opt))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid option %q of storage, expected non-negative number", opt)
+	}
+	q.Del(opt)
+	u.RawQuery = q.Encode()
+
+	return n, nil
+}
+
+// write is a call of setter, it's applied to backend, or to the last known state of it and queued
+type write struct {
+	apply  func(ctx context.Context, r MetricsRepo) error
+	totals mondata.CounterMap  // absolute values of cumulative counters set by the call
+	series []mondata.SeriesRef // series set by the call, they're checked against the limit of series
+	// the call adds to stored values, e.g. deltas of counters or histograms, so applying it twice changes them
+	accumulates bool
+}
+
+// writeBuffer keeps writes in order while backend is unreachable and replays them once it recovers.
+// Reads are served from the last known state of backend while it's unreachable. The state is loaded once
+// and it's kept up to date by writes of the server and by changes made by other instances,
+// it's reloaded only after backend recovers or if it could be out of date. The state is dropped
+// if backend stores more series than stateSize, so reads of unreachable backend fail then.
+//
+// A write which reply was lost with the connection could be committed by backend. Such writes are buffered
+// only if they're idempotent, writes which accumulate values fail with mondata.ErrCommitUnknown instead,
+// so they aren't applied twice
+type writeBuffer struct {
+	mu    sync.Mutex
+	down  bool
+	queue []write
+	size  int
+	// values of backend as of the last refresh with writes applied after it
+	state     *memory.MemorySt
+	stateSize int
+	// the state was dropped, since backend stores more than stateSize series, only buffered writes are applied to it
+	partial bool
+	// the state could be out of date, so it must be reloaded
+	stale bool
+	// keys of series changed by other instances of server by type, they're refreshed in the state one by one
+	changes map[string]map[string]struct{}
+	// signals that backend was changed by other instances of server, so the state must be refreshed
+	changed chan struct{}
+	logger  *zap.SugaredLogger
+}
+
+func newWriteBuffer(
+	ctx context.Context, size int, stateSize int, overflow mondata.OverflowPolicy, logger *zap.SugaredLogger,
+) (*writeBuffer, error) {
+	state, err := memory.Init(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// counters of the state are accumulated as backend accumulates them
+	state.SetOverflow(overflow)
+
+	return &writeBuffer{size: size, state: state, stateSize: stateSize, changed: make(chan struct{}, 1), logger: logger}, nil
+}
+
+func ping(ctx context.Context, r MetricsRepo) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	return r.Ping(ctx)
+}
+
+func (b *writeBuffer) isDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.down
+}
+
+// Reports whether reads are served from the last known state
+func (b *writeBuffer) serves() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.down && !b.partial
+}
+
+func (b *writeBuffer) setDown(err error) {
+	if !b.down {
+		b.down = true
+		b.logger.Warnln("storage is unreachable, writes are buffered in memory:", err)
+	}
+}
+
+// Queues write if it's valid for the last known state, it's called under the lock
+func (b *writeBuffer) enqueue(ctx context.Context, w write) error {
+	if len(b.queue) >= b.size {
+		return ErrBufferFull
+	}
+
+	// increments of totals which weren't seen yet are unknown, since they're computed from totals stored by backend
+	b.state.SeedTotals(w.totals)
+	if err := w.apply(ctx, b.state); err != nil {
+		return err
+	}
+	b.queue = append(b.queue, w)
+
+	return nil
+}
+
+// Applies write to backend, or queues it if backend is unreachable
+func (b *writeBuffer) write(ctx context.Context, backend MetricsRepo, w write) error {
+	b.mu.Lock()
+	if b.down {
+		defer b.mu.Unlock()
+		return b.enqueue(ctx, w)
+	}
+	b.mu.Unlock()
+
+	if err := w.apply(ctx, backend); err != nil {
+		// reachable backend rejects the write by itself, e.g. bounds of histogram don't match
+		if ctx.Err() != nil || ping(ctx, backend) == nil {
+			return err
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.setDown(err)
+		// the write could be committed before the connection was lost, see writeBuffer
+		if w.accumulates && errors.Is(err, mondata.ErrCommitUnknown) {
+			return err
+		}
+		return b.enqueue(ctx, w)
+	}
+
+	// the write is applied to the last known state as well, so it's kept up to date without reloading it
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.partial {
+		return nil
+	}
+	if err := w.apply(ctx, b.state); err != nil {
+		b.stale = true
+		b.logger.Warnln("the last known state of storage is out of date and it will be reloaded, error:", err)
+	}
+
+	return nil
+}
+
+// Applies buffered writes to backend in order, backend is used directly once the queue is empty
+func (b *writeBuffer) replay(ctx context.Context, backend MetricsRepo) error {
+	for n := 0; ; n++ {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			b.down = false
+			b.mu.Unlock()
+			b.logger.Infoln("storage is reachable again, buffered writes were replayed:", n)
+			return nil
+		}
+		w := b.queue[0]
+		b.mu.Unlock()
+
+		if err := w.apply(ctx, backend); err != nil {
+			switch {
+			case w.accumulates && errors.Is(err, mondata.ErrCommitUnknown):
+				// replaying the write once more could apply it twice
+				b.logger.Errorln("buffered write was dropped, since storage could commit it already, error:", err)
+			case ctx.Err() != nil || ping(ctx, backend) != nil:
+				return err
+			default:
+				b.logger.Errorln("buffered write was rejected by storage and dropped, error:", err)
+			}
+		}
+
+		b.mu.Lock()
+		b.queue[0] = write{}
+		b.queue = b.queue[1:]
+		b.mu.Unlock()
+	}
+}
+
+// Loads the whole state of backend, last totals of counters are loaded as well if backend exposes them,
+// otherwise they're known only for counters written by the server
+func (b *writeBuffer) refresh(ctx context.Context, backend MetricsRepo) error {
+	// changes made from now on could be missed by the read, so they're kept
+	b.mu.Lock()
+	b.stale = false
+	b.changes = nil
+	b.mu.Unlock()
+
+	st, err := readState(ctx, primaryReader(backend))
+	if err != nil {
+		b.mu.Lock()
+		b.stale = true
+		b.mu.Unlock()
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// state of unreachable backend is changed by buffered writes only
+	if b.down {
+		return nil
+	}
+
+	if n := len(st.Gauges) + len(st.Counters) + len(st.Histograms); n > b.stateSize {
+		return b.drop(n)
+	}
+	b.partial = false
+	if st.Totals == nil {
+		b.state.Load(st.Snapshot, st.Histograms, st.Meta)
+		return nil
+	}
+	return b.state.LoadState(ctx, st)
+}
+
+// Drops the last known state, since backend stores n series, which is more than the state keeps.
+// It's called under the lock
+func (b *writeBuffer) drop(n int) error {
+	if !b.partial {
+		b.logger.Warnln("storage stores more series than the last known state keeps, reads fail while it's unreachable:", n)
+	}
+	b.partial = true
+	b.changes = nil
+
+	return b.state.LoadState(context.Background(), mondata.State{Snapshot: mondata.NewSnapshot()})
+}
+
+func readState(ctx context.Context, backend MetricsRepo) (mondata.State, error) {
+	if sr, ok := backend.(stateRepo); ok {
+		return sr.GetState(ctx)
+	}
+
+	snap, err := backend.GetSnapshot(ctx)
+	if err != nil {
+		return mondata.State{}, err
+	}
+	hm, err := backend.GetHistogramAll(ctx)
+	if err != nil {
+		return mondata.State{}, err
+	}
+	meta, err := backend.GetMetaAll(ctx)
+	if err != nil {
+		return mondata.State{}, err
+	}
+
+	return mondata.State{Snapshot: snap, Histograms: hm, Meta: meta}, nil
+}
+
+// Reads series of type mtype by keys, series missing in backend are missing in the result
+func readKeys(ctx context.Context, backend MetricsRepo, mtype string, keys []string) (mondata.State, error) {
+	st := mondata.State{Snapshot: mondata.NewSnapshot(), Histograms: make(mondata.HistogramMap), Meta: make(mondata.MetaMap)}
+	for _, k := range keys {
+		var (
+			ok  bool
+			err error
+		)
+		switch mtype {
+		case mondata.GaugeType:
+			var v mondata.GaugeVType
+			if v, ok, err = backend.GetGauge(ctx, k); ok {
+				st.Gauges[k] = v
+			}
+		case mondata.CounterType:
+			var v mondata.CounterVType
+			if v, ok, err = backend.GetCounter(ctx, k); ok {
+				st.Counters[k] = v
+			}
+		case mondata.HistogramType:
+			var v mondata.HistogramVType
+			if v, ok, err = backend.GetHistogram(ctx, k); ok {
+				st.Histograms[k] = v
+			}
+		case mondata.MetaType:
+			var v mondata.Meta
+			if v, ok, err = backend.GetMeta(ctx, k); ok {
+				st.Meta[k] = v
+			}
+		}
+		if err != nil {
+			return st, err
+		}
+		if !ok || (mtype != mondata.GaugeType && mtype != mondata.CounterType) {
+			continue
+		}
+
+		stamp, ok, err := backend.GetStamp(ctx, mtype, k)
+		if err != nil {
+			return st, err
+		}
+		if ok && mtype == mondata.GaugeType {
+			st.GaugeStamps[k] = stamp
+		} else if ok {
+			st.CounterStamps[k] = stamp
+		}
+	}
+
+	return st, nil
+}
+
+// Refreshes series changed by other instances of server, the whole state is reloaded if it's stale
+func (b *writeBuffer) update(ctx context.Context, backend MetricsRepo) error {
+	b.mu.Lock()
+	if b.down || b.partial {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.stale {
+		b.mu.Unlock()
+		return b.refresh(ctx, backend)
+	}
+	changes := b.changes
+	b.changes = nil
+	b.mu.Unlock()
+
+	for mtype, set := range changes {
+		keys := make([]string, 0, len(set))
+		for k := range set {
+			keys = append(keys, k)
+		}
+
+		st, err := readKeys(ctx, primaryReader(backend), mtype, keys)
+		if err != nil {
+			// keys which weren't refreshed are unknown now
+			b.mu.Lock()
+			b.stale = true
+			b.mu.Unlock()
+			return err
+		}
+
+		b.mu.Lock()
+		if !b.down {
+			b.state.LoadKeys(mtype, keys, st)
+		}
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (b *writeBuffer) isStale() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stale
+}
+
+// Schedules refreshing of the changed series, the whole state is reloaded if keys of the change are unknown.
+// Changes made before the state is refreshed are coalesced
+func (b *writeBuffer) notify(c mondata.Change) {
+	b.mu.Lock()
+	if b.partial {
+		// series of the dropped state aren't kept, so they aren't refreshed
+		b.mu.Unlock()
+		return
+	}
+	if len(c.Keys) == 0 {
+		b.stale = true
+	} else {
+		if b.changes == nil {
+			b.changes = make(map[string]map[string]struct{})
+		}
+		if b.changes[c.MType] == nil {
+			b.changes[c.MType] = make(map[string]struct{})
+		}
+		for _, k := range c.Keys {
+			b.changes[c.MType][k] = struct{}{}
+		}
+	}
+	b.mu.Unlock()
+
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (b *writeBuffer) check(ctx context.Context, backend MetricsRepo) {
+	if err := ping(ctx, backend); err != nil {
+		b.mu.Lock()
+		b.setDown(err)
+		b.mu.Unlock()
+		return
+	}
+
+	if b.isDown() {
+		if err := b.replay(ctx, backend); err != nil {
+			b.logger.Warnln("replaying buffered writes failed with error:", err)
+			return
+		}
+
+		// changes made by other instances while backend was unreachable are unknown
+		b.mu.Lock()
+		b.stale = true
+		b.mu.Unlock()
+	}
+
+	// the state grows with series written by the server, so its size is checked periodically
+	b.mu.Lock()
+	if !b.stale && !b.partial {
+		if n := b.state.Len(); n > b.stateSize {
+			if err := b.drop(n); err != nil {
+				b.logger.Warnln("dropping the last known state of storage failed with error:", err)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if !b.isStale() {
+		return
+	}
+	if err := b.refresh(ctx, backend); err != nil {
+		b.logger.Warnln("refreshing the last known state of storage failed with error:", err)
+	}
+}
+
+// Replays buffered writes before backend is closed, they're lost if it's still unreachable
+func (b *writeBuffer) flush(backend MetricsRepo) {
+	if !b.isDown() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	err := ping(ctx, backend)
+	if err == nil {
+		err = b.replay(ctx, backend)
+	}
+	if err != nil {
+		b.mu.Lock()
+		n := len(b.queue)
+		b.mu.Unlock()
+		b.logger.Errorln("storage is unreachable, buffered writes are lost:", n, "error:", err)
+	}
+}
+
+// Buffers writes in memory while backend is unreachable, size is the max number of buffered writes,
+// stateSize is the max number of series in the last known state of backend
+func (c *Current) enableBuffer(ctx context.Context, size int, stateSize int) error {
+	b, err := newWriteBuffer(ctx, size, stateSize, c.Overflow(), c.logger.Named("buffer"))
+	if err != nil {
+		return err
+	}
+	if err := b.refresh(ctx, c.MetricsRepo); err != nil {
+		return fmt.Errorf("loading state of storage failed: %w", err)
+	}
+	c.buffer = b
+	c.Subscribe(b.notify)
+
+	return nil
+}
+
+// Checks periodically whether backend is reachable, once it recovers after it went down,
+// buffered writes are replayed to it in order and the last known state of it is reloaded.
+// Series changed by other instances of server are refreshed in the state as well
+func (c *Current) ScheduleFailover(ctx context.Context) error {
+	if c.buffer == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.buffer.check(ctx, c.MetricsRepo)
+		case <-c.buffer.changed:
+			if err := c.buffer.update(ctx, c.MetricsRepo); err != nil {
+				c.buffer.logger.Warnln("refreshing the last known state of storage failed with error:", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *Current) Close() {
+	if c.buffer != nil {
+		c.buffer.flush(c.MetricsRepo)
+	}
+
+	c.MetricsRepo.Close()
+}
+
+// Writes to backend, or to write buffer if backend is unreachable
+func (c *Current) write(ctx context.Context, w write) error {
+	if c.limit == nil || len(w.series) == 0 {
+		return c.store(ctx, w)
+	}
+
+	if c.limit.stale.Load() {
+		if err := c.resyncSeries(ctx); err != nil {
+			c.logger.Warnln("reloading series failed, the limit is checked against outdated ones, error:", err)
+		}
+	}
+
+	added, err := c.limit.admit(w.series)
+	if err != nil {
+		return err
+	}
+	if err := c.store(ctx, w); err != nil {
+		c.limit.release(added)
+		return err
+	}
+
+	return nil
+}
+
+func (c *Current) store(ctx context.Context, w write) error {
+	if c.buffer == nil {
+		return w.apply(ctx, c.MetricsRepo)
+	}
+
+	return c.buffer.write(ctx, c.MetricsRepo, w)
+}
+
+// Returns the last known state of backend while it's unreachable, otherwise backend itself
+func (c *Current) reader() MetricsRepo {
+	if c.buffer != nil && c.buffer.serves() {
+		return c.buffer.state
+	}
+
+	return c.MetricsRepo
+}
+
+// MARK: getters
+func (c *Current) GetGauge(ctx context.Context, name string) (mondata.GaugeVType, bool, error) {
+	return c.reader().GetGauge(ctx, name)
+}
+
+func (c *Current) GetGaugeAll(ctx context.Context) (mondata.GaugeMap, error) {
+	return c.reader().GetGaugeAll(ctx)
+}
+
+func (c *Current) GetCounter(ctx context.Context, name string) (mondata.CounterVType, bool, error) {
+	return c.reader().GetCounter(ctx, name)
+}
+
+func (c *Current) GetCounterAll(ctx context.Context) (mondata.CounterMap, error) {
+	return c.reader().GetCounterAll(ctx)
+}
+
+func (c *Current) GetHistogram(ctx context.Context, name string) (mondata.HistogramVType, bool, error) {
+	return c.reader().GetHistogram(ctx, name)
+}
+
+func (c *Current) GetHistogramAll(ctx context.Context) (mondata.HistogramMap, error) {
+	return c.reader().GetHistogramAll(ctx)
+}
+
+func (c *Current) GetStamp(ctx context.Context, mtype string, name string) (mondata.Stamp, bool, error) {
+	return c.reader().GetStamp(ctx, mtype, name)
+}
+
+func (c *Current) GetStampAll(ctx context.Context, mtype string) (mondata.StampMap, error) {
+	return c.reader().GetStampAll(ctx, mtype)
+}
+
+func (c *Current) GetSnapshot(ctx context.Context) (mondata.Snapshot, error) {
+	return c.reader().GetSnapshot(ctx)
+}
+
+func (c *Current) GetMeta(ctx context.Context, name string) (mondata.Meta, bool, error) {
+	return c.reader().GetMeta(ctx, name)
+}
+
+func (c *Current) GetMetaAll(ctx context.Context) (mondata.MetaMap, error) {
+	return c.reader().GetMetaAll(ctx)
+}
+
+// MARK: setters
+// setters of gauges and counters are in history.go, since they record history too
+func (c *Current) SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error {
+	return c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetHistogram(ctx, name, value)
+		},
+		series:      refOf(mondata.HistogramType, name),
+		accumulates: true,
+	})
+}
+
+func (c *Current) SetHistogramAll(ctx context.Context, histogramMap mondata.HistogramMap) error {
+	return c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetHistogramAll(ctx, histogramMap)
+		},
+		series:      refsOf(mondata.HistogramType, histogramMap),
+		accumulates: true,
+	})
+}
+
+func (c *Current) SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error {
+	return c.write(ctx, write{apply: func(ctx context.Context, r MetricsRepo) error {
+		return r.SetSampled(ctx, mtype, sampled)
+	}})
+}
+
+func (c *Current) SetMetaAll(ctx context.Context, metaMap mondata.MetaMap) error {
+	return c.write(ctx, write{apply: func(ctx context.Context, r MetricsRepo) error {
+		return r.SetMetaAll(ctx, metaMap)
+	}})
+}
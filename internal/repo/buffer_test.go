@@ -0,0 +1,313 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var errDown = errors.New("connection refused")
+
+// flakyRepo is remote storage which could go away
+type flakyRepo struct {
+	*memory.MemorySt
+	down  atomic.Bool
+	loads atomic.Int32 // number of times the whole state was read
+	// the connection is lost after the next counter is committed
+	lose atomic.Bool
+}
+
+func (f *flakyRepo) GetState(ctx context.Context) (mondata.State, error) {
+	if f.down.Load() {
+		return mondata.State{}, errDown
+	}
+	f.loads.Add(1)
+	return f.MemorySt.GetState(ctx)
+}
+
+func (f *flakyRepo) Ping(ctx context.Context) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return nil
+}
+
+func (f *flakyRepo) GetGauge(ctx context.Context, name string) (mondata.GaugeVType, bool, error) {
+	if f.down.Load() {
+		return 0, false, errDown
+	}
+	return f.MemorySt.GetGauge(ctx, name)
+}
+
+func (f *flakyRepo) GetCounter(ctx context.Context, name string) (mondata.CounterVType, bool, error) {
+	if f.down.Load() {
+		return 0, false, errDown
+	}
+	return f.MemorySt.GetCounter(ctx, name)
+}
+
+func (f *flakyRepo) SetGauge(ctx context.Context, name string, value mondata.GaugeVType) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.MemorySt.SetGauge(ctx, name, value)
+}
+
+func (f *flakyRepo) SetCounter(ctx context.Context, name string, value mondata.CounterVType) error {
+	if f.down.Load() {
+		return errDown
+	}
+	if err := f.MemorySt.SetCounter(ctx, name, value); err != nil || !f.lose.Load() {
+		return err
+	}
+	f.down.Store(true)
+	return fmt.Errorf("%w: %w", mondata.ErrCommitUnknown, errDown)
+}
+
+func (f *flakyRepo) SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.MemorySt.SetCounterTotal(ctx, name, total)
+}
+
+func (f *flakyRepo) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.MemorySt.ApplyBatch(ctx, gauges, counters, histograms)
+}
+
+func TestCurrent_WriteBuffer(t *testing.T) {
+	ctx := context.TODO()
+	backend := &flakyRepo{MemorySt: memory.InitEmpty()}
+	c := &Current{MetricsRepo: backend, logger: zap.NewNop().Sugar()}
+	require.NoError(t, backend.MemorySt.SetCounterTotal(ctx, "NumGC", 4))
+	require.NoError(t, c.enableBuffer(ctx, 3, 10))
+
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, c.SetCounterTotal(ctx, "NumGC", 10))
+	// writes are applied to the last known state, so it isn't reloaded while storage is reachable
+	c.buffer.check(ctx, backend)
+	assert.Equal(t, int32(1), backend.loads.Load())
+
+	backend.down.Store(true)
+
+	// writes are buffered and reads are served from the last known state with them applied
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 2))
+	require.NoError(t, c.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{"HeapAlloc": 5}},
+		mondata.CounterBatch{Deltas: mondata.CounterMap{"PollCount": 3}, Totals: mondata.CounterMap{"NumGC": 15}},
+		nil,
+	))
+	require.NoError(t, c.SetCounterTotal(ctx, "NumGC", 16))
+	assert.ErrorIs(t, c.SetGauge(ctx, "Alloc", 3), ErrBufferFull)
+
+	snap, err := c.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 2, "HeapAlloc": 5}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"NumGC": 16, "PollCount": 3}, snap.Counters)
+
+	v, _, err := backend.MemorySt.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), v, "writes mustn't reach storage while it's down")
+
+	// storage is still down, so nothing is replayed
+	c.buffer.check(ctx, backend)
+	assert.True(t, c.buffer.isDown())
+
+	backend.down.Store(false)
+	c.buffer.check(ctx, backend)
+	assert.False(t, c.buffer.isDown())
+	assert.Equal(t, int32(2), backend.loads.Load(), "the state is reloaded once storage recovers")
+
+	snap, err = backend.MemorySt.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 2, "HeapAlloc": 5}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"NumGC": 16, "PollCount": 3}, snap.Counters)
+
+	// writes reach storage directly again
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 4))
+	v, _, err = backend.MemorySt.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(4), v)
+}
+
+func TestCurrent_WriteBufferCommitUnknown(t *testing.T) {
+	ctx := context.TODO()
+	backend := &flakyRepo{MemorySt: memory.InitEmpty()}
+	c := &Current{MetricsRepo: backend, logger: zap.NewNop().Sugar()}
+	require.NoError(t, c.enableBuffer(ctx, 3, 10))
+
+	// counter which could be committed isn't buffered, since replaying it would add the delta twice
+	backend.lose.Store(true)
+	assert.ErrorIs(t, c.SetCounter(ctx, "PollCount", 3), mondata.ErrCommitUnknown)
+	assert.True(t, c.buffer.isDown())
+	backend.lose.Store(false)
+
+	require.NoError(t, c.SetCounter(ctx, "PollCount", 2))
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 1))
+
+	backend.down.Store(false)
+	c.buffer.check(ctx, backend)
+	require.False(t, c.buffer.isDown())
+
+	snap, err := backend.MemorySt.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 1}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"PollCount": 5}, snap.Counters)
+}
+
+func TestCurrent_WriteBufferState(t *testing.T) {
+	ctx := context.TODO()
+	backend := &flakyRepo{MemorySt: memory.InitEmpty()}
+	backend.MemorySt.SetOverflow(mondata.OverflowSaturate)
+	require.NoError(t, backend.MemorySt.SetCounter(ctx, "PollCount", math.MaxUint64-1))
+	c := &Current{MetricsRepo: backend, logger: zap.NewNop().Sugar()}
+	require.NoError(t, c.enableBuffer(ctx, 3, 2))
+
+	// counters of the state are accumulated by the policy of storage
+	backend.down.Store(true)
+	require.NoError(t, c.SetCounter(ctx, "PollCount", 5))
+	v, _, err := c.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), v)
+
+	// buffered writes are replayed on close once storage recovers
+	backend.down.Store(false)
+	c.Close()
+	assert.False(t, c.buffer.isDown())
+	v, _, err = backend.MemorySt.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), v)
+
+	// the state is dropped once there are more series than it keeps, so reads of unreachable storage fail
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, c.SetGauge(ctx, "Sys", 2))
+	c.buffer.check(ctx, backend)
+	assert.Equal(t, 0, c.buffer.state.Len())
+
+	backend.down.Store(true)
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 3))
+	_, _, err = c.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, errDown)
+
+	backend.down.Store(false)
+	c.buffer.check(ctx, backend)
+	v2, _, err := c.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(3), v2)
+	assert.Equal(t, 0, c.buffer.state.Len(), "the state isn't reloaded while storage stores too many series")
+}
+
+// notifyingRepo is storage shared with other instances of server
+type notifyingRepo struct {
+	*flakyRepo
+	changes chan mondata.Change
+}
+
+func (n *notifyingRepo) Listen(ctx context.Context, fn func(mondata.Change)) error {
+	for {
+		select {
+		case c := <-n.changes:
+			fn(c)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestCurrent_ListenChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	backend := &notifyingRepo{flakyRepo: &flakyRepo{MemorySt: memory.InitEmpty()}, changes: make(chan mondata.Change)}
+	c := &Current{MetricsRepo: backend, logger: zap.NewNop().Sugar()}
+	require.NoError(t, c.enableBuffer(ctx, 3, 10))
+
+	received := make(chan mondata.Change, 1)
+	c.Subscribe(func(change mondata.Change) {
+		received <- change
+	})
+	go c.ListenChanges(ctx)
+	go c.ScheduleFailover(ctx)
+
+	// another instance changes storage
+	require.NoError(t, backend.MemorySt.SetGauge(ctx, "Alloc", 7))
+	change := mondata.Change{Origin: "other", MType: mondata.GaugeType, Keys: []string{"Alloc"}}
+	backend.changes <- change
+	assert.Equal(t, change, <-received)
+
+	// the changed series is refreshed without waiting for the periodic check and without reloading the whole state
+	assert.Eventually(t, func() bool {
+		v, ok, err := c.buffer.state.GetGauge(ctx, "Alloc")
+		return err == nil && ok && v == 7
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), backend.loads.Load())
+
+	// series which any instance could change are unknown, so the whole state is reloaded
+	require.NoError(t, backend.MemorySt.SetCounterTotal(ctx, "NumGC", 3))
+	change = mondata.Change{Origin: "other", MType: mondata.CounterType}
+	backend.changes <- change
+	assert.Equal(t, change, <-received)
+	assert.Eventually(t, func() bool {
+		v, ok, err := c.buffer.state.GetCounter(ctx, "NumGC")
+		return err == nil && ok && v == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), backend.loads.Load())
+}
+
+func TestWriteBuffer_Update(t *testing.T) {
+	ctx := context.TODO()
+	backend := &flakyRepo{MemorySt: memory.InitEmpty()}
+	require.NoError(t, backend.MemorySt.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, backend.MemorySt.SetGauge(ctx, "Sys", 2))
+	require.NoError(t, backend.MemorySt.SetHistogram(ctx, "Latency", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}}))
+
+	b, err := newWriteBuffer(ctx, 3, 10, mondata.OverflowWrap, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, b.refresh(ctx, backend))
+
+	// another instance changes one gauge and evicts the other one and the histogram
+	require.NoError(t, backend.MemorySt.SetGauge(ctx, "Alloc", 5))
+	backend.MemorySt.LoadKeys(mondata.GaugeType, []string{"Sys"}, mondata.State{})
+	backend.MemorySt.LoadKeys(mondata.HistogramType, []string{"Latency"}, mondata.State{})
+	b.notify(mondata.Change{MType: mondata.GaugeType, Keys: []string{"Alloc", "Sys"}})
+	b.notify(mondata.Change{MType: mondata.HistogramType, Keys: []string{"Latency"}})
+	require.NoError(t, b.update(ctx, backend))
+
+	gauges, err := b.state.GetGaugeAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 5}, gauges)
+	stamp, ok, err := b.state.GetStamp(ctx, mondata.GaugeType, "Alloc")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.False(t, stamp.Received.IsZero())
+	hm, err := b.state.GetHistogramAll(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, hm)
+	assert.Equal(t, int32(1), backend.loads.Load())
+
+	// keys which failed to refresh are unknown, so the whole state is reloaded by the next update
+	backend.down.Store(true)
+	b.notify(mondata.Change{MType: mondata.CounterType, Keys: []string{"NumGC"}})
+	assert.ErrorIs(t, b.update(ctx, backend), errDown)
+	assert.True(t, b.isStale())
+
+	backend.down.Store(false)
+	require.NoError(t, b.update(ctx, backend))
+	assert.False(t, b.isStale())
+	assert.Equal(t, int32(2), backend.loads.Load())
+}
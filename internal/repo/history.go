@@ -0,0 +1,251 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// Setters of Current record values to history after they were stored by the active backend
+// or buffered while it's unreachable, history is nil if backend keeps samples by itself
+
+func (c *Current) SetGauge(ctx context.Context, name string, value mondata.GaugeVType) error {
+	err := c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetGauge(ctx, name, value)
+		},
+		series: refOf(mondata.GaugeType, name),
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.history != nil {
+		c.history.Add(mondata.GaugeType, name, time.Now(), value)
+	}
+	return nil
+}
+
+func (c *Current) SetGaugeAll(ctx context.Context, gaugeMap mondata.GaugeMap) error {
+	err := c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetGaugeAll(ctx, gaugeMap)
+		},
+		series: refsOf(mondata.GaugeType, gaugeMap),
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.history == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for k, v := range gaugeMap {
+		c.history.Add(mondata.GaugeType, k, now, v)
+	}
+	return nil
+}
+
+// counters are accumulated by backend, so their resulting values are read back from the primary database
+func (c *Current) recordCounter(ctx context.Context, name string) {
+	if c.history == nil {
+		return
+	}
+
+	v, ok, err := primaryReader(c.reader()).GetCounter(ctx, name)
+	if err != nil || !ok {
+		c.logger.Warnln("counter value wasn't recorded to history, name:", name, "error:", err)
+		return
+	}
+
+	c.history.Add(mondata.CounterType, name, time.Now(), float64(v))
+}
+
+func (c *Current) recordCounterAll(ctx context.Context, updated mondata.CounterMap) {
+	if c.history == nil {
+		return
+	}
+
+	// only the updated counters are read, since other series could be numerous
+	r := primaryReader(c.reader())
+	now := time.Now()
+	for k := range updated {
+		v, ok, err := r.GetCounter(ctx, k)
+		if err != nil {
+			c.logger.Warnln("counter values weren't recorded to history, error:", err)
+			return
+		}
+		if ok {
+			c.history.Add(mondata.CounterType, k, now, float64(v))
+		}
+	}
+}
+
+func (c *Current) SetCounter(ctx context.Context, name string, value mondata.CounterVType) error {
+	err := c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetCounter(ctx, name, value)
+		},
+		series:      refOf(mondata.CounterType, name),
+		accumulates: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.recordCounter(ctx, name)
+	return nil
+}
+
+func (c *Current) SetCounterAll(ctx context.Context, counterMap mondata.CounterMap) error {
+	err := c.write(ctx, write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetCounterAll(ctx, counterMap)
+		},
+		series:      refsOf(mondata.CounterType, counterMap),
+		accumulates: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.recordCounterAll(ctx, counterMap)
+	return nil
+}
+
+func (c *Current) SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error {
+	w := write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetCounterTotal(ctx, name, total)
+		},
+		totals: mondata.CounterMap{name: total},
+		series: refOf(mondata.CounterType, name),
+	}
+	if err := c.write(ctx, w); err != nil {
+		return err
+	}
+
+	c.recordCounter(ctx, name)
+	return nil
+}
+
+func (c *Current) SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error {
+	w := write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.SetCounterTotalAll(ctx, totals)
+		},
+		totals: totals,
+		series: refsOf(mondata.CounterType, totals),
+	}
+	if err := c.write(ctx, w); err != nil {
+		return err
+	}
+
+	c.recordCounterAll(ctx, totals)
+	return nil
+}
+
+func (c *Current) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	series := refsOf(mondata.GaugeType, gauges.Values)
+	series = append(series, refsOf(mondata.CounterType, counters.Deltas)...)
+	series = append(series, refsOf(mondata.CounterType, counters.Totals)...)
+	series = append(series, refsOf(mondata.HistogramType, histograms)...)
+
+	w := write{
+		apply: func(ctx context.Context, r MetricsRepo) error {
+			return r.ApplyBatch(ctx, gauges, counters, histograms)
+		},
+		totals:      counters.Totals,
+		series:      series,
+		accumulates: len(counters.Deltas) > 0 || len(histograms) > 0,
+	}
+	if err := c.write(ctx, w); err != nil {
+		return err
+	}
+
+	if c.history == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for k, v := range gauges.Values {
+		c.history.Add(mondata.GaugeType, k, now, v)
+	}
+
+	updated := make(mondata.CounterMap, len(counters.Deltas)+len(counters.Totals))
+	for k, v := range counters.Deltas {
+		updated[k] = v
+	}
+	for k, v := range counters.Totals {
+		updated[k] = v
+	}
+	c.recordCounterAll(ctx, updated)
+	return nil
+}
+
+// Backend which keeps history of series by itself
+type historyRepo interface {
+	GetHistory(
+		ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+	) ([]mondata.Sample, bool, error)
+}
+
+// Returns history of gauge or counter series within [from, to],
+// if step is set only the last sample of every step is returned.
+//
+// History is read from backend if it keeps one, otherwise from bounded in-memory history.
+func (c *Current) GetHistory(
+	ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+) ([]mondata.Sample, bool, error) {
+	if mtype != mondata.GaugeType && mtype != mondata.CounterType {
+		return nil, false, fmt.Errorf("history isn't kept for %s metrics", mtype)
+	}
+
+	if hr, ok := primaryOf(c.MetricsRepo).(historyRepo); ok {
+		return hr.GetHistory(ctx, mtype, name, from, to, step)
+	}
+
+	if c.history == nil {
+		return nil, false, nil
+	}
+
+	samples, ok := c.history.Range(mtype, name, from, to, step)
+	return samples, ok, nil
+}
+
+// interval of rolling raw samples up
+const rollupInterval = time.Minute
+
+// Backend which rolls samples up by itself
+type rollupRepo interface {
+	Rollup(ctx context.Context) error
+}
+
+// Periodically rolls raw samples up into aggregates of mondata.RollupResolutions
+func (c *Current) ScheduleRollup(ctx context.Context) error {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// storages of mirror could keep samples both by themselves and in memory
+			if rr, ok := c.MetricsRepo.(rollupRepo); ok {
+				if err := rr.Rollup(ctx); err != nil {
+					c.logger.Errorln("rolling samples up failed with error:", err)
+				}
+			}
+			if c.history != nil {
+				c.history.Rollup()
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// ring keeps the latest items, the oldest one is overwritten when it's full
+type ring[T any] struct {
+	buf   []T
+	start int
+	n     int
+}
+
+func newRing[T any](capacity int) *ring[T] {
+	return &ring[T]{buf: make([]T, capacity)}
+}
+
+func (r *ring[T]) push(v T) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = v
+		r.n++
+		return
+	}
+
+	r.buf[r.start] = v
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+func (r *ring[T]) at(i int) T {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+func (r *ring[T]) setLast(v T) {
+	r.buf[(r.start+r.n-1)%len(r.buf)] = v
+}
+
+// point is an aggregate of samples within a bucket of rollup resolution
+type point struct {
+	T     time.Time // start of the bucket
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int64
+	Last  float64
+	Inc   float64 // increase of accumulated counter value
+}
+
+func (p *point) merge(o point) {
+	if p.Count == 0 {
+		*p = o
+		return
+	}
+
+	p.Min = min(p.Min, o.Min)
+	p.Max = max(p.Max, o.Max)
+	p.Sum += o.Sum
+	p.Count += o.Count
+	p.Last = o.Last
+	p.Inc += o.Inc
+}
+
+type series struct {
+	raw *ring[mondata.Sample]
+	// rollups by mondata.RollupResolutions
+	levels []*ring[point]
+	// time of the last raw sample rolled up, later ones are read raw
+	rolled time.Time
+}
+
+// Store is a bounded in-memory history of series values
+type Store struct {
+	mu       sync.RWMutex
+	capacity int
+	series   map[string]*series
+}
+
+func New(capacity uint) *Store {
+	return &Store{
+		capacity: int(capacity),
+		series:   make(map[string]*series),
+	}
+}
+
+func seriesID(mtype string, key string) string {
+	return mtype + ":" + key
+}
+
+func (s *Store) Add(mtype string, key string, t time.Time, v float64) {
+	if s.capacity == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := seriesID(mtype, key)
+	sr, ok := s.series[id]
+	if !ok {
+		sr = &series{raw: newRing[mondata.Sample](s.capacity)}
+		for range mondata.RollupResolutions {
+			sr.levels = append(sr.levels, newRing[point](s.capacity))
+		}
+		s.series[id] = sr
+	}
+
+	// samples are expected in order, late ones would break the search by time
+	if sr.raw.n > 0 && t.Before(sr.raw.at(sr.raw.n-1).T) {
+		return
+	}
+	sr.raw.push(mondata.Sample{T: t, V: v})
+}
+
+func (s *Store) Delete(mtype string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.series, seriesID(mtype, key))
+}
+
+// Returns points of raw samples, increase of the first stored one is unknown
+func (sr *series) rawPoints(from time.Time) []point {
+	lo := sort.Search(sr.raw.n, func(i int) bool { return !sr.raw.at(i).T.Before(from) })
+
+	pp := make([]point, 0, sr.raw.n-lo)
+	for i := lo; i < sr.raw.n; i++ {
+		smp := sr.raw.at(i)
+		p := point{T: smp.T, Min: smp.V, Max: smp.V, Sum: smp.V, Count: 1, Last: smp.V}
+		if i > 0 {
+			p.Inc = mondata.Increase(sr.raw.at(i-1).V, smp.V)
+		}
+		pp = append(pp, p)
+	}
+
+	return pp
+}
+
+func (sr *series) levelPoints(lvl int, from time.Time) []point {
+	r := sr.levels[lvl]
+	lo := sort.Search(r.n, func(i int) bool { return !r.at(i).T.Before(from) })
+
+	pp := make([]point, 0, r.n-lo)
+	for i := lo; i < r.n; i++ {
+		pp = append(pp, r.at(i))
+	}
+
+	return pp
+}
+
+// Aggregates points of the previous level into buckets of the level,
+// the last bucket could be incomplete, so it's aggregated again on the next run
+func (sr *series) rollup(lvl int) {
+	dst := sr.levels[lvl]
+	res := mondata.RollupResolutions[lvl]
+
+	var from time.Time
+	if dst.n > 0 {
+		from = dst.at(dst.n - 1).T
+	}
+
+	var src []point
+	if lvl == 0 {
+		src = sr.rawPoints(from)
+	} else {
+		src = sr.levelPoints(lvl-1, from)
+	}
+
+	if lvl == 0 && len(src) > 0 {
+		sr.rolled = src[len(src)-1].T
+	}
+
+	for _, p := range src {
+		bucket := p.T.Truncate(res)
+		if dst.n > 0 {
+			last := dst.at(dst.n - 1)
+			if last.T.Equal(bucket) {
+				if !from.IsZero() && last.T.Equal(from) {
+					// incomplete bucket is aggregated from scratch
+					last = point{}
+					from = time.Time{}
+				}
+				last.merge(p)
+				last.T = bucket
+				dst.setLast(last)
+				continue
+			}
+		}
+
+		p.T = bucket
+		dst.push(p)
+		from = time.Time{}
+	}
+}
+
+// Rolls raw samples up into aggregates of mondata.RollupResolutions
+func (s *Store) Rollup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sr := range s.series {
+		for lvl := range sr.levels {
+			sr.rollup(lvl)
+		}
+	}
+}
+
+// Returns samples within [from, to], zero bounds are open.
+//
+// If step is set, only the last sample of every step starting from the first returned sample is kept,
+// samples are read from the coarsest rollup which resolution fits the step.
+func (s *Store) Range(mtype string, key string, from time.Time, to time.Time, step time.Duration) ([]mondata.Sample, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sr, ok := s.series[seriesID(mtype, key)]
+	if !ok {
+		return nil, false
+	}
+
+	lvl := mondata.RollupLevel(step)
+	var pp []point
+	if lvl < 0 {
+		pp = sr.rawPoints(from)
+	} else {
+		res := mondata.RollupResolutions[lvl]
+		pp = sr.levelPoints(lvl, from.Truncate(res))
+
+		// samples which weren't rolled up yet, the last bucket could be incomplete
+		rawFrom := from
+		if len(pp) > 0 && !sr.rolled.Before(from) {
+			rawFrom = sr.rolled.Add(time.Nanosecond)
+		}
+		pp = append(pp, sr.rawPoints(rawFrom)...)
+	}
+
+	samples := make([]mondata.Sample, 0, len(pp))
+	var stepEnd time.Time
+	for _, p := range pp {
+		if !to.IsZero() && p.T.After(to) {
+			break
+		}
+
+		smp := mondata.Sample{T: p.T, V: p.Last}
+		if step > 0 && len(samples) > 0 && smp.T.Before(stepEnd) {
+			samples[len(samples)-1] = smp
+			continue
+		}
+
+		if step > 0 {
+			if stepEnd.IsZero() {
+				stepEnd = smp.T
+			}
+			for !smp.T.Before(stepEnd) {
+				stepEnd = stepEnd.Add(step)
+			}
+		}
+		samples = append(samples, smp)
+	}
+
+	return samples, true
+}
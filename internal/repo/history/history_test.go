@@ -0,0 +1,151 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var base = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func at(offset time.Duration, v float64) mondata.Sample {
+	return mondata.Sample{T: base.Add(offset), V: v}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing[int](3)
+	for i := 1; i <= 5; i++ {
+		r.push(i)
+	}
+	require.Equal(t, 3, r.n)
+	assert.Equal(t, []int{3, 4, 5}, []int{r.at(0), r.at(1), r.at(2)})
+
+	r.setLast(6)
+	assert.Equal(t, 6, r.at(2))
+	assert.Equal(t, 3, r.at(0))
+}
+
+func TestStore_Range(t *testing.T) {
+	s := New(10)
+	for i := range 6 {
+		smp := at(time.Duration(i)*10*time.Second, float64(i))
+		s.Add(mondata.GaugeType, "Alloc", smp.T, smp.V)
+	}
+	// late samples are dropped
+	s.Add(mondata.GaugeType, "Alloc", base, 100)
+
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		step time.Duration
+		want []mondata.Sample
+	}{
+		{
+			name: "positive test #1 (open bounds)",
+			want: []mondata.Sample{at(0, 0), at(10*time.Second, 1), at(20*time.Second, 2), at(30*time.Second, 3), at(40*time.Second, 4), at(50*time.Second, 5)},
+		},
+		{
+			name: "positive test #2 (bounds are inclusive)",
+			from: base.Add(20 * time.Second),
+			to:   base.Add(40 * time.Second),
+			want: []mondata.Sample{at(20*time.Second, 2), at(30*time.Second, 3), at(40*time.Second, 4)},
+		},
+		{
+			name: "positive test #3 (the last sample of every step)",
+			step: 20 * time.Second,
+			want: []mondata.Sample{at(10*time.Second, 1), at(30*time.Second, 3), at(50*time.Second, 5)},
+		},
+		{
+			name: "positive test #4 (steps start from the first sample)",
+			from: base.Add(10 * time.Second),
+			step: 25 * time.Second,
+			want: []mondata.Sample{at(30*time.Second, 3), at(50*time.Second, 5)},
+		},
+		{
+			name: "positive test #5 (nothing within bounds)",
+			from: base.Add(time.Minute),
+			want: []mondata.Sample{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, ok := s.Range(mondata.GaugeType, "Alloc", tt.from, tt.to, tt.step)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, samples)
+		})
+	}
+
+	_, ok := s.Range(mondata.CounterType, "Alloc", time.Time{}, time.Time{}, 0)
+	assert.False(t, ok, "series are distinguished by type")
+}
+
+func TestStore_Wrap(t *testing.T) {
+	s := New(3)
+	for i := range 5 {
+		s.Add(mondata.GaugeType, "Alloc", base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	samples, ok := s.Range(mondata.GaugeType, "Alloc", time.Time{}, time.Time{}, 0)
+	require.True(t, ok)
+	assert.Equal(t, []mondata.Sample{at(2*time.Second, 2), at(3*time.Second, 3), at(4*time.Second, 4)}, samples)
+
+	s.Delete(mondata.GaugeType, "Alloc")
+	_, ok = s.Range(mondata.GaugeType, "Alloc", time.Time{}, time.Time{}, 0)
+	assert.False(t, ok)
+
+	disabled := New(0)
+	disabled.Add(mondata.GaugeType, "Alloc", base, 1)
+	_, ok = disabled.Range(mondata.GaugeType, "Alloc", time.Time{}, time.Time{}, 0)
+	assert.False(t, ok)
+}
+
+func TestStore_Rollup(t *testing.T) {
+	s := New(100)
+	for _, smp := range []mondata.Sample{
+		at(10*time.Second, 1), at(40*time.Second, 3), at(80*time.Second, 4), at(110*time.Second, 10),
+	} {
+		s.Add(mondata.CounterType, "PollCount", smp.T, smp.V)
+	}
+	s.Rollup()
+
+	sr := s.series[seriesID(mondata.CounterType, "PollCount")]
+	require.Equal(t, 2, sr.levels[0].n)
+	assert.Equal(t, point{T: base, Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3, Inc: 2}, sr.levels[0].at(0))
+	assert.Equal(t, point{T: base.Add(time.Minute), Min: 4, Max: 10, Sum: 14, Count: 2, Last: 10, Inc: 7}, sr.levels[0].at(1))
+
+	// the last bucket is incomplete, so it's aggregated again with samples added after the rollup
+	s.Add(mondata.CounterType, "PollCount", base.Add(115*time.Second), 12)
+	s.Rollup()
+	require.Equal(t, 2, sr.levels[0].n)
+	assert.Equal(t, point{T: base.Add(time.Minute), Min: 4, Max: 12, Sum: 26, Count: 3, Last: 12, Inc: 9}, sr.levels[0].at(1))
+	require.Equal(t, 1, sr.levels[1].n)
+	assert.Equal(t, point{T: base, Min: 1, Max: 12, Sum: 30, Count: 5, Last: 12, Inc: 11}, sr.levels[1].at(0))
+
+	// samples which weren't rolled up yet are read raw
+	s.Add(mondata.CounterType, "PollCount", base.Add(150*time.Second), 15)
+
+	samples, ok := s.Range(mondata.CounterType, "PollCount", time.Time{}, time.Time{}, time.Minute)
+	require.True(t, ok)
+	assert.Equal(t, []mondata.Sample{at(0, 3), at(time.Minute, 12), at(150*time.Second, 15)}, samples)
+
+	samples, ok = s.Range(mondata.CounterType, "PollCount", time.Time{}, time.Time{}, time.Hour)
+	require.True(t, ok)
+	assert.Equal(t, []mondata.Sample{at(150*time.Second, 15)}, samples)
+}
+
+func TestStore_RollupReset(t *testing.T) {
+	s := New(10)
+	for _, smp := range []mondata.Sample{at(0, 5), at(10*time.Second, 8), at(20*time.Second, 3), at(30*time.Second, 4)} {
+		s.Add(mondata.CounterType, "PollCount", smp.T, smp.V)
+	}
+	s.Rollup()
+
+	sr := s.series[seriesID(mondata.CounterType, "PollCount")]
+	require.Equal(t, 1, sr.levels[0].n)
+	// value which went down was reset, so all of it is an increase
+	assert.Equal(t, float64(3+3+1), sr.levels[0].at(0).Inc)
+}
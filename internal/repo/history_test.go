@@ -0,0 +1,47 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/history"
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCurrent_RecordCounters(t *testing.T) {
+	ctx := context.TODO()
+	backend := memory.InitEmpty()
+	require.NoError(t, backend.SetCounter(ctx, "Other", 1))
+	c := &Current{MetricsRepo: backend, history: history.New(10), logger: zap.NewNop().Sugar()}
+
+	require.NoError(t, c.SetCounterAll(ctx, mondata.CounterMap{"PollCount": 2}))
+	require.NoError(t, c.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{"Alloc": 1}},
+		mondata.CounterBatch{Deltas: mondata.CounterMap{"PollCount": 3}, Totals: mondata.CounterMap{"NumGC": 5}},
+		nil,
+	))
+
+	values := func(mtype string, name string) []float64 {
+		samples, ok, err := c.GetHistory(ctx, mtype, name, time.Time{}, time.Time{}, 0)
+		require.NoError(t, err)
+		if !ok {
+			return nil
+		}
+		vv := make([]float64, 0, len(samples))
+		for _, smp := range samples {
+			vv = append(vv, smp.V)
+		}
+		return vv
+	}
+
+	// accumulated values are recorded, not the written ones
+	assert.Equal(t, []float64{2, 5}, values(mondata.CounterType, "PollCount"))
+	assert.Equal(t, []float64{5}, values(mondata.CounterType, "NumGC"))
+	assert.Equal(t, []float64{1}, values(mondata.GaugeType, "Alloc"))
+	assert.Nil(t, values(mondata.CounterType, "Other"), "counters which weren't updated aren't recorded")
+}
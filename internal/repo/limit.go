@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// seriesLimit caps the number of distinct series, so an agent generating names can't exhaust storage.
+// Series are indexed in memory: the index is loaded from storage, it's updated by writes of the server
+// and by changes made by other instances, and it's reloaded after stale series are evicted
+type seriesLimit struct {
+	max    int
+	mu     sync.Mutex
+	series map[mondata.SeriesRef]struct{}
+	// changes made by other instances were missed, so the index must be reloaded
+	stale atomic.Bool
+}
+
+func refOf(mtype string, key string) []mondata.SeriesRef {
+	return []mondata.SeriesRef{{MType: mtype, Key: key}}
+}
+
+func refsOf[T any](mtype string, m map[string]T) []mondata.SeriesRef {
+	refs := make([]mondata.SeriesRef, 0, len(m))
+	for k := range m {
+		refs = append(refs, mondata.SeriesRef{MType: mtype, Key: k})
+	}
+
+	return refs
+}
+
+// Returns series stored by backend
+func loadSeries(ctx context.Context, r MetricsRepo) (map[mondata.SeriesRef]struct{}, error) {
+	snap, err := r.GetSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hm, err := r.GetHistogramAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[mondata.SeriesRef]struct{}, len(snap.Gauges)+len(snap.Counters)+len(hm))
+	for _, refs := range [][]mondata.SeriesRef{
+		refsOf(mondata.GaugeType, snap.Gauges),
+		refsOf(mondata.CounterType, snap.Counters),
+		refsOf(mondata.HistogramType, hm),
+	} {
+		for _, ref := range refs {
+			series[ref] = struct{}{}
+		}
+	}
+
+	return series, nil
+}
+
+// Indexes series which aren't indexed yet unless their number exceeds the limit,
+// none of them are indexed if it does. Indexed series are returned, so they can be released
+func (l *seriesLimit) admit(refs []mondata.SeriesRef) ([]mondata.SeriesRef, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var added []mondata.SeriesRef
+	for _, ref := range refs {
+		if _, ok := l.series[ref]; ok {
+			continue
+		}
+
+		if len(l.series) >= l.max {
+			for _, a := range added {
+				delete(l.series, a)
+			}
+			return nil, fmt.Errorf("%w: %d series are stored, %s %q is rejected", mondata.ErrSeriesLimit, l.max, ref.MType, ref.Key)
+		}
+		l.series[ref] = struct{}{}
+		added = append(added, ref)
+	}
+
+	return added, nil
+}
+
+// Removes series which weren't stored from the index
+func (l *seriesLimit) release(refs []mondata.SeriesRef) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, ref := range refs {
+		delete(l.series, ref)
+	}
+}
+
+// Indexes series changed by other instances of server, change without keys means any series could change
+func (l *seriesLimit) changed(c mondata.Change) {
+	if c.MType == mondata.MetaType {
+		return
+	}
+	if len(c.Keys) == 0 {
+		l.stale.Store(true)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, k := range c.Keys {
+		l.series[mondata.SeriesRef{MType: c.MType, Key: k}] = struct{}{}
+	}
+}
+
+// Caps the number of distinct series, writes of series beyond max fail with mondata.ErrSeriesLimit,
+// 0 disables the limit. Stored series are counted, so it must be called after values are restored
+func (c *Current) LimitSeries(ctx context.Context, max int) error {
+	if max == 0 {
+		return nil
+	}
+
+	series, err := loadSeries(ctx, primaryReader(c.reader()))
+	if err != nil {
+		return fmt.Errorf("loading series of storage failed: %w", err)
+	}
+	if len(series) >= max {
+		c.logger.Warnln("limit of series is already reached, new series are rejected, stored:", len(series), "limit:", max)
+	}
+
+	c.limit = &seriesLimit{max: max, series: series}
+	c.Subscribe(c.limit.changed)
+
+	return nil
+}
+
+// Reloads the index of series from storage, series indexed while storage is read are kept
+func (c *Current) resyncSeries(ctx context.Context) error {
+	l := c.limit
+	l.stale.Store(false)
+
+	l.mu.Lock()
+	before := maps.Clone(l.series)
+	l.mu.Unlock()
+
+	series, err := loadSeries(ctx, primaryReader(c.reader()))
+	if err != nil {
+		l.stale.Store(true)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ref := range before {
+		if _, ok := series[ref]; !ok {
+			delete(l.series, ref)
+		}
+	}
+	for ref := range series {
+		l.series[ref] = struct{}{}
+	}
+
+	return nil
+}
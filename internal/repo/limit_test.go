@@ -0,0 +1,48 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCurrent_LimitSeries(t *testing.T) {
+	ctx := context.TODO()
+
+	backend := memory.InitEmpty()
+	require.NoError(t, backend.SetGauge(ctx, "Alloc", 1))
+	c := &Current{MetricsRepo: backend, logger: zap.NewNop().Sugar()}
+	require.NoError(t, c.LimitSeries(ctx, 3))
+
+	require.NoError(t, c.SetGauge(ctx, "Alloc", 2))
+	require.NoError(t, c.SetCounter(ctx, "PollCount", 1))
+
+	// the batch exceeds the limit, so none of its series are stored
+	err := c.ApplyBatch(ctx, mondata.GaugeBatch{Values: mondata.GaugeMap{"HeapAlloc": 1, "Sys": 2}}, mondata.CounterBatch{}, nil)
+	require.ErrorIs(t, err, mondata.ErrSeriesLimit)
+	gm, err := c.GetGaugeAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 2}, gm)
+
+	// series of different types are different series
+	require.NoError(t, c.SetHistogram(ctx, "Alloc", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1}))
+	require.ErrorIs(t, c.SetGauge(ctx, "HeapAlloc", 1), mondata.ErrSeriesLimit)
+	require.NoError(t, c.SetCounterTotal(ctx, "PollCount", 5), "stored series are updated once the limit is reached")
+
+	// series created by other instances are counted as well
+	c.publish(mondata.Change{Origin: "other", MType: mondata.GaugeType, Keys: []string{"Remote"}})
+	_, err = backend.Evict(ctx, mondata.TTLPolicy{Prefixes: map[string]time.Duration{"Poll": time.Nanosecond}})
+	require.NoError(t, err)
+	require.ErrorIs(t, c.SetGauge(ctx, "HeapAlloc", 1), mondata.ErrSeriesLimit)
+
+	// series removed from storage are dropped once the index is reloaded
+	c.publish(mondata.Change{MType: mondata.GaugeType})
+	require.NoError(t, c.SetGauge(ctx, "HeapAlloc", 1))
+	require.ErrorIs(t, c.SetGauge(ctx, "Sys", 1), mondata.ErrSeriesLimit)
+}
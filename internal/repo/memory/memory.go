@@ -3,38 +3,63 @@ package memory
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"time"
 
 	"github.com/Allegathor/perfmon/internal/mondata"
 	"github.com/Allegathor/perfmon/internal/repo/safe"
 	"github.com/Allegathor/perfmon/internal/repo/transaction"
+	"github.com/Allegathor/perfmon/internal/repo/wal"
 	"go.uber.org/zap"
 )
 
+// number of lock stripes of gauges and counters
+const shards = 16
+
 type MemorySt struct {
-	Gauge   *safe.MRepo[mondata.GaugeVType]
-	Counter *safe.MRepo[mondata.CounterVType]
-	logger  *zap.SugaredLogger
+	Gauge     *safe.ShardedMRepo[mondata.GaugeVType]
+	Counter   *safe.ShardedMRepo[mondata.CounterVType]
+	Histogram *safe.HRepo
+	Meta      *safe.MetaRepo
+	logger    *zap.SugaredLogger
+	wal       *wal.Log // nil unless persistence is enabled by OpenWAL
+	walOpts   WALOptions
+	overflow  mondata.OverflowPolicy
 }
 
 func Init(ctx context.Context, logger *zap.SugaredLogger) (*MemorySt, error) {
 	return &MemorySt{
-		Gauge:   safe.NewMRepo[mondata.GaugeVType](),
-		Counter: safe.NewMRepo[mondata.CounterVType](),
-		logger:  logger,
+		Gauge:     safe.NewShardedMRepo[mondata.GaugeVType](shards),
+		Counter:   safe.NewShardedMRepo[mondata.CounterVType](shards),
+		Histogram: safe.NewHRepo(),
+		Meta:      safe.NewMetaRepo(),
+		logger:    logger,
 	}, nil
 }
 
 // for tests
 func InitEmpty() *MemorySt {
 	return &MemorySt{
-		Gauge:   safe.NewMRepo[mondata.GaugeVType](),
-		Counter: safe.NewMRepo[mondata.CounterVType](),
-		logger:  nil,
+		Gauge:     safe.NewShardedMRepo[mondata.GaugeVType](shards),
+		Counter:   safe.NewShardedMRepo[mondata.CounterVType](shards),
+		Histogram: safe.NewHRepo(),
+		Meta:      safe.NewMetaRepo(),
+		logger:    nil,
 	}
 }
 
 func (ms *MemorySt) Close() {
-	// TODO
+	if ms.wal == nil {
+		return
+	}
+
+	if err := ms.Snapshot(); err != nil && ms.logger != nil {
+		ms.logger.Errorln("writing snapshot failed with error:", err)
+	}
+	if err := ms.wal.Close(); err != nil && ms.logger != nil {
+		ms.logger.Errorln("closing write-ahead log failed with error:", err)
+	}
 }
 
 func (ms *MemorySt) log(args ...any) {
@@ -43,6 +68,99 @@ func (ms *MemorySt) log(args ...any) {
 	}
 }
 
+func (ms *MemorySt) warn(args ...any) {
+	if ms.logger != nil {
+		ms.logger.Warnln(args...)
+	}
+}
+
+// Updates batch shard by shard, so batches of different agents don't wait for each other.
+// Records of a batch are appended to write-ahead log at once, so shards of the batch are locked together if it's enabled
+func updateBatch[T mondata.VTypes](
+	ms *MemorySt, r *safe.ShardedMRepo[T], keys []string, fn func(tx transaction.TxExec[T], keys []string) error,
+) error {
+	if ms.wal == nil {
+		return r.UpdateSharded(keys, fn)
+	}
+
+	return r.UpdateKeys(keys, func(tx transaction.TxExec[T]) error {
+		return fn(tx, keys)
+	})
+}
+
+func keys[T any](m map[string]T) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+
+	return ks
+}
+
+// Sets policy of accumulating counters beyond the max value, it must be set before storage is used
+func (ms *MemorySt) SetOverflow(p mondata.OverflowPolicy) {
+	ms.overflow = p
+	ms.Counter.SetOverflow(p)
+}
+
+// Returns policy of accumulating counters beyond the max value
+func (ms *MemorySt) Overflow() mondata.OverflowPolicy {
+	return ms.overflow
+}
+
+// Changes series by fn and appends their resulting state to write-ahead log. If either fails,
+// the previous state of series is restored, so values in memory never differ from the log
+// and a retried write isn't accumulated twice
+func logSeries[T mondata.VTypes](
+	ms *MemorySt, tx transaction.TxExec[T], mtype string, keys []string, fn func() error,
+) error {
+	var prev []wal.Record
+	if ms.wal != nil || (mtype == mondata.CounterType && ms.overflow == mondata.OverflowReject) {
+		prev = stateRecords(tx, mtype, keys)
+	}
+
+	if err := fn(); err != nil {
+		restoreSeries(tx, prev)
+		return err
+	}
+	if err := ms.append(seriesRecords(tx, mtype, keys)...); err != nil {
+		restoreSeries(tx, prev)
+		return err
+	}
+	return nil
+}
+
+// Accumulates counters of a batch by fn, if the overflow policy rejects any of them
+// or the batch can't be logged, none of them are changed
+func (ms *MemorySt) updateCounters(
+	keys []string, fn func(tx transaction.TxExec[mondata.CounterVType], key string) error,
+) error {
+	if ms.overflow == mondata.OverflowReject {
+		// shards of the batch are locked together, so none of them are changed if any counter is rejected
+		return ms.Counter.UpdateKeys(keys, func(tx transaction.TxExec[mondata.CounterVType]) error {
+			return ms.accumCounters(tx, keys, fn)
+		})
+	}
+
+	return updateBatch(ms, ms.Counter, keys, func(tx transaction.TxExec[mondata.CounterVType], keys []string) error {
+		return ms.accumCounters(tx, keys, fn)
+	})
+}
+
+func (ms *MemorySt) accumCounters(
+	tx transaction.TxExec[mondata.CounterVType], keys []string,
+	fn func(tx transaction.TxExec[mondata.CounterVType], key string) error,
+) error {
+	return logSeries(ms, tx, mondata.CounterType, keys, func() error {
+		for _, k := range keys {
+			if err := fn(tx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // MARK: gauge metrics
 func (ms *MemorySt) GetGauge(ctx context.Context, name string) (mondata.GaugeVType, bool, error) {
 	var (
@@ -72,20 +190,32 @@ func (ms *MemorySt) GetGaugeAll(ctx context.Context) (mondata.GaugeMap, error) {
 }
 
 func (ms *MemorySt) SetGauge(ctx context.Context, name string, value mondata.GaugeVType) error {
-	ms.Gauge.Update(func(tx transaction.TxExec[mondata.GaugeVType]) error {
-		tx.Set(name, value)
-		return nil
+	err := ms.Gauge.UpdateKeys([]string{name}, func(tx transaction.TxExec[mondata.GaugeVType]) error {
+		return logSeries(ms, tx, mondata.GaugeType, []string{name}, func() error {
+			tx.Set(name, value)
+			return nil
+		})
 	})
+	if err != nil {
+		return err
+	}
 
 	ms.log("set gauge value in memstorage", "name:", name, "value:", value)
 	return nil
 }
 
 func (ms *MemorySt) SetGaugeAll(ctx context.Context, metrics mondata.GaugeMap) error {
-	ms.Gauge.Update(func(tx transaction.TxExec[mondata.GaugeVType]) error {
-		tx.SetAll(metrics)
-		return nil
+	err := updateBatch(ms, ms.Gauge, keys(metrics), func(tx transaction.TxExec[mondata.GaugeVType], keys []string) error {
+		return logSeries(ms, tx, mondata.GaugeType, keys, func() error {
+			for _, k := range keys {
+				tx.Set(k, metrics[k])
+			}
+			return nil
+		})
 	})
+	if err != nil {
+		return err
+	}
 
 	ms.log("set all gauge values in memstorage, values:", metrics)
 	return nil
@@ -119,25 +249,607 @@ func (ms *MemorySt) GetCounterAll(ctx context.Context) (mondata.CounterMap, erro
 }
 
 func (ms *MemorySt) SetCounter(ctx context.Context, name string, value mondata.CounterVType) error {
-	ms.Counter.Update(func(tx transaction.TxExec[mondata.CounterVType]) error {
-		tx.SetAccum(name, value)
-		return nil
+	err := ms.Counter.UpdateKeys([]string{name}, func(tx transaction.TxExec[mondata.CounterVType]) error {
+		return logSeries(ms, tx, mondata.CounterType, []string{name}, func() error {
+			return tx.SetAccum(name, value)
+		})
 	})
+	if err != nil {
+		return err
+	}
 
 	ms.log("set counter value in memstorage", "name:", name, "value:", value)
 	return nil
 }
 
 func (ms *MemorySt) SetCounterAll(ctx context.Context, values map[string]mondata.CounterVType) error {
-	ms.Counter.Update(func(tx transaction.TxExec[mondata.CounterVType]) error {
-		tx.SetAccumAll(values)
-		return nil
+	err := ms.updateCounters(keys(values), func(tx transaction.TxExec[mondata.CounterVType], k string) error {
+		return tx.SetAccum(k, values[k])
 	})
+	if err != nil {
+		return err
+	}
 
 	ms.log("set all counter values in memstorage", values)
 	return nil
 }
 
+// Accumulates increments of cumulative counter computed from its absolute value
+func (ms *MemorySt) SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error {
+	err := ms.Counter.UpdateKeys([]string{name}, func(tx transaction.TxExec[mondata.CounterVType]) error {
+		return logSeries(ms, tx, mondata.CounterType, []string{name}, func() error {
+			return tx.SetTotal(name, total)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	ms.log("set counter total in memstorage", "name:", name, "total:", total)
+	return nil
+}
+
+func (ms *MemorySt) SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error {
+	err := ms.updateCounters(keys(totals), func(tx transaction.TxExec[mondata.CounterVType], k string) error {
+		return tx.SetTotal(k, totals[k])
+	})
+	if err != nil {
+		return err
+	}
+
+	ms.log("set all counter totals in memstorage", totals)
+	return nil
+}
+
+// MARK: histogram metrics
+func (ms *MemorySt) GetHistogram(ctx context.Context, name string) (mondata.HistogramVType, bool, error) {
+	var (
+		v  mondata.HistogramVType
+		ok = false
+	)
+
+	ms.Histogram.Read(func(tx *safe.HRepoTx) error {
+		v, ok = tx.Get(name)
+		return nil
+	})
+
+	ms.log("read histogram value from memstorage", "name:", name, "ok:", ok, "value:", v)
+	return v, ok, nil
+}
+
+func (ms *MemorySt) GetHistogramAll(ctx context.Context) (mondata.HistogramMap, error) {
+	var m mondata.HistogramMap
+	ms.Histogram.Read(func(tx *safe.HRepoTx) error {
+		m = tx.GetAll()
+		return nil
+	})
+
+	ms.log("read all histogram values from memstorage, values", m)
+	return m, nil
+}
+
+// Merges histograms into stored ones, the resulting histograms are appended to write-ahead log before they're stored,
+// so none of them are changed if bounds of any of them don't match or the log can't be appended
+// Returns stored histograms merged with values and records of them, stored ones aren't changed
+func mergedHistograms(tx *safe.HRepoTx, values mondata.HistogramMap) (mondata.HistogramMap, []wal.Record, error) {
+	merged := make(mondata.HistogramMap, len(values))
+	recs := make([]wal.Record, 0, len(values))
+	for k, v := range values {
+		h, ok := tx.Get(k)
+		if !ok {
+			h = v.Clone()
+		} else if err := h.Merge(v); err != nil {
+			return nil, nil, err
+		}
+
+		merged[k] = h
+		recs = append(recs, wal.Record{Op: wal.OpSet, MType: mondata.HistogramType, Key: k, Histogram: &h})
+	}
+
+	return merged, recs, nil
+}
+
+func (ms *MemorySt) mergeHistograms(values mondata.HistogramMap) error {
+	return ms.Histogram.Update(func(tx *safe.HRepoTx) error {
+		merged, recs, err := mergedHistograms(tx, values)
+		if err != nil {
+			return err
+		}
+
+		if err := ms.append(recs...); err != nil {
+			return err
+		}
+		for k, h := range merged {
+			tx.Set(k, h)
+		}
+		return nil
+	})
+}
+
+func (ms *MemorySt) SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error {
+	err := ms.mergeHistograms(mondata.HistogramMap{name: value})
+	if err != nil {
+		return err
+	}
+
+	ms.log("set histogram value in memstorage", "name:", name, "value:", value)
+	return nil
+}
+
+func (ms *MemorySt) SetHistogramAll(ctx context.Context, values mondata.HistogramMap) error {
+	err := ms.mergeHistograms(values)
+	if err != nil {
+		return err
+	}
+
+	ms.log("set all histogram values in memstorage", values)
+	return nil
+}
+
+// MARK: timestamps
+func getStamp[T mondata.VTypes](r *safe.ShardedMRepo[T], name string) (mondata.Stamp, bool) {
+	var (
+		st mondata.Stamp
+		ok = false
+	)
+
+	r.Read(func(tx transaction.TxQry[T]) error {
+		st, ok = tx.Stamp(name)
+		return nil
+	})
+
+	return st, ok
+}
+
+func getStampAll[T mondata.VTypes](r *safe.ShardedMRepo[T]) mondata.StampMap {
+	var m mondata.StampMap
+
+	r.Read(func(tx transaction.TxQry[T]) error {
+		m = tx.StampAll()
+		return nil
+	})
+
+	return m
+}
+
+func setSampled[T mondata.VTypes](ms *MemorySt, r *safe.ShardedMRepo[T], mtype string, sampled map[string]time.Time) error {
+	return updateBatch(ms, r, keys(sampled), func(tx transaction.TxExec[T], keys []string) error {
+		return logSeries(ms, tx, mtype, keys, func() error {
+			for _, k := range keys {
+				tx.SetSampled(k, sampled[k])
+			}
+			return nil
+		})
+	})
+}
+
+// Returns timestamps of gauge or counter value
+func (ms *MemorySt) GetStamp(ctx context.Context, mtype string, name string) (mondata.Stamp, bool, error) {
+	switch mtype {
+	case mondata.GaugeType:
+		st, ok := getStamp(ms.Gauge, name)
+		return st, ok, nil
+	case mondata.CounterType:
+		st, ok := getStamp(ms.Counter, name)
+		return st, ok, nil
+	default:
+		return mondata.Stamp{}, false, nil
+	}
+}
+
+func (ms *MemorySt) GetStampAll(ctx context.Context, mtype string) (mondata.StampMap, error) {
+	switch mtype {
+	case mondata.GaugeType:
+		return getStampAll(ms.Gauge), nil
+	case mondata.CounterType:
+		return getStampAll(ms.Counter), nil
+	default:
+		return mondata.StampMap{}, nil
+	}
+}
+
+// Sets time when values were sampled by agent
+func (ms *MemorySt) SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error {
+	var err error
+	switch mtype {
+	case mondata.GaugeType:
+		err = setSampled(ms, ms.Gauge, mtype, sampled)
+	case mondata.CounterType:
+		err = setSampled(ms, ms.Counter, mtype, sampled)
+	default:
+		return fmt.Errorf("timestamps aren't tracked for %s metrics", mtype)
+	}
+	if err != nil {
+		return err
+	}
+
+	ms.log("set sample time in memstorage", "type:", mtype, "values:", sampled)
+	return nil
+}
+
+// MARK: snapshot
+// Reads gauges and counters while both of them are locked, so they can't be changed in between.
+// Besides GetSnapshot, it's used by the WAL writer, so snapshots which the log is compacted into are consistent
+func (ms *MemorySt) readSeries(fn func(g transaction.TxQry[mondata.GaugeVType], c transaction.TxQry[mondata.CounterVType])) {
+	ms.Gauge.Read(func(g transaction.TxQry[mondata.GaugeVType]) error {
+		return ms.Counter.Read(func(c transaction.TxQry[mondata.CounterVType]) error {
+			fn(g, c)
+			return nil
+		})
+	})
+}
+
+func (ms *MemorySt) GetSnapshot(ctx context.Context) (mondata.Snapshot, error) {
+	var snap mondata.Snapshot
+	ms.readSeries(func(g transaction.TxQry[mondata.GaugeVType], c transaction.TxQry[mondata.CounterVType]) {
+		snap = mondata.Snapshot{
+			Gauges:        g.GetAll(),
+			Counters:      c.GetAll(),
+			GaugeStamps:   g.StampAll(),
+			CounterStamps: c.StampAll(),
+		}
+	})
+
+	ms.log("read snapshot from memstorage, gauges:", snap.Gauges, "counters:", snap.Counters)
+	return snap, nil
+}
+
+func loadSeries[T mondata.VTypes](r *safe.ShardedMRepo[T], vals map[string]T, stamps mondata.StampMap) {
+	r.Update(func(tx transaction.TxExec[T]) error {
+		for k := range tx.StampAll() {
+			if _, ok := vals[k]; !ok {
+				tx.Delete(k)
+			}
+		}
+
+		for k, v := range vals {
+			tx.Set(k, v)
+			if st, ok := stamps[k]; ok {
+				tx.SetStamp(k, st)
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the number of stored series of all types
+func (ms *MemorySt) Len() int {
+	return ms.Gauge.Len() + ms.Counter.Len() + ms.Histogram.Len()
+}
+
+// Replaces stored values by state of another storage, e.g. the last known state of remote DB.
+// Last totals of counters which are still stored are kept, so increments of next totals are computed from them
+func (ms *MemorySt) Load(snap mondata.Snapshot, histograms mondata.HistogramMap, meta mondata.MetaMap) {
+	loadSeries(ms.Gauge, snap.Gauges, snap.GaugeStamps)
+	loadSeries(ms.Counter, snap.Counters, snap.CounterStamps)
+
+	ms.Histogram.Update(func(tx *safe.HRepoTx) error {
+		for k, v := range histograms {
+			tx.Set(k, v)
+		}
+		return nil
+	})
+	ms.Meta.SetAll(meta)
+}
+
+func loadKeys[T mondata.VTypes](r *safe.ShardedMRepo[T], keys []string, vals map[string]T, stamps mondata.StampMap) {
+	r.UpdateKeys(keys, func(tx transaction.TxExec[T]) error {
+		for _, k := range keys {
+			v, ok := vals[k]
+			if !ok {
+				tx.Delete(k)
+				continue
+			}
+
+			tx.Set(k, v)
+			if st, ok := stamps[k]; ok {
+				tx.SetStamp(k, st)
+			}
+		}
+		return nil
+	})
+}
+
+// Replaces stored values of keys of type mtype by state of another storage, keys missing in it are removed.
+// Last totals of counters which are still stored are kept as by Load
+func (ms *MemorySt) LoadKeys(mtype string, keys []string, st mondata.State) {
+	switch mtype {
+	case mondata.GaugeType:
+		loadKeys(ms.Gauge, keys, st.Gauges, st.GaugeStamps)
+	case mondata.CounterType:
+		loadKeys(ms.Counter, keys, st.Counters, st.CounterStamps)
+	case mondata.HistogramType:
+		ms.Histogram.Update(func(tx *safe.HRepoTx) error {
+			for _, k := range keys {
+				if h, ok := st.Histograms[k]; ok {
+					tx.Set(k, h)
+				} else {
+					tx.Delete(k)
+				}
+			}
+			return nil
+		})
+	case mondata.MetaType:
+		ms.Meta.Update(func(m map[string]mondata.Meta) error {
+			for _, k := range keys {
+				if v, ok := st.Meta[k]; ok {
+					m[k] = v
+				} else {
+					delete(m, k)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// Sets last totals of counters without accumulating increments, e.g. totals stored by another storage
+func (ms *MemorySt) SetLastTotals(totals mondata.CounterMap) {
+	ms.Counter.UpdateKeys(keys(totals), func(tx transaction.TxExec[mondata.CounterVType]) error {
+		for k, v := range totals {
+			tx.SetLastTotal(k, v)
+		}
+		return nil
+	})
+}
+
+// Sets last totals only of counters which have no last total yet, so increments of them aren't accumulated
+func (ms *MemorySt) SeedTotals(totals mondata.CounterMap) {
+	ms.Counter.UpdateKeys(keys(totals), func(tx transaction.TxExec[mondata.CounterVType]) error {
+		for k, v := range totals {
+			if _, ok := tx.Total(k); !ok {
+				tx.SetLastTotal(k, v)
+			}
+		}
+		return nil
+	})
+}
+
+// Replaces stored series by values, timestamps and last totals of another storage
+func replaceSeries[T mondata.VTypes](r *safe.ShardedMRepo[T], vals map[string]T, stamps mondata.StampMap, totals map[string]T) {
+	r.Update(func(tx transaction.TxExec[T]) error {
+		for k := range tx.StampAll() {
+			tx.Delete(k)
+		}
+
+		for k, v := range vals {
+			tx.Set(k, v)
+			if st, ok := stamps[k]; ok {
+				tx.SetStamp(k, st)
+			}
+			if t, ok := totals[k]; ok {
+				tx.SetLastTotal(k, t)
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the whole stored state, see LoadState
+func (ms *MemorySt) GetState(ctx context.Context) (mondata.State, error) {
+	st := mondata.State{Totals: make(mondata.CounterMap)}
+	ms.readSeries(func(g transaction.TxQry[mondata.GaugeVType], c transaction.TxQry[mondata.CounterVType]) {
+		st.Snapshot = mondata.Snapshot{
+			Gauges:        g.GetAll(),
+			Counters:      c.GetAll(),
+			GaugeStamps:   g.StampAll(),
+			CounterStamps: c.StampAll(),
+		}
+		for k := range st.Counters {
+			if t, ok := c.Total(k); ok {
+				st.Totals[k] = t
+			}
+		}
+	})
+
+	ms.Histogram.Read(func(tx *safe.HRepoTx) error {
+		st.Histograms = tx.GetAll()
+		return nil
+	})
+	st.Meta = ms.Meta.GetAll()
+
+	return st, nil
+}
+
+// Replaces the whole stored state by state of another storage, e.g. when storage mirrors it.
+// The state is written to snapshot of write-ahead log at once, so it isn't appended record by record
+func (ms *MemorySt) LoadState(ctx context.Context, st mondata.State) error {
+	replaceSeries(ms.Gauge, st.Gauges, st.GaugeStamps, nil)
+	replaceSeries(ms.Counter, st.Counters, st.CounterStamps, st.Totals)
+
+	ms.Histogram.Update(func(tx *safe.HRepoTx) error {
+		for k := range tx.GetAll() {
+			tx.Delete(k)
+		}
+		for k, v := range st.Histograms {
+			tx.Set(k, v)
+		}
+		return nil
+	})
+	ms.Meta.Update(func(m map[string]mondata.Meta) error {
+		clear(m)
+		maps.Copy(m, st.Meta)
+		return nil
+	})
+
+	ms.log("loaded state into memstorage, gauges:", len(st.Gauges), "counters:", len(st.Counters),
+		"histograms:", len(st.Histograms))
+	return ms.Snapshot()
+}
+
+// MARK: batch
+// Returns keys of all maps without duplicates
+func unionKeys(kss ...[]string) []string {
+	seen := make(map[string]struct{})
+	ks := make([]string, 0)
+	for _, keys := range kss {
+		for _, k := range keys {
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				ks = append(ks, k)
+			}
+		}
+	}
+
+	return ks
+}
+
+// Applies gauges, counters and histograms of a report while shards of all of them are locked.
+// Records of the report are appended to write-ahead log at once, if it fails, the overflow policy rejects
+// any of counters or bounds of any histogram don't match, the previous state of series is restored
+func (ms *MemorySt) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	gkeys := unionKeys(keys(gauges.Values), keys(gauges.Sampled))
+	ckeys := unionKeys(keys(counters.Deltas), keys(counters.Totals), keys(counters.Sampled))
+
+	// gauges are locked before counters as by readSeries, histograms are never locked along with them elsewhere
+	err := ms.Gauge.UpdateKeys(gkeys, func(g transaction.TxExec[mondata.GaugeVType]) error {
+		return ms.Counter.UpdateKeys(ckeys, func(c transaction.TxExec[mondata.CounterVType]) error {
+			return ms.Histogram.Update(func(h *safe.HRepoTx) error {
+				// histograms are merged aside, so they're set only once the batch is logged
+				merged, hrecs, err := mergedHistograms(h, histograms)
+				if err != nil {
+					return err
+				}
+
+				var gprev, cprev []wal.Record
+				if ms.wal != nil || ms.overflow == mondata.OverflowReject {
+					gprev = stateRecords(g, mondata.GaugeType, gkeys)
+					cprev = stateRecords(c, mondata.CounterType, ckeys)
+				}
+				restore := func(err error) error {
+					restoreSeries(g, gprev)
+					restoreSeries(c, cprev)
+					return err
+				}
+
+				for k, v := range gauges.Values {
+					g.Set(k, v)
+				}
+				for k, t := range gauges.Sampled {
+					g.SetSampled(k, t)
+				}
+				for k, v := range counters.Deltas {
+					if err := c.SetAccum(k, v); err != nil {
+						return restore(err)
+					}
+				}
+				for k, v := range counters.Totals {
+					if err := c.SetTotal(k, v); err != nil {
+						return restore(err)
+					}
+				}
+				for k, t := range counters.Sampled {
+					c.SetSampled(k, t)
+				}
+
+				recs := seriesRecords(g, mondata.GaugeType, gkeys)
+				recs = append(recs, seriesRecords(c, mondata.CounterType, ckeys)...)
+				recs = append(recs, hrecs...)
+				if err := ms.append(recs...); err != nil {
+					return restore(err)
+				}
+
+				for k, v := range merged {
+					h.Set(k, v)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	ms.log("applied batch in memstorage, gauges:", gauges.Values, "counters:", counters.Deltas, "totals:", counters.Totals,
+		"histograms:", histograms)
+	return nil
+}
+
+// MARK: eviction
+func evict[T mondata.VTypes](
+	ms *MemorySt, r *safe.ShardedMRepo[T], mtype string, policy mondata.TTLPolicy, now time.Time,
+) ([]mondata.SeriesRef, error) {
+	evicted := make([]mondata.SeriesRef, 0)
+
+	err := r.Update(func(tx transaction.TxExec[T]) error {
+		recs := make([]wal.Record, 0)
+		for k, st := range tx.StampAll() {
+			name, _, err := mondata.ParseSeriesKey(k)
+			if err != nil {
+				continue
+			}
+
+			if policy.Expired(name, st.Received, now) {
+				recs = append(recs, wal.Record{Op: wal.OpDelete, MType: mtype, Key: k})
+			}
+		}
+
+		// series are deleted only once the deletion is logged, so they aren't lost from the log on failure
+		if err := ms.append(recs...); err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			tx.Delete(rec.Key)
+			evicted = append(evicted, mondata.SeriesRef{MType: mtype, Key: rec.Key})
+		}
+		return nil
+	})
+
+	return evicted, err
+}
+
+// Removes gauges and counters which weren't updated within TTL
+func (ms *MemorySt) Evict(ctx context.Context, policy mondata.TTLPolicy) ([]mondata.SeriesRef, error) {
+	now := time.Now()
+	gauges, err := evict(ms, ms.Gauge, mondata.GaugeType, policy, now)
+	if err != nil {
+		return gauges, err
+	}
+	counters, err := evict(ms, ms.Counter, mondata.CounterType, policy, now)
+
+	return append(gauges, counters...), err
+}
+
+// MARK: metadata
+func (ms *MemorySt) GetMeta(ctx context.Context, name string) (mondata.Meta, bool, error) {
+	v, ok := ms.Meta.Get(name)
+
+	ms.log("read metadata from memstorage", "name:", name, "ok:", ok, "value:", v)
+	return v, ok, nil
+}
+
+func (ms *MemorySt) GetMetaAll(ctx context.Context) (mondata.MetaMap, error) {
+	m := ms.Meta.GetAll()
+
+	ms.log("read all metadata from memstorage, values", m)
+	return m, nil
+}
+
+func (ms *MemorySt) SetMetaAll(ctx context.Context, values mondata.MetaMap) error {
+	err := ms.Meta.Update(func(m map[string]mondata.Meta) error {
+		recs := make([]wal.Record, 0, len(values))
+		for k, v := range values {
+			recs = append(recs, wal.Record{Op: wal.OpSet, MType: wal.MetaType, Key: k, Meta: &v})
+		}
+		if err := ms.append(recs...); err != nil {
+			return err
+		}
+
+		for k, v := range values {
+			m[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ms.log("set metadata in memstorage", values)
+	return nil
+}
+
 func (ms *MemorySt) Ping(ctx context.Context) error {
 	return errors.New("there is no connection to remote db, in-memory storage is used")
 }
@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySt_WAL(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+
+	ms := InitEmpty()
+	require.NoError(t, ms.OpenWAL(WALOptions{Dir: dir}))
+	require.NoError(t, ms.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, ms.SetCounter(ctx, "PollCount", 2))
+	require.NoError(t, ms.SetHistogram(ctx, "Latency", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1}))
+	require.NoError(t, ms.SetMetaAll(ctx, mondata.MetaMap{"Alloc": {Name: "Alloc", Unit: mondata.UnitBytes}}))
+	ms.Close()
+
+	restored := InitEmpty()
+	require.NoError(t, restored.OpenWAL(WALOptions{Dir: dir, Restore: true}))
+	defer restored.Close()
+
+	snap, err := restored.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 1}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"PollCount": 2}, snap.Counters)
+	h, ok, err := restored.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(1), h.Count)
+}
+
+// values which weren't appended to write-ahead log mustn't be kept
+func TestMemorySt_RollbackFailedAppend(t *testing.T) {
+	ctx := context.TODO()
+	hist := mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1}
+
+	for _, overflow := range []mondata.OverflowPolicy{mondata.OverflowWrap, mondata.OverflowReject} {
+		ms := InitEmpty()
+		ms.SetOverflow(overflow)
+		require.NoError(t, ms.OpenWAL(WALOptions{Dir: t.TempDir()}))
+		require.NoError(t, ms.SetGauge(ctx, "Alloc", 1))
+		require.NoError(t, ms.SetCounter(ctx, "PollCount", 2))
+		require.NoError(t, ms.SetCounterTotal(ctx, "Requests", 10))
+		require.NoError(t, ms.SetHistogram(ctx, "Latency", hist))
+		ms.Close()
+
+		assert.Error(t, ms.SetGauge(ctx, "Alloc", 2))
+		assert.Error(t, ms.SetGaugeAll(ctx, mondata.GaugeMap{"Alloc": 3, "Sys": 1}))
+		assert.Error(t, ms.SetCounter(ctx, "PollCount", 1))
+		assert.Error(t, ms.SetCounterTotal(ctx, "Requests", 15))
+		assert.Error(t, ms.SetHistogram(ctx, "Latency", hist))
+		assert.Error(t, ms.ApplyBatch(ctx, mondata.GaugeBatch{Values: mondata.GaugeMap{"Alloc": 4}}, mondata.CounterBatch{Deltas: mondata.CounterMap{"PollCount": 1}, Totals: mondata.CounterMap{"Requests": 20}}, mondata.HistogramMap{"Latency": hist}))
+		evicted, err := ms.Evict(ctx, mondata.TTLPolicy{Default: time.Nanosecond})
+		assert.Error(t, err)
+		assert.Empty(t, evicted)
+
+		snap, err := ms.GetSnapshot(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, mondata.GaugeMap{"Alloc": 1}, snap.Gauges)
+		assert.Equal(t, mondata.CounterMap{"PollCount": 2, "Requests": 10}, snap.Counters)
+		h, _, err := ms.GetHistogram(ctx, "Latency")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), h.Count)
+
+		// totals are rolled back as well, so the next total is accumulated from the stored one
+		ms.wal = nil
+		require.NoError(t, ms.SetCounterTotal(ctx, "Requests", 15))
+		c, _, err := ms.GetCounter(ctx, "Requests")
+		require.NoError(t, err)
+		assert.Equal(t, mondata.CounterVType(15), c)
+	}
+}
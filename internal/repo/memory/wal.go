@@ -0,0 +1,320 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/safe"
+	"github.com/Allegathor/perfmon/internal/repo/transaction"
+	"github.com/Allegathor/perfmon/internal/repo/wal"
+	"go.uber.org/zap"
+)
+
+// WALOptions configures persistence of in-memory storage
+type WALOptions struct {
+	Dir string
+	// interval of compacting write-ahead log into snapshot, zero compacts it only on shutdown
+	SnapshotInterval time.Duration
+	// replays snapshot and write-ahead log on startup, otherwise they are discarded
+	Restore bool
+	// syncs every write to disk, otherwise writes survive crash of the process, but not crash of OS
+	Sync bool
+}
+
+// Parses options from DSN in the next format: memory://?dir=./data&snapshot_interval=5m&restore=true&sync=false,
+// values are persisted only if dir is set
+func ParseWALOptions(dsn *url.URL) (WALOptions, error) {
+	var opts WALOptions
+	for k, vv := range dsn.Query() {
+		v := vv[len(vv)-1]
+		var err error
+		switch k {
+		case "dir":
+			opts.Dir = v
+		case "snapshot_interval":
+			opts.SnapshotInterval, err = time.ParseDuration(v)
+		case "restore":
+			opts.Restore, err = strconv.ParseBool(v)
+		case "sync":
+			opts.Sync, err = strconv.ParseBool(v)
+		default:
+			return opts, fmt.Errorf("unknown option %q of in-memory storage, expected one of: dir, snapshot_interval, restore, sync, counter_overflow", k)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("invalid option %q of in-memory storage: %w", k, err)
+		}
+	}
+
+	return opts, nil
+}
+
+// Initializes in-memory storage with options parsed from DSN, see ParseWALOptions,
+// counter_overflow option is policy of accumulating counters beyond the max value, see mondata.OverflowPolicy
+func Open(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (*MemorySt, error) {
+	overflow, err := mondata.TakeOverflowPolicy(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := ParseWALOptions(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := Init(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+	ms.walOpts = opts
+	ms.SetOverflow(overflow)
+
+	return ms, nil
+}
+
+// Appends records to write-ahead log if it's enabled,
+// it's called under the lock of updated repo, so records of a series are kept in order of writes
+func (ms *MemorySt) append(recs ...wal.Record) error {
+	if ms.wal == nil {
+		return nil
+	}
+
+	return ms.wal.Append(recs...)
+}
+
+type txSeries[T mondata.VTypes] interface {
+	Get(name string) (T, bool)
+	Stamp(name string) (mondata.Stamp, bool)
+	Total(name string) (T, bool)
+}
+
+// Returns record of the stored state of gauge or counter
+func seriesRecord[T mondata.VTypes](tx txSeries[T], mtype string, key string) wal.Record {
+	r := wal.Record{Op: wal.OpSet, MType: mtype, Key: key}
+
+	v, _ := tx.Get(key)
+	switch v := any(v).(type) {
+	case mondata.GaugeVType:
+		r.Gauge = &v
+	case mondata.CounterVType:
+		r.Counter = &v
+	}
+
+	if total, ok := tx.Total(key); ok {
+		t := uint64(total)
+		r.Total = &t
+	}
+
+	if st, ok := tx.Stamp(key); ok {
+		r.Stamp = &st
+	}
+
+	return r
+}
+
+func seriesRecords[T mondata.VTypes](tx txSeries[T], mtype string, keys []string) []wal.Record {
+	recs := make([]wal.Record, 0, len(keys))
+	for _, k := range keys {
+		recs = append(recs, seriesRecord(tx, mtype, k))
+	}
+
+	return recs
+}
+
+func histogramRecord(tx *safe.HRepoTx, key string) wal.Record {
+	h, _ := tx.Get(key)
+	return wal.Record{Op: wal.OpSet, MType: mondata.HistogramType, Key: key, Histogram: &h}
+}
+
+// Sets value, total and timestamps of series from record
+func setSeries[T mondata.VTypes](tx transaction.TxExec[T], rec wal.Record, v *T) error {
+	if rec.Op == wal.OpDelete {
+		tx.Delete(rec.Key)
+		return nil
+	}
+
+	if v == nil {
+		return fmt.Errorf("record of %s %q has no value", rec.MType, rec.Key)
+	}
+	tx.Set(rec.Key, *v)
+	if rec.Total != nil {
+		tx.SetLastTotal(rec.Key, T(*rec.Total))
+	}
+	if rec.Stamp != nil {
+		tx.SetStamp(rec.Key, *rec.Stamp)
+	}
+	return nil
+}
+
+func applySeries[T mondata.VTypes](r *safe.ShardedMRepo[T], rec wal.Record, v *T) error {
+	return r.UpdateKeys([]string{rec.Key}, func(tx transaction.TxExec[T]) error {
+		return setSeries(tx, rec, v)
+	})
+}
+
+// Returns records of the current state of series, series which don't exist are recorded as deleted
+func stateRecords[T mondata.VTypes](tx txSeries[T], mtype string, keys []string) []wal.Record {
+	recs := make([]wal.Record, 0, len(keys))
+	for _, k := range keys {
+		if _, ok := tx.Get(k); !ok {
+			recs = append(recs, wal.Record{Op: wal.OpDelete, MType: mtype, Key: k})
+			continue
+		}
+		recs = append(recs, seriesRecord(tx, mtype, k))
+	}
+
+	return recs
+}
+
+// Returns value of series of type T kept in record
+func recordValue[T mondata.VTypes](rec wal.Record) *T {
+	var v any
+	switch any(*new(T)).(type) {
+	case mondata.GaugeVType:
+		v = rec.Gauge
+	case mondata.CounterVType:
+		v = rec.Counter
+	}
+
+	p, _ := v.(*T)
+	return p
+}
+
+// Brings series back to the state of records taken by stateRecords
+func restoreSeries[T mondata.VTypes](tx transaction.TxExec[T], recs []wal.Record) {
+	for _, rec := range recs {
+		// totals and timestamps which didn't exist before mustn't be left
+		tx.Delete(rec.Key)
+		setSeries(tx, rec, recordValue[T](rec))
+	}
+}
+
+// Applies replayed record to the storage
+func (ms *MemorySt) apply(rec wal.Record) error {
+	switch rec.MType {
+	case mondata.GaugeType:
+		return applySeries(ms.Gauge, rec, rec.Gauge)
+	case mondata.CounterType:
+		return applySeries(ms.Counter, rec, rec.Counter)
+	case mondata.HistogramType:
+		if rec.Histogram == nil {
+			return fmt.Errorf("record of histogram %q has no value", rec.Key)
+		}
+		return ms.Histogram.Update(func(tx *safe.HRepoTx) error {
+			tx.Set(rec.Key, *rec.Histogram)
+			return nil
+		})
+	case wal.MetaType:
+		if rec.Meta != nil {
+			ms.Meta.SetAll(mondata.MetaMap{rec.Key: *rec.Meta})
+		}
+		return nil
+	default:
+		return fmt.Errorf("record has unknown type %q", rec.MType)
+	}
+}
+
+// Returns records of the whole stored state, gauges and counters are read as of the same moment by readSeries
+func (ms *MemorySt) records() []wal.Record {
+	var recs []wal.Record
+	ms.readSeries(func(g transaction.TxQry[mondata.GaugeVType], c transaction.TxQry[mondata.CounterVType]) {
+		recs = seriesRecords(g, mondata.GaugeType, keys(g.GetAll()))
+		recs = append(recs, seriesRecords(c, mondata.CounterType, keys(c.GetAll()))...)
+	})
+
+	ms.Histogram.Read(func(tx *safe.HRepoTx) error {
+		for k := range tx.GetAll() {
+			recs = append(recs, histogramRecord(tx, k))
+		}
+		return nil
+	})
+
+	for k, v := range ms.Meta.GetAll() {
+		recs = append(recs, wal.Record{Op: wal.OpSet, MType: wal.MetaType, Key: k, Meta: &v})
+	}
+
+	return recs
+}
+
+// Enables persistence: every write is appended to write-ahead log in opts.Dir.
+// If opts.Restore is set, values are restored from the snapshot and the log first
+func (ms *MemorySt) OpenWAL(opts WALOptions) error {
+	if opts.Restore {
+		n, err := wal.Replay(opts.Dir, ms.apply)
+		if err != nil {
+			return err
+		}
+		ms.log("replayed records of snapshot and write-ahead log:", n)
+	} else if err := wal.Reset(opts.Dir); err != nil {
+		return err
+	}
+
+	l, err := wal.Open(opts.Dir, opts.Sync)
+	if err != nil {
+		return err
+	}
+	ms.wal, ms.walOpts = l, opts
+
+	return nil
+}
+
+// Opens write-ahead log with options storage was opened with,
+// values are replayed from it if restore option is set
+func (ms *MemorySt) Restore() error {
+	if ms.walOpts.Dir == "" {
+		ms.warn("restore: directory of write-ahead log isn't set, values won't be persisted")
+		return nil
+	}
+
+	if err := ms.OpenWAL(ms.walOpts); err != nil {
+		return err
+	}
+
+	if ms.walOpts.Restore {
+		ms.log("values were restored from snapshot and write-ahead log with success")
+	} else {
+		ms.warn("restore: flag wasn't set, previous snapshot and write-ahead log were discarded")
+	}
+	return nil
+}
+
+// Compacts write-ahead log into snapshot of the stored state
+func (ms *MemorySt) Snapshot() error {
+	if ms.wal == nil {
+		return nil
+	}
+
+	// state read after rotation contains all records of the closed segments,
+	// records of the new segment could be in it too, but replaying them again is harmless
+	seq, err := ms.wal.Rotate()
+	if err != nil {
+		return err
+	}
+
+	return ms.wal.WriteSnapshot(seq, ms.records())
+}
+
+// Periodically compacts write-ahead log into snapshot until ctx is done,
+// the last snapshot is written on Close
+func (ms *MemorySt) ScheduleSnapshots(ctx context.Context) error {
+	if ms.wal == nil || ms.walOpts.SnapshotInterval == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(ms.walOpts.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ms.Snapshot(); err != nil && ms.logger != nil {
+				ms.logger.Errorln("writing snapshot failed with error:", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
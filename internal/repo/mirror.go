@@ -0,0 +1,457 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultMirrorCheckInterval = time.Minute
+	// max number of diverged keys of every type in log messages
+	maxLoggedKeys = 10
+)
+
+// Mirror writes to both storages and reads from the primary one, e.g. to migrate to another DB
+// without downtime or to keep in-memory copy of DB. Writes are applied to the primary storage first,
+// failed writes to the secondary one don't fail the call, but they make storages diverge
+type Mirror struct {
+	MetricsRepo   // primary storage
+	secondary     MetricsRepo
+	checkInterval time.Duration
+	failed        atomic.Int64 // number of writes failed on the secondary storage
+	logger        *zap.SugaredLogger
+}
+
+// Divergence is the difference between storages of mirror
+type Divergence struct {
+	Gauges       []string // keys of gauges which differ or are missing in one of storages
+	Counters     []string // keys of counters which differ or are missing in one of storages
+	Histograms   []string // keys of histograms which differ or are missing in one of storages
+	Meta         []string // names of metrics which metadata differs or is missing in one of storages
+	FailedWrites int64    // writes failed on the secondary storage since start
+}
+
+func (d Divergence) Empty() bool {
+	return len(d.Gauges) == 0 && len(d.Counters) == 0 && len(d.Histograms) == 0 && len(d.Meta) == 0 &&
+		d.FailedWrites == 0
+}
+
+// Opens storages by DSNs in the next format: mirror://?primary=<DSN>&secondary=<DSN>&check_interval=1m,
+// DSNs of storages must be escaped. Storages are compared every check_interval, 0 disables comparing.
+// Optional counter_overflow option is passed to both storages, so they accumulate counters the same way
+func openMirror(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (*Mirror, error) {
+	var (
+		primaryDSN, secondaryDSN, overflow string
+		checkInterval                      = defaultMirrorCheckInterval
+	)
+	for k, vv := range dsn.Query() {
+		v := vv[len(vv)-1]
+		var err error
+		switch k {
+		case "primary":
+			primaryDSN = v
+		case "secondary":
+			secondaryDSN = v
+		case "check_interval":
+			checkInterval, err = time.ParseDuration(v)
+		case mondata.OverflowOption:
+			overflow = v
+			_, err = mondata.ParseOverflowPolicy(v)
+		default:
+			return nil, fmt.Errorf("unknown option %q of mirror, expected one of: primary, secondary, check_interval, counter_overflow", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %q of mirror: %w", k, err)
+		}
+	}
+	if primaryDSN == "" || secondaryDSN == "" {
+		return nil, fmt.Errorf("mirror requires both primary and secondary DSN")
+	}
+	if overflow != "" {
+		primaryDSN, secondaryDSN = withOverflow(primaryDSN, overflow), withOverflow(secondaryDSN, overflow)
+	}
+
+	primary, err := openBackend(ctx, primaryDSN, logger.Named("primary"))
+	if err != nil {
+		return nil, fmt.Errorf("primary: %w", err)
+	}
+	secondary, err := openBackend(ctx, secondaryDSN, logger.Named("secondary"))
+	if err != nil {
+		primary.Close()
+		return nil, fmt.Errorf("secondary: %w", err)
+	}
+
+	return &Mirror{MetricsRepo: primary, secondary: secondary, checkInterval: checkInterval, logger: logger}, nil
+}
+
+func openBackend(ctx context.Context, dsn string, logger *zap.SugaredLogger) (MetricsRepo, error) {
+	b, u, err := lookup(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := b.Open(ctx, u, logger.Named(b.Name))
+	if err != nil {
+		return nil, fmt.Errorf("init %s failed: %w", b.Name, err)
+	}
+
+	return r, nil
+}
+
+// Adds overflow policy to DSN of storage unless it's set by DSN itself
+func withOverflow(dsn string, overflow string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		// the error is reported on opening storage
+		return dsn
+	}
+
+	q := u.Query()
+	if !q.Has(mondata.OverflowOption) {
+		q.Set(mondata.OverflowOption, overflow)
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String()
+}
+
+// Returns storage which serves reads
+func primaryOf(r MetricsRepo) MetricsRepo {
+	if m, ok := r.(*Mirror); ok {
+		return primaryOf(m.MetricsRepo)
+	}
+
+	return r
+}
+
+func (m *Mirror) write(op string, fn func(r MetricsRepo) error) error {
+	if err := fn(m.MetricsRepo); err != nil {
+		return err
+	}
+
+	if err := fn(m.secondary); err != nil {
+		m.failed.Add(1)
+		m.logger.Errorln("write to secondary storage failed, storages diverge, op:", op, "error:", err)
+	}
+	return nil
+}
+
+func (m *Mirror) Close() {
+	m.MetricsRepo.Close()
+	m.secondary.Close()
+}
+
+// MARK: setters
+func (m *Mirror) SetGauge(ctx context.Context, name string, value mondata.GaugeVType) error {
+	return m.write("set gauge", func(r MetricsRepo) error {
+		return r.SetGauge(ctx, name, value)
+	})
+}
+
+func (m *Mirror) SetGaugeAll(ctx context.Context, gaugeMap mondata.GaugeMap) error {
+	return m.write("set all gauges", func(r MetricsRepo) error {
+		return r.SetGaugeAll(ctx, gaugeMap)
+	})
+}
+
+func (m *Mirror) SetCounter(ctx context.Context, name string, value mondata.CounterVType) error {
+	return m.write("set counter", func(r MetricsRepo) error {
+		return r.SetCounter(ctx, name, value)
+	})
+}
+
+func (m *Mirror) SetCounterAll(ctx context.Context, counterMap mondata.CounterMap) error {
+	return m.write("set all counters", func(r MetricsRepo) error {
+		return r.SetCounterAll(ctx, counterMap)
+	})
+}
+
+func (m *Mirror) SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error {
+	return m.write("set counter total", func(r MetricsRepo) error {
+		return r.SetCounterTotal(ctx, name, total)
+	})
+}
+
+func (m *Mirror) SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error {
+	return m.write("set all counter totals", func(r MetricsRepo) error {
+		return r.SetCounterTotalAll(ctx, totals)
+	})
+}
+
+func (m *Mirror) SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error {
+	return m.write("set histogram", func(r MetricsRepo) error {
+		return r.SetHistogram(ctx, name, value)
+	})
+}
+
+func (m *Mirror) SetHistogramAll(ctx context.Context, histogramMap mondata.HistogramMap) error {
+	return m.write("set all histograms", func(r MetricsRepo) error {
+		return r.SetHistogramAll(ctx, histogramMap)
+	})
+}
+
+func (m *Mirror) SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error {
+	return m.write("set sample time", func(r MetricsRepo) error {
+		return r.SetSampled(ctx, mtype, sampled)
+	})
+}
+
+func (m *Mirror) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	return m.write("apply batch", func(r MetricsRepo) error {
+		return r.ApplyBatch(ctx, gauges, counters, histograms)
+	})
+}
+
+func (m *Mirror) SetMetaAll(ctx context.Context, metaMap mondata.MetaMap) error {
+	return m.write("set metadata", func(r MetricsRepo) error {
+		return r.SetMetaAll(ctx, metaMap)
+	})
+}
+
+// Removes stale series from both storages, series evicted from the primary one are returned
+func (m *Mirror) Evict(ctx context.Context, policy mondata.TTLPolicy) ([]mondata.SeriesRef, error) {
+	var evicted []mondata.SeriesRef
+	err := m.write("evict", func(r MetricsRepo) error {
+		refs, err := r.Evict(ctx, policy)
+		if r == m.MetricsRepo {
+			evicted = refs
+		}
+		return err
+	})
+
+	return evicted, err
+}
+
+// MARK: capabilities
+// Restores values of storages which keep them outside of DB, then replaces state of the secondary storage
+// by state of the primary one, so writes to both of them start from the same state.
+// It must be called before storage is written to
+func (m *Mirror) Restore() error {
+	for _, r := range []MetricsRepo{m.MetricsRepo, m.secondary} {
+		if rr, ok := r.(restoreRepo); ok {
+			if err := rr.Restore(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := m.seed(context.Background()); err != nil {
+		return fmt.Errorf("copying state of the primary storage to the secondary one failed: %w", err)
+	}
+	return nil
+}
+
+// Copies values, last totals of counters, histograms and metadata of the primary storage to the secondary one
+func (m *Mirror) seed(ctx context.Context) error {
+	p, ok := m.MetricsRepo.(stateRepo)
+	if !ok {
+		m.logger.Warnln("state of the primary storage can't be copied, storages diverge until series are written again")
+		return nil
+	}
+	s, ok := m.secondary.(stateRepo)
+	if !ok {
+		m.logger.Warnln("state of the secondary storage can't be replaced, storages diverge until series are written again")
+		return nil
+	}
+
+	st, err := p.GetState(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.LoadState(ctx, st); err != nil {
+		return err
+	}
+
+	m.logger.Infoln("state of the primary storage was copied to the secondary one, gauges:", len(st.Gauges),
+		"counters:", len(st.Counters), "histograms:", len(st.Histograms), "metadata:", len(st.Meta))
+	return nil
+}
+
+func (m *Mirror) ScheduleSnapshots(ctx context.Context) error {
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, r := range []MetricsRepo{m.MetricsRepo, m.secondary} {
+		if sr, ok := r.(snapshotRepo); ok {
+			g.Go(func() error {
+				return sr.ScheduleSnapshots(gCtx)
+			})
+		}
+	}
+
+	return g.Wait()
+}
+
+func (m *Mirror) ScheduleRetention(ctx context.Context, retention time.Duration) error {
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, r := range []MetricsRepo{m.MetricsRepo, m.secondary} {
+		if rr, ok := r.(retentionRepo); ok {
+			g.Go(func() error {
+				return rr.ScheduleRetention(gCtx, retention)
+			})
+		}
+	}
+
+	return g.Wait()
+}
+
+func (m *Mirror) Rollup(ctx context.Context) error {
+	for _, r := range []MetricsRepo{m.MetricsRepo, m.secondary} {
+		if rr, ok := r.(rollupRepo); ok {
+			if err := rr.Rollup(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MARK: divergence
+// Returns sorted keys which values differ or which are missing in one of maps
+func diffKeys[T comparable](a map[string]T, b map[string]T) []string {
+	return diffKeysFunc(a, b, func(x T, y T) bool { return x == y })
+}
+
+// Returns sorted keys which values differ by eq or which are missing in one of maps
+func diffKeysFunc[T any](a map[string]T, b map[string]T, eq func(x T, y T) bool) []string {
+	keys := make([]string, 0)
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || !eq(v, bv) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func histogramsEqual(a mondata.Histogram, b mondata.Histogram) bool {
+	return a.Sum == b.Sum && a.Count == b.Count && slices.Equal(a.Bounds, b.Bounds) && slices.Equal(a.Counts, b.Counts)
+}
+
+func metaEqual(a mondata.Meta, b mondata.Meta) bool {
+	if (a.Precision == nil) != (b.Precision == nil) || (a.Precision != nil && *a.Precision != *b.Precision) {
+		return false
+	}
+	a.Precision, b.Precision = nil, nil
+
+	return a == b
+}
+
+// Values of a storage compared by Compare
+type mirrored struct {
+	snap       mondata.Snapshot
+	histograms mondata.HistogramMap
+	meta       mondata.MetaMap
+}
+
+func readMirrored(ctx context.Context, r MetricsRepo) (mirrored, error) {
+	var (
+		v   mirrored
+		err error
+	)
+	if v.snap, err = r.GetSnapshot(ctx); err != nil {
+		return v, err
+	}
+	if v.histograms, err = r.GetHistogramAll(ctx); err != nil {
+		return v, err
+	}
+	v.meta, err = r.GetMetaAll(ctx)
+
+	return v, err
+}
+
+// Compares gauges, counters, histograms and metadata of storages,
+// series written while they're read could differ as well
+func (m *Mirror) Compare(ctx context.Context) (Divergence, error) {
+	p, err := readMirrored(ctx, m.MetricsRepo)
+	if err != nil {
+		return Divergence{}, err
+	}
+	s, err := readMirrored(ctx, m.secondary)
+	if err != nil {
+		return Divergence{}, err
+	}
+
+	return Divergence{
+		Gauges:       diffKeys(p.snap.Gauges, s.snap.Gauges),
+		Counters:     diffKeys(p.snap.Counters, s.snap.Counters),
+		Histograms:   diffKeysFunc(p.histograms, s.histograms, histogramsEqual),
+		Meta:         diffKeysFunc(p.meta, s.meta, metaEqual),
+		FailedWrites: m.failed.Load(),
+	}, nil
+}
+
+// Returns keys of sorted slices which are in both of them
+func intersect(a []string, b []string) []string {
+	keys := make([]string, 0)
+	for _, k := range a {
+		if _, ok := slices.BinarySearch(b, k); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Returns at most maxLoggedKeys keys, so thousands of diverged series don't flood the log
+func loggedKeys(keys []string) []string {
+	if len(keys) <= maxLoggedKeys {
+		return keys
+	}
+
+	return append(keys[:maxLoggedKeys:maxLoggedKeys], fmt.Sprintf("... %d more", len(keys)-maxLoggedKeys))
+}
+
+// Compares storages periodically and reports series which differ on two checks in a row,
+// so series which were written during a check aren't reported
+func (m *Mirror) ScheduleDivergenceChecks(ctx context.Context) error {
+	if m.checkInterval == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	var prev Divergence
+	for {
+		select {
+		case <-ticker.C:
+			d, err := m.Compare(ctx)
+			if err != nil {
+				m.logger.Errorln("comparing storages failed with error:", err)
+				continue
+			}
+
+			diverged := Divergence{
+				Gauges:       intersect(prev.Gauges, d.Gauges),
+				Counters:     intersect(prev.Counters, d.Counters),
+				Histograms:   intersect(prev.Histograms, d.Histograms),
+				Meta:         intersect(prev.Meta, d.Meta),
+				FailedWrites: d.FailedWrites - prev.FailedWrites,
+			}
+			if !diverged.Empty() {
+				m.logger.Warnln("storages diverge", "gauges:", loggedKeys(diverged.Gauges),
+					"counters:", loggedKeys(diverged.Counters), "histograms:", loggedKeys(diverged.Histograms),
+					"metadata:", loggedKeys(diverged.Meta), "failed writes:", diverged.FailedWrites)
+			}
+			prev = d
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
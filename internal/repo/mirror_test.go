@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMirror(t *testing.T) {
+	ctx := context.TODO()
+
+	q := url.Values{}
+	q.Set("primary", "memory://")
+	q.Set("secondary", "memory://?dir="+url.QueryEscape(t.TempDir()))
+	db, err := Init(ctx, "mirror://?"+q.Encode(), 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NoError(t, db.Restore())
+	defer db.Close()
+
+	m := db.MetricsRepo.(*Mirror)
+	primary, secondary := m.MetricsRepo.(*memory.MemorySt), m.secondary.(*memory.MemorySt)
+
+	require.NoError(t, db.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{"Alloc": 1}},
+		mondata.CounterBatch{Deltas: mondata.CounterMap{"PollCount": 2}, Totals: mondata.CounterMap{"NumGC": 10}},
+		nil,
+	))
+	require.NoError(t, db.SetGauge(ctx, "HeapAlloc", 3))
+
+	for _, r := range []*memory.MemorySt{primary, secondary} {
+		snap, err := r.GetSnapshot(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, mondata.GaugeMap{"Alloc": 1, "HeapAlloc": 3}, snap.Gauges)
+		assert.Equal(t, mondata.CounterMap{"PollCount": 2, "NumGC": 10}, snap.Counters)
+	}
+
+	d, err := m.Compare(ctx)
+	require.NoError(t, err)
+	assert.True(t, d.Empty())
+
+	// values written to a single storage diverge, reads are served by the primary one
+	require.NoError(t, secondary.SetGauge(ctx, "Alloc", 5))
+	require.NoError(t, primary.SetCounter(ctx, "Requests", 1))
+
+	v, _, err := db.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), v)
+
+	d, err = m.Compare(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Alloc"}, d.Gauges)
+	assert.Equal(t, []string{"Requests"}, d.Counters)
+
+	// histograms and metadata are compared as well
+	hist := mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1}
+	require.NoError(t, db.SetHistogram(ctx, "Latency", hist))
+	require.NoError(t, primary.SetHistogram(ctx, "Latency", hist))
+	require.NoError(t, secondary.SetMetaAll(ctx, mondata.MetaMap{"Alloc": {Name: "Alloc", Unit: mondata.UnitBytes}}))
+	d, err = m.Compare(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Latency"}, d.Histograms)
+	assert.Equal(t, []string{"Alloc"}, d.Meta)
+
+	// failed write to the secondary storage doesn't fail the call, but it's counted
+	secondary.Close()
+	require.NoError(t, db.SetGauge(ctx, "Alloc", 6))
+	d, err = m.Compare(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), d.FailedWrites)
+}
+
+func TestMirror_Seed(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	precision := 2
+
+	// the primary storage is restored with values written before the secondary one was added
+	prev := memory.InitEmpty()
+	require.NoError(t, prev.OpenWAL(memory.WALOptions{Dir: dir}))
+	require.NoError(t, prev.SetGauge(ctx, "Alloc", 1))
+	require.NoError(t, prev.SetCounter(ctx, "PollCount", 2))
+	require.NoError(t, prev.SetCounterTotal(ctx, "Requests", 10))
+	require.NoError(t, prev.SetHistogram(ctx, "Latency", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1}))
+	require.NoError(t, prev.SetMetaAll(ctx, mondata.MetaMap{"Alloc": {Name: "Alloc", Unit: mondata.UnitBytes, Precision: &precision}}))
+	prev.Close()
+
+	q := url.Values{}
+	q.Set("primary", "memory://?restore=true&dir="+url.QueryEscape(dir))
+	q.Set("secondary", "memory://")
+	db, err := Init(ctx, "mirror://?"+q.Encode(), 16, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	m := db.MetricsRepo.(*Mirror)
+	secondary := m.secondary.(*memory.MemorySt)
+	// stale series of the secondary storage are replaced
+	require.NoError(t, secondary.SetGauge(ctx, "Stale", 1))
+
+	require.NoError(t, db.Restore())
+	defer db.Close()
+
+	d, err := m.Compare(ctx)
+	require.NoError(t, err)
+	assert.True(t, d.Empty(), d)
+
+	// increments of totals are computed from the same last totals
+	require.NoError(t, db.SetCounterTotal(ctx, "Requests", 15))
+	v, _, err := secondary.GetCounter(ctx, "Requests")
+	require.NoError(t, err)
+	assert.Equal(t, mondata.CounterVType(15), v)
+	d, err = m.Compare(ctx)
+	require.NoError(t, err)
+	assert.True(t, d.Empty(), d)
+}
+
+func TestLoggedKeys(t *testing.T) {
+	keys := make([]string, 0, maxLoggedKeys+5)
+	for i := range maxLoggedKeys + 5 {
+		keys = append(keys, fmt.Sprintf("Gauge%02d", i))
+	}
+
+	assert.Equal(t, keys[:3], loggedKeys(keys[:3]))
+	logged := loggedKeys(keys)
+	assert.Len(t, logged, maxLoggedKeys+1)
+	assert.Equal(t, "... 5 more", logged[maxLoggedKeys])
+	assert.Equal(t, fmt.Sprintf("Gauge%02d", maxLoggedKeys), keys[maxLoggedKeys], "keys aren't overwritten")
+}
+
+func TestMirror_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  string
+		err  string
+	}{
+		{name: "missing secondary", dsn: "mirror://?primary=memory%3A%2F%2F", err: "mirror requires both primary and secondary DSN"},
+		{name: "unknown option", dsn: "mirror://?replica=memory%3A%2F%2F", err: `unknown option "replica" of mirror`},
+		{name: "unknown overflow policy", dsn: "mirror://?primary=memory%3A%2F%2F&secondary=memory%3A%2F%2F&counter_overflow=ignore", err: `invalid option "counter_overflow" of mirror`},
+		{name: "unknown scheme of storage", dsn: "mirror://?primary=redis%3A%2F%2F&secondary=memory%3A%2F%2F", err: "primary: unknown storage scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Init(context.TODO(), tt.dsn, 16, zap.NewNop().Sugar())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
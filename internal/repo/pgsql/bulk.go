@@ -0,0 +1,251 @@
+package pgsql
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5"
+)
+
+// Batch upserts pass columns as arrays, so the whole map is upserted with a single statement.
+// Labels are passed as JSON text, since arrays of jsonb can't be built from Go maps directly
+var bulkUpsertGaugeQry = `
+	INSERT INTO gauge_m_table (name, labels, value)
+	SELECT name, labels::jsonb, value
+	FROM unnest(@names::varchar[], @labels::text[], @values::double precision[]) AS t(name, labels, value)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		value = EXCLUDED.value,
+		updated_at = now();
+`
+
+var bulkUpsertCounterQry = `
+	INSERT INTO counter_m_table (name, labels, value)
+	SELECT name, labels::jsonb, value
+	FROM unnest(@names::varchar[], @labels::text[], @values::numeric[]) AS t(name, labels, value)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		` + accumExpr("EXCLUDED.value") + `,
+		updated_at = now();
+`
+
+var bulkUpsertCounterTotalQry = `
+	INSERT INTO counter_m_table (name, labels, value, total)
+	SELECT name, labels::jsonb, total, total
+	FROM unnest(@names::varchar[], @labels::text[], @values::numeric[]) AS t(name, labels, total)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		` + accumExpr(totalIncExpr) + `,
+		total = EXCLUDED.total,
+		updated_at = now();
+`
+
+var (
+	bulkUpsertGaugeSampleQry        = withSample(mondata.GaugeType, bulkUpsertGaugeQry)
+	bulkUpsertCounterSampleQry      = withSample(mondata.CounterType, bulkUpsertCounterQry)
+	bulkUpsertCounterTotalSampleQry = withSample(mondata.CounterType, bulkUpsertCounterTotalQry)
+)
+
+// columns of series for batch upserts
+type columns[T mondata.VTypes] struct {
+	names  []string
+	labels []string
+	values []T
+}
+
+// Splits series keys into columns. A row can't be updated twice by a single statement,
+// so values of keys which refer to the same series are merged
+func toColumns[T mondata.VTypes](m map[string]T, merge func(prev T, v T) (T, error)) (columns[T], error) {
+	cols := columns[T]{
+		names:  make([]string, 0, len(m)),
+		labels: make([]string, 0, len(m)),
+		values: make([]T, 0, len(m)),
+	}
+	seen := make(map[string]int, len(m))
+
+	for k, v := range m {
+		n, labels, err := mondata.ParseSeriesKey(k)
+		if err != nil {
+			return cols, err
+		}
+
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		// keys of maps are sorted by encoder, so equal label sets have equal JSON
+		lj, err := json.Marshal(labels)
+		if err != nil {
+			return cols, err
+		}
+
+		id := mondata.SeriesKey(n, labels)
+		if i, ok := seen[id]; ok {
+			if cols.values[i], err = merge(cols.values[i], v); err != nil {
+				return cols, err
+			}
+			continue
+		}
+
+		seen[id] = len(cols.names)
+		cols.names = append(cols.names, n)
+		cols.labels = append(cols.labels, string(lj))
+		cols.values = append(cols.values, v)
+	}
+
+	return cols, nil
+}
+
+func (c columns[T]) args() pgx.NamedArgs {
+	return pgx.NamedArgs{"names": c.names, "labels": c.labels, "values": c.values}
+}
+
+// Arguments of counter upserts, values are passed as NUMERIC and accumulated according to the overflow policy
+func (pg *PgSQL) counterArgs(c columns[mondata.CounterVType]) pgx.NamedArgs {
+	args := c.args()
+	args["values"] = toNumerics(c.values)
+	args["policy"] = string(pg.overflow)
+
+	return args
+}
+
+func last[T mondata.VTypes](_ T, v T) (T, error) {
+	return v, nil
+}
+
+// Merges increments of the same counter according to the overflow policy, as counter_add accumulates them
+func (pg *PgSQL) sum(prev mondata.CounterVType, v mondata.CounterVType) (mondata.CounterVType, error) {
+	sum, _, err := pg.overflow.Add(prev, v)
+	return sum, err
+}
+
+func (pg *PgSQL) bulkUpsert(ctx context.Context, qry string, args pgx.NamedArgs, mtype string, keys []string) error {
+	return pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, qry, args); err != nil {
+				return overflowErr(err)
+			}
+			return pg.notify(ctx, tx, mtype, keys)
+		})
+}
+
+// batch upsert of a single table, it's skipped if there are no rows
+type upsert struct {
+	qry  string
+	rows int
+	args pgx.NamedArgs
+}
+
+// Upserts all gauges with a single statement
+func (pg *PgSQL) SetGaugeAll(ctx context.Context, metrics mondata.GaugeMap) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	cols, err := toColumns(metrics, last[mondata.GaugeVType])
+	if err != nil {
+		return err
+	}
+
+	return pg.bulkUpsert(ctx, bulkUpsertGaugeSampleQry, cols.args(), mondata.GaugeType, keysOf(metrics))
+}
+
+// Accumulates all counters with a single statement
+func (pg *PgSQL) SetCounterAll(ctx context.Context, metrics mondata.CounterMap) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	cols, err := toColumns(metrics, pg.sum)
+	if err != nil {
+		return err
+	}
+
+	return pg.bulkUpsert(ctx, bulkUpsertCounterSampleQry, pg.counterArgs(cols), mondata.CounterType, keysOf(metrics))
+}
+
+// Accumulates increments of all cumulative counters with a single statement
+func (pg *PgSQL) SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error {
+	if len(totals) == 0 {
+		return nil
+	}
+
+	cols, err := toColumns(totals, last[mondata.CounterVType])
+	if err != nil {
+		return err
+	}
+
+	return pg.bulkUpsert(ctx, bulkUpsertCounterTotalSampleQry, pg.counterArgs(cols), mondata.CounterType, keysOf(totals))
+}
+
+// Upserts gauges, counters and histograms of a report and sets sample time of series within a single transaction
+func (pg *PgSQL) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	gcols, err := toColumns(gauges.Values, last[mondata.GaugeVType])
+	if err != nil {
+		return err
+	}
+	ccols, err := toColumns(counters.Deltas, pg.sum)
+	if err != nil {
+		return err
+	}
+	tcols, err := toColumns(counters.Totals, last[mondata.CounterVType])
+	if err != nil {
+		return err
+	}
+
+	// totals are upserted after increments as in separate requests
+	upserts := []upsert{
+		{bulkUpsertGaugeSampleQry, len(gcols.names), gcols.args()},
+		{bulkUpsertCounterSampleQry, len(ccols.names), pg.counterArgs(ccols)},
+		{bulkUpsertCounterTotalSampleQry, len(tcols.names), pg.counterArgs(tcols)},
+	}
+
+	return pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			for _, u := range upserts {
+				if u.rows == 0 {
+					continue
+				}
+				if _, err := tx.Exec(ctx, u.qry, u.args); err != nil {
+					return overflowErr(err)
+				}
+			}
+			for k, v := range histograms {
+				if err := upsertHistogram(ctx, tx, k, v); err != nil {
+					return err
+				}
+			}
+
+			if err := setSampled(ctx, tx, mondata.GaugeType, gauges.Sampled); err != nil {
+				return err
+			}
+			if err := setSampled(ctx, tx, mondata.CounterType, counters.Sampled); err != nil {
+				return err
+			}
+
+			if err := pg.notify(ctx, tx, mondata.GaugeType, keysOf(gauges.Values)); err != nil {
+				return err
+			}
+			if err := pg.notify(ctx, tx, mondata.HistogramType, keysOf(histograms)); err != nil {
+				return err
+			}
+			return pg.notify(ctx, tx, mondata.CounterType, unionKeys(counters.Deltas, counters.Totals))
+		})
+}
+
+func unionKeys(a mondata.CounterMap, b mondata.CounterMap) []string {
+	keys := keysOf(a)
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
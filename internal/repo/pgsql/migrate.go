@@ -0,0 +1,234 @@
+package pgsql
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Migration changes schema from version Version-1 to Version, Down reverts it
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Reads migrations from files named like 0001_create_metrics.up.sql and 0001_create_metrics.down.sql,
+// versions must start from 1 and have no gaps
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration file name %q doesn't match NNNN_name.(up|down).sql", e.Name())
+		}
+
+		v, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("migration file name %q has invalid version: %w", e.Name(), err)
+		}
+
+		b, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mg, ok := byVersion[uint(v)]
+		if !ok {
+			mg = &Migration{Version: uint(v), Name: m[2]}
+			byVersion[uint(v)] = mg
+		}
+		if mg.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", v, mg.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mg.Up = string(b)
+		} else {
+			mg.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" || mg.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", mg.Version, mg.Name)
+		}
+		migrations = append(migrations, *mg)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, mg := range migrations {
+		if mg.Version != uint(i+1) {
+			return nil, fmt.Errorf("migration of version %d is missing", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func mustLoadMigrations() []Migration {
+	sub, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		panic(err)
+	}
+
+	migrations, err := loadMigrations(sub)
+	if err != nil {
+		panic(err)
+	}
+
+	return migrations
+}
+
+// embedded migrations ordered by version
+var migrations = mustLoadMigrations()
+
+// Returns version of schema after all embedded migrations are applied
+func LatestSchemaVersion() uint {
+	return uint(len(migrations))
+}
+
+var createMigrationsQry = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+`
+
+var schemaVersionQry = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`
+
+var insertMigrationQry = `INSERT INTO schema_migrations (version, name) VALUES (@version, @name);`
+
+var deleteMigrationQry = `DELETE FROM schema_migrations WHERE version = @version;`
+
+// key of advisory lock held while schema is migrated
+const migrationsLockKey int64 = 0x7065_7266_6d6f_6e // "perfmon"
+
+// Returns version of the latest applied migration, zero if there are none
+func (pg *PgSQL) SchemaVersion(ctx context.Context) (uint, error) {
+	var v uint
+	err := pg.QueryRow(ctx, schemaVersionQry).Scan(&v)
+
+	// schema_migrations is created by the first migration run
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UndefinedTable {
+		return 0, nil
+	}
+
+	return v, err
+}
+
+// Applies migrations up to version or reverts ones above it, each migration is applied in its own transaction.
+// Migrations are serialized by advisory lock, so servers started concurrently don't race
+func (pg *PgSQL) Migrate(ctx context.Context, version uint) error {
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("schema version %d is unknown, the latest one is %d", version, LatestSchemaVersion())
+	}
+
+	conn, err := pg.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1);", migrationsLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		// the lock is held by session, so connection which failed to release it mustn't get back to the pool
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1);", migrationsLockKey); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+
+	if _, err = conn.Exec(ctx, createMigrationsQry); err != nil {
+		return err
+	}
+
+	var current uint
+	if err = conn.QueryRow(ctx, schemaVersionQry).Scan(&current); err != nil {
+		return err
+	}
+
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("schema version %d is newer than the latest known one %d", current, LatestSchemaVersion())
+	}
+
+	for ; current < version; current++ {
+		m := migrations[current]
+		if err = runMigration(ctx, conn, m.Up, insertMigrationQry, m); err != nil {
+			return fmt.Errorf("applying migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		pg.logger.Infof("applied migration %d_%s", m.Version, m.Name)
+	}
+
+	for ; current > version; current-- {
+		m := migrations[current-1]
+		if err = runMigration(ctx, conn, m.Down, deleteMigrationQry, m); err != nil {
+			return fmt.Errorf("reverting migration %d_%s failed: %w", m.Version, m.Name, err)
+		}
+		pg.logger.Infof("reverted migration %d_%s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+func runMigration(ctx context.Context, conn *pgxpool.Conn, qry string, recordQry string, m Migration) error {
+	return pgx.BeginTxFunc(ctx, conn, pgx.TxOptions{AccessMode: pgx.ReadWrite}, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, qry); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, recordQry, pgx.NamedArgs{"version": m.Version, "name": m.Name})
+		return err
+	})
+}
+
+// Migrates schema to the latest version and reports it,
+// schema migrated by a newer server is left as is, since migrations are expected to be backward compatible
+func (pg *PgSQL) migrateUp(ctx context.Context) error {
+	v, err := pg.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if v > LatestSchemaVersion() {
+		pg.logger.Warnf("schema version %d is newer than the latest known one %d", v, LatestSchemaVersion())
+		return nil
+	}
+
+	if v < LatestSchemaVersion() {
+		if err = pg.Migrate(ctx, LatestSchemaVersion()); err != nil {
+			return err
+		}
+		if v, err = pg.SchemaVersion(ctx); err != nil {
+			return err
+		}
+	}
+	pg.logger.Infoln("schema version:", v)
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package pgsql
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(s string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(s)}
+	}
+
+	type want struct {
+		versions []uint
+		err      string
+	}
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want want
+	}{
+		{
+			name: "ordered by version",
+			fsys: fstest.MapFS{
+				"0002_b.up.sql":   file("up b"),
+				"0002_b.down.sql": file("down b"),
+				"0001_a.up.sql":   file("up a"),
+				"0001_a.down.sql": file("down a"),
+			},
+			want: want{versions: []uint{1, 2}},
+		},
+		{
+			name: "missing version",
+			fsys: fstest.MapFS{
+				"0001_a.up.sql":   file("up a"),
+				"0001_a.down.sql": file("down a"),
+				"0003_c.up.sql":   file("up c"),
+				"0003_c.down.sql": file("down c"),
+			},
+			want: want{err: "migration of version 2 is missing"},
+		},
+		{
+			name: "missing down",
+			fsys: fstest.MapFS{
+				"0001_a.up.sql": file("up a"),
+			},
+			want: want{err: "migration 1_a must have both up and down files"},
+		},
+		{
+			name: "different names",
+			fsys: fstest.MapFS{
+				"0001_a.up.sql":   file("up a"),
+				"0001_b.down.sql": file("down b"),
+			},
+			want: want{err: "migration 1 has different names: a and b"},
+		},
+		{
+			name: "invalid file name",
+			fsys: fstest.MapFS{
+				"init.sql": file("up"),
+			},
+			want: want{err: `migration file name "init.sql" doesn't match NNNN_name.(up|down).sql`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrations, err := loadMigrations(test.fsys)
+			if test.want.err != "" {
+				assert.EqualError(t, err, test.want.err)
+				return
+			}
+
+			require.NoError(t, err)
+			versions := make([]uint, 0, len(migrations))
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			assert.Equal(t, test.want.versions, versions)
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations := mustLoadMigrations()
+	assert.Equal(t, uint(len(migrations)), LatestSchemaVersion())
+	assert.NotZero(t, LatestSchemaVersion())
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS counter_m_table;
+DROP TABLE IF EXISTS gauge_m_table;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS gauge_m_table (
+	m_id SERIAL PRIMARY KEY,
+	name VARCHAR(64) UNIQUE,
+	value DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS counter_m_table (
+	m_id SERIAL PRIMARY KEY,
+	name VARCHAR(64) UNIQUE,
+	value BIGINT NOT NULL DEFAULT 0
+);
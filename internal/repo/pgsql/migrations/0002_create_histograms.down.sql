@@ -0,0 +1 @@
+DROP TABLE IF EXISTS histogram_m_table;
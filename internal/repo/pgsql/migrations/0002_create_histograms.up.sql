@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS histogram_m_table (
+	m_id SERIAL PRIMARY KEY,
+	name VARCHAR(64) UNIQUE,
+	bounds DOUBLE PRECISION[] NOT NULL,
+	counts BIGINT[] NOT NULL,
+	sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+	count BIGINT NOT NULL DEFAULT 0
+);
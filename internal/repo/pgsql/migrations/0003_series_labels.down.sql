@@ -0,0 +1,18 @@
+-- labelled series are dropped, since names must be unique again
+DELETE FROM gauge_m_table WHERE labels <> '{}';
+DROP INDEX IF EXISTS gauge_m_table_series_idx;
+ALTER TABLE gauge_m_table DROP COLUMN IF EXISTS labels;
+ALTER TABLE gauge_m_table ADD CONSTRAINT gauge_m_table_name_key UNIQUE (name);
+ALTER TABLE gauge_m_table ALTER COLUMN name DROP NOT NULL;
+
+DELETE FROM counter_m_table WHERE labels <> '{}';
+DROP INDEX IF EXISTS counter_m_table_series_idx;
+ALTER TABLE counter_m_table DROP COLUMN IF EXISTS labels;
+ALTER TABLE counter_m_table ADD CONSTRAINT counter_m_table_name_key UNIQUE (name);
+ALTER TABLE counter_m_table ALTER COLUMN name DROP NOT NULL;
+
+DELETE FROM histogram_m_table WHERE labels <> '{}';
+DROP INDEX IF EXISTS histogram_m_table_series_idx;
+ALTER TABLE histogram_m_table DROP COLUMN IF EXISTS labels;
+ALTER TABLE histogram_m_table ADD CONSTRAINT histogram_m_table_name_key UNIQUE (name);
+ALTER TABLE histogram_m_table ALTER COLUMN name DROP NOT NULL;
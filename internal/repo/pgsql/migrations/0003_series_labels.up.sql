@@ -0,0 +1,15 @@
+-- series are identified by name and labels instead of name
+ALTER TABLE gauge_m_table ALTER COLUMN name SET NOT NULL;
+ALTER TABLE gauge_m_table ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE gauge_m_table DROP CONSTRAINT IF EXISTS gauge_m_table_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS gauge_m_table_series_idx ON gauge_m_table (name, labels);
+
+ALTER TABLE counter_m_table ALTER COLUMN name SET NOT NULL;
+ALTER TABLE counter_m_table ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE counter_m_table DROP CONSTRAINT IF EXISTS counter_m_table_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS counter_m_table_series_idx ON counter_m_table (name, labels);
+
+ALTER TABLE histogram_m_table ALTER COLUMN name SET NOT NULL;
+ALTER TABLE histogram_m_table ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE histogram_m_table DROP CONSTRAINT IF EXISTS histogram_m_table_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS histogram_m_table_series_idx ON histogram_m_table (name, labels);
@@ -0,0 +1,5 @@
+ALTER TABLE gauge_m_table DROP COLUMN IF EXISTS sampled_at;
+ALTER TABLE gauge_m_table DROP COLUMN IF EXISTS updated_at;
+
+ALTER TABLE counter_m_table DROP COLUMN IF EXISTS sampled_at;
+ALTER TABLE counter_m_table DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,6 @@
+-- sampled_at is the time reported by agent, updated_at is the time of receiving
+ALTER TABLE gauge_m_table ADD COLUMN IF NOT EXISTS sampled_at TIMESTAMPTZ;
+ALTER TABLE gauge_m_table ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+ALTER TABLE counter_m_table ADD COLUMN IF NOT EXISTS sampled_at TIMESTAMPTZ;
+ALTER TABLE counter_m_table ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS meta_table (
+	name VARCHAR(64) PRIMARY KEY,
+	unit VARCHAR(32) NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	help TEXT NOT NULL DEFAULT '',
+	precision INTEGER
+);
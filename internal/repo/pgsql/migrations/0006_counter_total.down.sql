@@ -0,0 +1 @@
+ALTER TABLE counter_m_table DROP COLUMN IF EXISTS total;
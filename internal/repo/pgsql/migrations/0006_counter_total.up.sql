@@ -0,0 +1,2 @@
+-- last absolute value of cumulative counter, NULL for counters updated with deltas only
+ALTER TABLE counter_m_table ADD COLUMN IF NOT EXISTS total BIGINT;
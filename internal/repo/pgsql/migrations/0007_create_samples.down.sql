@@ -0,0 +1,2 @@
+-- partitions are dropped with the table
+DROP TABLE IF EXISTS samples_table;
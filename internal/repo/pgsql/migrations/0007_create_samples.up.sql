@@ -0,0 +1,10 @@
+-- samples_table is append-only, every accepted gauge and counter update is written to it,
+-- counters are stored with accumulated values. Daily partitions are created by the server
+CREATE TABLE IF NOT EXISTS samples_table (
+	mtype VARCHAR(16) NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	labels JSONB NOT NULL DEFAULT '{}',
+	value DOUBLE PRECISION NOT NULL,
+	received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+) PARTITION BY RANGE (received_at);
+CREATE INDEX IF NOT EXISTS samples_table_series_idx ON samples_table (mtype, name, labels, received_at);
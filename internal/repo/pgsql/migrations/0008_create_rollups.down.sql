@@ -0,0 +1 @@
+DROP TABLE IF EXISTS samples_rollup_table;
@@ -0,0 +1,16 @@
+-- aggregates of samples within buckets of mondata.RollupResolutions,
+-- resolution is in seconds, inc is an increase of accumulated counter value
+CREATE TABLE IF NOT EXISTS samples_rollup_table (
+	resolution INTEGER NOT NULL,
+	mtype VARCHAR(16) NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	labels JSONB NOT NULL DEFAULT '{}',
+	bucket TIMESTAMPTZ NOT NULL,
+	min DOUBLE PRECISION NOT NULL,
+	max DOUBLE PRECISION NOT NULL,
+	sum DOUBLE PRECISION NOT NULL,
+	count BIGINT NOT NULL,
+	last DOUBLE PRECISION NOT NULL,
+	inc DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (resolution, mtype, name, labels, bucket)
+);
@@ -0,0 +1,7 @@
+DROP FUNCTION IF EXISTS counter_wrapped(NUMERIC, NUMERIC, TEXT);
+DROP FUNCTION IF EXISTS counter_add(NUMERIC, NUMERIC, TEXT);
+ALTER TABLE counter_m_table DROP COLUMN IF EXISTS wrapped_at;
+ALTER TABLE gauge_m_table DROP COLUMN IF EXISTS wrapped_at;
+-- fails if any value exceeds the max value of BIGINT
+ALTER TABLE counter_m_table ALTER COLUMN total TYPE BIGINT;
+ALTER TABLE counter_m_table ALTER COLUMN value TYPE BIGINT;
@@ -0,0 +1,30 @@
+-- counters are unsigned 64-bit integers, see mondata.CounterVType
+ALTER TABLE counter_m_table ALTER COLUMN value TYPE NUMERIC(20, 0);
+ALTER TABLE counter_m_table ALTER COLUMN total TYPE NUMERIC(20, 0);
+-- wrapped_at is the time when counter wrapped around last time, gauges never wrap,
+-- the column keeps queries of timestamps the same for both tables
+ALTER TABLE gauge_m_table ADD COLUMN IF NOT EXISTS wrapped_at TIMESTAMPTZ;
+ALTER TABLE counter_m_table ADD COLUMN IF NOT EXISTS wrapped_at TIMESTAMPTZ;
+
+-- adds increment to counter value according to the overflow policy, see mondata.OverflowPolicy,
+-- the rejected sum raises numeric_value_out_of_range
+CREATE OR REPLACE FUNCTION counter_add(value NUMERIC, inc NUMERIC, policy TEXT) RETURNS NUMERIC AS $$
+BEGIN
+	IF value + inc <= 18446744073709551615 THEN
+		RETURN value + inc;
+	END IF;
+
+	CASE policy
+		WHEN 'saturate' THEN
+			RETURN 18446744073709551615;
+		WHEN 'reject' THEN
+			RAISE EXCEPTION 'counter value exceeds the max one' USING ERRCODE = 'numeric_value_out_of_range';
+		ELSE
+			RETURN value + inc - 18446744073709551616;
+	END CASE;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION counter_wrapped(value NUMERIC, inc NUMERIC, policy TEXT) RETURNS BOOLEAN AS $$
+	SELECT value + inc > 18446744073709551615 AND policy NOT IN ('saturate', 'reject');
+$$ LANGUAGE sql IMMUTABLE;
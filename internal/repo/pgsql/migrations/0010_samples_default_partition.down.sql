@@ -0,0 +1,2 @@
+-- samples of the default partition are dropped with it
+DROP TABLE IF EXISTS samples_table_default;
@@ -0,0 +1,3 @@
+-- samples which don't fit daily partitions, e.g. while they aren't created yet,
+-- are kept by the default partition until the server moves them to the daily one
+CREATE TABLE IF NOT EXISTS samples_table_default PARTITION OF samples_table DEFAULT;
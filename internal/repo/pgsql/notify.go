@@ -0,0 +1,154 @@
+package pgsql
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// channel of notifications about changes made by instances of server sharing DB
+	changesChannel = "perfmon_changes"
+	// payload of notification must be shorter than 8000 bytes
+	maxPayloadSize = 7999
+	// delay of reconnecting after listening connection was lost
+	listenRetryDelay = 5 * time.Second
+)
+
+// types of changes sent by storage
+var changeTypes = []string{mondata.GaugeType, mondata.CounterType, mondata.HistogramType, mondata.MetaType}
+
+// Generates ID of instance, so notifications about its own changes are skipped
+func newInstanceID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func keysOf[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// Encodes change, keys are dropped if they don't fit into notification,
+// so listeners treat any series of the type as changed
+func changePayload(c mondata.Change) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) > maxPayloadSize {
+		c.Keys = nil
+		if b, err = json.Marshal(c); err != nil {
+			return "", err
+		}
+	}
+
+	return string(b), nil
+}
+
+// Notifies other instances about changed series, notification is delivered once transaction is committed
+func (pg *PgSQL) notify(ctx context.Context, tx pgx.Tx, mtype string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	payload, err := changePayload(mondata.Change{Origin: pg.instance, MType: mtype, Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `SELECT pg_notify(@channel, @payload)`,
+		pgx.NamedArgs{"channel": changesChannel, "payload": payload})
+	return err
+}
+
+// Notifies other instances that any series could change, so they reload the whole state
+func (pg *PgSQL) notifyReload(ctx context.Context, tx pgx.Tx) error {
+	for _, mtype := range changeTypes {
+		payload, err := changePayload(mondata.Change{Origin: pg.instance, MType: mtype})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `SELECT pg_notify(@channel, @payload)`,
+			pgx.NamedArgs{"channel": changesChannel, "payload": payload})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Calls fn on every change made by other instances of server until ctx is done,
+// listening connection is reestablished if it's lost. Changes made while it was lost are unknown,
+// so any series are reported as changed once it's reestablished
+func (pg *PgSQL) Listen(ctx context.Context, fn func(mondata.Change)) error {
+	resync := false
+	for {
+		err := pg.listen(ctx, fn, resync)
+		if ctx.Err() != nil {
+			return nil
+		}
+		pg.logger.Warnln("listening to changes of other instances failed, reconnecting, error:", err)
+		resync = true
+
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (pg *PgSQL) listen(ctx context.Context, fn func(mondata.Change), resync bool) error {
+	pconn, err := pg.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// listening connection mustn't be returned to the pool, so it's closed once listening stops
+	conn := pconn.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return err
+	}
+
+	if resync {
+		for _, mtype := range changeTypes {
+			fn(mondata.Change{MType: mtype})
+		}
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var c mondata.Change
+		if err := json.Unmarshal([]byte(n.Payload), &c); err != nil {
+			pg.logger.Warnln("invalid notification about change was skipped, error:", err)
+			continue
+		}
+		if c.Origin == pg.instance {
+			continue
+		}
+
+		fn(c)
+	}
+}
@@ -0,0 +1,38 @@
+package pgsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangePayload(t *testing.T) {
+	many := make([]string, 0, 1000)
+	for i := range 1000 {
+		many = append(many, fmt.Sprintf("Metric%d{host=node%d}", i, i))
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want []string
+	}{
+		{name: "keys fit", keys: []string{"Alloc", "HeapAlloc"}, want: []string{"Alloc", "HeapAlloc"}},
+		{name: "keys are dropped", keys: many, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := changePayload(mondata.Change{Origin: "a1", MType: mondata.GaugeType, Keys: tt.keys})
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(payload), maxPayloadSize)
+
+			var c mondata.Change
+			require.NoError(t, json.Unmarshal([]byte(payload), &c))
+			assert.Equal(t, mondata.Change{Origin: "a1", MType: mondata.GaugeType, Keys: tt.want}, c)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package pgsql
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// counterNumeric is value of counter stored as NUMERIC, since pgx maps NUMERIC only to signed integers
+type counterNumeric mondata.CounterVType
+
+func (c *counterNumeric) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid || v.NaN || v.InfinityModifier != pgtype.Finite {
+		return errors.New("value of counter must be a finite number")
+	}
+
+	n := new(big.Int).Set(v.Int)
+	exp := int64(v.Exp)
+	if exp < 0 {
+		exp = -exp
+	}
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil)
+	if v.Exp >= 0 {
+		n.Mul(n, pow)
+	} else {
+		n.Quo(n, pow)
+	}
+
+	if !n.IsUint64() {
+		return fmt.Errorf("value of counter %s is out of range", n)
+	}
+	*c = counterNumeric(n.Uint64())
+
+	return nil
+}
+
+func (c counterNumeric) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: new(big.Int).SetUint64(uint64(c)), Valid: true}, nil
+}
+
+// Returns destination of scanning value of series, counters are scanned from NUMERIC
+func valueDest[T mondata.VTypes](v *T) any {
+	if c, ok := any(v).(*mondata.CounterVType); ok {
+		return (*counterNumeric)(c)
+	}
+
+	return v
+}
+
+func toNumerics(values []mondata.CounterVType) []counterNumeric {
+	nn := make([]counterNumeric, len(values))
+	for i, v := range values {
+		nn[i] = counterNumeric(v)
+	}
+
+	return nn
+}
+
+// counter_add function raises numeric_value_out_of_range if the overflow policy rejects the sum
+func overflowErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.NumericValueOutOfRange {
+		return fmt.Errorf("%w: %w", mondata.ErrCounterOverflow, err)
+	}
+
+	return err
+}
+
+// increment of cumulative counter computed from its total,
+// a decreased total means the source was restarted and counts from zero again
+const totalIncExpr = `CASE
+	WHEN counter_m_table.total IS NULL OR EXCLUDED.total < counter_m_table.total THEN EXCLUDED.total
+	ELSE EXCLUDED.total - counter_m_table.total
+END`
+
+// Returns assignments of upsert which accumulate increment according to the overflow policy
+func accumExpr(inc string) string {
+	return fmt.Sprintf(`value = counter_add(counter_m_table.value, %[1]s, @policy),
+		wrapped_at = CASE
+			WHEN counter_wrapped(counter_m_table.value, %[1]s, @policy) THEN now()
+			ELSE counter_m_table.wrapped_at
+		END`, inc)
+}
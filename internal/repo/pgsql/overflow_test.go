@@ -0,0 +1,79 @@
+package pgsql
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterNumeric(t *testing.T) {
+	m := pgtype.NewMap()
+
+	tests := []struct {
+		name string
+		v    counterNumeric
+	}{
+		{name: "zero", v: 0},
+		{name: "max of BIGINT", v: math.MaxInt64},
+		{name: "above max of BIGINT", v: math.MaxInt64 + 1},
+		{name: "max", v: math.MaxUint64},
+	}
+	for _, tt := range tests {
+		for _, format := range []int16{pgtype.TextFormatCode, pgtype.BinaryFormatCode} {
+			t.Run(tt.name, func(t *testing.T) {
+				buf, err := m.Encode(pgtype.NumericOID, format, tt.v, nil)
+				require.NoError(t, err)
+
+				var got counterNumeric
+				require.NoError(t, m.Scan(pgtype.NumericOID, format, buf, &got))
+				assert.Equal(t, tt.v, got)
+
+				buf, err = m.Encode(pgtype.NumericArrayOID, format, []counterNumeric{tt.v, 1}, nil)
+				require.NoError(t, err)
+
+				var gotAll []counterNumeric
+				require.NoError(t, m.Scan(pgtype.NumericArrayOID, format, buf, &gotAll))
+				assert.Equal(t, []counterNumeric{tt.v, 1}, gotAll)
+			})
+		}
+	}
+
+	t.Run("out of range", func(t *testing.T) {
+		var got counterNumeric
+		err := m.Scan(pgtype.NumericOID, pgtype.TextFormatCode, []byte("18446744073709551616"), &got)
+		assert.Error(t, err)
+		err = m.Scan(pgtype.NumericOID, pgtype.TextFormatCode, []byte("-1"), &got)
+		assert.Error(t, err)
+	})
+}
+
+func TestToColumns_MergeCounters(t *testing.T) {
+	// keys refer to the same series, since labels are sorted
+	cm := map[string]uint64{`Requests{a="1",b="2"}`: math.MaxUint64 - 5, `Requests{b="2",a="1"}`: 10}
+
+	tests := []struct {
+		policy  mondata.OverflowPolicy
+		want    uint64
+		wantErr bool
+	}{
+		{policy: mondata.OverflowWrap, want: 4},
+		{policy: mondata.OverflowSaturate, want: math.MaxUint64},
+		{policy: mondata.OverflowReject, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			pg := &PgSQL{overflow: tt.policy}
+			cols, err := toColumns(cm, pg.sum)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, mondata.ErrCounterOverflow)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []uint64{tt.want}, cols.values)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package pgsql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleCond(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     mondata.TTLRule
+		wantCond string
+		wantArgs pgx.NamedArgs
+	}{
+		{
+			name:     "default rule",
+			rule:     mondata.TTLRule{TTL: time.Hour},
+			wantCond: "updated_at < @cutoff",
+			wantArgs: pgx.NamedArgs{},
+		},
+		{
+			name:     "prefix with wildcards",
+			rule:     mondata.TTLRule{Prefix: `Heap_%\`, TTL: time.Hour},
+			wantCond: "updated_at < @cutoff AND name LIKE @prefix || '%'",
+			wantArgs: pgx.NamedArgs{"prefix": `Heap\_\%\\`},
+		},
+		{
+			name:     "excluded prefixes",
+			rule:     mondata.TTLRule{Excluded: []string{"Go", "Heap_"}, TTL: time.Hour},
+			wantCond: "updated_at < @cutoff AND name NOT LIKE @excluded0 || '%' AND name NOT LIKE @excluded1 || '%'",
+			wantArgs: pgx.NamedArgs{"excluded0": "Go", "excluded1": `Heap\_`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := pgx.NamedArgs{}
+			assert.Equal(t, tt.wantCond, ruleCond(tt.rule, args))
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func TestPgSQL_Evict(t *testing.T) {
+	pg := openTest(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	age := func(key string, d time.Duration) {
+		t.Helper()
+		n, labels, err := mondata.ParseSeriesKey(key)
+		require.NoError(t, err)
+		_, err = pg.Exec(ctx, `UPDATE gauge_m_table SET updated_at = @at WHERE name = @name AND labels = @labels`,
+			pgx.NamedArgs{"at": now.Add(-d), "name": n, "labels": labels})
+		require.NoError(t, err)
+	}
+
+	for _, k := range []string{"test_Alloc", "test_Fresh", "test_GoRoutines", "test_GoTempDir", "test_Heap_Alloc", `test_HeapXAlloc{host="srv-1"}`} {
+		require.NoError(t, pg.SetGauge(ctx, k, 1))
+	}
+	age("test_Alloc", 2*time.Hour)
+	age("test_GoRoutines", 2*time.Hour)
+	for _, k := range []string{"test_GoTempDir", "test_Heap_Alloc", `test_HeapXAlloc{host="srv-1"}`} {
+		age(k, 5*time.Minute)
+	}
+
+	// series of other tests aren't stale by the default TTL
+	policy := mondata.TTLPolicy{
+		Default:  0,
+		Prefixes: map[string]time.Duration{"test_": time.Hour, "test_Go": 0, "test_GoTemp": time.Minute, "test_Heap_": time.Minute},
+	}
+	evicted, err := pg.Evict(ctx, policy)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []mondata.SeriesRef{
+		{MType: mondata.GaugeType, Key: "test_Alloc"},
+		{MType: mondata.GaugeType, Key: "test_GoTempDir"},
+		{MType: mondata.GaugeType, Key: "test_Heap_Alloc"},
+	}, evicted)
+
+	for _, k := range []string{"test_Fresh", "test_GoRoutines", `test_HeapXAlloc{host="srv-1"}`} {
+		_, ok, err := pg.GetGauge(ctx, k)
+		require.NoError(t, err)
+		assert.True(t, ok, k)
+	}
+}
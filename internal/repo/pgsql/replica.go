@@ -0,0 +1,117 @@
+package pgsql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const (
+	replicaCheckPeriod  = 10 * time.Second
+	replicaCheckTimeout = 2 * time.Second
+)
+
+// replica serves reads while it's healthy, health is checked periodically
+// and lost on the first read which failed to connect, so reads fall back to the primary without waiting for the check
+type replica struct {
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+	stop    context.CancelFunc
+	logger  *zap.SugaredLogger
+}
+
+func connectReplica(ctx context.Context, connStr string, logger *zap.SugaredLogger) (*replica, error) {
+	config, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	checkCtx, stop := context.WithCancel(context.Background())
+	r := &replica{pool: pool, stop: stop, logger: logger}
+	r.check(ctx)
+	go r.monitor(checkCtx)
+
+	return r, nil
+}
+
+func (r *replica) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	err := r.pool.Ping(ctx)
+	r.setHealthy(err == nil, err)
+}
+
+func (r *replica) setHealthy(healthy bool, err error) {
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		r.logger.Infoln("replica is healthy, reads are routed to it")
+	} else {
+		r.logger.Warnln("replica is unhealthy, reads fall back to primary:", err)
+	}
+}
+
+func (r *replica) monitor(ctx context.Context) {
+	ticker := time.NewTicker(replicaCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *replica) close() {
+	r.stop()
+	r.pool.Close()
+}
+
+// Executes read-only fnc on the replica if it's healthy, otherwise on the primary.
+// Reads on the replica aren't retried, they fall back to the primary instead
+func (pg *PgSQL) ExecuteReadTx(ctx context.Context, txOptions pgx.TxOptions, fnc func(pgx.Tx) error) error {
+	if r := pg.replica; r != nil && r.healthy.Load() {
+		err := executeTx(ctx, r.pool, 0, txOptions, fnc)
+		if err == nil || !isConnError(err) || ctx.Err() != nil {
+			return err
+		}
+		r.setHealthy(false, err)
+	}
+
+	return pg.ExecuteTx(ctx, txOptions, fnc)
+}
+
+// Reports whether err is caused by lost connection, errors of queries don't tell about health of the replica
+func isConnError(err error) bool {
+	var (
+		connErr *pgconn.ConnectError
+		netErr  net.Error
+	)
+	return pgconn.SafeToRetry(err) || errors.As(err, &connErr) || errors.As(err, &netErr)
+}
+
+// Returns storage which reads the primary only, e.g. to load state which must include the latest writes.
+// It shares connections with pg, so it mustn't be closed
+func (pg *PgSQL) Primary() *PgSQL {
+	p := *pg
+	p.replica = nil
+	return &p
+}
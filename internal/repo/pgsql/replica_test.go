@@ -0,0 +1,116 @@
+package pgsql
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Returns pool of server which refuses connections, errors of it contain the address
+func refusingPool(t *testing.T, addr string) *pgxpool.Pool {
+	t.Helper()
+
+	pool, err := pgxpool.New(context.Background(), "postgres://user@"+addr+"/db?connect_timeout=1")
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	return pool
+}
+
+func TestExecuteReadTx_Fallback(t *testing.T) {
+	ctx := context.Background()
+	r := &replica{pool: refusingPool(t, "127.0.0.1:2"), stop: func() {}, logger: zap.NewNop().Sugar()}
+	r.healthy.Store(true)
+	pg := &PgSQL{Pool: refusingPool(t, "127.0.0.1:1"), replica: r, logger: zap.NewNop().Sugar()}
+
+	readOnly := pgx.TxOptions{AccessMode: pgx.ReadOnly}
+	read := func(tx pgx.Tx) error { return nil }
+
+	// the failed read on the replica falls back to the primary at once
+	err := pg.ExecuteReadTx(ctx, readOnly, read)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "127.0.0.1:1")
+	assert.False(t, r.healthy.Load(), "health is lost on the failed read")
+
+	// unreachable replica stays unhealthy until it's checked
+	r.check(ctx)
+	assert.False(t, r.healthy.Load())
+
+	// reads of the primary storage bypass the replica
+	r.healthy.Store(true)
+	err = pg.Primary().ExecuteReadTx(ctx, readOnly, read)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "127.0.0.1:1")
+	assert.True(t, r.healthy.Load(), "the replica isn't read")
+	assert.NotNil(t, pg.replica)
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "positive test #1 (failed to connect)",
+			err:  fmt.Errorf("failed to begin tx: %w", &pgconn.ConnectError{}),
+			want: true,
+		},
+		{
+			name: "positive test #2 (network error)",
+			err:  &net.OpError{Op: "read", Err: syscall.ECONNRESET},
+			want: true,
+		},
+		{
+			name: "negative test #1 (query error)",
+			err:  &pgconn.PgError{Code: "42P01"},
+		},
+		{
+			name: "negative test #2 (canceled read)",
+			err:  context.Canceled,
+		},
+		{
+			name: "negative test #3 (no rows)",
+			err:  pgx.ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isConnError(tt.err))
+		})
+	}
+}
+
+func TestReplica_Recovery(t *testing.T) {
+	pg := openTest(t)
+	ctx := context.Background()
+
+	r, err := connectReplica(ctx, os.Getenv("TEST_DATABASE_DSN"), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer r.close()
+	require.True(t, r.healthy.Load())
+	pg.replica = r
+	defer func() { pg.replica = nil }()
+
+	// the replica is read again once the check succeeds
+	r.setHealthy(false, nil)
+	r.check(ctx)
+	assert.True(t, r.healthy.Load())
+
+	var one int
+	require.NoError(t, pg.ExecuteReadTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, "SELECT 1").Scan(&one)
+	}))
+	assert.Equal(t, 1, one)
+	assert.True(t, r.healthy.Load())
+}
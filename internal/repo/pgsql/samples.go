@@ -0,0 +1,378 @@
+package pgsql
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5"
+)
+
+// samples are appended in the same statement as values are upserted
+var appendSampleQry = `
+	WITH up AS (%s RETURNING name, labels, value)
+	INSERT INTO samples_table (mtype, name, labels, value)
+	SELECT '%s', name, labels, value FROM up;
+`
+
+// Wraps upsert query, so the resulting value is appended to samples_table
+func withSample(mtype string, upsertQry string) string {
+	upsert := strings.TrimSuffix(strings.TrimSpace(upsertQry), ";")
+	return fmt.Sprintf(appendSampleQry, upsert, mtype)
+}
+
+const (
+	partitionPrefix = "samples_table_p"
+	partitionLayout = "20060102"
+	partitionsAhead = 2
+	// interval of creating and dropping partitions
+	partitionsCheck = time.Hour
+	// partition of samples which don't fit daily ones, see migrations
+	defaultPartition = "samples_table_default"
+)
+
+func partitionName(day time.Time) string {
+	return partitionPrefix + day.Format(partitionLayout)
+}
+
+// Returns the first day of samples of daily partition, false if it isn't a daily partition
+func partitionDay(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, partitionPrefix) {
+		return time.Time{}, false
+	}
+
+	day, err := time.Parse(partitionLayout, strings.TrimPrefix(name, partitionPrefix))
+	return day, err == nil
+}
+
+// Returns daily partitions which contain samples older than cutoff only
+func expiredPartitions(names []string, cutoff time.Time) []string {
+	expired := make([]string, 0)
+	for _, name := range names {
+		day, ok := partitionDay(name)
+		if ok && !day.AddDate(0, 0, 1).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+
+	return expired
+}
+
+func listPartitions(ctx context.Context, tx pgx.Tx) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'samples_table'
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// Creates daily partitions of samples_table from the day of t for partitionsAhead days.
+// Samples of these days could be written to the default partition already, a partition can't be created
+// over them, so they're moved to the daily partition before it's attached
+func (pg *PgSQL) createPartitions(ctx context.Context, t time.Time) error {
+	day := t.UTC().Truncate(24 * time.Hour)
+
+	return pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			names, err := listPartitions(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			for i := range partitionsAhead + 1 {
+				from := day.AddDate(0, 0, i)
+				to := from.AddDate(0, 0, 1)
+				name := partitionName(from)
+				if slices.Contains(names, name) {
+					continue
+				}
+
+				args := pgx.NamedArgs{"from": from, "to": to}
+				b := &pgx.Batch{}
+				b.Queue(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (LIKE samples_table INCLUDING DEFAULTS)`, name))
+				b.Queue(fmt.Sprintf(`
+					WITH moved AS (
+						DELETE FROM %s WHERE received_at >= @from AND received_at < @to RETURNING *
+					)
+					INSERT INTO %s SELECT * FROM moved
+				`, defaultPartition, name), args)
+				b.Queue(fmt.Sprintf(
+					`ALTER TABLE samples_table ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`,
+					name, from.Format(time.RFC3339), to.Format(time.RFC3339),
+				))
+				if err := tx.SendBatch(ctx, b).Close(); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+}
+
+// Drops partitions of samples_table which contain samples older than retention only,
+// old samples of the default partition are deleted
+func (pg *PgSQL) dropPartitions(ctx context.Context, t time.Time, retention time.Duration) ([]string, error) {
+	cutoff := t.UTC().Add(-retention)
+	var dropped []string
+
+	err := pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			names, err := listPartitions(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			dropped = expiredPartitions(names, cutoff)
+			for _, name := range dropped {
+				if _, err := tx.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+					return err
+				}
+			}
+
+			if slices.Contains(names, defaultPartition) {
+				_, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE received_at < @cutoff`, defaultPartition),
+					pgx.NamedArgs{"cutoff": cutoff})
+				return err
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return dropped, nil
+}
+
+// Creates partitions of samples_table ahead and drops ones older than retention,
+// runs every hour until ctx is done
+func (pg *PgSQL) ScheduleRetention(ctx context.Context, retention time.Duration) error {
+	ticker := time.NewTicker(partitionsCheck)
+	defer ticker.Stop()
+
+	for {
+		if err := pg.createPartitions(ctx, time.Now()); err != nil {
+			pg.logger.Errorln("creating partitions of samples failed with error:", err)
+		}
+
+		if retention > 0 {
+			dropped, err := pg.dropPartitions(ctx, time.Now(), retention)
+			if err != nil {
+				pg.logger.Errorln("dropping partitions of samples failed with error:", err)
+			} else if len(dropped) > 0 {
+				pg.logger.Infoln("dropped partitions of samples:", dropped)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns samples of gauge or counter series within [from, to], zero bounds are open.
+//
+// If step is set, only the last sample of every step starting from the from bound is returned,
+// samples are read from the coarsest rollup which resolution fits the step. The latest bucket of the rollup
+// could be incomplete, so samples since its start are read raw.
+func (pg *PgSQL) GetHistory(
+	ctx context.Context, mtype string, name string, from time.Time, to time.Time, step time.Duration,
+) ([]mondata.Sample, bool, error) {
+	n, labels, err := mondata.ParseSeriesKey(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	args := pgx.NamedArgs{"mtype": mtype, "name": n, "labels": labels}
+	series := "mtype = @mtype AND name = @name AND labels = @labels"
+	src := fmt.Sprintf("SELECT received_at AS t, value AS v FROM samples_table WHERE %s", series)
+	if lvl := mondata.RollupLevel(step); lvl >= 0 {
+		res := mondata.RollupResolutions[lvl]
+		latest := fmt.Sprintf(
+			"(SELECT coalesce(max(bucket), '-infinity') FROM samples_rollup_table WHERE resolution = @res AND %s)", series)
+		src = fmt.Sprintf(`
+			SELECT bucket AS t, last AS v FROM samples_rollup_table WHERE resolution = @res AND %[1]s AND bucket < %[2]s
+			UNION ALL
+			SELECT received_at AS t, value AS v FROM samples_table WHERE %[1]s AND received_at >= %[2]s
+		`, series, latest)
+		args["res"] = int(res.Seconds())
+		from = from.Truncate(res)
+	}
+
+	bounds := make([]string, 0, 2)
+	if !from.IsZero() {
+		bounds = append(bounds, "t >= @from")
+		args["from"] = from
+	}
+	if !to.IsZero() {
+		bounds = append(bounds, "t <= @to")
+		args["to"] = to
+	}
+	where := ""
+	if len(bounds) > 0 {
+		where = " WHERE " + strings.Join(bounds, " AND ")
+	}
+
+	qry := fmt.Sprintf(`SELECT t, v FROM (%s) s%s ORDER BY t`, src, where)
+	if step > 0 {
+		origin := from
+		if origin.IsZero() {
+			origin = time.Unix(0, 0)
+		}
+		args["step"] = step.Microseconds()
+		args["origin"] = origin
+		qry = fmt.Sprintf(`
+			SELECT t, v FROM (
+				SELECT DISTINCT ON (bin) date_bin(@step::double precision * interval '1 microsecond', t, @origin) AS bin, t, v
+				FROM (%s) s%s
+				ORDER BY bin, t DESC
+			) b ORDER BY t
+		`, src, where)
+	}
+
+	var samples []mondata.Sample
+	err = pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadOnly},
+		func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, qry, args)
+			if err != nil {
+				return err
+			}
+
+			samples, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (mondata.Sample, error) {
+				var s mondata.Sample
+				err := row.Scan(&s.T, &s.V)
+				return s, err
+			})
+			return err
+		})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(samples) == 0 {
+		ok, err := pg.hasSeries(ctx, mtype, name)
+		return samples, ok, err
+	}
+
+	return samples, true, nil
+}
+
+// Checks whether gauge or counter series exists
+func (pg *PgSQL) hasSeries(ctx context.Context, mtype string, name string) (bool, error) {
+	switch mtype {
+	case mondata.GaugeType:
+		_, ok, err := pg.GetGauge(ctx, name)
+		return ok, err
+	case mondata.CounterType:
+		_, ok, err := pg.GetCounter(ctx, name)
+		return ok, err
+	default:
+		return false, fmt.Errorf("history isn't kept for %s metrics", mtype)
+	}
+}
+
+var upsertRollupSetQry = `
+	ON CONFLICT (resolution, mtype, name, labels, bucket)
+	DO UPDATE SET
+		min = EXCLUDED.min,
+		max = EXCLUDED.max,
+		sum = EXCLUDED.sum,
+		count = EXCLUDED.count,
+		last = EXCLUDED.last,
+		inc = EXCLUDED.inc;
+`
+
+// the finest rollup is aggregated from raw samples, the previous sample of the first one of every series
+// is the last one before @from, it's read by the index of series. Value which went down was reset or wrapped,
+// so all of it is an increase
+var rollupRawQry = `
+	WITH win AS (
+		SELECT mtype, name, labels, value, received_at FROM samples_table WHERE received_at >= @from
+	), prev AS (
+		SELECT f.mtype, f.name, f.labels, p.value
+		FROM (SELECT mtype, name, labels, min(received_at) AS first FROM win GROUP BY mtype, name, labels) f
+		CROSS JOIN LATERAL (
+			SELECT value FROM samples_table s
+			WHERE s.mtype = f.mtype AND s.name = f.name AND s.labels = f.labels AND s.received_at < f.first
+			ORDER BY s.received_at DESC
+			LIMIT 1
+		) p
+	)
+	INSERT INTO samples_rollup_table (resolution, mtype, name, labels, bucket, min, max, sum, count, last, inc)
+	SELECT @res::integer, mtype, name, labels, bucket,
+		min(value), max(value), sum(value), count(*),
+		(array_agg(value ORDER BY received_at DESC))[1],
+		sum(CASE WHEN prev_value IS NULL THEN 0 WHEN value < prev_value THEN value ELSE value - prev_value END)
+	FROM (
+		SELECT w.mtype, w.name, w.labels, w.value, w.received_at,
+			date_bin(make_interval(secs => @res::integer), w.received_at, TIMESTAMPTZ 'epoch') AS bucket,
+			coalesce(lag(w.value) OVER (PARTITION BY w.mtype, w.name, w.labels ORDER BY w.received_at), p.value) AS prev_value
+		FROM win w
+		LEFT JOIN prev p ON p.mtype = w.mtype AND p.name = w.name AND p.labels = w.labels
+	) s
+	GROUP BY mtype, name, labels, bucket
+` + upsertRollupSetQry
+
+// coarser rollups are aggregated from the previous ones
+var rollupLevelQry = `
+	INSERT INTO samples_rollup_table (resolution, mtype, name, labels, bucket, min, max, sum, count, last, inc)
+	SELECT @res::integer, mtype, name, labels, date_bin(make_interval(secs => @res::integer), bucket, TIMESTAMPTZ 'epoch') AS b,
+		min(min), max(max), sum(sum), sum(count),
+		(array_agg(last ORDER BY bucket DESC))[1],
+		sum(inc)
+	FROM samples_rollup_table
+	WHERE resolution = @src AND bucket >= @from
+	GROUP BY mtype, name, labels, b
+` + upsertRollupSetQry
+
+// Rolls raw samples up into aggregates of mondata.RollupResolutions,
+// the last bucket of every resolution could be incomplete, so it's aggregated again on the next run
+func (pg *PgSQL) Rollup(ctx context.Context) error {
+	return pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			for lvl, res := range mondata.RollupResolutions {
+				sec := int(res.Seconds())
+
+				var from *time.Time
+				row := tx.QueryRow(ctx, `SELECT max(bucket) FROM samples_rollup_table WHERE resolution = @res`,
+					pgx.NamedArgs{"res": sec})
+				if err := row.Scan(&from); err != nil {
+					return err
+				}
+				if from == nil {
+					from = &time.Time{}
+				}
+
+				args := pgx.NamedArgs{"res": sec, "from": *from}
+				qry := rollupRawQry
+				if lvl > 0 {
+					args["src"] = int(mondata.RollupResolutions[lvl-1].Seconds())
+					qry = rollupLevelQry
+				}
+
+				if _, err := tx.Exec(ctx, qry, args); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+}
@@ -0,0 +1,192 @@
+package pgsql
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Tests of queries need PostgreSQL, see openBench, series of them are named with test_ prefix
+func openTest(t *testing.T) *PgSQL {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN isn't set")
+	}
+
+	u, err := url.Parse(dsn)
+	require.NoError(t, err)
+
+	pg, err := Open(context.Background(), u, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		ctx := context.Background()
+		for _, table := range []string{"gauge_m_table", "counter_m_table", "samples_table", "samples_rollup_table"} {
+			_, err := pg.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE name LIKE 'test\_%%'`, table))
+			assert.NoError(t, err)
+		}
+		pg.Close()
+	})
+
+	return pg
+}
+
+func TestPartitionName(t *testing.T) {
+	day := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	name := partitionName(day)
+	assert.Equal(t, "samples_table_p20240309", name)
+
+	parsed, ok := partitionDay(name)
+	require.True(t, ok)
+	assert.Equal(t, day, parsed)
+
+	_, ok = partitionDay(defaultPartition)
+	assert.False(t, ok, "the default partition isn't a daily one")
+	_, ok = partitionDay("samples_table_pX")
+	assert.False(t, ok)
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	names := []string{
+		defaultPartition,
+		"samples_table_p20240307",
+		"samples_table_p20240308",
+		"samples_table_p20240309",
+		"samples_table_p20240310",
+	}
+
+	tests := []struct {
+		name   string
+		cutoff time.Time
+		want   []string
+	}{
+		{
+			name:   "positive test #1 (partition ending at cutoff is expired)",
+			cutoff: time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC),
+			want:   []string{"samples_table_p20240307", "samples_table_p20240308"},
+		},
+		{
+			name:   "positive test #2 (partition containing cutoff is kept)",
+			cutoff: time.Date(2024, 3, 9, 23, 59, 0, 0, time.UTC),
+			want:   []string{"samples_table_p20240307", "samples_table_p20240308"},
+		},
+		{
+			name:   "positive test #3 (nothing expired)",
+			cutoff: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC),
+			want:   []string{},
+		},
+		{
+			name:   "positive test #4 (the default partition is never dropped)",
+			cutoff: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			want:   names[1:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, expiredPartitions(names, tt.cutoff))
+		})
+	}
+}
+
+func TestPgSQL_DefaultPartition(t *testing.T) {
+	pg := openTest(t)
+	ctx := context.Background()
+
+	// a day far ahead, so its partition isn't created by the server yet
+	day := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.Cleanup(func() {
+		for i := range partitionsAhead + 1 {
+			_, err := pg.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, partitionName(day.AddDate(0, 0, i))))
+			assert.NoError(t, err)
+		}
+	})
+
+	_, err := pg.Exec(ctx,
+		`INSERT INTO samples_table (mtype, name, value, received_at) VALUES ('gauge', 'test_Alloc', 1, $1)`,
+		day.Add(time.Hour))
+	require.NoError(t, err, "samples which don't fit daily partitions are written to the default one")
+
+	require.NoError(t, pg.createPartitions(ctx, day))
+
+	var n int
+	row := pg.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE name = 'test_Alloc'`, partitionName(day)))
+	require.NoError(t, row.Scan(&n))
+	assert.Equal(t, 1, n, "samples are moved from the default partition")
+
+	row = pg.QueryRow(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE name = 'test_Alloc'`, defaultPartition))
+	require.NoError(t, row.Scan(&n))
+	assert.Equal(t, 0, n)
+
+	// partitions which exist already are skipped
+	require.NoError(t, pg.createPartitions(ctx, day))
+}
+
+func TestPgSQL_RollupIncrease(t *testing.T) {
+	pg := openTest(t)
+	ctx := context.Background()
+
+	bucket := time.Now().UTC().Truncate(time.Minute)
+	insert := func(name string, v float64, at time.Time) {
+		t.Helper()
+		_, err := pg.Exec(ctx,
+			`INSERT INTO samples_table (mtype, name, value, received_at) VALUES ('counter', $1, $2, $3)`, name, v, at)
+		require.NoError(t, err)
+	}
+
+	insert("test_PollCount", 5, bucket.Add(-3*time.Minute))
+	// another series moves the start of the next rollup past the previous sample of test_PollCount
+	insert("test_Other", 1, bucket.Add(-time.Minute))
+	require.NoError(t, pg.Rollup(ctx))
+
+	insert("test_PollCount", 8, bucket.Add(time.Second))
+	// the counter was reset
+	insert("test_PollCount", 3, bucket.Add(2*time.Second))
+	require.NoError(t, pg.Rollup(ctx))
+
+	var inc, last float64
+	row := pg.QueryRow(ctx, `
+		SELECT inc, last FROM samples_rollup_table
+		WHERE resolution = 60 AND mtype = 'counter' AND name = 'test_PollCount' AND bucket = $1
+	`, bucket)
+	require.NoError(t, row.Scan(&inc, &last))
+	assert.Equal(t, float64(3+3), inc, "the increase is counted from the sample before the rollup window")
+	assert.Equal(t, float64(3), last)
+}
+
+func TestPgSQL_HistoryRollup(t *testing.T) {
+	pg := openTest(t)
+	ctx := context.Background()
+
+	bucket := time.Now().UTC().Truncate(time.Minute)
+	insert := func(v float64, at time.Time) {
+		t.Helper()
+		_, err := pg.Exec(ctx,
+			`INSERT INTO samples_table (mtype, name, value, received_at) VALUES ('gauge', 'test_Alloc', $1, $2)`, v, at)
+		require.NoError(t, err)
+	}
+
+	insert(1, bucket.Add(-2*time.Minute+time.Second))
+	insert(2, bucket.Add(-2*time.Minute+30*time.Second))
+	insert(3, bucket.Add(-time.Minute+10*time.Second))
+	require.NoError(t, pg.Rollup(ctx))
+	// the latest bucket is stale once samples are added to it
+	insert(4, bucket.Add(-time.Minute+40*time.Second))
+
+	samples, _, err := pg.GetHistory(ctx, mondata.GaugeType, "test_Alloc", bucket.Add(-2*time.Minute), time.Time{}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.True(t, samples[0].T.Equal(bucket.Add(-2*time.Minute)), "rolled up bucket is read")
+	assert.Equal(t, float64(2), samples[0].V)
+	assert.True(t, samples[1].T.Equal(bucket.Add(-time.Minute+40*time.Second)), "the latest bucket is read raw")
+	assert.Equal(t, float64(4), samples[1].V)
+}
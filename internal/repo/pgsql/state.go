@@ -0,0 +1,220 @@
+package pgsql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/jackc/pgx/v5"
+)
+
+var seriesTables = []string{"gauge_m_table", "counter_m_table", "histogram_m_table", "meta_table"}
+
+var insertGaugeQry = `
+	INSERT INTO gauge_m_table (name, labels, value, sampled_at, wrapped_at, updated_at)
+	VALUES (@name, @labels, @value, @sampled, @wrapped, @updated);
+`
+
+var insertCounterQry = `
+	INSERT INTO counter_m_table (name, labels, value, total, sampled_at, wrapped_at, updated_at)
+	VALUES (@name, @labels, @value, @total, @sampled, @wrapped, @updated);
+`
+
+func readTotals(ctx context.Context, tx pgx.Tx, totals mondata.CounterMap) error {
+	rows, err := tx.Query(ctx, `SELECT name, labels, total FROM counter_m_table WHERE total IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			k      string
+			labels map[string]string
+			total  counterNumeric
+		)
+
+		if err = rows.Scan(&k, &labels, &total); err != nil {
+			return err
+		}
+		totals[mondata.SeriesKey(k, labels)] = mondata.CounterVType(total)
+	}
+
+	return rows.Err()
+}
+
+func readHistograms(ctx context.Context, tx pgx.Tx, hm mondata.HistogramMap) error {
+	rows, err := tx.Query(ctx, `SELECT name, labels, bounds, counts, sum, count FROM histogram_m_table`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			k      string
+			labels map[string]string
+			v      mondata.HistogramVType
+		)
+
+		if err = rows.Scan(&k, &labels, &v.Bounds, &v.Counts, &v.Sum, &v.Count); err != nil {
+			return err
+		}
+		hm[mondata.SeriesKey(k, labels)] = v
+	}
+
+	return rows.Err()
+}
+
+func readMeta(ctx context.Context, tx pgx.Tx, mm mondata.MetaMap) error {
+	rows, err := tx.Query(ctx, `SELECT name, unit, description, help, precision FROM meta_table`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m mondata.Meta
+		if err = rows.Scan(&m.Name, &m.Unit, &m.Description, &m.Help, &m.Precision); err != nil {
+			return err
+		}
+		mm[m.Name] = m
+	}
+
+	return rows.Err()
+}
+
+// Returns the whole stored state read within a single repeatable read transaction.
+// It's read from the primary, since the state must include writes which replica could lag behind
+func (pg *PgSQL) GetState(ctx context.Context) (mondata.State, error) {
+	var st mondata.State
+
+	err := pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly},
+		func(tx pgx.Tx) error {
+			st = mondata.State{
+				Snapshot:   mondata.NewSnapshot(),
+				Totals:     make(mondata.CounterMap),
+				Histograms: make(mondata.HistogramMap),
+				Meta:       make(mondata.MetaMap),
+			}
+
+			if err := readSeries(ctx, tx, "gauge_m_table", st.Gauges, st.GaugeStamps); err != nil {
+				return err
+			}
+			if err := readSeries(ctx, tx, "counter_m_table", st.Counters, st.CounterStamps); err != nil {
+				return err
+			}
+			if err := readTotals(ctx, tx, st.Totals); err != nil {
+				return err
+			}
+			if err := readHistograms(ctx, tx, st.Histograms); err != nil {
+				return err
+			}
+
+			return readMeta(ctx, tx, st.Meta)
+		})
+	if err != nil {
+		return mondata.State{}, err
+	}
+
+	return st, nil
+}
+
+// Queues inserting series with their timestamps and totals, series without timestamps are received now
+func queueSeries[T mondata.VTypes](
+	b *pgx.Batch, qry string, vals map[string]T, stamps mondata.StampMap, totals mondata.CounterMap,
+) error {
+	now := time.Now()
+	for k, v := range vals {
+		n, labels, err := mondata.ParseSeriesKey(k)
+		if err != nil {
+			return err
+		}
+
+		st, ok := stamps[k]
+		if !ok {
+			st.Received = now
+		}
+
+		var value any = v
+		if c, ok := value.(mondata.CounterVType); ok {
+			value = counterNumeric(c)
+		}
+		var total *counterNumeric
+		if t, ok := totals[k]; ok {
+			c := counterNumeric(t)
+			total = &c
+		}
+
+		b.Queue(qry, pgx.NamedArgs{
+			"name":    n,
+			"labels":  labels,
+			"value":   value,
+			"total":   total,
+			"sampled": st.Sampled,
+			"wrapped": st.Wrapped,
+			"updated": st.Received,
+		})
+	}
+
+	return nil
+}
+
+// Replaces the whole stored state by state of another storage within a single transaction,
+// other instances reload their state once it's committed
+func (pg *PgSQL) LoadState(ctx context.Context, st mondata.State) error {
+	return pg.ExecuteTx(
+		ctx,
+		pgx.TxOptions{AccessMode: pgx.ReadWrite},
+		func(tx pgx.Tx) error {
+			b := &pgx.Batch{}
+			for _, table := range seriesTables {
+				b.Queue(fmt.Sprintf(`DELETE FROM %s`, table))
+			}
+
+			if err := queueSeries(b, insertGaugeQry, st.Gauges, st.GaugeStamps, nil); err != nil {
+				return err
+			}
+			if err := queueSeries(b, insertCounterQry, st.Counters, st.CounterStamps, st.Totals); err != nil {
+				return err
+			}
+
+			for k, v := range st.Histograms {
+				n, labels, err := mondata.ParseSeriesKey(k)
+				if err != nil {
+					return err
+				}
+				if v.Bounds == nil {
+					v.Bounds = []float64{}
+				}
+				// histograms aren't stored yet, so they aren't merged
+				b.Queue(upsertHistogramQry, pgx.NamedArgs{
+					"name":   n,
+					"labels": labels,
+					"bounds": v.Bounds,
+					"counts": v.Counts,
+					"sum":    v.Sum,
+					"count":  v.Count,
+				})
+			}
+
+			for k, m := range st.Meta {
+				b.Queue(upsertMetaQry, pgx.NamedArgs{
+					"name":        k,
+					"unit":        m.Unit,
+					"description": m.Description,
+					"help":        m.Help,
+					"precision":   m.Precision,
+				})
+			}
+
+			if err := tx.SendBatch(ctx, b).Close(); err != nil {
+				return err
+			}
+
+			return pg.notifyReload(ctx, tx)
+		})
+}
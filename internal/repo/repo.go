@@ -2,9 +2,12 @@ package repo
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Allegathor/perfmon/internal/mondata"
-	"github.com/Allegathor/perfmon/internal/repo/memory"
+	"github.com/Allegathor/perfmon/internal/repo/history"
 	"github.com/Allegathor/perfmon/internal/repo/pgsql"
 	"go.uber.org/zap"
 )
@@ -15,6 +18,15 @@ type MetricsGetters interface {
 
 	GetCounter(ctx context.Context, name string) (mondata.CounterVType, bool, error)
 	GetCounterAll(ctx context.Context) (mondata.CounterMap, error)
+
+	GetHistogram(ctx context.Context, name string) (mondata.HistogramVType, bool, error)
+	GetHistogramAll(ctx context.Context) (mondata.HistogramMap, error)
+
+	GetStamp(ctx context.Context, mtype string, name string) (mondata.Stamp, bool, error)
+	GetStampAll(ctx context.Context, mtype string) (mondata.StampMap, error)
+
+	// Returns gauges and counters with their timestamps as of the same moment
+	GetSnapshot(ctx context.Context) (mondata.Snapshot, error)
 }
 
 type MetricsSetters interface {
@@ -23,68 +35,249 @@ type MetricsSetters interface {
 
 	SetCounter(ctx context.Context, name string, value mondata.CounterVType) error
 	SetCounterAll(ctx context.Context, gaugeMap mondata.CounterMap) error
+	SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error
+	SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error
+
+	SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error
+	SetHistogramAll(ctx context.Context, histogramMap mondata.HistogramMap) error
+
+	SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error
+
+	// Stores gauges and counters of a report all together, none of them are stored if it fails
+	ApplyBatch(ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap) error
+}
+
+// MetadataRepo keeps unit, description and display hints of metrics by their names
+type MetadataRepo interface {
+	GetMeta(ctx context.Context, name string) (mondata.Meta, bool, error)
+	GetMetaAll(ctx context.Context) (mondata.MetaMap, error)
+	SetMetaAll(ctx context.Context, metaMap mondata.MetaMap) error
 }
 
 type MetricsRepo interface {
 	MetricsGetters
 	MetricsSetters
+	MetadataRepo
+	Evict(ctx context.Context, policy mondata.TTLPolicy) ([]mondata.SeriesRef, error)
 	Ping(ctx context.Context) error
 	Close()
 }
 
-type backupWriter interface {
-	RestorePrev(MetricsRepo) error
-	Schedule(context.Context, MetricsRepo) error
-	ShouldRestore() bool
-}
-
 type Current struct {
 	MetricsRepo
-	bkp        backupWriter
-	logger     *zap.SugaredLogger
-	isInMemory bool
+	history *history.Store
+	buffer  *writeBuffer // nil unless backend is buffered
+	limit   *seriesLimit // nil unless number of series is limited
+	logger  *zap.SugaredLogger
+
+	mu          sync.Mutex
+	subscribers []func(mondata.Change)
 }
 
-func Init(ctx context.Context, connStr string, bkp backupWriter, logger *zap.SugaredLogger) *Current {
+// Initializes storage by DSN, backend is chosen by scheme of the DSN, see Register.
+// historySize is the number of samples kept in history of every series in memory,
+// if backend doesn't keep samples by itself.
+//
+// Writes to buffered backend are kept in memory while it's unreachable,
+// write_buffer option of DSN limits their number, 0 disables buffering.
+// buffer_state option limits the number of series of the last known state of backend,
+// which serves reads while it's unreachable
+func Init(ctx context.Context, dsn string, historySize uint, logger *zap.SugaredLogger) (*Current, error) {
+	b, u, err := lookup(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	bufferSize, stateSize := 0, 0
+	if b.Buffered {
+		if bufferSize, err = takeCount(u, bufferSizeOpt, defaultBufferSize); err != nil {
+			return nil, err
+		}
+		if stateSize, err = takeCount(u, bufferStateOpt, defaultBufferState); err != nil {
+			return nil, err
+		}
+	}
+
+	l := logger.Named(b.Name)
+	r, err := b.Open(ctx, u, l)
+	if err != nil {
+		return nil, fmt.Errorf("init %s failed: %w", b.Name, err)
+	}
+
+	c := &Current{MetricsRepo: r, logger: l}
+	if _, ok := primaryOf(r).(historyRepo); !ok {
+		c.history = history.New(historySize)
+	}
 
-	l := logger.Named("PostgreSQL DB")
-	if connStr != "" {
-		if pg, err := pgsql.Init(ctx, connStr, l); err != nil {
-			l.Errorln("init PostgreSQL failed with error:", err)
-		} else {
-			return &Current{MetricsRepo: pg, bkp: bkp, logger: l, isInMemory: false}
+	if bufferSize > 0 {
+		if err := c.enableBuffer(ctx, bufferSize, stateSize); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("init %s failed: %w", b.Name, err)
 		}
 	}
 
-	l = logger.Named("in-memory storage")
-	ms, _ := memory.Init(ctx, l)
+	return c, nil
+}
 
-	return &Current{MetricsRepo: ms, bkp: bkp, logger: l, isInMemory: true}
+// Backend which restores values on startup
+type restoreRepo interface {
+	Restore() error
 }
 
+// Restores values if backend keeps them outside of DB, e.g. in write-ahead log
 func (c *Current) Restore() error {
-	if c.isInMemory {
-		if c.bkp.ShouldRestore() {
-			err := c.bkp.RestorePrev(c.MetricsRepo)
+	rr, ok := c.MetricsRepo.(restoreRepo)
+	if !ok {
+		c.logger.Warn("restore: storage keeps values by itself")
+		return nil
+	}
+
+	if err := rr.Restore(); err != nil {
+		c.logger.Error("values couldn't be restored, error: ", err)
+		return err
+	}
+	return nil
+}
+
+// Backend which state could be copied to another storage
+type stateRepo interface {
+	GetState(ctx context.Context) (mondata.State, error)
+	LoadState(ctx context.Context, st mondata.State) error
+}
+
+// Returns backend which reads the primary database of storage with a read replica,
+// reads of the replica lag behind writes, so state which must include them is read by the primary
+func primaryReader(r MetricsRepo) MetricsRepo {
+	if pg, ok := primaryOf(r).(*pgsql.PgSQL); ok {
+		return pg.Primary()
+	}
+
+	return r
+}
+
+// Backend which accumulates counters by configurable overflow policy
+type overflowRepo interface {
+	Overflow() mondata.OverflowPolicy
+}
+
+// Returns overflow policy of counters of backend, storages of mirrored backend share it
+func (c *Current) Overflow() mondata.OverflowPolicy {
+	if or, ok := primaryOf(c.MetricsRepo).(overflowRepo); ok {
+		return or.Overflow()
+	}
+
+	return mondata.OverflowWrap
+}
+
+// Backend which keeps samples and drops old ones by itself
+type retentionRepo interface {
+	ScheduleRetention(ctx context.Context, retention time.Duration) error
+}
+
+// Drops samples older than retention from backend which keeps them
+func (c *Current) ScheduleRetention(ctx context.Context, retention time.Duration) error {
+	if rr, ok := c.MetricsRepo.(retentionRepo); ok {
+		return rr.ScheduleRetention(ctx, retention)
+	}
+
+	return nil
+}
+
+// interval of evicting stale series
+const evictionInterval = time.Minute
+
+// Periodically removes gauges and counters which weren't updated within TTL,
+// the index of limited series is reloaded afterwards, since other instances could evict series as well
+func (c *Current) ScheduleEviction(ctx context.Context, policy mondata.TTLPolicy) error {
+	if !policy.Enabled() {
+		return nil
+	}
+
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			evicted, err := c.Evict(ctx, policy)
 			if err != nil {
-				c.logger.Error("values couldn't be restored from backup, error: ", err)
-				return err
+				c.logger.Errorln("evicting stale series failed with error:", err)
+				continue
 			}
-			c.logger.Info("values were restored from backup file with success")
-			return nil
-		} else {
-			c.logger.Warn("restore: flag wasn't set")
+
+			for _, ref := range evicted {
+				if c.history != nil {
+					c.history.Delete(ref.MType, ref.Key)
+				}
+				c.logger.Infoln("evicted stale series", "type:", ref.MType, "key:", ref.Key)
+			}
+
+			if c.limit != nil {
+				if err := c.resyncSeries(ctx); err != nil {
+					c.logger.Errorln("reloading series after eviction failed with error:", err)
+				}
+			}
+		case <-ctx.Done():
 			return nil
 		}
 	}
+}
+
+// Backend which compacts its write-ahead log into snapshots
+type snapshotRepo interface {
+	ScheduleSnapshots(ctx context.Context) error
+}
+
+// Periodically compacts write-ahead log of backend into snapshot
+func (c *Current) ScheduleSnapshots(ctx context.Context) error {
+	if sr, ok := c.MetricsRepo.(snapshotRepo); ok {
+		return sr.ScheduleSnapshots(ctx)
+	}
+
+	return nil
+}
+
+// Backend which compares its storages
+type divergenceRepo interface {
+	ScheduleDivergenceChecks(ctx context.Context) error
+}
+
+// Periodically reports divergence between storages of mirrored backend
+func (c *Current) ScheduleDivergenceChecks(ctx context.Context) error {
+	if dr, ok := c.MetricsRepo.(divergenceRepo); ok {
+		return dr.ScheduleDivergenceChecks(ctx)
+	}
 
-	c.logger.Warn("restore: not a memory storage ")
 	return nil
 }
 
-func (c *Current) ScheduleBackup(ctx context.Context) error {
-	if c.isInMemory {
-		return c.bkp.Schedule(ctx, c.MetricsRepo)
+// Backend which notifies about changes made by other instances of server sharing it
+type changeRepo interface {
+	Listen(ctx context.Context, fn func(mondata.Change)) error
+}
+
+// Calls fn on every change made by other instances of server, fn mustn't block
+func (c *Current) Subscribe(fn func(mondata.Change)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribers = append(c.subscribers, fn)
+}
+
+func (c *Current) publish(change mondata.Change) {
+	c.mu.Lock()
+	subscribers := c.subscribers
+	c.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(change)
+	}
+}
+
+// Listens to changes made by other instances of server and passes them to subscribers
+func (c *Current) ListenChanges(ctx context.Context) error {
+	if cr, ok := primaryOf(c.MetricsRepo).(changeRepo); ok {
+		return cr.Listen(ctx, c.publish)
 	}
 
 	return nil
@@ -0,0 +1,135 @@
+package safe
+
+import (
+	"sync"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// HRepo is a storage for histograms,
+// writing to existing histogram merges buckets instead of overwriting them
+type HRepo struct {
+	mu   sync.RWMutex
+	Data map[string]mondata.Histogram
+}
+
+type HRepoTx struct {
+	repo     *HRepo
+	writable bool
+}
+
+func (tx *HRepoTx) Get(name string) (mondata.Histogram, bool) {
+	v, ok := tx.repo.Data[name]
+	return v.Clone(), ok
+}
+
+func (tx *HRepoTx) GetAll() map[string]mondata.Histogram {
+	m := make(map[string]mondata.Histogram, len(tx.repo.Data))
+	for k, v := range tx.repo.Data {
+		m[k] = v.Clone()
+	}
+
+	return m
+}
+
+// Replaces stored histogram, e.g. when it's restored
+func (tx *HRepoTx) Set(name string, h mondata.Histogram) {
+	tx.repo.Data[name] = h.Clone()
+}
+
+func (tx *HRepoTx) Delete(name string) {
+	delete(tx.repo.Data, name)
+}
+
+func (tx *HRepoTx) Merge(name string, h mondata.Histogram) error {
+	return tx.MergeAll(map[string]mondata.Histogram{name: h})
+}
+
+// Merges all provided histograms or none of them,
+// if bounds of any histogram don't match already stored ones
+func (tx *HRepoTx) MergeAll(data map[string]mondata.Histogram) error {
+	for k, v := range data {
+		if prev, ok := tx.repo.Data[k]; ok {
+			check := prev.Clone()
+			if err := check.Merge(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, v := range data {
+		if prev, ok := tx.repo.Data[k]; ok {
+			prev.Merge(v)
+			tx.repo.Data[k] = prev
+			continue
+		}
+		tx.repo.Data[k] = v.Clone()
+	}
+
+	return nil
+}
+
+func (tx *HRepoTx) Lock() {
+	if tx.writable {
+		tx.repo.mu.Lock()
+	} else {
+		tx.repo.mu.RLock()
+	}
+}
+
+func (tx *HRepoTx) Unlock() {
+	if tx.writable {
+		tx.repo.mu.Unlock()
+	} else {
+		tx.repo.mu.RUnlock()
+	}
+}
+
+func NewHRepo() *HRepo {
+	return &HRepo{
+		Data: make(map[string]mondata.Histogram),
+	}
+}
+
+func (r *HRepo) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.Data)
+}
+
+func (r *HRepo) Begin(writable bool) (*HRepoTx, error) {
+	tx := &HRepoTx{
+		repo:     r,
+		writable: writable,
+	}
+	tx.Lock()
+
+	return tx, nil
+}
+
+func (r *HRepo) Read(fn func(*HRepoTx) error) error {
+	tx, err := r.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		tx.Unlock()
+	}()
+
+	return fn(tx)
+}
+
+func (r *HRepo) Update(fn func(*HRepoTx) error) error {
+	tx, err := r.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		tx.Unlock()
+	}()
+
+	return fn(tx)
+}
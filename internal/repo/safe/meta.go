@@ -0,0 +1,56 @@
+package safe
+
+import (
+	"sync"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+// MetaRepo keeps metadata of metrics by their names
+type MetaRepo struct {
+	mu   sync.RWMutex
+	Data map[string]mondata.Meta
+}
+
+func NewMetaRepo() *MetaRepo {
+	return &MetaRepo{
+		Data: make(map[string]mondata.Meta),
+	}
+}
+
+func (r *MetaRepo) Get(name string) (mondata.Meta, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	v, ok := r.Data[name]
+	return v, ok
+}
+
+func (r *MetaRepo) GetAll() mondata.MetaMap {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(mondata.MetaMap, len(r.Data))
+	for k, v := range r.Data {
+		m[k] = v
+	}
+
+	return m
+}
+
+func (r *MetaRepo) SetAll(data mondata.MetaMap) {
+	r.Update(func(m map[string]mondata.Meta) error {
+		for k, v := range data {
+			m[k] = v
+		}
+		return nil
+	})
+}
+
+// Calls fn with stored metadata under the write lock
+func (r *MetaRepo) Update(fn func(map[string]mondata.Meta) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return fn(r.Data)
+}
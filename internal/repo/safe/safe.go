@@ -2,19 +2,70 @@ package safe
 
 import (
 	"sync"
+	"time"
 
 	"github.com/Allegathor/perfmon/internal/mondata"
 	"github.com/Allegathor/perfmon/internal/repo/transaction"
 )
 
 type MRepo[T mondata.VTypes] struct {
-	mu   sync.RWMutex
-	Data map[string]T
+	mu     sync.RWMutex
+	Data   map[string]T
+	Stamps mondata.StampMap // created on first write
+	Totals map[string]T     // last totals of cumulative series, created on first write
+	// policy of accumulating counters beyond the max value, floats don't overflow
+	Overflow mondata.OverflowPolicy
 }
 
 type MRepoTx[T mondata.VTypes] struct {
 	repo     *MRepo[T]
 	writable bool
+	now      time.Time
+}
+
+// Sets time of receiving for the value
+func (tx *MRepoTx[T]) touch(name string) {
+	if tx.repo.Stamps == nil {
+		tx.repo.Stamps = make(mondata.StampMap)
+	}
+
+	st := tx.repo.Stamps[name]
+	st.Received = tx.now
+	tx.repo.Stamps[name] = st
+}
+
+func (tx *MRepoTx[T]) Stamp(name string) (mondata.Stamp, bool) {
+	st, ok := tx.repo.Stamps[name]
+	return st, ok
+}
+
+func (tx *MRepoTx[T]) StampAll() mondata.StampMap {
+	m := make(mondata.StampMap, len(tx.repo.Stamps))
+	for k, v := range tx.repo.Stamps {
+		m[k] = v
+	}
+
+	return m
+}
+
+// Sets time when the value was sampled by agent
+func (tx *MRepoTx[T]) SetSampled(name string, t time.Time) {
+	if tx.repo.Stamps == nil {
+		tx.repo.Stamps = make(mondata.StampMap)
+	}
+
+	st := tx.repo.Stamps[name]
+	st.Sampled = &t
+	tx.repo.Stamps[name] = st
+}
+
+// Sets both timestamps of the value, e.g. when it's restored
+func (tx *MRepoTx[T]) SetStamp(name string, st mondata.Stamp) {
+	if tx.repo.Stamps == nil {
+		tx.repo.Stamps = make(mondata.StampMap)
+	}
+
+	tx.repo.Stamps[name] = st
 }
 
 func (tx *MRepoTx[T]) Get(name string) (T, bool) {
@@ -22,24 +73,106 @@ func (tx *MRepoTx[T]) Get(name string) (T, bool) {
 	return v, ok
 }
 
+// Returns copy of values, so it could be read after the transaction is over
 func (tx *MRepoTx[T]) GetAll() map[string]T {
-	return tx.repo.Data
+	m := make(map[string]T, len(tx.repo.Data))
+	for k, v := range tx.repo.Data {
+		m[k] = v
+	}
+
+	return m
 }
 
 func (tx *MRepoTx[T]) Set(name string, v T) {
 	tx.repo.Data[name] = v
+	tx.touch(name)
 }
 
-func (tx *MRepoTx[T]) SetAccum(name string, v T) {
-	if _, ok := tx.repo.Data[name]; ok {
-		tx.repo.Data[name] += v
-		return
+// Marks counter as wrapped around at the time of the transaction
+func (tx *MRepoTx[T]) wrap(name string) {
+	st := tx.repo.Stamps[name]
+	t := tx.now
+	st.Wrapped = &t
+	tx.repo.Stamps[name] = st
+}
+
+// Adds increment to the value according to the overflow policy
+func (tx *MRepoTx[T]) add(prev T, v T) (T, bool, error) {
+	c, ok := any(prev).(mondata.CounterVType)
+	if !ok {
+		return prev + v, false, nil
 	}
-	tx.repo.Data[name] = v
+
+	sum, wrapped, err := tx.repo.Overflow.Add(c, any(v).(mondata.CounterVType))
+	return T(sum), wrapped, err
+}
+
+// Accumulates the value, it isn't changed if the sum is rejected by the overflow policy
+func (tx *MRepoTx[T]) SetAccum(name string, v T) error {
+	sum, wrapped, err := tx.add(tx.repo.Data[name], v)
+	if err != nil {
+		return err
+	}
+
+	tx.repo.Data[name] = sum
+	tx.touch(name)
+	if wrapped {
+		tx.wrap(name)
+	}
+
+	return nil
+}
+
+// Accumulates increment of cumulative series since the previously stored total,
+// neither the value nor the total is changed if the sum is rejected by the overflow policy
+func (tx *MRepoTx[T]) SetTotal(name string, total T) error {
+	prev, seen := tx.repo.Totals[name]
+
+	// a decreased total means the source was restarted and counts from zero again
+	d := total - prev
+	if !seen || total < prev {
+		d = total
+	}
+	if err := tx.SetAccum(name, d); err != nil {
+		return err
+	}
+
+	if tx.repo.Totals == nil {
+		tx.repo.Totals = make(map[string]T)
+	}
+	tx.repo.Totals[name] = total
+
+	return nil
+}
+
+// Returns the last total of cumulative series
+func (tx *MRepoTx[T]) Total(name string) (T, bool) {
+	v, ok := tx.repo.Totals[name]
+	return v, ok
+}
+
+// Sets the last total of cumulative series without accumulating increment, e.g. when it's restored
+func (tx *MRepoTx[T]) SetLastTotal(name string, total T) {
+	if tx.repo.Totals == nil {
+		tx.repo.Totals = make(map[string]T)
+	}
+
+	tx.repo.Totals[name] = total
+}
+
+func (tx *MRepoTx[T]) SetTotalAll(data map[string]T) error {
+	for k, v := range data {
+		if err := tx.SetTotal(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (tx *MRepoTx[T]) SetAll(data map[string]T) {
 	for k, v := range data {
+		tx.touch(k)
 		if _, ok := tx.repo.Data[k]; ok {
 			tx.repo.Data[k] = v
 			continue
@@ -48,14 +181,21 @@ func (tx *MRepoTx[T]) SetAll(data map[string]T) {
 	}
 }
 
-func (tx *MRepoTx[T]) SetAccumAll(data map[string]T) {
+func (tx *MRepoTx[T]) SetAccumAll(data map[string]T) error {
 	for k, v := range data {
-		if _, ok := tx.repo.Data[k]; ok {
-			tx.repo.Data[k] += v
-			continue
+		if err := tx.SetAccum(k, v); err != nil {
+			return err
 		}
-		tx.repo.Data[k] = v
 	}
+
+	return nil
+}
+
+// Removes the value with its timestamps
+func (tx *MRepoTx[T]) Delete(name string) {
+	delete(tx.repo.Data, name)
+	delete(tx.repo.Stamps, name)
+	delete(tx.repo.Totals, name)
 }
 
 func (tx *MRepoTx[T]) Lock() {
@@ -84,6 +224,7 @@ func (r *MRepo[T]) Begin(writable bool) (*MRepoTx[T], error) {
 	tx := &MRepoTx[T]{
 		repo:     r,
 		writable: writable,
+		now:      time.Now(),
 	}
 	tx.Lock()
 
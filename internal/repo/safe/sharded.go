@@ -0,0 +1,289 @@
+package safe
+
+import (
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/transaction"
+)
+
+// ShardedMRepo splits series between stripes by hash of series key, every stripe is MRepo with its own lock.
+// Shards are always locked in ascending order, so transactions locking several of them don't deadlock
+type ShardedMRepo[T mondata.VTypes] struct {
+	seed   maphash.Seed
+	shards []*MRepo[T]
+}
+
+// ShardedMRepoTx routes calls to transactions of shards which own the series,
+// shards which aren't locked by the transaction mustn't be accessed
+type ShardedMRepoTx[T mondata.VTypes] struct {
+	repo   *ShardedMRepo[T]
+	txs    []*MRepoTx[T] // by index of shard, nil if it isn't locked
+	locked []int         // indexes of locked shards in ascending order
+}
+
+func NewShardedMRepo[T mondata.VTypes](n int) *ShardedMRepo[T] {
+	if n < 1 {
+		n = 1
+	}
+
+	r := &ShardedMRepo[T]{seed: maphash.MakeSeed(), shards: make([]*MRepo[T], n)}
+	for i := range r.shards {
+		r.shards[i] = NewMRepo[T]()
+	}
+
+	return r
+}
+
+// Sets policy of accumulating counters beyond the max value, it must be set before the repo is used
+func (r *ShardedMRepo[T]) SetOverflow(p mondata.OverflowPolicy) {
+	for _, s := range r.shards {
+		s.Overflow = p
+	}
+}
+
+// Returns the number of stored series, shards are counted one by one
+func (r *ShardedMRepo[T]) Len() int {
+	n := 0
+	for _, s := range r.shards {
+		s.mu.RLock()
+		n += len(s.Data)
+		s.mu.RUnlock()
+	}
+
+	return n
+}
+
+func (r *ShardedMRepo[T]) index(name string) int {
+	return int(maphash.String(r.seed, name) % uint64(len(r.shards)))
+}
+
+func (r *ShardedMRepo[T]) begin(writable bool, indexes []int) *ShardedMRepoTx[T] {
+	now := time.Now()
+	tx := &ShardedMRepoTx[T]{repo: r, txs: make([]*MRepoTx[T], len(r.shards)), locked: indexes}
+	for _, i := range indexes {
+		tx.txs[i] = &MRepoTx[T]{repo: r.shards[i], writable: writable, now: now}
+	}
+	tx.Lock()
+
+	return tx
+}
+
+func (r *ShardedMRepo[T]) all() []int {
+	indexes := make([]int, len(r.shards))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	return indexes
+}
+
+// Returns sorted indexes of shards which own keys
+func (r *ShardedMRepo[T]) owners(keys []string) []int {
+	seen := make(map[int]struct{}, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for _, k := range keys {
+		i := r.index(k)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// Reads all shards within a single transaction
+func (r *ShardedMRepo[T]) Read(fn func(transaction.TxQry[T]) error) error {
+	tx := r.begin(false, r.all())
+	defer tx.Unlock()
+
+	return fn(tx)
+}
+
+// Updates all shards within a single transaction, writers of any series wait for it
+func (r *ShardedMRepo[T]) Update(fn func(transaction.TxExec[T]) error) error {
+	tx := r.begin(true, r.all())
+	defer tx.Unlock()
+
+	return fn(tx)
+}
+
+// Updates keys shard by shard: fn is called with keys of a shard while only that shard is locked,
+// so batches with keys of different shards don't wait for each other. fn mustn't access other keys.
+// Keys of every shard are updated atomically, but the whole batch isn't: if fn fails, keys of previous shards stay updated
+func (r *ShardedMRepo[T]) UpdateSharded(keys []string, fn func(tx transaction.TxExec[T], keys []string) error) error {
+	// keys are grouped by shard with counting sort, starts[i] is the offset of keys of shard i
+	indexes := make([]int, len(keys))
+	starts := make([]int, len(r.shards)+1)
+	for j, k := range keys {
+		indexes[j] = r.index(k)
+		starts[indexes[j]+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+
+	sorted := make([]string, len(keys))
+	next := slices.Clone(starts[:len(r.shards)])
+	for j, k := range keys {
+		sorted[next[indexes[j]]] = k
+		next[indexes[j]]++
+	}
+
+	tx := &MRepoTx[T]{writable: true, now: time.Now()}
+	for i, shard := range r.shards {
+		from, to := starts[i], starts[i+1]
+		if from == to {
+			continue
+		}
+
+		tx.repo = shard
+		if err := updateShard(tx, sorted[from:to:to], fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateShard[T mondata.VTypes](tx *MRepoTx[T], keys []string, fn func(tx transaction.TxExec[T], keys []string) error) error {
+	tx.Lock()
+	defer tx.Unlock()
+
+	return fn(tx, keys)
+}
+
+// Updates keys within a single transaction which locks only shards owning them
+func (r *ShardedMRepo[T]) UpdateKeys(keys []string, fn func(transaction.TxExec[T]) error) error {
+	tx := r.begin(true, r.owners(keys))
+	defer tx.Unlock()
+
+	return fn(tx)
+}
+
+func (tx *ShardedMRepoTx[T]) shard(name string) *MRepoTx[T] {
+	i := tx.repo.index(name)
+	if tx.txs[i] == nil {
+		panic(fmt.Sprintf("shard %d of %q isn't locked by the transaction", i, name))
+	}
+
+	return tx.txs[i]
+}
+
+func (tx *ShardedMRepoTx[T]) Lock() {
+	for _, i := range tx.locked {
+		tx.txs[i].Lock()
+	}
+}
+
+func (tx *ShardedMRepoTx[T]) Unlock() {
+	for j := len(tx.locked) - 1; j >= 0; j-- {
+		tx.txs[tx.locked[j]].Unlock()
+	}
+}
+
+func (tx *ShardedMRepoTx[T]) Get(name string) (T, bool) {
+	return tx.shard(name).Get(name)
+}
+
+// Returns copy of values of locked shards
+func (tx *ShardedMRepoTx[T]) GetAll() map[string]T {
+	m := make(map[string]T)
+	for _, i := range tx.locked {
+		for k, v := range tx.txs[i].repo.Data {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
+func (tx *ShardedMRepoTx[T]) Stamp(name string) (mondata.Stamp, bool) {
+	return tx.shard(name).Stamp(name)
+}
+
+// Returns timestamps of locked shards
+func (tx *ShardedMRepoTx[T]) StampAll() mondata.StampMap {
+	m := make(mondata.StampMap)
+	for _, i := range tx.locked {
+		for k, v := range tx.txs[i].repo.Stamps {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
+func (tx *ShardedMRepoTx[T]) Total(name string) (T, bool) {
+	return tx.shard(name).Total(name)
+}
+
+func (tx *ShardedMRepoTx[T]) Set(name string, v T) {
+	tx.shard(name).Set(name, v)
+}
+
+func (tx *ShardedMRepoTx[T]) SetAll(data map[string]T) {
+	for k, v := range data {
+		tx.Set(k, v)
+	}
+}
+
+func (tx *ShardedMRepoTx[T]) SetAccum(name string, v T) error {
+	return tx.shard(name).SetAccum(name, v)
+}
+
+func (tx *ShardedMRepoTx[T]) SetAccumAll(data map[string]T) error {
+	for k, v := range data {
+		if err := tx.SetAccum(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *ShardedMRepoTx[T]) SetTotal(name string, total T) error {
+	return tx.shard(name).SetTotal(name, total)
+}
+
+func (tx *ShardedMRepoTx[T]) SetTotalAll(data map[string]T) error {
+	for k, v := range data {
+		if err := tx.SetTotal(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *ShardedMRepoTx[T]) SetLastTotal(name string, total T) {
+	tx.shard(name).SetLastTotal(name, total)
+}
+
+func (tx *ShardedMRepoTx[T]) SetSampled(name string, t time.Time) {
+	tx.shard(name).SetSampled(name, t)
+}
+
+func (tx *ShardedMRepoTx[T]) SetStamp(name string, st mondata.Stamp) {
+	tx.shard(name).SetStamp(name, st)
+}
+
+func (tx *ShardedMRepoTx[T]) Delete(name string) {
+	tx.shard(name).Delete(name)
+}
+
+// Creates repo with n shards filled with data, e.g. in tests
+func ShardedMRepoOf[T mondata.VTypes](n int, data map[string]T) *ShardedMRepo[T] {
+	r := NewShardedMRepo[T](n)
+	for k, v := range data {
+		r.shards[r.index(k)].Data[k] = v
+	}
+
+	return r
+}
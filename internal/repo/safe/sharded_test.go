@@ -0,0 +1,207 @@
+package safe
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/Allegathor/perfmon/internal/repo/transaction"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// number of metrics in a batch sent by agent to /updates
+const batchSize = 30
+
+var agentID atomic.Int64
+
+// Returns batch of the next agent, every agent reports the same metrics with its own host label
+func agentBatch() mondata.GaugeMap {
+	host := fmt.Sprintf("srv-%d", agentID.Add(1))
+	batch := make(mondata.GaugeMap, batchSize)
+	for i := range batchSize {
+		batch[mondata.SeriesKey(fmt.Sprintf("Metric%d", i), map[string]string{"host": host})] = float64(i)
+	}
+
+	return batch
+}
+
+func TestShardedMRepo(t *testing.T) {
+	r := NewShardedMRepo[mondata.CounterVType](8)
+	batch := mondata.CounterMap{}
+	for i := range 100 {
+		batch[fmt.Sprintf("Counter%d", i)] = uint64(i)
+	}
+
+	for range 2 {
+		err := r.UpdateSharded(keys(batch), func(tx transaction.TxExec[mondata.CounterVType], keys []string) error {
+			for _, k := range keys {
+				tx.SetAccum(k, batch[k])
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	r.Read(func(tx transaction.TxQry[mondata.CounterVType]) error {
+		all := tx.GetAll()
+		assert.Len(t, all, len(batch))
+		assert.Len(t, tx.StampAll(), len(batch))
+		for k, v := range batch {
+			assert.Equal(t, 2*v, all[k], k)
+		}
+		return nil
+	})
+
+	assert.Panics(t, func() {
+		r.UpdateKeys([]string{"Counter1"}, func(tx transaction.TxExec[mondata.CounterVType]) error {
+			for k := range batch {
+				tx.Set(k, 0)
+			}
+			return nil
+		})
+	}, "keys of shards which aren't locked mustn't be accessed")
+}
+
+func TestShardedMRepo_Overflow(t *testing.T) {
+	tests := []struct {
+		policy  mondata.OverflowPolicy
+		want    uint64
+		wrapped bool
+		err     error
+	}{
+		{policy: mondata.OverflowWrap, want: 4, wrapped: true},
+		{policy: mondata.OverflowSaturate, want: math.MaxUint64},
+		{policy: mondata.OverflowReject, want: math.MaxUint64 - 5, err: mondata.ErrCounterOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			r := NewShardedMRepo[mondata.CounterVType](4)
+			r.SetOverflow(tt.policy)
+
+			err := r.Update(func(tx transaction.TxExec[mondata.CounterVType]) error {
+				require.NoError(t, tx.SetAccum("BytesSent", math.MaxUint64-5))
+				require.NoError(t, tx.SetTotal("BytesRecv", math.MaxUint64-5))
+				return nil
+			})
+			require.NoError(t, err)
+
+			for _, set := range []func(tx transaction.TxExec[mondata.CounterVType]) error{
+				func(tx transaction.TxExec[mondata.CounterVType]) error { return tx.SetAccum("BytesSent", 10) },
+				// the total decreased, so it's accumulated as the increment since restart of the source
+				func(tx transaction.TxExec[mondata.CounterVType]) error { return tx.SetTotal("BytesRecv", 10) },
+			} {
+				err := r.Update(set)
+				if tt.err != nil {
+					assert.ErrorIs(t, err, tt.err)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+
+			r.Read(func(tx transaction.TxQry[mondata.CounterVType]) error {
+				for _, k := range []string{"BytesSent", "BytesRecv"} {
+					v, _ := tx.Get(k)
+					assert.Equal(t, tt.want, v, k)
+					st, _ := tx.Stamp(k)
+					assert.Equal(t, tt.wrapped, st.Wrapped != nil, k)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func keys[T any](m map[string]T) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+
+	return ks
+}
+
+// Shows gain on machines with several cores, e.g. go test -bench Updates -cpu 1,4,16 ./internal/repo/safe
+func BenchmarkUpdates(b *testing.B) {
+	b.Run("single_lock", func(b *testing.B) {
+		r := NewMRepo[mondata.GaugeVType]()
+		b.RunParallel(func(pb *testing.PB) {
+			batch := agentBatch()
+			for pb.Next() {
+				r.Update(func(tx transaction.TxExec[mondata.GaugeVType]) error {
+					tx.SetAll(batch)
+					return nil
+				})
+			}
+		})
+	})
+
+	for _, n := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("sharded/%d", n), func(b *testing.B) {
+			r := NewShardedMRepo[mondata.GaugeVType](n)
+			b.RunParallel(func(pb *testing.PB) {
+				batch := agentBatch()
+				keys := keys(batch)
+				for pb.Next() {
+					r.UpdateSharded(keys, func(tx transaction.TxExec[mondata.GaugeVType], keys []string) error {
+						for _, k := range keys {
+							tx.Set(k, batch[k])
+						}
+						return nil
+					})
+				}
+			})
+		})
+	}
+}
+
+// Batches are updated while dashboard reads all values
+func BenchmarkUpdatesWithReads(b *testing.B) {
+	read := func(r interface {
+		Read(func(transaction.TxQry[mondata.GaugeVType]) error) error
+	}) {
+		r.Read(func(tx transaction.TxQry[mondata.GaugeVType]) error {
+			_ = len(tx.GetAll())
+			return nil
+		})
+	}
+
+	b.Run("single_lock", func(b *testing.B) {
+		r := NewMRepo[mondata.GaugeVType]()
+		b.RunParallel(func(pb *testing.PB) {
+			batch := agentBatch()
+			for i := 0; pb.Next(); i++ {
+				if i%100 == 0 {
+					read(r)
+					continue
+				}
+				r.Update(func(tx transaction.TxExec[mondata.GaugeVType]) error {
+					tx.SetAll(batch)
+					return nil
+				})
+			}
+		})
+	})
+
+	b.Run("sharded/64", func(b *testing.B) {
+		r := NewShardedMRepo[mondata.GaugeVType](64)
+		b.RunParallel(func(pb *testing.PB) {
+			batch := agentBatch()
+			keys := keys(batch)
+			for i := 0; pb.Next(); i++ {
+				if i%100 == 0 {
+					read(r)
+					continue
+				}
+				r.UpdateSharded(keys, func(tx transaction.TxExec[mondata.GaugeVType], keys []string) error {
+					for _, k := range keys {
+						tx.Set(k, batch[k])
+					}
+					return nil
+				})
+			}
+		})
+	})
+}
@@ -0,0 +1,1267 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/failsafe-go/failsafe-go"
+	"github.com/failsafe-go/failsafe-go/retrypolicy"
+	"go.uber.org/zap"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// labels are stored as JSON with sorted keys, so equal label sets have equal text.
+// Timestamps are stored as unix nanoseconds, values and totals of counters are stored as bits of signed integers,
+// see counterBits. Gauges never wrap, wrapped_at keeps queries of timestamps the same for both tables
+var createTablesQry = `
+	CREATE TABLE IF NOT EXISTS gauge_m_table (
+		m_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		labels TEXT NOT NULL DEFAULT '{}',
+		value REAL NOT NULL DEFAULT 0,
+		sampled_at INTEGER,
+		wrapped_at INTEGER,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (name, labels)
+	);
+
+	CREATE TABLE IF NOT EXISTS counter_m_table (
+		m_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		labels TEXT NOT NULL DEFAULT '{}',
+		value INTEGER NOT NULL DEFAULT 0,
+		total INTEGER,
+		sampled_at INTEGER,
+		wrapped_at INTEGER,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (name, labels)
+	);
+
+	CREATE TABLE IF NOT EXISTS histogram_m_table (
+		m_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		labels TEXT NOT NULL DEFAULT '{}',
+		bounds TEXT NOT NULL,
+		counts TEXT NOT NULL,
+		sum REAL NOT NULL DEFAULT 0,
+		count INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (name, labels)
+	);
+
+	CREATE TABLE IF NOT EXISTS meta_table (
+		name TEXT PRIMARY KEY,
+		unit TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		help TEXT NOT NULL DEFAULT '',
+		precision INTEGER
+	);
+`
+
+// columns added to tables created by previous versions
+var addedColumns = []struct{ table, column, def string }{
+	{"gauge_m_table", "wrapped_at", "INTEGER"},
+	{"counter_m_table", "wrapped_at", "INTEGER"},
+}
+
+func addColumns(ctx context.Context, tx *sql.Tx) error {
+	for _, c := range addedColumns {
+		var n int
+		row := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(@table) WHERE name = @column`,
+			sql.Named("table", c.table), sql.Named("column", c.column))
+		if err := row.Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.def)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type SQLite struct {
+	*sql.DB
+	overflow mondata.OverflowPolicy
+	logger   *zap.SugaredLogger
+}
+
+func (s *SQLite) Close() {
+	s.DB.Close()
+}
+
+// Returns policy of accumulating counters beyond the max value
+func (s *SQLite) Overflow() mondata.OverflowPolicy {
+	return s.overflow
+}
+
+func IsRetryable(err error) bool {
+	var sqlErr *sqlite.Error
+	if err == nil {
+		return false
+	}
+
+	if !errors.As(err, &sqlErr) {
+		return false
+	}
+
+	// primary result code is in the lowest byte of extended one
+	switch sqlErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+
+	return false
+}
+
+const maxRetryes = 3
+
+func (s *SQLite) ExecuteTx(
+	ctx context.Context, txOptions *sql.TxOptions, fnc func(*sql.Tx) error,
+) error {
+	retry := retrypolicy.Builder[any]().HandleIf(func(_ any, err error) bool {
+		return IsRetryable(err)
+	}).
+		WithMaxRetries(maxRetryes).
+		WithDelayFunc(func(exec failsafe.ExecutionAttempt[any]) time.Duration {
+			return time.Second + time.Duration(exec.Attempts()-1)*2*time.Second
+		}).
+		Build()
+
+	return failsafe.NewExecutor(retry).
+		WithContext(ctx).
+		RunWithExecution(func(exec failsafe.Execution[any]) (err error) {
+			ctx := exec.Context()
+			tx, err := s.BeginTx(ctx, txOptions)
+			if err != nil {
+				return fmt.Errorf("failed to begin tx: %w", err)
+			}
+
+			defer tx.Rollback()
+
+			if fnErr := fnc(tx); fnErr != nil {
+				return fnErr
+			}
+
+			if commitErr := tx.Commit(); commitErr != nil {
+				return fmt.Errorf("failed to commit: %w", commitErr)
+			}
+
+			return err
+		})
+}
+
+var (
+	readOnly  = &sql.TxOptions{ReadOnly: true}
+	readWrite = &sql.TxOptions{}
+)
+
+// pragmas set on every connection if they aren't set by DSN
+var pragmaDefaults = map[string]string{
+	"busy_timeout": "5000",
+	"journal_mode": "WAL",
+	"synchronous":  "NORMAL",
+}
+
+// Initializes storage by DSN in the next format: file:///var/lib/perfmon.db?busy_timeout=5000,
+// relative paths are written as file:perfmon.db. Options are SQLite pragmas: busy_timeout, journal_mode, synchronous,
+// and counter_overflow, which is policy of accumulating counters beyond the max value, see mondata.OverflowPolicy
+func Open(ctx context.Context, dsn *url.URL, logger *zap.SugaredLogger) (*SQLite, error) {
+	path := dsn.Opaque
+	if path == "" {
+		path = dsn.Host + dsn.Path
+	}
+	if path == "" {
+		return nil, errors.New("path to SQLite DB file isn't set")
+	}
+
+	overflow, err := mondata.TakeOverflowPolicy(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	pragmas := make(map[string]string, len(pragmaDefaults))
+	for k, v := range pragmaDefaults {
+		pragmas[k] = v
+	}
+	for k, vv := range dsn.Query() {
+		if _, ok := pragmaDefaults[k]; !ok {
+			return nil, fmt.Errorf("unknown option %q of SQLite, expected one of: busy_timeout, journal_mode, synchronous, counter_overflow", k)
+		}
+		pragmas[k] = vv[len(vv)-1]
+	}
+
+	s, err := open(ctx, path, pragmas, logger)
+	if err != nil {
+		return nil, err
+	}
+	s.overflow = overflow
+
+	return s, nil
+}
+
+// Opens database file at path with default pragmas, it's created if it doesn't exist
+func Init(ctx context.Context, path string, logger *zap.SugaredLogger) (*SQLite, error) {
+	return open(ctx, path, pragmaDefaults, logger)
+}
+
+func open(ctx context.Context, path string, pragmas map[string]string, logger *zap.SugaredLogger) (*SQLite, error) {
+	q := url.Values{}
+	for k, v := range pragmas {
+		q.Add("_pragma", fmt.Sprintf("%s(%s)", k, v))
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, so writes are serialized by the pool instead of failing as busy
+	db.SetMaxOpenConns(1)
+
+	s := &SQLite{DB: db, overflow: mondata.OverflowWrap, logger: logger}
+	err = s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, createTablesQry); err != nil {
+			return err
+		}
+		return addColumns(ctx, tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Splits series key into name and labels encoded as they are stored
+func seriesArgs(key string) (string, string, error) {
+	n, labels, err := mondata.ParseSeriesKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return "", "", err
+	}
+
+	return n, string(b), nil
+}
+
+func seriesKey(name string, labels string) (string, error) {
+	var m map[string]string
+	if err := json.Unmarshal([]byte(labels), &m); err != nil {
+		return "", err
+	}
+
+	return mondata.SeriesKey(name, m), nil
+}
+
+func nanos(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	return time.Unix(0, n)
+}
+
+// counterBits is value of counter stored as bits of signed integer, since SQLite has no unsigned integers
+type counterBits mondata.CounterVType
+
+func (c *counterBits) Scan(src any) error {
+	v, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("value of counter must be integer, got %T", src)
+	}
+
+	*c = counterBits(v)
+	return nil
+}
+
+func (c counterBits) Value() (driver.Value, error) {
+	return int64(c), nil
+}
+
+// Returns destination of scanning value of series, counters are scanned from bits of signed integers
+func valueDest[T mondata.VTypes](v *T) any {
+	if c, ok := any(v).(*mondata.CounterVType); ok {
+		return (*counterBits)(c)
+	}
+
+	return v
+}
+
+// MARK: gauge metrics
+func (s *SQLite) GetGauge(ctx context.Context, name string) (mondata.GaugeVType, bool, error) {
+	var v mondata.GaugeVType
+
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT value FROM gauge_m_table WHERE name = @name AND labels = @labels
+		`, sql.Named("name", n), sql.Named("labels", labels))
+
+		return row.Scan(&v)
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return v, true, nil
+}
+
+func (s *SQLite) GetGaugeAll(ctx context.Context) (mondata.GaugeMap, error) {
+	gm := make(mondata.GaugeMap)
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT name, labels, value FROM gauge_m_table`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				n, labels string
+				v         mondata.GaugeVType
+			)
+
+			if err = rows.Scan(&n, &labels, &v); err != nil {
+				return err
+			}
+
+			k, err := seriesKey(n, labels)
+			if err != nil {
+				return err
+			}
+			gm[k] = v
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return gm, nil
+}
+
+var upsertGaugeQry = `
+	INSERT INTO gauge_m_table (name, labels, value, updated_at)
+	VALUES (@name, @labels, @value, @now)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		value = excluded.value,
+		updated_at = excluded.updated_at;
+`
+
+func upsertGauge(ctx context.Context, tx *sql.Tx, name string, value mondata.GaugeVType, now time.Time) error {
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, upsertGaugeQry,
+		sql.Named("name", n), sql.Named("labels", labels), sql.Named("value", value), sql.Named("now", nanos(now)))
+	return err
+}
+
+func (s *SQLite) SetGauge(ctx context.Context, name string, value mondata.GaugeVType) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return upsertGauge(ctx, tx, name, value, time.Now())
+	})
+}
+
+func (s *SQLite) SetGaugeAll(ctx context.Context, metrics mondata.GaugeMap) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		now := time.Now()
+		for k, v := range metrics {
+			if err := upsertGauge(ctx, tx, k, v, now); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// MARK: counter metrics
+func (s *SQLite) GetCounter(ctx context.Context, name string) (mondata.CounterVType, bool, error) {
+	var v mondata.CounterVType
+
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT value FROM counter_m_table WHERE name = @name AND labels = @labels
+		`, sql.Named("name", n), sql.Named("labels", labels))
+
+		return row.Scan(valueDest(&v))
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return v, true, nil
+}
+
+func (s *SQLite) GetCounterAll(ctx context.Context) (mondata.CounterMap, error) {
+	cm := make(mondata.CounterMap)
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT name, labels, value FROM counter_m_table`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				n, labels string
+				v         mondata.CounterVType
+			)
+
+			if err = rows.Scan(&n, &labels, valueDest(&v)); err != nil {
+				return err
+			}
+
+			k, err := seriesKey(n, labels)
+			if err != nil {
+				return err
+			}
+			cm[k] = v
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+var selectCounterQry = `
+	SELECT value, total FROM counter_m_table WHERE name = @name AND labels = @labels
+`
+
+// value is accumulated by accumCounter, since sums of unsigned values can't be checked by SQLite
+var upsertCounterQry = `
+	INSERT INTO counter_m_table (name, labels, value, total, wrapped_at, updated_at)
+	VALUES (@name, @labels, @value, @total, @wrapped, @now)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		value = excluded.value,
+		total = excluded.total,
+		wrapped_at = COALESCE(excluded.wrapped_at, counter_m_table.wrapped_at),
+		updated_at = excluded.updated_at;
+`
+
+// Accumulates increment of counter according to the overflow policy, if total isn't nil
+// the increment is computed from the absolute value of cumulative counter. Writes are serialized,
+// so the value can't be changed between reading and upserting it
+func (s *SQLite) accumCounter(
+	ctx context.Context, tx *sql.Tx, name string, inc mondata.CounterVType, total *mondata.CounterVType, now time.Time,
+) error {
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return err
+	}
+
+	var (
+		prev      counterBits
+		prevTotal sql.NullInt64
+	)
+	row := tx.QueryRowContext(ctx, selectCounterQry, sql.Named("name", n), sql.Named("labels", labels))
+	if err := row.Scan(&prev, &prevTotal); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if total != nil {
+		inc = mondata.TotalIncrement(mondata.CounterVType(prevTotal.Int64), prevTotal.Valid, *total)
+		prevTotal = sql.NullInt64{Int64: int64(*total), Valid: true}
+	}
+
+	v, wrapped, err := s.overflow.Add(mondata.CounterVType(prev), inc)
+	if err != nil {
+		return err
+	}
+	var wrappedAt sql.NullInt64
+	if wrapped {
+		wrappedAt = sql.NullInt64{Int64: nanos(now), Valid: true}
+	}
+
+	_, err = tx.ExecContext(ctx, upsertCounterQry,
+		sql.Named("name", n), sql.Named("labels", labels), sql.Named("value", counterBits(v)),
+		sql.Named("total", prevTotal), sql.Named("wrapped", wrappedAt), sql.Named("now", nanos(now)))
+	return err
+}
+
+func (s *SQLite) SetCounter(ctx context.Context, name string, value mondata.CounterVType) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return s.accumCounter(ctx, tx, name, value, nil, time.Now())
+	})
+}
+
+func (s *SQLite) SetCounterAll(ctx context.Context, metrics mondata.CounterMap) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		now := time.Now()
+		for k, v := range metrics {
+			if err := s.accumCounter(ctx, tx, k, v, nil, now); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Accumulates increments of cumulative counter computed from its absolute value
+func (s *SQLite) SetCounterTotal(ctx context.Context, name string, total mondata.CounterVType) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return s.accumCounter(ctx, tx, name, 0, &total, time.Now())
+	})
+}
+
+func (s *SQLite) SetCounterTotalAll(ctx context.Context, totals mondata.CounterMap) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		now := time.Now()
+		for k, v := range totals {
+			if err := s.accumCounter(ctx, tx, k, 0, &v, now); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// MARK: histogram metrics
+func scanHistogram(bounds string, counts string, h *mondata.Histogram) error {
+	if err := json.Unmarshal([]byte(bounds), &h.Bounds); err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(counts), &h.Counts)
+}
+
+func getHistogram(ctx context.Context, tx *sql.Tx, n string, labels string) (mondata.HistogramVType, error) {
+	var (
+		v              mondata.HistogramVType
+		bounds, counts string
+	)
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT bounds, counts, sum, count FROM histogram_m_table WHERE name = @name AND labels = @labels
+	`, sql.Named("name", n), sql.Named("labels", labels))
+
+	if err := row.Scan(&bounds, &counts, &v.Sum, &v.Count); err != nil {
+		return v, err
+	}
+
+	return v, scanHistogram(bounds, counts, &v)
+}
+
+func (s *SQLite) GetHistogram(ctx context.Context, name string) (mondata.HistogramVType, bool, error) {
+	var v mondata.HistogramVType
+
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return v, false, err
+	}
+
+	err = s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		v, err = getHistogram(ctx, tx, n, labels)
+		return err
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return v, false, nil
+		}
+		return v, false, err
+	}
+
+	return v, true, nil
+}
+
+func (s *SQLite) GetHistogramAll(ctx context.Context) (mondata.HistogramMap, error) {
+	hm := make(mondata.HistogramMap)
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT name, labels, bounds, counts, sum, count FROM histogram_m_table`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				n, labels, bounds, counts string
+				v                         mondata.HistogramVType
+			)
+
+			if err = rows.Scan(&n, &labels, &bounds, &counts, &v.Sum, &v.Count); err != nil {
+				return err
+			}
+			if err = scanHistogram(bounds, counts, &v); err != nil {
+				return err
+			}
+
+			k, err := seriesKey(n, labels)
+			if err != nil {
+				return err
+			}
+			hm[k] = v
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hm, nil
+}
+
+var upsertHistogramQry = `
+	INSERT INTO histogram_m_table (name, labels, bounds, counts, sum, count)
+	VALUES (@name, @labels, @bounds, @counts, @sum, @count)
+	ON CONFLICT(name, labels)
+	DO UPDATE SET
+		counts = excluded.counts,
+		sum = excluded.sum,
+		count = excluded.count;
+`
+
+// Histograms are merged with stored ones within the transaction,
+// update fails with mondata.ErrBoundsMismatch if bounds differ
+func upsertHistogram(ctx context.Context, tx *sql.Tx, name string, value mondata.HistogramVType) error {
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return err
+	}
+
+	h, err := getHistogram(ctx, tx, n, labels)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h = value.Clone()
+	case err != nil:
+		return err
+	default:
+		if err := h.Merge(value); err != nil {
+			return fmt.Errorf("%w: %s", err, name)
+		}
+	}
+
+	if h.Bounds == nil {
+		h.Bounds = []float64{}
+	}
+	bounds, err := json.Marshal(h.Bounds)
+	if err != nil {
+		return err
+	}
+	counts, err := json.Marshal(h.Counts)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, upsertHistogramQry,
+		sql.Named("name", n),
+		sql.Named("labels", labels),
+		sql.Named("bounds", string(bounds)),
+		sql.Named("counts", string(counts)),
+		sql.Named("sum", h.Sum),
+		sql.Named("count", h.Count),
+	)
+	return err
+}
+
+func (s *SQLite) SetHistogram(ctx context.Context, name string, value mondata.HistogramVType) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return upsertHistogram(ctx, tx, name, value)
+	})
+}
+
+func (s *SQLite) SetHistogramAll(ctx context.Context, metrics mondata.HistogramMap) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		for k, v := range metrics {
+			if err := upsertHistogram(ctx, tx, k, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// MARK: timestamps
+func stampsTable(mtype string) (string, error) {
+	switch mtype {
+	case mondata.GaugeType:
+		return "gauge_m_table", nil
+	case mondata.CounterType:
+		return "counter_m_table", nil
+	default:
+		return "", fmt.Errorf("timestamps aren't tracked for %s metrics", mtype)
+	}
+}
+
+func toStamp(sampled sql.NullInt64, wrapped sql.NullInt64, updated int64) mondata.Stamp {
+	st := mondata.Stamp{Received: fromNanos(updated)}
+	if sampled.Valid {
+		t := fromNanos(sampled.Int64)
+		st.Sampled = &t
+	}
+	if wrapped.Valid {
+		t := fromNanos(wrapped.Int64)
+		st.Wrapped = &t
+	}
+
+	return st
+}
+
+// Returns timestamps of gauge or counter value
+func (s *SQLite) GetStamp(ctx context.Context, mtype string, name string) (mondata.Stamp, bool, error) {
+	var st mondata.Stamp
+
+	table, err := stampsTable(mtype)
+	if err != nil {
+		return st, false, nil
+	}
+
+	n, labels, err := seriesArgs(name)
+	if err != nil {
+		return st, false, err
+	}
+
+	err = s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		var (
+			sampled, wrapped sql.NullInt64
+			updated          int64
+		)
+
+		row := tx.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT sampled_at, wrapped_at, updated_at FROM %s WHERE name = @name AND labels = @labels
+		`, table), sql.Named("name", n), sql.Named("labels", labels))
+
+		if err := row.Scan(&sampled, &wrapped, &updated); err != nil {
+			return err
+		}
+
+		st = toStamp(sampled, wrapped, updated)
+		return nil
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return st, false, nil
+		}
+		return st, false, err
+	}
+
+	return st, true, nil
+}
+
+func (s *SQLite) GetStampAll(ctx context.Context, mtype string) (mondata.StampMap, error) {
+	sm := make(mondata.StampMap)
+
+	table, err := stampsTable(mtype)
+	if err != nil {
+		return sm, nil
+	}
+
+	err = s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name, labels, sampled_at, wrapped_at, updated_at FROM %s`, table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				n, labels        string
+				sampled, wrapped sql.NullInt64
+				updated          int64
+			)
+
+			if err = rows.Scan(&n, &labels, &sampled, &wrapped, &updated); err != nil {
+				return err
+			}
+
+			k, err := seriesKey(n, labels)
+			if err != nil {
+				return err
+			}
+			sm[k] = toStamp(sampled, wrapped, updated)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+func setSampled(ctx context.Context, tx *sql.Tx, mtype string, sampled map[string]time.Time) error {
+	table, err := stampsTable(mtype)
+	if err != nil {
+		return err
+	}
+
+	qry := fmt.Sprintf(`
+		UPDATE %s SET sampled_at = @sampled WHERE name = @name AND labels = @labels
+	`, table)
+
+	for k, t := range sampled {
+		n, labels, err := seriesArgs(k)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, qry,
+			sql.Named("name", n), sql.Named("labels", labels), sql.Named("sampled", nanos(t)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sets time when values were sampled by agent
+func (s *SQLite) SetSampled(ctx context.Context, mtype string, sampled map[string]time.Time) error {
+	if _, err := stampsTable(mtype); err != nil {
+		return err
+	}
+
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return setSampled(ctx, tx, mtype, sampled)
+	})
+}
+
+// MARK: batch
+// Upserts gauges, counters and histograms of a report and sets sample time of series within a single transaction
+func (s *SQLite) ApplyBatch(
+	ctx context.Context, gauges mondata.GaugeBatch, counters mondata.CounterBatch, histograms mondata.HistogramMap,
+) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		now := time.Now()
+		for k, v := range gauges.Values {
+			if err := upsertGauge(ctx, tx, k, v, now); err != nil {
+				return err
+			}
+		}
+		for k, v := range counters.Deltas {
+			if err := s.accumCounter(ctx, tx, k, v, nil, now); err != nil {
+				return err
+			}
+		}
+		// totals are upserted after increments as in separate requests
+		for k, v := range counters.Totals {
+			if err := s.accumCounter(ctx, tx, k, 0, &v, now); err != nil {
+				return err
+			}
+		}
+		for k, v := range histograms {
+			if err := upsertHistogram(ctx, tx, k, v); err != nil {
+				return err
+			}
+		}
+
+		if err := setSampled(ctx, tx, mondata.GaugeType, gauges.Sampled); err != nil {
+			return err
+		}
+		return setSampled(ctx, tx, mondata.CounterType, counters.Sampled)
+	})
+}
+
+// MARK: snapshot
+func readSeries[T mondata.VTypes](ctx context.Context, tx *sql.Tx, table string, vals map[string]T, stamps mondata.StampMap) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name, labels, value, sampled_at, wrapped_at, updated_at FROM %s`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			n, labels        string
+			v                T
+			sampled, wrapped sql.NullInt64
+			updated          int64
+		)
+
+		if err = rows.Scan(&n, &labels, valueDest(&v), &sampled, &wrapped, &updated); err != nil {
+			return err
+		}
+
+		k, err := seriesKey(n, labels)
+		if err != nil {
+			return err
+		}
+		vals[k] = v
+		stamps[k] = toStamp(sampled, wrapped, updated)
+	}
+
+	return rows.Err()
+}
+
+// Reads gauges and counters within a single transaction, which sees the same state of DB
+func (s *SQLite) GetSnapshot(ctx context.Context) (mondata.Snapshot, error) {
+	var snap mondata.Snapshot
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		snap = mondata.NewSnapshot()
+		if err := readSeries(ctx, tx, "gauge_m_table", snap.Gauges, snap.GaugeStamps); err != nil {
+			return err
+		}
+
+		return readSeries(ctx, tx, "counter_m_table", snap.Counters, snap.CounterStamps)
+	})
+	if err != nil {
+		return mondata.Snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+// MARK: state
+func readTotals(ctx context.Context, tx *sql.Tx, totals mondata.CounterMap) error {
+	rows, err := tx.QueryContext(ctx, `SELECT name, labels, total FROM counter_m_table WHERE total IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			n, labels string
+			total     counterBits
+		)
+
+		if err = rows.Scan(&n, &labels, &total); err != nil {
+			return err
+		}
+
+		k, err := seriesKey(n, labels)
+		if err != nil {
+			return err
+		}
+		totals[k] = mondata.CounterVType(total)
+	}
+
+	return rows.Err()
+}
+
+// Returns the whole stored state, series and their totals are read within a single transaction
+func (s *SQLite) GetState(ctx context.Context) (mondata.State, error) {
+	st := mondata.State{Snapshot: mondata.NewSnapshot(), Totals: make(mondata.CounterMap)}
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		if err := readSeries(ctx, tx, "gauge_m_table", st.Gauges, st.GaugeStamps); err != nil {
+			return err
+		}
+		if err := readSeries(ctx, tx, "counter_m_table", st.Counters, st.CounterStamps); err != nil {
+			return err
+		}
+
+		return readTotals(ctx, tx, st.Totals)
+	})
+	if err != nil {
+		return mondata.State{}, err
+	}
+
+	if st.Histograms, err = s.GetHistogramAll(ctx); err != nil {
+		return mondata.State{}, err
+	}
+	if st.Meta, err = s.GetMetaAll(ctx); err != nil {
+		return mondata.State{}, err
+	}
+
+	return st, nil
+}
+
+func nullNanos(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: nanos(*t), Valid: true}
+}
+
+// Inserts series with their timestamps and totals, series without timestamps are received now
+func insertSeries[T mondata.VTypes](
+	ctx context.Context, tx *sql.Tx, table string, vals map[string]T, stamps mondata.StampMap, totals map[string]T,
+) error {
+	qry := fmt.Sprintf(`
+		INSERT INTO %s (name, labels, value, sampled_at, wrapped_at, updated_at)
+		VALUES (@name, @labels, @value, @sampled, @wrapped, @updated)
+	`, table)
+	totalQry := fmt.Sprintf(`UPDATE %s SET total = @total WHERE name = @name AND labels = @labels`, table)
+	now := time.Now()
+
+	for k, v := range vals {
+		n, labels, err := seriesArgs(k)
+		if err != nil {
+			return err
+		}
+
+		st, ok := stamps[k]
+		if !ok {
+			st.Received = now
+		}
+
+		var value any = v
+		if c, ok := value.(mondata.CounterVType); ok {
+			value = counterBits(c)
+		}
+
+		_, err = tx.ExecContext(ctx, qry,
+			sql.Named("name", n), sql.Named("labels", labels), sql.Named("value", value),
+			sql.Named("sampled", nullNanos(st.Sampled)), sql.Named("wrapped", nullNanos(st.Wrapped)),
+			sql.Named("updated", nanos(st.Received)))
+		if err != nil {
+			return err
+		}
+
+		if t, ok := totals[k]; ok {
+			_, err = tx.ExecContext(ctx, totalQry,
+				sql.Named("name", n), sql.Named("labels", labels), sql.Named("total", counterBits(t)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Replaces the whole stored state by state of another storage within a single transaction
+func (s *SQLite) LoadState(ctx context.Context, st mondata.State) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		for _, table := range []string{"gauge_m_table", "counter_m_table", "histogram_m_table", "meta_table"} {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+table); err != nil {
+				return err
+			}
+		}
+
+		if err := insertSeries(ctx, tx, "gauge_m_table", st.Gauges, st.GaugeStamps, nil); err != nil {
+			return err
+		}
+		if err := insertSeries(ctx, tx, "counter_m_table", st.Counters, st.CounterStamps, st.Totals); err != nil {
+			return err
+		}
+		// histograms aren't stored yet, so they aren't merged
+		for k, v := range st.Histograms {
+			if err := upsertHistogram(ctx, tx, k, v); err != nil {
+				return err
+			}
+		}
+
+		return upsertMeta(ctx, tx, st.Meta)
+	})
+}
+
+// MARK: eviction
+// Builds condition of series matching rule, prefixes are compared by substr,
+// since LIKE of SQLite is case-insensitive and treats _ as a wildcard
+func ruleCond(rule mondata.TTLRule) (string, []any) {
+	cond := "updated_at < @cutoff"
+	args := make([]any, 0, len(rule.Excluded)+1)
+	if rule.Prefix != "" {
+		cond += " AND substr(name, 1, length(@prefix)) = @prefix"
+		args = append(args, sql.Named("prefix", rule.Prefix))
+	}
+	for i, ex := range rule.Excluded {
+		arg := fmt.Sprintf("excluded%d", i)
+		cond += fmt.Sprintf(" AND substr(name, 1, length(@%[1]s)) <> @%[1]s", arg)
+		args = append(args, sql.Named(arg, ex))
+	}
+
+	return cond, args
+}
+
+// Deletes stale series by a statement per rule of policy
+func evictStale(ctx context.Context, tx *sql.Tx, mtype string, policy mondata.TTLPolicy, now time.Time) ([]mondata.SeriesRef, error) {
+	table, err := stampsTable(mtype)
+	if err != nil {
+		return nil, err
+	}
+
+	evicted := make([]mondata.SeriesRef, 0)
+	for _, rule := range policy.Rules() {
+		cond, args := ruleCond(rule)
+		args = append(args, sql.Named("cutoff", nanos(now.Add(-rule.TTL))))
+
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s RETURNING name, labels`, table, cond), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var n, labels string
+			if err := rows.Scan(&n, &labels); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			k, err := seriesKey(n, labels)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			evicted = append(evicted, mondata.SeriesRef{MType: mtype, Key: k})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return evicted, nil
+}
+
+// Removes gauges and counters which weren't updated within TTL
+func (s *SQLite) Evict(ctx context.Context, policy mondata.TTLPolicy) ([]mondata.SeriesRef, error) {
+	var evicted []mondata.SeriesRef
+
+	err := s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		evicted = make([]mondata.SeriesRef, 0)
+		now := time.Now()
+		for _, mtype := range []string{mondata.GaugeType, mondata.CounterType} {
+			refs, err := evictStale(ctx, tx, mtype, policy, now)
+			if err != nil {
+				return err
+			}
+			evicted = append(evicted, refs...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return evicted, nil
+}
+
+// MARK: metadata
+func (s *SQLite) GetMeta(ctx context.Context, name string) (mondata.Meta, bool, error) {
+	m := mondata.Meta{Name: name}
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT unit, description, help, precision FROM meta_table WHERE name = @name
+		`, sql.Named("name", name))
+
+		return row.Scan(&m.Unit, &m.Description, &m.Help, &m.Precision)
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, false, nil
+		}
+		return m, false, err
+	}
+
+	return m, true, nil
+}
+
+func (s *SQLite) GetMetaAll(ctx context.Context) (mondata.MetaMap, error) {
+	mm := make(mondata.MetaMap)
+
+	err := s.ExecuteTx(ctx, readOnly, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT name, unit, description, help, precision FROM meta_table`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var m mondata.Meta
+			if err = rows.Scan(&m.Name, &m.Unit, &m.Description, &m.Help, &m.Precision); err != nil {
+				return err
+			}
+
+			mm[m.Name] = m
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mm, nil
+}
+
+var upsertMetaQry = `
+	INSERT INTO meta_table (name, unit, description, help, precision)
+	VALUES (@name, @unit, @description, @help, @precision)
+	ON CONFLICT(name)
+	DO UPDATE SET
+		unit = excluded.unit,
+		description = excluded.description,
+		help = excluded.help,
+		precision = excluded.precision;
+`
+
+func upsertMeta(ctx context.Context, tx *sql.Tx, metaMap mondata.MetaMap) error {
+	for k, m := range metaMap {
+		_, err := tx.ExecContext(ctx, upsertMetaQry,
+			sql.Named("name", k),
+			sql.Named("unit", m.Unit),
+			sql.Named("description", m.Description),
+			sql.Named("help", m.Help),
+			sql.Named("precision", m.Precision),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLite) SetMetaAll(ctx context.Context, metaMap mondata.MetaMap) error {
+	return s.ExecuteTx(ctx, readWrite, func(tx *sql.Tx) error {
+		return upsertMeta(ctx, tx, metaMap)
+	})
+}
+
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.PingContext(ctx)
+}
@@ -0,0 +1,269 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func openTest(t *testing.T) *SQLite {
+	t.Helper()
+
+	s, err := Init(context.TODO(), filepath.Join(t.TempDir(), "perfmon.db"), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestSQLite_State(t *testing.T) {
+	ctx := context.TODO()
+	precision := 2
+
+	src := openTest(t)
+	require.NoError(t, src.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{`Alloc{host="srv-1"}`: 1.5}},
+		mondata.CounterBatch{Deltas: mondata.CounterMap{"PollCount": 2}, Totals: mondata.CounterMap{"Requests": 1 << 63}},
+		nil,
+	))
+	require.NoError(t, src.SetHistogram(ctx, "Latency", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1}))
+	require.NoError(t, src.SetMetaAll(ctx, mondata.MetaMap{"Alloc": {Name: "Alloc", Unit: mondata.UnitBytes, Precision: &precision}}))
+
+	st, err := src.GetState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{`Alloc{host="srv-1"}`: 1.5}, st.Gauges)
+	assert.Equal(t, mondata.CounterMap{"PollCount": 2, "Requests": 1 << 63}, st.Counters)
+	assert.Equal(t, mondata.CounterMap{"Requests": 1 << 63}, st.Totals)
+
+	dst := openTest(t)
+	require.NoError(t, dst.SetGauge(ctx, "Stale", 1))
+	require.NoError(t, dst.SetHistogram(ctx, "Latency", mondata.Histogram{Bounds: []float64{1}, Counts: []int64{5, 5}, Count: 10}))
+	require.NoError(t, dst.LoadState(ctx, st))
+
+	loaded, err := dst.GetState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, st, loaded)
+
+	// increments of the next total are computed from the loaded one
+	require.NoError(t, dst.SetCounterTotal(ctx, "Requests", 1<<63+5))
+	v, _, err := dst.GetCounter(ctx, "Requests")
+	require.NoError(t, err)
+	assert.Equal(t, mondata.CounterVType(1<<63+5), v)
+}
+
+func TestSQLite_Counters(t *testing.T) {
+	ctx := context.TODO()
+	s := openTest(t)
+
+	get := func(name string) mondata.CounterVType {
+		t.Helper()
+		v, ok, err := s.GetCounter(ctx, name)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return v
+	}
+
+	// increments are accumulated
+	require.NoError(t, s.SetCounter(ctx, "PollCount", 2))
+	require.NoError(t, s.SetCounterAll(ctx, mondata.CounterMap{"PollCount": 3, `PollCount{host="srv-1"}`: 1}))
+	assert.Equal(t, mondata.CounterVType(5), get("PollCount"))
+	assert.Equal(t, mondata.CounterVType(1), get(`PollCount{host="srv-1"}`))
+
+	// increments of cumulative counter are computed from its totals, decreased total was reset
+	require.NoError(t, s.SetCounterTotal(ctx, "NumGC", 10))
+	require.NoError(t, s.SetCounterTotal(ctx, "NumGC", 15))
+	require.NoError(t, s.SetCounterTotalAll(ctx, mondata.CounterMap{"NumGC": 3}))
+	assert.Equal(t, mondata.CounterVType(18), get("NumGC"))
+
+	// values beyond the max one of BIGINT are kept as bits of signed integers
+	require.NoError(t, s.SetCounter(ctx, "Requests", math.MaxUint64-1))
+	stamp, _, err := s.GetStamp(ctx, mondata.CounterType, "Requests")
+	require.NoError(t, err)
+	assert.Nil(t, stamp.Wrapped)
+
+	require.NoError(t, s.SetCounter(ctx, "Requests", 3))
+	assert.Equal(t, mondata.CounterVType(1), get("Requests"))
+	stamp, _, err = s.GetStamp(ctx, mondata.CounterType, "Requests")
+	require.NoError(t, err)
+	assert.NotNil(t, stamp.Wrapped, "time of wrapping is kept")
+}
+
+func TestSQLite_RejectOverflow(t *testing.T) {
+	ctx := context.TODO()
+	s := openTest(t)
+	s.overflow = mondata.OverflowReject
+	require.NoError(t, s.SetCounter(ctx, "Requests", math.MaxUint64))
+
+	err := s.SetCounterAll(ctx, mondata.CounterMap{"PollCount": 1, "Requests": 1})
+	assert.ErrorIs(t, err, mondata.ErrCounterOverflow)
+
+	err = s.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{"Alloc": 1}},
+		mondata.CounterBatch{Deltas: mondata.CounterMap{"Requests": 1}},
+		nil,
+	)
+	assert.ErrorIs(t, err, mondata.ErrCounterOverflow)
+
+	// the rejected writes are rolled back as a whole
+	snap, err := s.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"Requests": math.MaxUint64}, snap.Counters)
+}
+
+func TestSQLite_ApplyBatch(t *testing.T) {
+	ctx := context.TODO()
+	s := openTest(t)
+	sampled := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.SetCounterTotal(ctx, "NumGC", 4))
+	require.NoError(t, s.ApplyBatch(ctx,
+		mondata.GaugeBatch{
+			Values:  mondata.GaugeMap{"Alloc": 1.5, `Sys{host="srv-1"}`: 2},
+			Sampled: map[string]time.Time{"Alloc": sampled},
+		},
+		mondata.CounterBatch{
+			Deltas:  mondata.CounterMap{"PollCount": 2},
+			Totals:  mondata.CounterMap{"NumGC": 10},
+			Sampled: map[string]time.Time{"PollCount": sampled},
+		},
+		mondata.HistogramMap{"Latency": {Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1}},
+	))
+
+	snap, err := s.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Alloc": 1.5, `Sys{host="srv-1"}`: 2}, snap.Gauges)
+	assert.Equal(t, mondata.CounterMap{"PollCount": 2, "NumGC": 10}, snap.Counters)
+
+	require.Contains(t, snap.GaugeStamps, "Alloc")
+	require.NotNil(t, snap.GaugeStamps["Alloc"].Sampled)
+	assert.True(t, sampled.Equal(*snap.GaugeStamps["Alloc"].Sampled))
+	assert.Nil(t, snap.GaugeStamps[`Sys{host="srv-1"}`].Sampled)
+	require.NotNil(t, snap.CounterStamps["PollCount"].Sampled)
+	assert.True(t, sampled.Equal(*snap.CounterStamps["PollCount"].Sampled))
+	assert.False(t, snap.CounterStamps["NumGC"].Received.IsZero())
+
+	// histogram which bounds don't match rolls the whole batch back
+	err = s.ApplyBatch(ctx,
+		mondata.GaugeBatch{Values: mondata.GaugeMap{"Alloc": 3}},
+		mondata.CounterBatch{},
+		mondata.HistogramMap{"Latency": {Bounds: []float64{2}, Counts: []int64{1, 0}, Sum: 1, Count: 1}},
+	)
+	assert.ErrorIs(t, err, mondata.ErrBoundsMismatch)
+	v, _, err := s.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, v)
+	h, ok, err := s.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(1), h.Count)
+}
+
+func TestSQLite_Evict(t *testing.T) {
+	ctx := context.TODO()
+	s := openTest(t)
+
+	now := time.Now()
+	age := func(mtype string, key string, d time.Duration) {
+		t.Helper()
+		n, labels, err := seriesArgs(key)
+		require.NoError(t, err)
+		table, err := stampsTable(mtype)
+		require.NoError(t, err)
+		_, err = s.ExecContext(ctx, `UPDATE `+table+` SET updated_at = @at WHERE name = @name AND labels = @labels`,
+			sql.Named("at", nanos(now.Add(-d))), sql.Named("name", n), sql.Named("labels", labels))
+		require.NoError(t, err)
+	}
+
+	gauges := []string{"Alloc", "Fresh", "GoRoutines", "GoTempDir", "Heap_Alloc", "HeapXAlloc", "heap_alloc"}
+	for _, k := range gauges {
+		require.NoError(t, s.SetGauge(ctx, k, 1))
+	}
+	require.NoError(t, s.SetCounter(ctx, `PollCount{host="srv-1"}`, 1))
+
+	age(mondata.GaugeType, "Alloc", 2*time.Hour)
+	age(mondata.GaugeType, "GoRoutines", 2*time.Hour)
+	for _, k := range []string{"GoTempDir", "Heap_Alloc", "HeapXAlloc", "heap_alloc"} {
+		age(mondata.GaugeType, k, 5*time.Minute)
+	}
+	age(mondata.CounterType, `PollCount{host="srv-1"}`, 2*time.Hour)
+
+	policy := mondata.TTLPolicy{
+		Default:  time.Hour,
+		Prefixes: map[string]time.Duration{"Go": 0, "GoTemp": time.Minute, "Heap_": time.Minute},
+	}
+	evicted, err := s.Evict(ctx, policy)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []mondata.SeriesRef{
+		{MType: mondata.GaugeType, Key: "Alloc"},
+		{MType: mondata.GaugeType, Key: "GoTempDir"},
+		{MType: mondata.GaugeType, Key: "Heap_Alloc"},
+		{MType: mondata.CounterType, Key: `PollCount{host="srv-1"}`},
+	}, evicted)
+
+	// prefixes are case-sensitive and _ isn't a wildcard
+	snap, err := s.GetSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, mondata.GaugeMap{"Fresh": 1, "GoRoutines": 1, "HeapXAlloc": 1, "heap_alloc": 1}, snap.Gauges)
+	assert.Empty(t, snap.Counters)
+}
+
+func TestSQLite_AddColumns(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "perfmon.db")
+
+	// tables of a version before wrapped_at was added
+	db, err := sql.Open("sqlite", "file:"+path)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE gauge_m_table (
+			m_id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			value REAL NOT NULL DEFAULT 0,
+			sampled_at INTEGER,
+			updated_at INTEGER NOT NULL,
+			UNIQUE (name, labels)
+		);
+		CREATE TABLE counter_m_table (
+			m_id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			value INTEGER NOT NULL DEFAULT 0,
+			total INTEGER,
+			sampled_at INTEGER,
+			updated_at INTEGER NOT NULL,
+			UNIQUE (name, labels)
+		);
+		INSERT INTO counter_m_table (name, value, updated_at) VALUES ('PollCount', 5, 1);
+	`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := Init(ctx, path, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.SetCounter(ctx, "PollCount", math.MaxUint64))
+	v, ok, err := s.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, mondata.CounterVType(4), v)
+
+	stamp, _, err := s.GetStamp(ctx, mondata.CounterType, "PollCount")
+	require.NoError(t, err)
+	assert.NotNil(t, stamp.Wrapped)
+
+	// the upgrade is applied once
+	reopened, err := Init(ctx, path, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	reopened.Close()
+}
@@ -1,6 +1,10 @@
 package transaction
 
-import "github.com/Allegathor/perfmon/internal/mondata"
+import (
+	"time"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
 
 type Tx[T mondata.VTypes] interface {
 	Lock()
@@ -11,14 +15,27 @@ type TxQry[T mondata.VTypes] interface {
 	Tx[T]
 	Get(name string) (T, bool)
 	GetAll() map[string]T
+	Stamp(name string) (mondata.Stamp, bool)
+	StampAll() mondata.StampMap
+	Total(name string) (T, bool)
 }
 
 type TxExec[T mondata.VTypes] interface {
 	Tx[T]
+	Get(name string) (T, bool)
+	Stamp(name string) (mondata.Stamp, bool)
+	Total(name string) (T, bool)
 	Set(name string, v T)
 	SetAll(map[string]T)
-	SetAccum(name string, v T)
-	SetAccumAll(map[string]T)
+	SetAccum(name string, v T) error
+	SetAccumAll(map[string]T) error
+	SetTotal(name string, total T) error
+	SetTotalAll(map[string]T) error
+	SetLastTotal(name string, total T)
+	SetSampled(name string, t time.Time)
+	SetStamp(name string, st mondata.Stamp)
+	StampAll() mondata.StampMap
+	Delete(name string)
 }
 
 type GaugeRepo interface {
@@ -27,6 +44,6 @@ type GaugeRepo interface {
 }
 
 type CounterRepo interface {
-	Read(func(TxQry[int64]) error) error
-	Update(func(TxExec[int64]) error) error
+	Read(func(TxQry[uint64]) error) error
+	Update(func(TxExec[uint64]) error) error
 }
@@ -0,0 +1,360 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+)
+
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+
+	// pseudo type of metadata records
+	MetaType = "meta"
+)
+
+// Record keeps the resulting state of a series after a write,
+// so records could be replayed any number of times with the same result
+type Record struct {
+	Op        string             `json:"op"`
+	MType     string             `json:"type"`
+	Key       string             `json:"key"`
+	Gauge     *float64           `json:"gauge,omitempty"`
+	Counter   *uint64            `json:"counter,omitempty"`
+	Total     *uint64            `json:"total,omitempty"` // last total of cumulative counter
+	Histogram *mondata.Histogram `json:"histogram,omitempty"`
+	Meta      *mondata.Meta      `json:"meta,omitempty"`
+	Stamp     *mondata.Stamp     `json:"stamp,omitempty"`
+}
+
+var ErrClosed = errors.New("write-ahead log is closed")
+
+const (
+	segmentPrefix  = "wal-"
+	segmentExt     = ".log"
+	snapshotPrefix = "snapshot-"
+	snapshotExt    = ".json"
+)
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentExt)
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotExt)
+}
+
+// Returns sequence numbers of files with prefix and extension in ascending order
+func list(dir string, prefix string, ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+// Log appends records to segment files in the directory,
+// snapshot-N.json contains the state written to segments up to N, so they are removed after it's written.
+//
+// Unless sync is set, appended records are only written to the page cache of OS,
+// so they survive crash of the process, but records written shortly before crash of OS could be lost.
+// Segments are synced on rotation and close, snapshots are synced before they replace segments
+type Log struct {
+	mu   sync.Mutex
+	dir  string
+	seq  uint64 // sequence number of the current segment
+	f    *os.File
+	sync bool // every append is synced to disk
+}
+
+// Opens a new segment after existing ones, the directory is created if it doesn't exist.
+// If sync is set, every append is synced to disk before it returns
+func Open(dir string, sync bool) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	seqs, err := list(dir, segmentPrefix, segmentExt)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := list(dir, snapshotPrefix, snapshotExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var seq uint64
+	if len(seqs) > 0 {
+		seq = seqs[len(seqs)-1]
+	}
+	if len(snaps) > 0 {
+		seq = max(seq, snaps[len(snaps)-1])
+	}
+
+	l := &Log{dir: dir, sync: sync}
+	if err := l.openSegment(seq + 1); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) openSegment(seq uint64) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, segmentName(seq)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.f, l.seq = f, seq
+	if l.sync {
+		// a new segment mustn't disappear with records synced to it
+		return syncDir(l.dir)
+	}
+	return nil
+}
+
+// Appends records with a single write, so they aren't interleaved with records of other writers
+func (l *Log) Append(recs ...Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	if _, err := l.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if l.sync {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// Syncs and closes the current segment and opens the next one,
+// returns sequence number of the closed segment
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return 0, ErrClosed
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := l.f.Close(); err != nil {
+		return 0, err
+	}
+
+	seq := l.seq
+	if err := l.openSegment(seq + 1); err != nil {
+		l.f = nil
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// Writes snapshot of the state written to segments up to seq,
+// then removes these segments and older snapshots
+func (l *Log) WriteSnapshot(seq uint64, recs []Record) error {
+	path := filepath.Join(l.dir, snapshotName(seq))
+	tmp, err := os.CreateTemp(l.dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// the rename must be durable before segments it replaces are removed
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+
+	return removeUpTo(l.dir, seq)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// Removes segments up to seq and snapshots older than seq
+func removeUpTo(dir string, seq uint64) error {
+	seqs, err := list(dir, segmentPrefix, segmentExt)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s <= seq {
+			if err := os.Remove(filepath.Join(dir, segmentName(s))); err != nil {
+				return err
+			}
+		}
+	}
+
+	snaps, err := list(dir, snapshotPrefix, snapshotExt)
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		if s < seq {
+			if err := os.Remove(filepath.Join(dir, snapshotName(s))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := errors.Join(l.f.Sync(), l.f.Close())
+	l.f = nil
+	return err
+}
+
+// Reads records of the file, a record torn by crash at the end of the file is skipped
+func readFile(path string, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var r Record
+		err := dec.Decode(&r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s failed: %w", filepath.Base(path), err)
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+// Calls fn for records of the latest snapshot and segments written after it,
+// returns number of replayed records
+func Replay(dir string, fn func(Record) error) (int, error) {
+	n := 0
+	count := func(r Record) error {
+		n++
+		return fn(r)
+	}
+
+	snaps, err := list(dir, snapshotPrefix, snapshotExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var from uint64
+	if len(snaps) > 0 {
+		from = snaps[len(snaps)-1]
+		if err := readFile(filepath.Join(dir, snapshotName(from)), count); err != nil {
+			return n, err
+		}
+	}
+
+	seqs, err := list(dir, segmentPrefix, segmentExt)
+	if err != nil {
+		return n, err
+	}
+	for _, s := range seqs {
+		if s <= from {
+			continue
+		}
+		if err := readFile(filepath.Join(dir, segmentName(s)), count); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Removes segments and snapshots from the directory
+func Reset(dir string) error {
+	err := removeUpTo(dir, ^uint64(0))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
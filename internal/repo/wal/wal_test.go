@@ -0,0 +1,144 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Allegathor/perfmon/internal/mondata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(key string, v float64) Record {
+	return Record{Op: OpSet, MType: mondata.GaugeType, Key: key, Gauge: &v}
+}
+
+func replayAll(t *testing.T, dir string) []Record {
+	t.Helper()
+
+	var recs []Record
+	n, err := Replay(dir, func(r Record) error {
+		recs = append(recs, r)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, recs, n)
+
+	return recs
+}
+
+func TestLog_Replay(t *testing.T) {
+	for _, sync := range []bool{false, true} {
+		dir := t.TempDir()
+		l, err := Open(dir, sync)
+		require.NoError(t, err)
+
+		require.NoError(t, l.Append(gauge("Alloc", 1), gauge("HeapAlloc", 2)))
+		require.NoError(t, l.Append())
+		require.NoError(t, l.Append(Record{Op: OpDelete, MType: mondata.GaugeType, Key: "HeapAlloc"}))
+		require.NoError(t, l.Close())
+		require.NoError(t, l.Close(), "closing closed log is no-op")
+		assert.ErrorIs(t, l.Append(gauge("Alloc", 3)), ErrClosed)
+
+		recs := replayAll(t, dir)
+		require.Len(t, recs, 3)
+		assert.Equal(t, gauge("Alloc", 1), recs[0])
+		assert.Equal(t, OpDelete, recs[2].Op)
+	}
+}
+
+func TestLog_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(gauge("Alloc", 1)))
+	require.NoError(t, l.Close())
+
+	// crash in the middle of appending a record
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"set","type":"gauge","key":"Heap`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, []Record{gauge("Alloc", 1)}, replayAll(t, dir))
+
+	// records appended after restart are written to the next segment, so they aren't glued to the torn one
+	l, err = Open(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(gauge("Alloc", 2)))
+	require.NoError(t, l.Close())
+	assert.Equal(t, []Record{gauge("Alloc", 1), gauge("Alloc", 2)}, replayAll(t, dir))
+}
+
+func TestLog_CorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte("{\"op\":1}\n"), 0644))
+
+	_, err := Replay(dir, func(Record) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestLog_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, false)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Append(gauge("Alloc", 1)))
+	seq, err := l.Rotate()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	// written to the next segment while the snapshot is written
+	require.NoError(t, l.Append(gauge("Alloc", 2)))
+	require.NoError(t, l.WriteSnapshot(seq, []Record{gauge("Alloc", 1)}))
+
+	segs, err := list(dir, segmentPrefix, segmentExt)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, segs, "segments covered by the snapshot are removed")
+	assert.Equal(t, []Record{gauge("Alloc", 1), gauge("Alloc", 2)}, replayAll(t, dir))
+
+	// the next snapshot replaces the previous one
+	seq, err = l.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, l.WriteSnapshot(seq, []Record{gauge("Alloc", 2)}))
+	snaps, err := list(dir, snapshotPrefix, snapshotExt)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, snaps)
+	require.NoError(t, l.Close())
+
+	// the log is reopened after the latest segment
+	l, err = Open(dir, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), l.seq)
+	require.NoError(t, l.Close())
+	assert.Equal(t, []Record{gauge("Alloc", 2)}, replayAll(t, dir))
+
+	require.NoError(t, Reset(dir))
+	assert.Empty(t, replayAll(t, dir))
+}
+
+func TestRemoveUpTo(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{segmentName(1), segmentName(2), segmentName(3), snapshotName(1), snapshotName(2), "notes.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	require.NoError(t, removeUpTo(dir, 2))
+
+	segs, err := list(dir, segmentPrefix, segmentExt)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3}, segs)
+	snaps, err := list(dir, snapshotPrefix, snapshotExt)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, snaps)
+	assert.FileExists(t, filepath.Join(dir, "notes.txt"))
+}
+
+func TestReplay_MissingDir(t *testing.T) {
+	n, err := Replay(filepath.Join(t.TempDir(), "missing"), func(Record) error { return nil })
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.NoError(t, Reset(filepath.Join(t.TempDir(), "missing")))
+}